@@ -0,0 +1,182 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A SIF as an OCI artifact, the way Singularity pushes it with oras://: a
+// manifest with an empty config and a single layer, the SIF file as is.
+// They are read and written in a local OCI image layout, to be uploaded
+// (e.g., with `oras copy --from-oci-layout`) or checked offline.
+// https://github.com/sylabs/singularity/blob/master/internal/pkg/client/oras/oras.go
+
+// Media types of a SIF artifact.
+const (
+	SifConfigMediaType = "application/vnd.sylabs.sif.config.v1+json"
+	SifLayerMediaType  = "application/vnd.sylabs.sif.layer.v1.sif"
+
+	ociTitleAnnotation = "org.opencontainers.image.title"
+)
+
+// Artifact is a SIF artifact found in an image layout.
+type Artifact struct {
+	Ref      string        `json:"ref"`
+	Manifest ociDescriptor `json:"manifestDescriptor"`
+	Content  ociManifest   `json:"manifest"`
+	Layer    ociDescriptor `json:"layer"`
+
+	dir string
+}
+
+// WriteArtifact adds the SIF at file to the image layout in dir as an
+// artifact named ref (e.g., "lolcow:latest"). The SIF is checked to load
+// first. Progress is reported in bytes copied.
+func WriteArtifact(ctx context.Context, file, dir, ref string, fn ProgressFunc) error {
+	fimg, err := LoadContainer(file, true)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(blobs, "sif-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := &hashWriter{Hash: sha256.New()}
+	p := newProgress(ctx, fimg.Filesize, fn)
+	_, err = copyProgress(io.MultiWriter(tmp, h), io.NewSectionReader(fimg.Reader, 0, fimg.Filesize), p)
+	p.finish()
+	if err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	layer := ociBlob{
+		desc: ociDescriptor{
+			MediaType:   SifLayerMediaType,
+			Digest:      h.digest(),
+			Size:        h.n,
+			Annotations: map[string]string{ociTitleAnnotation: filepath.Base(file)},
+		},
+		file: tmp.Name(),
+	}
+	config, err := jsonBlob(SifConfigMediaType, struct{}{})
+	if err != nil {
+		return err
+	}
+	manifest, err := jsonBlob(ociManifestType, ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        config.desc,
+		Layers:        []ociDescriptor{layer.desc},
+	})
+	if err != nil {
+		return err
+	}
+	desc := manifest.desc
+	desc.Annotations = map[string]string{ociRefNameAnnotation: ref}
+	return writeLayout(dir, []ociBlob{config, manifest, layer}, desc)
+}
+
+// OpenArtifact finds the SIF artifact named ref in the image layout in dir,
+// or the only one if ref is empty.
+func OpenArtifact(dir, ref string) (*Artifact, error) {
+	img := &OCIImage{src: ociDir(dir)}
+	var index ociIndex
+	if err := img.readJSON("index.json", "", &index); err != nil {
+		return nil, err
+	}
+
+	var found []*Artifact
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[ociRefNameAnnotation]
+		if ref != "" && !refMatches(name, ref) {
+			continue
+		}
+		blob, err := blobName(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		a := &Artifact{Ref: name, Manifest: desc, dir: dir}
+		if err := img.readJSON(blob, desc.Digest, &a.Content); err != nil {
+			return nil, err
+		}
+		if a.Content.Config.MediaType != SifConfigMediaType {
+			continue // an image, or another kind of artifact
+		}
+		if len(a.Content.Layers) != 1 || a.Content.Layers[0].MediaType != SifLayerMediaType {
+			return nil, fmt.Errorf("%s: expected a single layer of type %s", desc.Digest, SifLayerMediaType)
+		}
+		a.Layer = a.Content.Layers[0]
+		found = append(found, a)
+	}
+
+	i, err := pickOne(len(found), ref, func(i int) string { return found[i].Ref })
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	return found[i], nil
+}
+
+// Verify reads the SIF of the artifact, checks it against the digest and
+// size of the layer, and copies it to w if not nil. It then checks that
+// the blob is a SIF. Progress is reported in bytes read.
+func (a *Artifact) Verify(ctx context.Context, w io.Writer, fn ProgressFunc) error {
+	name, err := blobName(a.Layer.Digest)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(a.Layer.Digest, "sha256:") {
+		return fmt.Errorf("%s: only sha256 digests are supported", a.Layer.Digest)
+	}
+	blob := filepath.Join(a.dir, filepath.FromSlash(name))
+	f, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if w == nil {
+		w = ioutil.Discard
+	}
+	h := &hashWriter{Hash: sha256.New()}
+	p := newProgress(ctx, a.Layer.Size, fn)
+	_, err = copyProgress(io.MultiWriter(w, h), f, p)
+	p.finish()
+	if err != nil {
+		return err
+	}
+	if h.n != a.Layer.Size {
+		return fmt.Errorf("%s: %d bytes, the manifest says %d: %w", blob, h.n, a.Layer.Size, ErrDigestMismatch)
+	}
+	if got := h.digest(); got != a.Layer.Digest {
+		return fmt.Errorf("%s: %s, the manifest says %s: %w", blob, got, a.Layer.Digest, ErrDigestMismatch)
+	}
+
+	fimg, err := LoadContainer(blob, true)
+	if err != nil {
+		return err
+	}
+	return fimg.UnloadContainer()
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArtifact(t *testing.T) {
+	fimg, cleanup := testContainer(t, testSquashInputs(t, map[string]string{"/etc/hello": "hello\n"}))
+	defer cleanup()
+	image, err := ioutil.ReadFile(fimg.Fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "sifweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	// an image next to the artifact is skipped
+	if err := fimg.ExportOCI(ctx, dir, "image", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteArtifact(ctx, fimg.Fp.Name(), dir, "test:1", nil); err != nil {
+		t.Fatal(err)
+	}
+	a, err := OpenArtifact(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Ref != "test:1" || a.Layer.Size != int64(len(image)) || a.Layer.Annotations[ociTitleAnnotation] != "test.sif" {
+		t.Errorf("got artifact %s, layer %+v", a.Ref, a.Layer)
+	}
+	var out bytes.Buffer
+	if err := a.Verify(ctx, &out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), image) {
+		t.Error("the artifact is not the SIF")
+	}
+
+	// another tag makes the name needed, the same tag replaces it
+	for _, ref := range []string{"test:2", "test:1"} {
+		if err := WriteArtifact(ctx, fimg.Fp.Name(), dir, ref, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := OpenArtifact(dir, ""); err == nil {
+		t.Error("opened one of two artifacts without a ref")
+	}
+	if a, err = OpenArtifact(dir, "test:2"); err != nil || a.Ref != "test:2" {
+		t.Fatalf("got %v, %v", a, err)
+	}
+	var index ociImageIndex
+	if err := (&OCIImage{src: ociDir(dir)}).readJSON("index.json", "", &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 3 {
+		t.Errorf("got %d manifests, want the image and two artifacts", len(index.Manifests))
+	}
+
+	// a changed blob doesn't match its digest
+	name, _ := blobName(a.Layer.Digest)
+	blob := filepath.Join(dir, filepath.FromSlash(name))
+	tampered := append([]byte(nil), image...)
+	tampered[len(tampered)-1] ^= 0xff
+	if err := ioutil.WriteFile(blob, tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(ctx, nil, nil); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("got %v, want ErrDigestMismatch", err)
+	}
+
+	notSIF := filepath.Join(dir, "index.json")
+	if err := WriteArtifact(ctx, notSIF, dir, "bad", nil); err == nil {
+		t.Error("wrote an artifact of a file that isn't a SIF")
+	}
+}
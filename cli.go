@@ -0,0 +1,1397 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// command is a subcommand of the sifweb command line.
+type command struct {
+	usage   string // arguments, shown after the command name
+	summary string // one line description
+	run     func(args []string) error
+}
+
+// commands maps each subcommand name to its command.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"add":          {"[options] FILE DATA", "add a data object to a SIF", cmdAdd},
+		"delete":       {"[-compact] FILE ID", "delete a data object from a SIF", cmdDelete},
+		"artifact":     {"[-ref NAME] FILE LAYOUT | -check [-json] [-ref NAME] LAYOUT [OUT]", "wrap a SIF as an OCI artifact in an image layout, or check one", cmdArtifact},
+		"convert":      {"[-ref NAME] [-arch ARCH] IMAGE OUT", "convert an OCI image layout or docker save tarball to a SIF", cmdConvert},
+		"create":       {"[options] OUT", "create a SIF from a partition and metadata files", cmdCreate},
+		"dedup":        {"[-json] [-workers N] DIR", "find duplicate images and identical partitions in a directory tree", cmdDedup},
+		"diff":         {"[-json] OLD NEW", "show what changed between two SIFs", cmdDiff},
+		"encrypt":      {"[-pem KEY] FILE OUT", "encrypt the primary partition for an RSA key or passphrase", cmdEncrypt},
+		"export":       {"[-docker] [-ref NAME] FILE OUT", "export a SIF as an OCI image layout or docker load tarball", cmdExport},
+		"extract":      {"FILE PATH [OUT]", "extract a file of the primary partition, to stdout or OUT", cmdExtract},
+		"inspect":      {"[-json] FILE", "show the header and descriptors of a SIF", cmdInspect},
+		"lint":         {"[-json] FILE", "check the structure of a SIF in depth", cmdLint},
+		"inventory":    {"[-json] [-workers N] [-o OUT] DIR", "report on every SIF of a directory tree, as CSV or JSON", cmdInventory},
+		"library":      {"[-url URL] [-arch ARCH] [-json] REF | -pull [-url URL] [-arch ARCH] REF OUT", "browse a library server, or download an image from it", cmdLibrary},
+		"library-mock": {"[-addr ADDR] [-ui DIR] DIR", "serve a directory of SIFs as a library server, for testing", cmdLibraryMock},
+		"partition":    {"[-primary] [-type TYPE] [-arch ARCH] FILE ID", "change the type or arch of a partition", cmdPartition},
+		"repair":       {"[-n] FILE [OUT]", "fix common corruptions, writing a corrected copy", cmdRepair},
+		"sbom":         {"[-format FORMAT] [-o OUT] [-add] FILE", "list the packages installed in the primary partition, or export them as SPDX or CycloneDX", cmdSBOM},
+		"serve":        {"[-addr ADDR] [-ui DIR] [-cors ORIGIN] DIR", "serve the web UI and a JSON API over the SIFs of a directory", cmdServe},
+		"sign":         {"-key FILE [-group N] [-hash HASH] FILE", "sign objects of a SIF with an OpenPGP key", cmdSign},
+		"tar":          {"[-root PATH] FILE OUT", "export the primary partition as a tar archive", cmdTar},
+		"verify":       {"[-json] [-keyring FILE] FILE", "check the signatures of a SIF", cmdVerify},
+		"vulns":        {"-db PATH [-json] FILE", "match the installed packages against a local OSV advisory database", cmdVulns},
+	}
+}
+
+// printUsage shows the list of commands on stderr.
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: sifweb COMMAND [options] [arguments]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].summary)
+		fmt.Fprintf(os.Stderr, "  %-12s   sifweb %s %s\n", "", name, commands[name].usage)
+	}
+}
+
+// usageError returns an error for bad command line arguments.
+func usageError(format string, a ...interface{}) error {
+	return fmt.Errorf("%s: %w", fmt.Sprintf(format, a...), ErrUsage)
+}
+
+// newFlagSet returns a flag set for a command that reports errors instead
+// of exiting, so they get the usage exit code.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: sifweb %s %s\n", name, commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args for a command and checks the number of remaining
+// (positional) arguments.
+func parseFlags(fs *flag.FlagSet, args []string, nargs int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return usageError("%s", err)
+	}
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return usageError("%s expects %d argument(s), got %d", fs.Name(), nargs, fs.NArg())
+	}
+	return nil
+}
+
+// progressBar draws the progress of an operation on stderr, if it's a terminal.
+type progressBar struct {
+	label string
+	drawn bool
+}
+
+// newProgressBar returns a progress bar for an operation.
+func newProgressBar(label string) *progressBar {
+	return &progressBar{label: label}
+}
+
+// update is a ProgressFunc that redraws the bar.
+func (b *progressBar) update(done, total int64) {
+	if fi, err := os.Stderr.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return
+	}
+
+	const width = 30
+	filled, percent := width, 100
+	if total > 0 && done < total {
+		filled = int(width * done / total)
+		percent = int(100 * done / total)
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	fmt.Fprintf(os.Stderr, "\r%s [%s] %3d%% %s/%s", b.label, bar, percent,
+		readableSize(uint64(done)), readableSize(uint64(total)))
+	b.drawn = true
+}
+
+// finish ends the line of the bar, if it was drawn.
+func (b *progressBar) finish() {
+	if b.drawn {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// interruptContext returns a context that is canceled on Ctrl-C.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(c)
+	}()
+	return ctx, cancel
+}
+
+// cmdInspect prints the header and descriptor list of a SIF, like the
+// browser does, or the same ContainerInfo as JSON.
+func cmdInspect(args []string) error {
+	fs := newFlagSet("inspect")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	path := fs.Arg(0)
+
+	fimg, err := LoadContainer(path, true)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	info := fimg.getInfo(path)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			return err
+		}
+	} else {
+		fmt.Print(addFileName(path, fimg.FmtHeader()))
+		fmt.Println("----------------------------------------------------")
+		fmt.Print(fimg.FmtDescrList())
+	}
+
+	// Descriptor problems don't stop the listing, but still set the exit code
+	if len(info.errs) > 0 {
+		return errorList(info.errs)
+	}
+	return nil
+}
+
+// cmdLint checks the structure of a SIF, and fails if there are errors.
+func cmdLint(args []string) error {
+	fs := newFlagSet("lint")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	fp, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return readError(ErrIO, 0, fs.Arg(0), err, "")
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return readError(ErrIO, 0, fs.Arg(0), err, "")
+	}
+
+	fimg := &FileImage{}
+	fimg.loadReader(fp, fi.Size())
+	findings := fimg.Lint()
+
+	errs := 0
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			errs++
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(findings); err != nil {
+			return err
+		}
+	} else {
+		if len(findings) == 0 {
+			fmt.Println("No problems found")
+		}
+		for _, f := range findings {
+			message := f.Message
+			if f.Context != "" {
+				message = f.Context + ": " + message
+			}
+			fmt.Printf("%-7s %-9s offset %-8d %s\n", f.Severity, f.Check, f.Offset, message)
+		}
+	}
+
+	if errs > 0 {
+		return fmt.Errorf("%d error(s) and %d warning(s): %w", errs, len(findings)-errs, ErrLintFailed)
+	}
+	return nil
+}
+
+// cmdRepair reports the fixes for a damaged SIF and, unless -n is given,
+// writes a corrected copy.
+func cmdRepair(args []string) error {
+	fs := newFlagSet("repair")
+	dryRun := fs.Bool("n", false, "only report what would be fixed")
+	if err := fs.Parse(args); err != nil {
+		return usageError("%s", err)
+	}
+	if fs.NArg() != 2 && !(*dryRun && fs.NArg() == 1) {
+		fs.Usage()
+		return usageError("repair expects FILE and OUT, or -n FILE")
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	fixes := fimg.Repair()
+	if len(fixes) == 0 {
+		fmt.Println("Nothing to fix")
+	}
+	for _, f := range fixes {
+		fmt.Printf("offset %-8d %s: %s\n", f.Offset, f.Context, f.Message)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	bar := newProgressBar("Writing")
+	err = fimg.WriteRepaired(ctx, out, bar.update)
+	bar.finish()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fs.Arg(1))
+		return err
+	}
+
+	// what the fixes don't cover
+	repaired, err := os.Open(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer repaired.Close()
+	fi, err := repaired.Stat()
+	if err != nil {
+		return err
+	}
+	check := &FileImage{}
+	check.loadReader(repaired, fi.Size())
+	if left := len(check.Lint()); left > 0 {
+		fmt.Printf("Wrote %s, %d problem(s) left, see sifweb lint\n", fs.Arg(1), left)
+	} else {
+		fmt.Printf("Wrote %s\n", fs.Arg(1))
+	}
+	return nil
+}
+
+// cmdVerify checks the digests of every signature of a SIF.
+func cmdVerify(args []string) error {
+	fs := newFlagSet("verify")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	keyringFile := fs.String("keyring", "", "OpenPGP public keys to check the signatures with (armored)")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	var keyring openpgp.KeyRing
+	if *keyringFile != "" {
+		f, err := os.Open(*keyringFile)
+		if err != nil {
+			return err
+		}
+		keys, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %s", *keyringFile, err)
+		}
+		keyring = keys
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Hashing")
+	checks, err := fimg.Verify(ctx, keyring, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if !c.Verified {
+			failed++
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(checks); err != nil {
+			return err
+		}
+	} else {
+		if len(checks) == 0 {
+			fmt.Println("No signatures found")
+		}
+		for _, c := range checks {
+			status := "OK  "
+			if !c.Verified {
+				status = "FAIL"
+			}
+			fmt.Printf("%s signature %d (objects %v, %s): %s\n", status, c.ID, c.Objects, c.Format, c.Message)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d signature(s): %w", failed, len(checks), ErrVerifyFailed)
+	}
+	return nil
+}
+
+// cmdSign signs a group of objects of a SIF. The passphrase of an
+// encrypted key is read from $SIFWEB_PASSPHRASE.
+func cmdSign(args []string) error {
+	fs := newFlagSet("sign")
+	keyFile := fs.String("key", "", "OpenPGP private key (e.g., from gpg --export-secret-keys)")
+	group := fs.Uint("group", 1, "group of objects to sign")
+	hashName := fs.String("hash", "sha256", "hash of the digests: sha256, sha384 or sha512")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		fs.Usage()
+		return usageError("sign needs a -key")
+	}
+
+	hashes := map[string]Hashtype{"sha256": HashSHA256, "sha384": HashSHA384, "sha512": HashSHA512}
+	hash, ok := hashes[*hashName]
+	if !ok {
+		return usageError("unsupported hash %q", *hashName)
+	}
+
+	f, err := os.Open(*keyFile)
+	if err != nil {
+		return err
+	}
+	entity, err := readSigningKey(f, []byte(os.Getenv("SIFWEB_PASSPHRASE")))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Signing")
+	sigID, err := fimg.Sign(ctx, entity, uint32(*group), hash, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Signature %d added, key %X\n", sigID, entity.PrimaryKey.Fingerprint)
+	return nil
+}
+
+// cmdDiff compares two SIFs.
+func cmdDiff(args []string) error {
+	fs := newFlagSet("diff")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+
+	a, err := LoadContainer(fs.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer a.UnloadContainer()
+	b, err := LoadContainer(fs.Arg(1), true)
+	if err != nil {
+		return err
+	}
+	defer b.UnloadContainer()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Comparing")
+	diff, err := DiffImages(ctx, a, b, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	diff.Old, diff.New = fs.Arg(0), fs.Arg(1)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	fmt.Print(diff.FmtDiff())
+	return nil
+}
+
+// cmdEncrypt writes a copy of a SIF with its primary partition encrypted,
+// for an RSA public key or the passphrase in $SIFWEB_PASSPHRASE.
+func cmdEncrypt(args []string) error {
+	fs := newFlagSet("encrypt")
+	pemFile := fs.String("pem", "", "RSA public key in PEM format, instead of a passphrase")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+
+	var key EncryptionKey
+	if *pemFile != "" {
+		data, err := ioutil.ReadFile(*pemFile)
+		if err != nil {
+			return err
+		}
+		if key.PublicKey, err = ReadPEMPublicKey(data); err != nil {
+			return fmt.Errorf("%s: %w", *pemFile, err)
+		}
+	} else if key.Passphrase = []byte(os.Getenv("SIFWEB_PASSPHRASE")); len(key.Passphrase) == 0 {
+		fs.Usage()
+		return usageError("encrypt needs a -pem key or $SIFWEB_PASSPHRASE")
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	cinfo, warnings, err := fimg.EncryptedCopy(key)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+	cinfo.Pathname = fs.Arg(1)
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Encrypting")
+	out, err := CreateContainer(ctx, cinfo, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	defer out.UnloadContainer()
+
+	fmt.Print(out.FmtDescrList())
+	return nil
+}
+
+// cmdExtract copies a file of the primary partition out of the SIF, to
+// stdout unless an output file is given.
+func cmdExtract(args []string) error {
+	fs := newFlagSet("extract")
+	if err := fs.Parse(args); err != nil {
+		return usageError("%s", err)
+	}
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fs.Usage()
+		return usageError("extract expects 2 or 3 arguments, got %d", fs.NArg())
+	}
+	src, dest := fs.Arg(1), "-"
+	if fs.NArg() == 3 {
+		dest = fs.Arg(2)
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	sqfs, err := fimg.GetPrimSquashFS()
+	if err != nil {
+		return err
+	}
+
+	// only create the output for a file that is there
+	inode, err := sqfs.Lookup(src)
+	if err != nil {
+		return err
+	}
+	if !inode.IsRegular() {
+		return fmt.Errorf("%s: not a regular file", src)
+	}
+
+	out := os.Stdout
+	if dest != "-" {
+		if out, err = os.Create(dest); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Extracting")
+	err = sqfs.Extract(ctx, out, src, bar.update)
+	bar.finish()
+	if dest != "-" {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dest)
+		}
+	}
+	return err
+}
+
+// cmdTar writes the primary partition (or a tree of it) as a tar archive.
+func cmdTar(args []string) error {
+	fs := newFlagSet("tar")
+	root := fs.String("root", "/", "directory of the partition to export")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	sqfs, err := fimg.GetPrimSquashFS()
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if fs.Arg(1) != "-" {
+		if out, err = os.Create(fs.Arg(1)); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Exporting")
+	err = sqfs.WriteTar(ctx, out, *root, bar.update)
+	bar.finish()
+	return err
+}
+
+// fileList is a flag that can be given more than once.
+type fileList []string
+
+func (l *fileList) String() string     { return strings.Join(*l, ",") }
+func (l *fileList) Set(v string) error { *l = append(*l, v); return nil }
+
+// cmdCreate writes a new SIF from a squashfs partition and metadata files.
+func cmdCreate(args []string) error {
+	fs := newFlagSet("create")
+	deffile := fs.String("deffile", "", "definition file")
+	labels := fs.String("labels", "", "JSON labels file")
+	env := fs.String("env", "", "environment variables file")
+	partition := fs.String("partition", "", "squashfs image of the primary system partition")
+	arch := fs.String("arch", runtime.GOARCH, "arch of the partition (go name, e.g., amd64)")
+	var generic, genericJSON fileList
+	fs.Var(&generic, "generic", "generic data file (can be repeated)")
+	fs.Var(&genericJSON, "json", "generic JSON file (can be repeated)")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	cinfo := CreateInfo{Pathname: fs.Arg(0)}
+	add := func(t Datatype, fname string) {
+		if fname != "" {
+			cinfo.InputDescr = append(cinfo.InputDescr, DescriptorInput{
+				Datatype: t, Groupid: DescrDefaultGroup, Fname: fname})
+		}
+	}
+	add(DataDeffile, *deffile)
+	add(DataLabels, *labels)
+	add(DataEnvVar, *env)
+	if *partition != "" {
+		sifarch := GetSIFArch(*arch)
+		if sifarch == HdrArchUnknown {
+			return usageError("unknown arch %q", *arch)
+		}
+		add(DataPartition, *partition)
+		input := &cinfo.InputDescr[len(cinfo.InputDescr)-1]
+		if err := input.SetPartExtra(FsSquash, PartPrimSys, sifarch); err != nil {
+			return err
+		}
+	}
+	for _, f := range genericJSON {
+		add(DataGenericJSON, f)
+	}
+	for _, f := range generic {
+		add(DataGeneric, f)
+	}
+	if len(cinfo.InputDescr) == 0 {
+		fs.Usage()
+		return usageError("create needs at least one input")
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Writing")
+	fimg, err := CreateContainer(ctx, &cinfo, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	fmt.Print(fimg.FmtDescrList())
+	return nil
+}
+
+// cmdArtifact adds a SIF to an OCI image layout as an artifact or, with
+// -check, shows an artifact of a layout and checks its digest.
+func cmdArtifact(args []string) error {
+	fs := newFlagSet("artifact")
+	check := fs.Bool("check", false, "show and check the artifact of LAYOUT, copying the SIF to OUT if given")
+	asJSON := fs.Bool("json", false, "print the artifact as JSON (with -check)")
+	ref := fs.String("ref", "", "name of the artifact (default: the file name when writing)")
+	if err := fs.Parse(args); err != nil {
+		return usageError("%s", err)
+	}
+	if *check && (fs.NArg() < 1 || fs.NArg() > 2) || !*check && fs.NArg() != 2 {
+		fs.Usage()
+		return usageError("artifact expects FILE and LAYOUT, or -check LAYOUT [OUT]")
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	if !*check {
+		name := *ref
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(fs.Arg(0)), filepath.Ext(fs.Arg(0)))
+		}
+		if !strings.Contains(path.Base(name), ":") {
+			name += ":latest"
+		}
+		bar := newProgressBar("Copying")
+		err := WriteArtifact(ctx, fs.Arg(0), fs.Arg(1), name, bar.update)
+		bar.finish()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s to %s\n", name, fs.Arg(1))
+		return nil
+	}
+
+	a, err := OpenArtifact(fs.Arg(0), *ref)
+	if err != nil {
+		return err
+	}
+	if !*asJSON {
+		manifest, _ := json.MarshalIndent(a.Content, "", "  ")
+		fmt.Printf("Artifact: %s\nManifest: %s (%d bytes)\n%s\n", a.Ref, a.Manifest.Digest, a.Manifest.Size, manifest)
+	}
+
+	var w io.Writer
+	if fs.NArg() == 2 {
+		out, err := os.Create(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+	bar := newProgressBar("Checking")
+	err = a.Verify(ctx, w, bar.update)
+	bar.finish()
+	if err != nil {
+		if fs.NArg() == 2 {
+			os.Remove(fs.Arg(1))
+		}
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(a)
+	}
+	fmt.Printf("Layer:    %s OK (%d bytes, a valid SIF)\n", a.Layer.Digest, a.Layer.Size)
+	if fs.NArg() == 2 {
+		fmt.Printf("Wrote %s\n", fs.Arg(1))
+	}
+	return nil
+}
+
+// cmdConvert makes a SIF from an OCI image layout or docker save tarball.
+func cmdConvert(args []string) error {
+	fs := newFlagSet("convert")
+	ref := fs.String("ref", "", "image to convert if there are several (ref name or repo tag)")
+	arch := fs.String("arch", runtime.GOARCH, "arch to convert from a multi-arch image (go name)")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+
+	img, err := OpenOCI(fs.Arg(0), *ref, *arch)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	tmp, err := ioutil.TempFile("", "sifweb-*.squashfs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	bar := newProgressBar("Layers")
+	size, warnings, err := img.WriteSquashFS(ctx, tmp, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	inputs, err := img.SIFInputs(tmp, size)
+	if err != nil {
+		return err
+	}
+	cinfo := CreateInfo{Pathname: fs.Arg(1), InputDescr: inputs}
+	bar = newProgressBar("Writing")
+	fimg, err := CreateContainer(ctx, &cinfo, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	fmt.Print(fimg.FmtDescrList())
+	return nil
+}
+
+// cmdExport writes the primary partition of a SIF as an OCI image.
+func cmdExport(args []string) error {
+	fs := newFlagSet("export")
+	docker := fs.Bool("docker", false, "write a tarball for docker load instead of a layout directory")
+	ref := fs.String("ref", "", "name of the image (default: the file name)")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+	name := *ref
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(fs.Arg(0)), filepath.Ext(fs.Arg(0)))
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Exporting")
+	err = fimg.ExportOCI(ctx, fs.Arg(1), name, *docker, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", fs.Arg(1))
+	return nil
+}
+
+// cmdAdd appends a data object to an existing SIF.
+func cmdAdd(args []string) error {
+	fs := newFlagSet("add")
+	datatype := fs.String("datatype", "json", "type of the data: deffile, env, labels, json or generic")
+	group := fs.Uint("group", 1, "group of the object, 0 for none")
+	link := fs.Uint("link", 0, "ID of the object this one is linked to")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+
+	types := map[string]Datatype{
+		"deffile": DataDeffile,
+		"env":     DataEnvVar,
+		"labels":  DataLabels,
+		"json":    DataGenericJSON,
+		"generic": DataGeneric,
+	}
+	t, ok := types[*datatype]
+	if !ok {
+		return usageError("unknown datatype %q", *datatype)
+	}
+	input := DescriptorInput{Datatype: t, Groupid: DescrUnusedGroup, Link: uint32(*link), Fname: fs.Arg(1)}
+	if *group > 0 {
+		input.Groupid = DescrGroupMask | uint32(*group)
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Writing")
+	err = fimg.AddObject(ctx, &input, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(fimg.FmtDescrList())
+	return nil
+}
+
+// cmdDelete removes a data object from a SIF, zeroing its data or
+// compacting the file.
+func cmdDelete(args []string) error {
+	fs := newFlagSet("delete")
+	compact := fs.Bool("compact", false, "move the following objects down and shrink the file")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(fs.Arg(1), 10, 32)
+	if err != nil {
+		return usageError("invalid ID %q", fs.Arg(1))
+	}
+	flags := DelZero
+	if *compact {
+		flags = DelCompact
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	bar := newProgressBar("Deleting")
+	warnings, err := fimg.DeleteObject(ctx, uint32(id), flags, bar.update)
+	bar.finish()
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(fimg.FmtDescrList())
+	return nil
+}
+
+// cmdPartition changes the partition type or arch of a partition, or
+// makes it the primary system partition.
+func cmdPartition(args []string) error {
+	fs := newFlagSet("partition")
+	primary := fs.Bool("primary", false, "make it the primary system partition (the current one becomes a system partition)")
+	ptype := fs.String("type", "", "partition type: system, primsys, data or overlay")
+	arch := fs.String("arch", "", "arch of the partition (go name, e.g., arm64)")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(fs.Arg(1), 10, 32)
+	if err != nil {
+		return usageError("invalid ID %q", fs.Arg(1))
+	}
+
+	types := map[string]Parttype{
+		"system":  PartSystem,
+		"primsys": PartPrimSys,
+		"data":    PartData,
+		"overlay": PartOverlay,
+	}
+	part, ok := types[*ptype]
+	if *ptype != "" && !ok {
+		return usageError("unknown partition type %q", *ptype)
+	}
+	sifarch := ""
+	if *arch != "" {
+		if sifarch = GetSIFArch(*arch); sifarch == HdrArchUnknown {
+			return usageError("unknown arch %q", *arch)
+		}
+	}
+	if !*primary && *ptype == "" && *arch == "" {
+		fs.Usage()
+		return usageError("partition needs -primary, -type or -arch")
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	// Keep the current type when only the arch changes
+	if *ptype == "" {
+		index, err := fimg.descriptorIndex(uint32(id))
+		if err != nil {
+			return err
+		}
+		if part, err = fimg.DescrArr[index].GetPartType(); err != nil {
+			return err
+		}
+	}
+	if *primary {
+		if err := fimg.SetPartPrimSys(uint32(id)); err != nil {
+			return err
+		}
+		if *ptype == "" {
+			part = PartPrimSys
+		}
+	}
+	if *ptype != "" || sifarch != "" {
+		if err := fimg.SetPartType(uint32(id), part, sifarch); err != nil {
+			return err
+		}
+	}
+
+	fmt.Print(fimg.FmtDescrList())
+	return nil
+}
+
+// cmdInventory walks a directory tree and writes a line per SIF found,
+// from its header and descriptors only.
+func cmdInventory(args []string) error {
+	fs := newFlagSet("inventory")
+	asJSON := fs.Bool("json", false, "write the report as JSON instead of CSV")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of images inspected at a time")
+	out := fs.String("o", "-", "file to write the report to")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	entries, err := Inventory(ctx, fs.Arg(0), *workers, nil)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "-" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(entries)
+	} else {
+		err = WriteInventoryCSV(w, entries)
+	}
+	if err != nil {
+		return err
+	}
+
+	var failed, broken int
+	for _, e := range entries {
+		if e.Error != nil {
+			failed++
+		} else if e.Errors > 0 {
+			broken++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d images, %d with structural errors, %d could not be loaded\n", len(entries), broken, failed)
+	if w != os.Stdout {
+		return w.Close()
+	}
+	return nil
+}
+
+// cmdDedup reports the images of a directory tree with the same ID and
+// their identical partitions.
+func cmdDedup(args []string) error {
+	fs := newFlagSet("dedup")
+	asJSON := fs.Bool("json", false, "write the report as JSON")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of images read at a time")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	bar := newProgressBar("Hashing")
+	report, err := Duplicates(ctx, fs.Arg(0), *workers, bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Print(report.FmtDedup())
+	return nil
+}
+
+// cmdSBOM lists the packages installed in the primary partition, or writes
+// them as a document, which can also be added to the image.
+func cmdSBOM(args []string) error {
+	fs := newFlagSet("sbom")
+	format := fs.String("format", "text", "output format: text, json, spdx or cyclonedx")
+	out := fs.String("o", "-", "file to write to")
+	add := fs.Bool("add", false, "also add the document to the image, as a JSON object")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	if *add && *format == "text" {
+		return usageError("-add needs -format json, spdx or cyclonedx")
+	}
+
+	fimg, err := LoadContainer(fs.Arg(0), !*add)
+	if err != nil {
+		return err
+	}
+	defer fimg.UnloadContainer()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	bar := newProgressBar("Scanning")
+	sbom, err := fimg.Packages(ctx, filepath.Base(fs.Arg(0)), bar.update)
+	bar.finish()
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	var name string
+	if *format == "text" {
+		data = []byte(sbom.FmtPackages())
+	} else if data, name, err = sbom.Document(*format, time.Now()); err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		os.Stdout.Write(data)
+		if *format != "text" {
+			fmt.Println()
+		}
+	} else if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+
+	if *add {
+		input := DescriptorInput{Datatype: DataGenericJSON, Groupid: DescrGroupMask | 1, Fname: name, Data: data}
+		if err := fimg.AddObject(ctx, &input, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "added %s as object %d\n", name, input.Descr.ID)
+	}
+	return nil
+}
+
+// cmdVulns matches the packages of a SIF, or of an SBOM saved with
+// sbom -format json, against the advisories of a file or directory.
+func cmdVulns(args []string) error {
+	fs := newFlagSet("vulns")
+	dbPath := fs.String("db", "", "OSV advisories: a JSON file, a zip of them or a directory")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	if *dbPath == "" {
+		return usageError("-db is required")
+	}
+
+	db, err := LoadAdvisoryDB(*dbPath)
+	if err != nil {
+		return err
+	}
+
+	var sbom *SBOM
+	fimg, err := LoadContainer(fs.Arg(0), true)
+	switch {
+	case errors.Is(err, ErrBadMagic):
+		data, rerr := ioutil.ReadFile(fs.Arg(0))
+		if rerr != nil {
+			return rerr
+		}
+		if json.Unmarshal(data, &sbom) != nil || sbom == nil || sbom.Packages == nil {
+			return err // neither a SIF nor an SBOM
+		}
+	case err != nil:
+		return err
+	default:
+		defer fimg.UnloadContainer()
+		ctx, cancel := interruptContext()
+		defer cancel()
+		bar := newProgressBar("Scanning")
+		sbom, err = fimg.Packages(ctx, filepath.Base(fs.Arg(0)), bar.update)
+		bar.finish()
+		if err != nil {
+			return err
+		}
+	}
+
+	report := db.Match(sbom)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Print(report.FmtVulns())
+	return nil
+}
+
+// cmdServe serves the web UI and a JSON API over the SIFs of a directory,
+// until interrupted.
+func cmdServe(args []string) error {
+	fs := newFlagSet("serve")
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	ui := fs.String("ui", "docs", "directory of the web UI, empty for the API only")
+	cors := fs.String("cors", "", "origin allowed to use the API from a browser (e.g., *)")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	dir := fs.Arg(0)
+	if fi, err := os.Stat(dir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return usageError("%s is not a directory", dir)
+	}
+	if *ui != "" {
+		if _, err := os.Stat(filepath.Join(*ui, "index.html")); err != nil {
+			return fmt.Errorf("web UI: %w (use -ui \"\" to serve the API only)", err)
+		}
+		mime.AddExtensionType(".wasm", "application/wasm")
+	}
+
+	s := &Server{Dir: dir, UI: *ui, CORS: *cors}
+	log.Printf("Serving %s on http://%s/", dir, *addr)
+	return listenAndServe(*addr, s.Handler())
+}
+
+// libraryFlags adds the flags to reach a library server.
+func libraryFlags(fs *flag.FlagSet) (*string, *string) {
+	base := os.Getenv("SIFWEB_LIBRARY")
+	if base == "" {
+		base = DefaultLibraryURL
+	}
+	u := fs.String("url", base, "URL of the library server, $SIFWEB_LIBRARY if set")
+	arch := fs.String("arch", "", "arch of the images (default: all when browsing, amd64 when pulling)")
+	return u, arch
+}
+
+// cmdLibrary shows an entry of a library server and what is below it, or
+// with -pull, downloads an image and checks its hash. The token for private
+// entries is read from $SIFWEB_LIBRARY_TOKEN.
+func cmdLibrary(args []string) error {
+	fs := newFlagSet("library")
+	base, arch := libraryFlags(fs)
+	asJSON := fs.Bool("json", false, "print the entry as JSON")
+	pull := fs.Bool("pull", false, "download the image REF to OUT")
+	if err := fs.Parse(args); err != nil {
+		return usageError("%s", err)
+	}
+	if *pull && fs.NArg() != 2 || !*pull && fs.NArg() != 1 {
+		fs.Usage()
+		return usageError("library expects REF, or -pull REF OUT")
+	}
+	client := NewLibraryClient(*base, os.Getenv("SIFWEB_LIBRARY_TOKEN"))
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	if !*pull {
+		entry, err := client.Browse(ctx, fs.Arg(0), *arch)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(entry)
+		}
+		fmt.Print(entry.FmtEntry())
+		return nil
+	}
+
+	ref, err := ParseLibraryRef(fs.Arg(0))
+	if err != nil {
+		return usageError("%s", err)
+	}
+	image, err := ref.Image()
+	if err != nil {
+		return usageError("%s", err)
+	}
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	bar := newProgressBar("Downloading")
+	img, err := client.Download(ctx, out, image, *arch, bar.update)
+	bar.finish()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fs.Arg(1))
+		return err
+	}
+	fmt.Printf("Wrote %s (%s, %s)\n", fs.Arg(1), image, img.Hash)
+	return nil
+}
+
+// cmdLibraryMock serves a directory of SIFs laid out as
+// entity/collection/container/tag.sif as a library server, with the web UI.
+func cmdLibraryMock(args []string) error {
+	fs := newFlagSet("library-mock")
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	ui := fs.String("ui", "", "directory of the web UI to serve too")
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+	mock, err := NewLibraryMock(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", mock)
+	mux.Handle("/version", mock)
+	if *ui != "" {
+		mime.AddExtensionType(".wasm", "application/wasm")
+		mux.Handle("/", http.FileServer(http.Dir(*ui)))
+	}
+	log.Printf("Serving a library of %d images from %s on http://%s/", len(mock.images), fs.Arg(0), *addr)
+	return listenAndServe(*addr, logRequests(mux))
+}
+
+// listenAndServe serves handler on addr until interrupted.
+func listenAndServe(addr string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		shutdown, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		srv.Shutdown(shutdown)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// printError shows an error (or each error of an errorList) with its hint.
+func printError(err error) {
+	if list, ok := err.(errorList); ok {
+		for _, e := range list {
+			printError(e)
+		}
+		return
+	}
+	info := errorInfo(err)
+	fmt.Fprintf(os.Stderr, "Error: %s\n", info.Message)
+	if info.Hint != "" {
+		fmt.Fprintf(os.Stderr, "Hint:  %s\n", info.Hint)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(ExitUsage)
+	}
+
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage()
+		os.Exit(ExitOK)
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", name)
+		printUsage()
+		os.Exit(ExitUsage)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(ExitOK)
+		}
+		printError(err)
+		os.Exit(exitCode(err))
+	}
+}
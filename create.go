@@ -0,0 +1,736 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// Creating a SIF: the header and the descriptor table come first in the
+// file, so the layout (the offset of every data object) is planned from the
+// input sizes before anything is written. The image can then be streamed
+// to any io.Writer, a file or a download in the browser.
+
+// defaultAlignment is the alignment of partitions when the input doesn't
+// give one, so they can be mounted straight from the image.
+const defaultAlignment = 4096
+
+// SetPartExtra sets the partition info of a DataPartition input: the file
+// system, the partition type and the SIF arch code (e.g., HdrArchAMD64).
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func (di *DescriptorInput) SetPartExtra(fs Fstype, part Parttype, arch string) error {
+	if GetGoArch(arch) == "unknown" {
+		return fmt.Errorf("unknown arch code %q", arch)
+	}
+	extra := Partition{Fstype: fs, Parttype: part}
+	copy(extra.Arch[:], arch)
+
+	di.Extra.Reset()
+	return binary.Write(&di.Extra, binary.LittleEndian, extra)
+}
+
+// SetSignExtra sets the hash type and signing entity (key fingerprint) of
+// a DataSignature input.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func (di *DescriptorInput) SetSignExtra(hash Hashtype, entity []byte) error {
+	extra := Signature{Hashtype: hash}
+	if len(entity) > DescrEntityLen {
+		return fmt.Errorf("entity is %d bytes, max %d", len(entity), DescrEntityLen)
+	}
+	copy(extra.Entity[:], entity)
+
+	di.Extra.Reset()
+	return binary.Write(&di.Extra, binary.LittleEndian, extra)
+}
+
+// SetCryptoMsgExtra sets the format and message type of a DataCryptoMessage input.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func (di *DescriptorInput) SetCryptoMsgExtra(format Formattype, message Messagetype) error {
+	extra := CryptoMessage{Formattype: format, Messagetype: message}
+
+	di.Extra.Reset()
+	return binary.Write(&di.Extra, binary.LittleEndian, extra)
+}
+
+// openInput makes the data of an input readable: Fp if set, else Data,
+// else the file Fname. The size is taken from Data or Fname if not given.
+// The returned closer (possibly nil) must be closed when done.
+func (di *DescriptorInput) openInput() (io.Closer, error) {
+	switch {
+	case di.Fp != nil:
+		return nil, nil
+	case di.Data != nil:
+		di.Fp = bytes.NewReader(di.Data)
+		if di.Size == 0 {
+			di.Size = int64(len(di.Data))
+		}
+		return nil, nil
+	case di.Fname != "":
+		fp, err := os.Open(di.Fname)
+		if err != nil {
+			return nil, err
+		}
+		if di.Size == 0 {
+			fi, err := fp.Stat()
+			if err != nil {
+				fp.Close()
+				return nil, err
+			}
+			di.Size = fi.Size()
+		}
+		di.Fp = fp
+		return fp, nil
+	}
+	return nil, fmt.Errorf("input of type %s has no data", datatypeStr(di.Datatype))
+}
+
+// align returns off rounded up to a multiple of alignment.
+func align(off int64, alignment int) int64 {
+	if alignment <= 1 {
+		return off
+	}
+	a := int64(alignment)
+	return (off + a - 1) / a * a
+}
+
+// nextID returns the ID for a new descriptor, after the highest one used.
+func (fimg *FileImage) nextID() uint32 {
+	var id uint32
+	for _, v := range fimg.DescrArr {
+		if v.Used && v.ID > id {
+			id = v.ID
+		}
+	}
+	return id + 1
+}
+
+// fillDescriptor sets up descriptor index of fimg for input, placing its
+// data at the first offset from end aligned as requested, and accounts for
+// it in the header.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func (fimg *FileImage) fillDescriptor(index int, end int64, input *DescriptorInput) error {
+	if input.Datatype < DataDeffile || input.Datatype > DataCryptoMessage {
+		return fmt.Errorf("input %d: unknown datatype %d", index, input.Datatype)
+	}
+	if input.Size < 0 {
+		return fmt.Errorf("input %d: negative size %d", index, input.Size)
+	}
+	if input.Datatype == DataPartition && input.Extra.Len() == 0 {
+		return fmt.Errorf("input %d: partition without SetPartExtra", index)
+	}
+
+	alignment := input.Alignment
+	if alignment == 0 && input.Datatype == DataPartition {
+		alignment = defaultAlignment
+	}
+
+	descr := &fimg.DescrArr[index]
+	*descr = Descriptor{
+		Datatype: input.Datatype,
+		Used:     true,
+		ID:       fimg.nextID(),
+		Groupid:  input.Groupid,
+		Link:     input.Link,
+		Fileoff:  align(end, alignment),
+		Filelen:  input.Size,
+		Ctime:    fimg.Header.Mtime,
+		Mtime:    fimg.Header.Mtime,
+	}
+	descr.Storelen = descr.Fileoff - end + input.Size
+	if input.Fname != "" {
+		copy(descr.Name[:], path.Base(input.Fname))
+	}
+	copy(descr.Extra[:], input.Extra.Bytes())
+
+	fimg.Header.Datalen = descr.Fileoff + descr.Filelen - fimg.Header.Dataoff
+	fimg.Header.Dfree--
+	input.Descr = descr
+	return nil
+}
+
+// planContainer returns the FileImage (header and descriptors) of a new
+// SIF holding the inputs of cinfo, whose data must be opened already.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func planContainer(cinfo *CreateInfo) (*FileImage, error) {
+	if len(cinfo.InputDescr) > DescrNumEntries {
+		return nil, fmt.Errorf("%d inputs, a SIF holds at most %d", len(cinfo.InputDescr), DescrNumEntries)
+	}
+
+	launch, version := cinfo.Launchstr, cinfo.Sifversion
+	if launch == "" {
+		launch = HdrLaunch
+	}
+	if version == "" {
+		version = HdrVersion
+	}
+	if len(launch) > HdrLaunchLen {
+		return nil, fmt.Errorf("launch string is %d bytes, max %d", len(launch), HdrLaunchLen)
+	}
+	if len(version) >= HdrVersionLen {
+		return nil, fmt.Errorf("invalid SIF version %q", version)
+	}
+	id := cinfo.ID
+	if id == uuid.Nil {
+		id = uuid.New()
+	}
+
+	fimg := &FileImage{DescrArr: make([]Descriptor, DescrNumEntries)}
+	h := &fimg.Header
+	copy(h.Launch[:], launch)
+	copy(h.Magic[:], HdrMagic)
+	copy(h.Version[:], version)
+	copy(h.Arch[:], HdrArchUnknown)
+	h.ID = id
+	h.Ctime = time.Now().Unix()
+	h.Mtime = h.Ctime
+	h.Dfree = DescrNumEntries
+	h.Dtotal = DescrNumEntries
+	h.Descroff = DescrStartOffset
+	h.Descrlen = h.Dtotal * int64(binary.Size(Descriptor{}))
+	h.Dataoff = DataStartOffset
+
+	for i := range cinfo.InputDescr {
+		end := h.Dataoff + h.Datalen
+		if err := fimg.fillDescriptor(i, end, &cinfo.InputDescr[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// The header arch is the arch of the primary system partition
+	descr, _, err := fimg.GetPartPrimSys()
+	if err == ErrMultValues {
+		return nil, fmt.Errorf("more than one primary system partition")
+	}
+	if err == nil {
+		fimg.PrimPartID = descr.ID
+		copy(h.Arch[:], descr.Extra[8:8+HdrArchLen])
+	}
+	return fimg, nil
+}
+
+// WriteContainer writes a new SIF holding the inputs of cinfo to w. Progress
+// is reported in bytes of data written. It returns the FileImage of the new
+// SIF, without a reader.
+func WriteContainer(ctx context.Context, w io.Writer, cinfo *CreateInfo, fn ProgressFunc) (*FileImage, error) {
+	for i := range cinfo.InputDescr {
+		closer, err := cinfo.InputDescr[i].openInput()
+		if err != nil {
+			return nil, err
+		}
+		if closer != nil {
+			defer closer.Close()
+		}
+	}
+
+	fimg, err := planContainer(cinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// offset w is at, to pad up to the next part
+	var off int64
+	pad := func(to int64) error {
+		n, err := io.CopyN(w, zeroReader{}, to-off)
+		off += n
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, fimg.Header); err != nil {
+		return nil, err
+	}
+	off = int64(binary.Size(fimg.Header))
+	if err := pad(fimg.Header.Descroff); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, fimg.DescrArr); err != nil {
+		return nil, err
+	}
+	off += int64(binary.Size(fimg.DescrArr))
+	if err := pad(fimg.Header.Dataoff); err != nil {
+		return nil, err
+	}
+
+	p := newProgress(ctx, fimg.Header.Datalen, fn)
+	defer p.finish()
+	for _, input := range cinfo.InputDescr {
+		if err := pad(input.Descr.Fileoff); err != nil {
+			return nil, err
+		}
+		n, err := copyProgress(w, io.LimitReader(input.Fp, input.Size), p)
+		off += n
+		if err != nil {
+			return nil, err
+		}
+		if n != input.Size {
+			return nil, fmt.Errorf("%s: got %d bytes of data, expected %d",
+				descriptorContext(*input.Descr), n, input.Size)
+		}
+	}
+	return fimg, nil
+}
+
+// CreateContainer creates the SIF cinfo.Pathname holding the inputs of
+// cinfo, and returns it loaded read-write. Call UnloadContainer when done.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func CreateContainer(ctx context.Context, cinfo *CreateInfo, fn ProgressFunc) (*FileImage, error) {
+	fp, err := os.Create(cinfo.Pathname)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := WriteContainer(ctx, fp, cinfo, fn); err != nil {
+		fp.Close()
+		os.Remove(cinfo.Pathname)
+		return nil, err
+	}
+	if err := fp.Close(); err != nil {
+		os.Remove(cinfo.Pathname)
+		return nil, err
+	}
+	return LoadContainer(cinfo.Pathname, false)
+}
+
+// zeroReader reads zero bytes forever, to pad data objects.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// writeAt writes b at offset off of the opened SIF file.
+func (fimg *FileImage) writeAt(b []byte, off int64) error {
+	if fimg.Fp == nil {
+		return fmt.Errorf("image was not opened from a file")
+	}
+	if _, err := fimg.Fp.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := fimg.Fp.Write(b)
+	return err
+}
+
+// writeHeader rewrites the global header of the opened SIF file.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func (fimg *FileImage) writeHeader() error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, fimg.Header); err != nil {
+		return err
+	}
+	return fimg.writeAt(buf.Bytes(), 0)
+}
+
+// writeDescriptor rewrites descriptor index of the opened SIF file.
+func (fimg *FileImage) writeDescriptor(index int) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, fimg.DescrArr[index]); err != nil {
+		return err
+	}
+	return fimg.writeAt(buf.Bytes(), fimg.Header.Descroff+int64(index*buf.Len()))
+}
+
+// resize sets the size of the opened SIF file after it was changed, so
+// that reads see the new data.
+func (fimg *FileImage) resize(size int64) {
+	if r, ok := fimg.Fp.(io.ReaderAt); ok {
+		fimg.loadReader(r, size)
+	}
+}
+
+// AddObject adds the data object of input to the SIF opened read-write:
+// the data is written at the (aligned) end of the file and described in a
+// free descriptor. Only that descriptor and the header are rewritten.
+// Progress is reported in bytes of data written.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func (fimg *FileImage) AddObject(ctx context.Context, input *DescriptorInput, fn ProgressFunc) error {
+	index := -1
+	for i, v := range fimg.DescrArr {
+		if !v.Used {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return fmt.Errorf("no free descriptor, all %d are used", len(fimg.DescrArr))
+	}
+
+	closer, err := input.openInput()
+	if err != nil {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	// Work on a copy of the header, the image is only changed once the
+	// data is written
+	saved := fimg.Header
+	fimg.Header.Mtime = time.Now().Unix()
+	end := fimg.Filesize
+	if dataEnd := fimg.Header.Dataoff + fimg.Header.Datalen; dataEnd > end {
+		end = dataEnd
+	}
+	if err := fimg.fillDescriptor(index, end, input); err != nil {
+		fimg.Header = saved
+		fimg.DescrArr[index] = Descriptor{}
+		return err
+	}
+	descr := fimg.DescrArr[index]
+
+	// A new primary partition sets the arch, there can only be one
+	prim, _, primErr := fimg.GetPartPrimSys()
+	if primErr == ErrMultValues {
+		fimg.Header = saved
+		fimg.DescrArr[index] = Descriptor{}
+		return fmt.Errorf("image already has a primary system partition (%d)", fimg.PrimPartID)
+	}
+	if primErr != nil {
+		prim = nil
+	}
+	if prim != nil && prim.ID == descr.ID {
+		copy(fimg.Header.Arch[:], descr.Extra[8:8+HdrArchLen])
+	}
+
+	err = func() error {
+		if descr.Fileoff > end {
+			if err := fimg.writeAt(make([]byte, descr.Fileoff-end), end); err != nil {
+				return err
+			}
+		} else if _, err := fimg.Fp.Seek(descr.Fileoff, io.SeekStart); err != nil {
+			return err
+		}
+
+		p := newProgress(ctx, input.Size, fn)
+		defer p.finish()
+		n, err := copyProgress(fimg.Fp, io.LimitReader(input.Fp, input.Size), p)
+		if err != nil {
+			return err
+		}
+		if n != input.Size {
+			return fmt.Errorf("%s: got %d bytes of data, expected %d", descriptorContext(descr), n, input.Size)
+		}
+		return nil
+	}()
+	if err != nil {
+		// leave the file as it was, the header still describes it
+		fimg.Header = saved
+		fimg.DescrArr[index] = Descriptor{}
+		fimg.Fp.Truncate(fimg.Filesize)
+		return err
+	}
+
+	if err := fimg.writeDescriptor(index); err != nil {
+		return err
+	}
+	if err := fimg.writeHeader(); err != nil {
+		return err
+	}
+	if prim != nil && prim.ID == descr.ID {
+		fimg.PrimPartID = prim.ID
+	}
+	fimg.resize(descr.Fileoff + descr.Filelen)
+	return nil
+}
+
+// alignmentOf guesses the alignment an object was placed with from its
+// offset, up to the default partition alignment, so that compacting keeps
+// objects aligned.
+func alignmentOf(off int64) int {
+	a := 1
+	for a < defaultAlignment && off%int64(2*a) == 0 {
+		a *= 2
+	}
+	return a
+}
+
+// zeroData overwrites n bytes at off of the opened SIF file with zeros.
+func (fimg *FileImage) zeroData(off, n int64, p *progress) error {
+	if _, err := fimg.Fp.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := copyProgress(fimg.Fp, io.LimitReader(zeroReader{}, n), p)
+	return err
+}
+
+// moveData copies n bytes of the opened SIF file from off to the lower
+// offset to, front to back so the ranges may overlap.
+func (fimg *FileImage) moveData(to, off, n int64, p *progress) error {
+	buf := make([]byte, 1<<20)
+	for n > 0 {
+		chunk := buf
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if _, err := fimg.Reader.ReadAt(chunk, off); err != nil {
+			return err
+		}
+		if err := fimg.writeAt(chunk, to); err != nil {
+			return err
+		}
+		if err := p.add(int64(len(chunk))); err != nil {
+			return err
+		}
+		off, to, n = off+int64(len(chunk)), to+int64(len(chunk)), n-int64(len(chunk))
+	}
+	return nil
+}
+
+// DeleteObject removes the data object id from the SIF opened read-write.
+// With DelZero its data is overwritten with zeros in place, with DelCompact
+// the objects after it are moved down and the file is truncated. Links to
+// the object are cleared; signatures over it (or over its group) don't
+// verify anymore, which is returned as warnings. Progress is reported in
+// bytes zeroed or moved.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func (fimg *FileImage) DeleteObject(ctx context.Context, id uint32, flags int, fn ProgressFunc) ([]string, error) {
+	if flags != DelZero && flags != DelCompact {
+		return nil, fmt.Errorf("unknown delete strategy %d", flags)
+	}
+	index := -1
+	for i, v := range fimg.DescrArr {
+		if v.Used && v.ID == id {
+			index = i
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("object %d: %w", id, ErrNotFound)
+	}
+	descr := fimg.DescrArr[index]
+	if err := fimg.checkBounds(descr); err != nil {
+		return nil, err
+	}
+
+	// Objects after this one in the file, in file order
+	var after []int
+	for i, v := range fimg.DescrArr {
+		if v.Used && i != index && v.Fileoff >= descr.Fileoff+descr.Filelen {
+			after = append(after, i)
+		}
+	}
+	sort.Slice(after, func(a, b int) bool {
+		return fimg.DescrArr[after[a]].Fileoff < fimg.DescrArr[after[b]].Fileoff
+	})
+
+	total := descr.Filelen
+	if flags == DelCompact {
+		total = 0
+		for _, i := range after {
+			total += fimg.DescrArr[i].Filelen
+		}
+	}
+	p := newProgress(ctx, total, fn)
+	defer p.finish()
+
+	// Links and signatures that referenced the object
+	var warnings []string
+	changed := map[int]bool{}
+	grouped := descr.Groupid&^DescrGroupMask != 0 // else Groupid is 0 or DescrUnusedGroup
+	for i, v := range fimg.DescrArr {
+		if !v.Used || i == index {
+			continue
+		}
+		if v.Datatype == DataSignature && (v.Link == id || grouped && v.Link == descr.Groupid) {
+			warnings = append(warnings, fmt.Sprintf("signature %d covered object %d, it is not valid anymore", v.ID, id))
+		}
+		if v.Link == id {
+			fimg.DescrArr[i].Link = DescrUnusedLink
+			changed[i] = true
+			if v.Datatype != DataSignature {
+				warnings = append(warnings, fmt.Sprintf("object %d was linked to object %d, the link was removed", v.ID, id))
+			}
+		}
+	}
+
+	if flags == DelZero {
+		if err := fimg.zeroData(descr.Fileoff, descr.Filelen, p); err != nil {
+			return warnings, err
+		}
+	}
+
+	fimg.DescrArr[index] = Descriptor{}
+	changed[index] = true
+	fimg.Header.Dfree++
+	fimg.Header.Mtime = time.Now().Unix()
+	if id == fimg.PrimPartID {
+		fimg.PrimPartID = 0
+		copy(fimg.Header.Arch[:], HdrArchUnknown)
+	}
+
+	size := fimg.Filesize
+	if flags == DelCompact {
+		// Objects after it move down to the end of the data before it
+		end := fimg.Header.Dataoff
+		for _, v := range fimg.DescrArr {
+			if v.Used && v.Fileoff < descr.Fileoff && v.Fileoff+v.Filelen > end {
+				end = v.Fileoff + v.Filelen
+			}
+		}
+		for _, i := range after {
+			v := &fimg.DescrArr[i]
+			off := align(end, alignmentOf(v.Fileoff))
+			if err := fimg.moveData(off, v.Fileoff, v.Filelen, p); err != nil {
+				return warnings, err
+			}
+			v.Storelen = off - end + v.Filelen
+			v.Fileoff = off
+			end = off + v.Filelen
+			changed[i] = true
+		}
+		fimg.Header.Datalen = end - fimg.Header.Dataoff
+		size = end
+	}
+
+	for i := range changed {
+		if err := fimg.writeDescriptor(i); err != nil {
+			return warnings, err
+		}
+	}
+	if err := fimg.writeHeader(); err != nil {
+		return warnings, err
+	}
+	if size < fimg.Filesize {
+		if err := fimg.Fp.Truncate(size); err != nil {
+			return warnings, err
+		}
+		fimg.resize(size)
+	}
+	return warnings, nil
+}
+
+// descriptorIndex returns the index in DescrArr of the used descriptor id.
+func (fimg *FileImage) descriptorIndex(id uint32) (int, error) {
+	for i, v := range fimg.DescrArr {
+		if v.Used && v.ID == id {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("object %d: %w", id, ErrNotFound)
+}
+
+// primaryPartitions returns the IDs of the primary system partitions,
+// normally one at most.
+func (fimg *FileImage) primaryPartitions() []uint32 {
+	var ids []uint32
+	for _, v := range fimg.DescrArr {
+		if !v.Used || v.Datatype != DataPartition {
+			continue
+		}
+		if ptype, err := v.GetPartType(); err == nil && ptype == PartPrimSys {
+			ids = append(ids, v.ID)
+		}
+	}
+	return ids
+}
+
+// SetPartType changes the partition type and, unless arch is empty, the
+// SIF arch code of partition id, in the SIF opened read-write. There can
+// only be one primary system partition: making a second one returns
+// ErrMultValues (see SetPartPrimSys to swap it). The header arch follows
+// the primary partition.
+func (fimg *FileImage) SetPartType(id uint32, part Parttype, arch string) error {
+	index, err := fimg.descriptorIndex(id)
+	if err != nil {
+		return err
+	}
+	descr := &fimg.DescrArr[index]
+	pinfo, err := descr.getPartition()
+	if err != nil {
+		return err
+	}
+	if part < PartSystem || part > PartOverlay {
+		return fmt.Errorf("unknown partition type %d", part)
+	}
+	if arch != "" {
+		if GetGoArch(arch) == "unknown" {
+			return fmt.Errorf("unknown arch code %q", arch)
+		}
+		copy(pinfo.Arch[:], arch)
+	}
+	if part == PartPrimSys {
+		for _, prim := range fimg.primaryPartitions() {
+			if prim != id {
+				return fmt.Errorf("partition %d is the primary system partition: %w", prim, ErrMultValues)
+			}
+		}
+	}
+
+	pinfo.Parttype = part
+	saved := *descr
+	if err := descr.setPartition(pinfo); err != nil {
+		return err
+	}
+	descr.Mtime = time.Now().Unix()
+	if err := fimg.writeDescriptor(index); err != nil {
+		*descr = saved
+		return err
+	}
+
+	switch {
+	case part == PartPrimSys:
+		fimg.PrimPartID = id
+		copy(fimg.Header.Arch[:], pinfo.Arch[:])
+	case fimg.PrimPartID == id:
+		fimg.PrimPartID = 0
+		copy(fimg.Header.Arch[:], HdrArchUnknown)
+	}
+	fimg.Header.Mtime = descr.Mtime
+	return fimg.writeHeader()
+}
+
+// SetPartPrimSys makes partition id the primary system partition of the
+// SIF opened read-write. The previous primary partition becomes a system
+// partition, or stays the primary one if id can't be made primary.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/create.go
+func (fimg *FileImage) SetPartPrimSys(id uint32) error {
+	index, err := fimg.descriptorIndex(id)
+	if err != nil {
+		return err
+	}
+	pinfo, err := fimg.DescrArr[index].getPartition()
+	if err != nil {
+		return err
+	}
+
+	// restore puts back the partition types changed before err
+	var demoted []uint32
+	restore := func(err error) error {
+		if ptype, _ := fimg.DescrArr[index].GetPartType(); ptype != pinfo.Parttype {
+			if rerr := fimg.SetPartType(id, pinfo.Parttype, ""); rerr != nil {
+				return fmt.Errorf("%w (restoring partition %d: %s)", err, id, rerr)
+			}
+		}
+		for _, prev := range demoted {
+			if rerr := fimg.SetPartType(prev, PartPrimSys, ""); rerr != nil {
+				return fmt.Errorf("%w (restoring primary partition %d: %s)", err, prev, rerr)
+			}
+		}
+		return err
+	}
+	for _, prev := range fimg.primaryPartitions() {
+		if prev == id {
+			continue
+		}
+		if err := fimg.SetPartType(prev, PartSystem, ""); err != nil {
+			return restore(err)
+		}
+		demoted = append(demoted, prev)
+	}
+	if err := fimg.SetPartType(id, PartPrimSys, ""); err != nil {
+		return restore(err)
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testInputs are a definition file, a JSON object and a primary partition.
+func testInputs(t *testing.T) []DescriptorInput {
+	part := DescriptorInput{Datatype: DataPartition, Groupid: DescrDefaultGroup, Fname: "root.sqfs", Data: bytes.Repeat([]byte{1}, 5000)}
+	if err := part.SetPartExtra(FsSquash, PartPrimSys, GetSIFArch("amd64")); err != nil {
+		t.Fatal(err)
+	}
+	return []DescriptorInput{
+		{Datatype: DataDeffile, Groupid: DescrDefaultGroup, Fname: "def", Data: []byte("Bootstrap: docker\n")},
+		{Datatype: DataGenericJSON, Groupid: DescrDefaultGroup, Fname: "x.json", Data: []byte(`{"a": 1}`)},
+		part,
+	}
+}
+
+// checkDescriptorTable reads the descriptor table of image the way sif
+// does: Dtotal descriptors from the Descrlen bytes at Descroff.
+func checkDescriptorTable(t *testing.T, image []byte) {
+	var h Header
+	if err := binary.Read(bytes.NewReader(image), binary.LittleEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	if want := h.Dtotal * int64(binary.Size(Descriptor{})); h.Descrlen != want {
+		t.Errorf("got descrlen %d, want %d for %d descriptors", h.Descrlen, want, h.Dtotal)
+	}
+	if h.Descroff+h.Descrlen > int64(len(image)) {
+		t.Fatalf("descriptor table %d+%d is past the end of the image", h.Descroff, h.Descrlen)
+	}
+	table := bytes.NewReader(image[h.Descroff : h.Descroff+h.Descrlen])
+	if err := binary.Read(table, binary.LittleEndian, make([]Descriptor, h.Dtotal)); err != nil {
+		t.Errorf("reading %d descriptors: %v", h.Dtotal, err)
+	}
+}
+
+func TestWriteContainer(t *testing.T) {
+	inputs := testInputs(t)
+	var buf bytes.Buffer
+	if _, err := WriteContainer(context.Background(), &buf, &CreateInfo{InputDescr: inputs}, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkDescriptorTable(t, buf.Bytes())
+
+	fimg, info := loadBytes(buf.Bytes())
+	if len(info.Errors) > 0 {
+		t.Fatalf("got errors %+v", info.Errors)
+	}
+	if info.Header.Arch != "amd64" || info.Header.Dfree != DescrNumEntries-3 || info.Header.Datalen != int64(buf.Len()-DataStartOffset) {
+		t.Errorf("got header %+v", info.Header)
+	}
+	if fimg.PrimPartID != 3 {
+		t.Errorf("got primary partition %d, want 3", fimg.PrimPartID)
+	}
+	for i, d := range info.Descriptors {
+		if d.ID != uint32(i+1) || d.Groupid != DescrDefaultGroup {
+			t.Errorf("descriptor %d: got %+v", i, d)
+		}
+		content, err := fimg.readDescriptorContent(d.Fileoff, d.Filelen)
+		if err != nil || content != string(inputs[i].Data) {
+			t.Errorf("descriptor %d: got content %.20q, %v", d.ID, content, err)
+		}
+	}
+	if p := info.Descriptors[2]; p.Fileoff%defaultAlignment != 0 {
+		t.Errorf("partition at %d, not aligned to %d", p.Fileoff, defaultAlignment)
+	}
+}
+
+func TestWriteContainerErrors(t *testing.T) {
+	second := testInputs(t)[2]
+	tests := []struct {
+		name   string
+		inputs []DescriptorInput
+	}{
+		{"unknown datatype", []DescriptorInput{{Datatype: 1, Data: []byte("x")}}},
+		{"partition without extra", []DescriptorInput{{Datatype: DataPartition, Data: []byte("x")}}},
+		{"two primary partitions", append(testInputs(t), second)},
+		{"no data", []DescriptorInput{{Datatype: DataDeffile}}},
+		{"too many inputs", make([]DescriptorInput, DescrNumEntries+1)},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if _, err := WriteContainer(context.Background(), &buf, &CreateInfo{InputDescr: tt.inputs}, nil); err == nil {
+			t.Errorf("%s: created an image", tt.name)
+		}
+	}
+}
+
+// testContainer creates a SIF of inputs in a temporary directory, loaded
+// read-write. The directory is removed by the returned function.
+func testContainer(t *testing.T, inputs []DescriptorInput) (*FileImage, func()) {
+	dir, err := ioutil.TempDir("", "sifweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fimg, err := CreateContainer(context.Background(), &CreateInfo{Pathname: filepath.Join(dir, "test.sif"), InputDescr: inputs}, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return fimg, func() {
+		fimg.UnloadContainer()
+		os.RemoveAll(dir)
+	}
+}
+
+// reload reads the SIF of fimg again from its file.
+func reload(t *testing.T, fimg *FileImage) (*FileImage, *ContainerInfo) {
+	image, err := ioutil.ReadFile(fimg.Fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDescriptorTable(t, image)
+	loaded, info := loadBytes(image)
+	if len(info.Errors) > 0 {
+		t.Fatalf("got errors %+v", info.Errors)
+	}
+	return loaded, info
+}
+
+func TestCreateContainer(t *testing.T) {
+	fimg, cleanup := testContainer(t, testInputs(t))
+	defer cleanup()
+
+	if fimg.PrimPartID != 3 || len(fimg.DescrArr) != DescrNumEntries {
+		t.Errorf("got primary partition %d, %d descriptors", fimg.PrimPartID, len(fimg.DescrArr))
+	}
+	if _, info := reload(t, fimg); len(info.Descriptors) != 3 {
+		t.Errorf("got %d descriptors, want 3", len(info.Descriptors))
+	}
+}
+
+func TestAddObject(t *testing.T) {
+	fimg, cleanup := testContainer(t, testInputs(t)[:2])
+	defer cleanup()
+
+	inputs := []DescriptorInput{{Datatype: DataGenericJSON, Fname: "y.json", Data: []byte(`{"b": 2}`)}, testInputs(t)[2]}
+	for i := range inputs {
+		if err := fimg.AddObject(context.Background(), &inputs[i], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fimg.PrimPartID != 4 {
+		t.Errorf("got primary partition %d, want 4", fimg.PrimPartID)
+	}
+
+	loaded, info := reload(t, fimg)
+	if info.Header.Arch != "amd64" || info.Header.Dfree != DescrNumEntries-4 || len(info.Descriptors) != 4 {
+		t.Fatalf("got header %+v, %d descriptors", info.Header, len(info.Descriptors))
+	}
+	for i, d := range info.Descriptors[2:] {
+		content, err := loaded.readDescriptorContent(d.Fileoff, d.Filelen)
+		if d.ID != uint32(i+3) || err != nil || content != string(inputs[i].Data) {
+			t.Errorf("descriptor %d: got content %.20q, %v", d.ID, content, err)
+		}
+	}
+	if p := info.Descriptors[3]; p.Fileoff%defaultAlignment != 0 {
+		t.Errorf("partition at %d, not aligned to %d", p.Fileoff, defaultAlignment)
+	}
+
+	// a second primary partition is refused, the image is left as it was
+	size := fimg.Filesize
+	second := testInputs(t)[2]
+	if err := fimg.AddObject(context.Background(), &second, nil); err == nil {
+		t.Error("added a second primary system partition")
+	}
+	if _, info := reload(t, fimg); fimg.Filesize != size || len(info.Descriptors) != 4 {
+		t.Errorf("got %d bytes, %d descriptors after a failed add", fimg.Filesize, len(info.Descriptors))
+	}
+}
+
+func TestDeleteObject(t *testing.T) {
+	sig := DescriptorInput{Datatype: DataSignature, Link: DescrDefaultGroup, Fname: "sig", Data: []byte("signature")}
+	if err := sig.SetSignExtra(HashSHA256, nil); err != nil {
+		t.Fatal(err)
+	}
+	loose := DescriptorInput{Datatype: DataGeneric, Fname: "loose", Data: []byte("no group")}
+
+	tests := []struct {
+		name     string
+		id       uint32
+		flags    int
+		warnings int // about the signature over the group
+	}{
+		{"zero grouped", 2, DelZero, 1},
+		{"compact grouped", 2, DelCompact, 1},
+		{"zero ungrouped", 5, DelZero, 0},
+		{"compact primary", 3, DelCompact, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fimg, cleanup := testContainer(t, append(testInputs(t), sig, loose))
+			defer cleanup()
+			before, info := reload(t, fimg)
+			contents := map[uint32]string{}
+			var deleted DescriptorInfo
+			for _, d := range info.Descriptors {
+				contents[d.ID], _ = before.readDescriptorContent(d.Fileoff, d.Filelen)
+				if d.ID == tt.id {
+					deleted = d
+				}
+			}
+			size := fimg.Filesize
+
+			warnings, err := fimg.DeleteObject(context.Background(), tt.id, tt.flags, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(warnings) != tt.warnings {
+				t.Errorf("got warnings %q, want %d", warnings, tt.warnings)
+			}
+
+			after, info := reload(t, fimg)
+			if info.Header.Dfree != DescrNumEntries-4 || len(info.Descriptors) != 4 {
+				t.Fatalf("got header %+v, %d descriptors", info.Header, len(info.Descriptors))
+			}
+			if tt.flags == DelZero && fimg.Filesize != size || tt.flags == DelCompact && fimg.Filesize > size-deleted.Filelen+defaultAlignment {
+				t.Errorf("got %d bytes, was %d", fimg.Filesize, size)
+			}
+			if primary := tt.id != 3; primary != (after.PrimPartID == 3) || primary != (info.Header.Arch == "amd64") {
+				t.Errorf("got primary partition %d, arch %s", after.PrimPartID, info.Header.Arch)
+			}
+			for _, d := range info.Descriptors {
+				if content, err := after.readDescriptorContent(d.Fileoff, d.Filelen); err != nil || content != contents[d.ID] {
+					t.Errorf("descriptor %d: got content %.20q, %v", d.ID, content, err)
+				}
+				if d.Datatype == "FS" && d.Fileoff%defaultAlignment != 0 {
+					t.Errorf("partition at %d, not aligned to %d", d.Fileoff, defaultAlignment)
+				}
+			}
+			if tt.flags == DelZero {
+				zeroed, _ := after.readDescriptorContent(deleted.Fileoff, deleted.Filelen)
+				if strings.Trim(zeroed, "\x00") != "" {
+					t.Errorf("data of %d was not zeroed: %q", tt.id, zeroed)
+				}
+			}
+		})
+	}
+
+	fimg, cleanup := testContainer(t, testInputs(t))
+	defer cleanup()
+	if _, err := fimg.DeleteObject(context.Background(), 9, DelZero, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := fimg.DeleteObject(context.Background(), 1, 0, nil); err == nil {
+		t.Error("deleted without a strategy")
+	}
+}
+
+// failingFile is a SIF file whose writes numbered fail to until (from 1)
+// fail.
+type failingFile struct {
+	*os.File
+	writes, fail, until int
+}
+
+func (f *failingFile) Write(b []byte) (int, error) {
+	f.writes++
+	if f.writes >= f.fail && f.writes <= f.until {
+		return 0, errors.New("write failed")
+	}
+	return f.File.Write(b)
+}
+
+func TestSetPartPrimSys(t *testing.T) {
+	system := testInputs(t)[2]
+	if err := system.SetPartExtra(FsSquash, PartSystem, GetSIFArch("arm64")); err != nil {
+		t.Fatal(err)
+	}
+	// partType returns the partition type of descriptor id after a reload
+	partType := func(fimg *FileImage, id uint32) string {
+		_, info := reload(t, fimg)
+		return info.Descriptors[id-1].Partition.Parttype
+	}
+
+	fimg, cleanup := testContainer(t, append(testInputs(t), system))
+	defer cleanup()
+	if err := fimg.SetPartPrimSys(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, info := reload(t, fimg); fimg.PrimPartID != 4 || info.Header.Arch != "arm64" || partType(fimg, 3) != "System" || partType(fimg, 4) != "*System" {
+		t.Errorf("got primary partition %d, arch %s", fimg.PrimPartID, info.Header.Arch)
+	}
+	if err := fimg.SetPartType(3, PartPrimSys, ""); !errors.Is(err, ErrMultValues) {
+		t.Errorf("got %v, want %v", err, ErrMultValues)
+	}
+	if err := fimg.SetPartType(3, PartData, GetSIFArch("386")); err != nil || partType(fimg, 3) != "Data" {
+		t.Errorf("got %v, type %s", err, partType(fimg, 3))
+	}
+	for _, id := range []uint32{1, 9} {
+		if err := fimg.SetPartPrimSys(id); err == nil {
+			t.Errorf("made %d the primary partition", id)
+		}
+	}
+	if fimg.PrimPartID != 4 || partType(fimg, 4) != "*System" {
+		t.Errorf("got primary partition %d after failures", fimg.PrimPartID)
+	}
+
+	// failed writes while promoting 3 leave 4 the primary partition, or
+	// say that it couldn't be restored
+	for _, tt := range []struct {
+		name        string
+		until       int
+		restoreFail bool
+	}{{"promotion fails", 3, false}, {"restore fails", 100, true}} {
+		t.Run(tt.name, func(t *testing.T) {
+			fimg, cleanup := testContainer(t, append(testInputs(t), system))
+			defer cleanup()
+			fimg.SetPartPrimSys(4)
+			fimg.Fp = &failingFile{File: fimg.Fp.(*os.File), fail: 3, until: tt.until}
+
+			err := fimg.SetPartPrimSys(3)
+			if err == nil {
+				t.Fatal("no error from failed writes")
+			}
+			if restoreFail := strings.Contains(err.Error(), "restoring"); restoreFail != tt.restoreFail {
+				t.Errorf("got %v", err)
+			}
+			if !tt.restoreFail && (fimg.PrimPartID != 4 || partType(fimg, 4) != "*System" || partType(fimg, 3) != "System") {
+				t.Errorf("got primary partition %d after a failed promotion", fimg.PrimPartID)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// IDGroup lists the images that have the same header ID: copies of an
+// image, or images built from one another without a new ID.
+type IDGroup struct {
+	ID    string   `json:"id"`
+	Paths []string `json:"paths"`
+}
+
+// DedupCopy is a partition of an image. Linked is set if it's in the same
+// file as an earlier copy (a hard or symbolic link), so it takes no space.
+type DedupCopy struct {
+	Path   string `json:"path"`
+	ID     uint32 `json:"id"`
+	Name   string `json:"name"`
+	Linked bool   `json:"linked"`
+}
+
+// DedupGroup lists byte-identical partitions, and the space that storing
+// them once would save.
+type DedupGroup struct {
+	Digest  string      `json:"digest"`
+	Size    int64       `json:"size"`
+	Fstype  string      `json:"fstype"`
+	Copies  []DedupCopy `json:"copies"`
+	Savings int64       `json:"savings"`
+}
+
+// DedupReport is what Duplicates found in a directory. PartitionBytes is
+// the space taken by the partitions, counting linked files once.
+type DedupReport struct {
+	Images         int          `json:"images"`
+	Skipped        int          `json:"skipped"`
+	SameID         []IDGroup    `json:"sameId"`
+	Partitions     []DedupGroup `json:"partitions"`
+	PartitionBytes int64        `json:"partitionBytes"`
+	Savings        int64        `json:"savings"`
+}
+
+// dedupImage is what Duplicates needs of an image.
+type dedupImage struct {
+	path  string
+	id    string
+	fi    os.FileInfo
+	parts []Descriptor
+}
+
+// dedupPart is a partition that may have a duplicate.
+type dedupPart struct {
+	img    *dedupImage
+	d      Descriptor
+	link   *dedupPart // the same data, in the same file
+	digest string
+	err    error
+}
+
+// Duplicates walks dir and finds the images with the same ID and the
+// partitions with the same content, with up to workers images read at a
+// time. Only partitions the same size as another one are hashed. Files
+// that are not SIFs, or can't be loaded, are skipped. Progress is reported
+// in bytes hashed.
+func Duplicates(ctx context.Context, dir string, workers int, fn ProgressFunc) (*DedupReport, error) {
+	files, err := walkFiles(dir, func(string, error) {})
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]*dedupImage, len(files))
+	err = parallel(ctx, len(files), workers, func(i int) {
+		images[i] = loadDedupImage(files[i])
+	}, func(int) {})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DedupReport{SameID: []IDGroup{}, Partitions: []DedupGroup{}}
+	byID := map[string][]string{}
+	bySize := map[int64][]*dedupPart{}
+	for _, img := range images {
+		if img == nil {
+			report.Skipped++
+			continue
+		}
+		report.Images++
+		byID[img.id] = append(byID[img.id], img.path)
+		for _, d := range img.parts {
+			bySize[d.Filelen] = append(bySize[d.Filelen], &dedupPart{img: img, d: d})
+		}
+	}
+	for id, paths := range byID {
+		if len(paths) > 1 {
+			report.SameID = append(report.SameID, IDGroup{ID: id, Paths: paths})
+		}
+	}
+	sort.Slice(report.SameID, func(i, j int) bool { return report.SameID[i].Paths[0] < report.SameID[j].Paths[0] })
+
+	// A partition can only have a duplicate of the same size, and one
+	// in the same file as another (through a link) is only read once.
+	var hash []*dedupPart
+	var total int64
+	for size, parts := range bySize {
+		for i, p := range parts {
+			for _, q := range parts[:i] {
+				if q.link == nil && q.d.Fileoff == p.d.Fileoff && os.SameFile(q.img.fi, p.img.fi) {
+					p.link = q
+					break
+				}
+			}
+			if p.link == nil {
+				report.PartitionBytes += size
+				if len(parts) > 1 {
+					hash = append(hash, p)
+					total += size
+				}
+			}
+		}
+	}
+
+	prog := newProgress(ctx, total, fn)
+	err = parallel(ctx, len(hash), workers, func(i int) {
+		hash[i].digest, hash[i].err = hashPartition(ctx, hash[i].img.path, hash[i].d)
+	}, func(i int) { prog.add(hash[i].d.Filelen) })
+	prog.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string]*DedupGroup{}
+	for _, parts := range bySize {
+		if len(parts) < 2 {
+			continue
+		}
+		for _, p := range parts {
+			orig := p
+			if p.link != nil {
+				orig = p.link
+			}
+			if orig.err != nil {
+				continue
+			}
+			g := groups[orig.digest]
+			if g == nil {
+				g = &DedupGroup{Digest: orig.digest, Size: p.d.Filelen}
+				if part, err := p.d.getPartition(); err == nil {
+					g.Fstype = fstypeStr(part.Fstype)
+				}
+				groups[orig.digest] = g
+			}
+			g.Copies = append(g.Copies, DedupCopy{
+				Path:   p.img.path,
+				ID:     p.d.ID,
+				Name:   trimZeroBytes(p.d.Name[:]),
+				Linked: p.link != nil,
+			})
+			if p.link == nil && len(g.Copies) > 1 {
+				g.Savings += g.Size
+			}
+		}
+	}
+	for _, g := range groups {
+		if len(g.Copies) < 2 {
+			continue
+		}
+		sort.Slice(g.Copies, func(i, j int) bool {
+			a, b := g.Copies[i], g.Copies[j]
+			return a.Path < b.Path || a.Path == b.Path && a.ID < b.ID
+		})
+		report.Partitions = append(report.Partitions, *g)
+		report.Savings += g.Savings
+	}
+	sort.Slice(report.Partitions, func(i, j int) bool {
+		a, b := report.Partitions[i], report.Partitions[j]
+		return a.Savings > b.Savings || a.Savings == b.Savings && a.Digest < b.Digest
+	})
+	return report, nil
+}
+
+// loadDedupImage reads the header and the partition descriptors of the
+// image at p, or returns nil if it can't be loaded.
+func loadDedupImage(p string) *dedupImage {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil
+	}
+	fimg, err := LoadContainer(p, true)
+	if err != nil {
+		return nil
+	}
+	defer fimg.UnloadContainer()
+
+	img := &dedupImage{path: p, id: fimg.headerInfo().ID, fi: fi}
+	for _, v := range fimg.DescrArr {
+		if v.Used && v.Datatype == DataPartition && v.Filelen > 0 && fimg.checkBounds(v) == nil {
+			img.parts = append(img.parts, v)
+		}
+	}
+	return img
+}
+
+// hashPartition returns the digest of partition d of the image at p.
+func hashPartition(ctx context.Context, p string, d Descriptor) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := copyProgress(h, io.NewSectionReader(f, d.Fileoff, d.Filelen), newProgress(ctx, d.Filelen, nil)); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FmtDedup returns the report in a readable text form.
+func (r *DedupReport) FmtDedup() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d images, %s in partitions", r.Images, readableSize(uint64(r.PartitionBytes)))
+	if r.Skipped > 0 {
+		fmt.Fprintf(&b, " (%d other files skipped)", r.Skipped)
+	}
+	b.WriteString("\n")
+
+	if len(r.SameID) > 0 {
+		b.WriteString("\nImages with the same ID:\n")
+		for _, g := range r.SameID {
+			fmt.Fprintf(&b, "  %s\n", g.ID)
+			for _, p := range g.Paths {
+				fmt.Fprintf(&b, "    %s\n", p)
+			}
+		}
+	}
+
+	if len(r.Partitions) > 0 {
+		b.WriteString("\nIdentical partitions:\n")
+		for _, g := range r.Partitions {
+			fstype := ""
+			if g.Fstype != "" {
+				fstype = g.Fstype + ", "
+			}
+			fmt.Fprintf(&b, "  %s (%s%s), %d copies, %s to save\n", g.Digest, fstype, readableSize(uint64(g.Size)), len(g.Copies), readableSize(uint64(g.Savings)))
+			for _, c := range g.Copies {
+				s := fmt.Sprintf("    %s: %d", c.Path, c.ID)
+				if c.Name != "" {
+					s += fmt.Sprintf(" %q", c.Name)
+				}
+				if c.Linked {
+					s += " (linked)"
+				}
+				fmt.Fprintln(&b, s)
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "\nStoring identical partitions once would save %s", readableSize(uint64(r.Savings)))
+	if r.PartitionBytes > 0 {
+		fmt.Fprintf(&b, " (%.1f%%)", 100*float64(r.Savings)/float64(r.PartitionBytes))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
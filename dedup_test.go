@@ -0,0 +1,92 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDuplicates(t *testing.T) {
+	image, other := testImage(t), testImage(t)
+	inputs := testInputs(t)
+	inputs[2].Data = bytes.Repeat([]byte{2}, 5000)
+	fimg, cleanup := testContainer(t, inputs)
+	different, err := ioutil.ReadFile(fimg.Fp.Name())
+	cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "sifweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string][]byte{
+		"copy.sif":  image,
+		"one.sif":   image,
+		"other.sif": other,
+		"diff.sif":  different,
+		"notes.txt": []byte("notes\n"),
+	})
+	if err := os.Link(filepath.Join(dir, "one.sif"), filepath.Join(dir, "hard.sif")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Duplicates(context.Background(), dir, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Images != 5 || r.Skipped != 1 {
+		t.Errorf("got %d images, %d skipped; want 5 and 1", r.Images, r.Skipped)
+	}
+
+	rel := func(paths []string) []string {
+		var out []string
+		for _, p := range paths {
+			out = append(out, strings.TrimPrefix(p, dir+string(filepath.Separator)))
+		}
+		return out
+	}
+	if len(r.SameID) != 1 || !reflect.DeepEqual(rel(r.SameID[0].Paths), []string{"copy.sif", "hard.sif", "one.sif"}) {
+		t.Errorf("got same IDs %+v", r.SameID)
+	}
+
+	if len(r.Partitions) != 1 {
+		t.Fatalf("got %d groups of partitions, want 1", len(r.Partitions))
+	}
+	g := r.Partitions[0]
+	var copies []string
+	for _, c := range g.Copies {
+		s := rel([]string{c.Path})[0]
+		if c.Linked {
+			s += " linked"
+		}
+		copies = append(copies, s)
+	}
+	if want := []string{"copy.sif", "hard.sif", "one.sif linked", "other.sif"}; !reflect.DeepEqual(copies, want) {
+		t.Errorf("got copies %q, want %q", copies, want)
+	}
+	if g.Size != 5000 || g.Savings != 10000 || g.Fstype != "Squashfs" {
+		t.Errorf("got group %+v", g)
+	}
+	if r.PartitionBytes != 20000 || r.Savings != 10000 {
+		t.Errorf("got %d bytes of partitions, %d to save; want 20000 and 10000", r.PartitionBytes, r.Savings)
+	}
+	if text := r.FmtDedup(); !strings.Contains(text, "(linked)") || !strings.Contains(text, "(50.0%)") {
+		t.Errorf("got report:\n%s", text)
+	}
+}
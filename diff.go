@@ -0,0 +1,588 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ImageDiff is what changed from an old image to a new one. Like
+// ContainerInfo, it is handed back to the host page as a plain object.
+type ImageDiff struct {
+	Old     string         `json:"old"`
+	New     string         `json:"new"`
+	Header  []FieldChange  `json:"header"`
+	Objects []ObjectChange `json:"objects"`
+	Texts   []TextDiff     `json:"texts"`
+	Files   []FileChange   `json:"files"`
+
+	// FilesError says why the partitions could not be compared file by file
+	FilesError string `json:"filesError,omitempty"`
+}
+
+// FieldChange is a header field with a different value.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// ObjectChange is a data object that was added, removed or changed.
+type ObjectChange struct {
+	Change    string          `json:"change"` // added, removed or changed
+	Old       *DescriptorInfo `json:"old,omitempty"`
+	New       *DescriptorInfo `json:"new,omitempty"`
+	OldDigest string          `json:"oldDigest,omitempty"`
+	NewDigest string          `json:"newDigest,omitempty"`
+	Fields    []string        `json:"fields,omitempty"` // what changed
+}
+
+// TextDiff is a line diff of a text object (definition file, labels or
+// environment) that changed.
+type TextDiff struct {
+	Datatype string     `json:"datatype"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// DiffLine is a line of a TextDiff: kept (" "), removed ("-") or added
+// ("+"), with its line number in the old and new text (0 if not there).
+type DiffLine struct {
+	Op   string `json:"op"`
+	Old  int    `json:"old"`
+	New  int    `json:"new"`
+	Text string `json:"text"`
+}
+
+// FileChange is a path of the primary partitions that was added, removed
+// or modified.
+type FileChange struct {
+	Change string    `json:"change"` // added, removed or modified
+	Path   string    `json:"path"`
+	Old    *FileInfo `json:"old,omitempty"`
+	New    *FileInfo `json:"new,omitempty"`
+	Fields []string  `json:"fields,omitempty"` // what changed
+}
+
+// maxDiffCells bounds the work of a line diff (lines of old x lines of
+// new). Larger texts are shown as entirely replaced.
+const maxDiffCells = 1 << 22
+
+// diffLines returns the line diff from a to b, from a longest common
+// subsequence of lines.
+func diffLines(a, b string) []DiffLine {
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	}
+	x, y := split(a), split(b)
+	n, m := len(x), len(y)
+
+	// Too many lines to compare: all of a is removed, all of b added
+	var lines []DiffLine
+	if n*m > maxDiffCells {
+		for i, l := range x {
+			lines = append(lines, DiffLine{"-", i + 1, 0, l})
+		}
+		for j, l := range y {
+			lines = append(lines, DiffLine{"+", 0, j + 1, l})
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the length of the LCS of x[i:] and y[j:]
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && x[i] == y[j] && lcs[i][j] == lcs[i+1][j+1]+1:
+			lines = append(lines, DiffLine{" ", i + 1, j + 1, x[i]})
+			i, j = i+1, j+1
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, DiffLine{"-", i + 1, 0, x[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{"+", 0, j + 1, y[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// headerChanges compares the header fields of two images.
+func headerChanges(a, b *HeaderInfo) []FieldChange {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"launch", a.Launch, b.Launch},
+		{"magic", a.Magic, b.Magic},
+		{"version", a.Version, b.Version},
+		{"arch", a.Arch, b.Arch},
+		{"id", a.ID, b.ID},
+		{"ctime", a.Ctime, b.Ctime},
+		{"mtime", a.Mtime, b.Mtime},
+		{"dfree", a.Dfree, b.Dfree},
+		{"dtotal", a.Dtotal, b.Dtotal},
+		{"descroff", a.Descroff, b.Descroff},
+		{"descrlen", a.Descrlen, b.Descrlen},
+		{"dataoff", a.Dataoff, b.Dataoff},
+		{"datalen", a.Datalen, b.Datalen},
+	}
+	changes := []FieldChange{}
+	for _, f := range fields {
+		if old, new := fmt.Sprint(f.old), fmt.Sprint(f.new); old != new {
+			changes = append(changes, FieldChange{f.name, old, new})
+		}
+	}
+	return changes
+}
+
+// objectDigests returns the SHA-256 of the data of the used descriptors, by ID.
+func (fimg *FileImage) objectDigests(p *progress) (map[uint32]string, error) {
+	digests := map[uint32]string{}
+	for _, v := range fimg.DescrArr {
+		if !v.Used {
+			continue
+		}
+		h := sha256.New()
+		if err := fimg.hashObject(h, v, p); err != nil {
+			return nil, err
+		}
+		digests[v.ID] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// dataSize returns the total size of the used objects of the image.
+func (fimg *FileImage) dataSize() int64 {
+	var total int64
+	for _, v := range fimg.DescrArr {
+		if v.Used {
+			total += v.Filelen
+		}
+	}
+	return total
+}
+
+// usedDescriptors returns the used descriptors of the image.
+func (fimg *FileImage) usedDescriptors() []Descriptor {
+	var used []Descriptor
+	for _, v := range fimg.DescrArr {
+		if v.Used {
+			used = append(used, v)
+		}
+	}
+	return used
+}
+
+// objectChanges matches the objects of two images by data type and name,
+// then the rest by data type alone, in order, and returns those that were
+// added, removed or changed.
+func objectChanges(a, b *FileImage, da, db map[uint32]string) []ObjectChange {
+	info := func(v Descriptor) *DescriptorInfo {
+		d := descriptorInfo(v)
+		if v.Datatype == DataPartition {
+			d.Partition, _ = parsePartition(v)
+		}
+		return &d
+	}
+
+	olds, news := a.usedDescriptors(), b.usedDescriptors()
+	match := make([]int, len(olds)) // index in news of the match of olds[i], or -1
+	taken := make([]bool, len(news))
+	for i := range match {
+		match[i] = -1
+	}
+	for _, sameName := range []bool{true, false} {
+		for i, v := range olds {
+			for j, w := range news {
+				if match[i] < 0 && !taken[j] && v.Datatype == w.Datatype && (!sameName || v.Name == w.Name) {
+					match[i], taken[j] = j, true
+				}
+			}
+		}
+	}
+
+	changes := []ObjectChange{}
+	for i, v := range olds {
+		if match[i] < 0 {
+			changes = append(changes, ObjectChange{Change: "removed", Old: info(v), OldDigest: da[v.ID]})
+			continue
+		}
+		w := news[match[i]]
+
+		var fields []string
+		if v.Name != w.Name {
+			fields = append(fields, "name")
+		}
+		if v.Filelen != w.Filelen {
+			fields = append(fields, "size")
+		}
+		if da[v.ID] != db[w.ID] {
+			fields = append(fields, "digest")
+		}
+		if v.Extra != w.Extra {
+			fields = append(fields, "extra")
+		}
+		if v.Groupid != w.Groupid {
+			fields = append(fields, "group")
+		}
+		if len(fields) > 0 {
+			changes = append(changes, ObjectChange{Change: "changed", Old: info(v), New: info(w),
+				OldDigest: da[v.ID], NewDigest: db[w.ID], Fields: fields})
+		}
+	}
+	for j, w := range news {
+		if !taken[j] {
+			changes = append(changes, ObjectChange{Change: "added", New: info(w), NewDigest: db[w.ID]})
+		}
+	}
+	return changes
+}
+
+// firstContent returns the content of the first object of type t, and
+// whether there is one.
+func (fimg *FileImage) firstContent(t Datatype) (string, bool, error) {
+	for _, v := range fimg.DescrArr {
+		if v.Used && v.Datatype == t {
+			content, err := fimg.readDescriptorContent(v.Fileoff, v.Filelen)
+			return content, true, err
+		}
+	}
+	return "", false, nil
+}
+
+// textDiffs diffs the definition files, labels and environments of two
+// images, if any changed.
+func textDiffs(a, b *FileImage) ([]TextDiff, error) {
+	diffs := []TextDiff{}
+	for _, t := range []Datatype{DataDeffile, DataLabels, DataEnvVar} {
+		ta, oka, err := a.firstContent(t)
+		if err != nil {
+			return nil, err
+		}
+		tb, okb, err := b.firstContent(t)
+		if err != nil {
+			return nil, err
+		}
+		if (oka || okb) && ta != tb {
+			diffs = append(diffs, TextDiff{Datatype: datatypeStr(t), Lines: diffLines(ta, tb)})
+		}
+	}
+	return diffs, nil
+}
+
+// squashFiles returns the inodes of a squashfs by path.
+func squashFiles(fs *SquashFS) (map[string]*SquashInode, error) {
+	files := map[string]*SquashInode{}
+	err := fs.Walk("/", func(p string, inode *SquashInode) error {
+		files[p] = inode
+		return nil
+	})
+	return files, err
+}
+
+// sameContent compares two regular files of the same size.
+func sameContent(fa, fb *SquashFS, a, b *SquashInode, p *progress) (bool, error) {
+	ra, err := fa.Open(a)
+	if err != nil {
+		return false, err
+	}
+	rb, err := fb.Open(b)
+	if err != nil {
+		return false, err
+	}
+	bufa, bufb := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		na, erra := io.ReadFull(ra, bufa)
+		nb, errb := io.ReadFull(rb, bufb)
+		if err := p.add(int64(na)); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if erra == io.EOF || erra == io.ErrUnexpectedEOF {
+			return errb == erra, nil
+		}
+		if erra != nil {
+			return false, erra
+		}
+		if errb != nil {
+			return false, errb
+		}
+	}
+}
+
+// fileChanges compares the trees of two squashfs partitions. Regular files
+// of the same size are compared by content.
+func fileChanges(fa, fb *SquashFS, p *progress) ([]FileChange, error) {
+	filesA, err := squashFiles(fa)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := squashFiles(fb)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for name, a := range filesA {
+		paths = append(paths, name)
+		if b, ok := filesB[name]; ok && a.IsRegular() && b.IsRegular() && a.Size == b.Size {
+			p.total += a.Size
+		}
+	}
+	for name := range filesB {
+		if _, ok := filesA[name]; !ok {
+			paths = append(paths, name)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := []FileChange{}
+	for _, name := range paths {
+		a, b := filesA[name], filesB[name]
+		switch {
+		case b == nil:
+			info := fileInfo(name, a)
+			changes = append(changes, FileChange{Change: "removed", Path: name, Old: &info})
+			continue
+		case a == nil:
+			info := fileInfo(name, b)
+			changes = append(changes, FileChange{Change: "added", Path: name, New: &info})
+			continue
+		}
+
+		var fields []string
+		if a.Mode != b.Mode {
+			fields = append(fields, "mode")
+		}
+		if a.UID != b.UID || a.GID != b.GID {
+			fields = append(fields, "owner")
+		}
+		if a.Target != b.Target {
+			fields = append(fields, "target")
+		}
+		if a.Size != b.Size && !a.IsDir() {
+			fields = append(fields, "size")
+		} else if a.IsRegular() && b.IsRegular() {
+			same, err := sameContent(fa, fb, a, b, p)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			if !same {
+				fields = append(fields, "content")
+			}
+		}
+		if len(fields) > 0 {
+			infoA, infoB := fileInfo(name, a), fileInfo(name, b)
+			changes = append(changes, FileChange{Change: "modified", Path: name, Old: &infoA, New: &infoB, Fields: fields})
+		}
+	}
+	return changes, nil
+}
+
+// DiffImages compares two loaded images: header fields, objects (by data
+// type, name, size and SHA-256), text objects line by line, and the files
+// of the primary squashfs partitions. Progress is reported in bytes read.
+func DiffImages(ctx context.Context, a, b *FileImage, fn ProgressFunc) (*ImageDiff, error) {
+	d := &ImageDiff{}
+	d.Header = headerChanges(a.headerInfo(), b.headerInfo())
+
+	p := newProgress(ctx, a.dataSize()+b.dataSize(), fn)
+	defer p.finish()
+	da, err := a.objectDigests(p)
+	if err != nil {
+		return nil, err
+	}
+	db, err := b.objectDigests(p)
+	if err != nil {
+		return nil, err
+	}
+	d.Objects = objectChanges(a, b, da, db)
+
+	if d.Texts, err = textDiffs(a, b); err != nil {
+		return nil, err
+	}
+
+	d.Files = []FileChange{}
+	fa, err := a.GetPrimSquashFS()
+	if err != nil {
+		d.FilesError = fmt.Sprintf("old image: %s", err)
+		return d, nil
+	}
+	fb, err := b.GetPrimSquashFS()
+	if err != nil {
+		d.FilesError = fmt.Sprintf("new image: %s", err)
+		return d, nil
+	}
+
+	// same partition data, same files
+	pa, _, _ := a.GetPartPrimSys()
+	pb, _, _ := b.GetPartPrimSys()
+	if da[pa.ID] == db[pb.ID] {
+		return d, nil
+	}
+	if d.Files, err = fileChanges(fa, fb, p); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// hunks returns the text diff in unified format, with diffContext lines
+// of context.
+func (t TextDiff) hunks() string {
+	var b strings.Builder
+	for start := 0; start < len(t.Lines); {
+		// find the next change, and the end of the hunk around it
+		first := start
+		for first < len(t.Lines) && t.Lines[first].Op == " " {
+			first++
+		}
+		if first == len(t.Lines) {
+			break
+		}
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		end, kept := first, 0
+		for end < len(t.Lines) && kept <= 2*diffContext {
+			if t.Lines[end].Op == " " {
+				kept++
+			} else {
+				kept = 0
+			}
+			end++
+		}
+		if kept > diffContext {
+			end -= kept - diffContext
+		}
+
+		var oldStart, newStart, oldCount, newCount int
+		for _, l := range t.Lines[from:end] {
+			if l.Op != "+" {
+				if oldCount == 0 {
+					oldStart = l.Old
+				}
+				oldCount++
+			}
+			if l.Op != "-" {
+				if newCount == 0 {
+					newStart = l.New
+				}
+				newCount++
+			}
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, l := range t.Lines[from:end] {
+			fmt.Fprintf(&b, "%s%s\n", l.Op, l.Text)
+		}
+		start = end
+	}
+	return b.String()
+}
+
+// objectLabel describes an object of a diff.
+func objectLabel(d *DescriptorInfo) string {
+	s := fmt.Sprintf("%d %s", d.ID, d.Datatype)
+	if d.Name != "" {
+		s += fmt.Sprintf(" %q", d.Name)
+	}
+	return s
+}
+
+// FmtDiff returns the diff in a readable text form.
+func (d *ImageDiff) FmtDiff() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", d.Old, d.New)
+
+	if len(d.Header) > 0 {
+		b.WriteString("\nHeader:\n")
+		for _, f := range d.Header {
+			fmt.Fprintf(&b, "  %-9s %s -> %s\n", f.Field+":", f.Old, f.New)
+		}
+	}
+
+	if len(d.Objects) > 0 {
+		b.WriteString("\nObjects:\n")
+		for _, o := range d.Objects {
+			switch o.Change {
+			case "added":
+				fmt.Fprintf(&b, "  + %s, %d bytes\n", objectLabel(o.New), o.New.Filelen)
+			case "removed":
+				fmt.Fprintf(&b, "  - %s, %d bytes\n", objectLabel(o.Old), o.Old.Filelen)
+			default:
+				fmt.Fprintf(&b, "  ~ %s -> %d: %s", objectLabel(o.Old), o.New.ID, strings.Join(o.Fields, ", "))
+				if o.Old.Filelen != o.New.Filelen {
+					fmt.Fprintf(&b, " (%d -> %d bytes)", o.Old.Filelen, o.New.Filelen)
+				}
+				b.WriteString("\n")
+			}
+		}
+	}
+
+	for _, t := range d.Texts {
+		fmt.Fprintf(&b, "\n%s:\n%s", t.Datatype, t.hunks())
+	}
+
+	if d.FilesError != "" {
+		fmt.Fprintf(&b, "\nFiles not compared: %s\n", d.FilesError)
+	} else if len(d.Files) > 0 {
+		b.WriteString("\nFiles:\n")
+		for _, f := range d.Files {
+			switch f.Change {
+			case "added":
+				fmt.Fprintf(&b, "  + %s %s %d\n", f.New.Mode, f.Path, f.New.Size)
+			case "removed":
+				fmt.Fprintf(&b, "  - %s %s %d\n", f.Old.Mode, f.Path, f.Old.Size)
+			default:
+				fmt.Fprintf(&b, "  ~ %s %s: %s", f.New.Mode, f.Path, strings.Join(f.Fields, ", "))
+				if f.Old.Mode != f.New.Mode {
+					fmt.Fprintf(&b, " (mode %s -> %s)", f.Old.Mode, f.New.Mode)
+				}
+				if f.Old.Size != f.New.Size {
+					fmt.Fprintf(&b, " (%d -> %d bytes)", f.Old.Size, f.New.Size)
+				}
+				b.WriteString("\n")
+			}
+		}
+	}
+
+	if len(d.Header) == 0 && len(d.Objects) == 0 && len(d.Texts) == 0 && len(d.Files) == 0 {
+		b.WriteString("\nNo differences\n")
+	}
+	return b.String()
+}
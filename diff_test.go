@@ -0,0 +1,97 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []DiffLine
+	}{
+		{"a\nb\n", "a\nb\n", []DiffLine{{" ", 1, 1, "a"}, {" ", 2, 2, "b"}}},
+		{"a\nb\nc\n", "a\nx\nc\n", []DiffLine{{" ", 1, 1, "a"}, {"-", 2, 0, "b"}, {"+", 0, 2, "x"}, {" ", 3, 3, "c"}}},
+		{"", "a\n", []DiffLine{{"+", 0, 1, "a"}}},
+		{"a", "", []DiffLine{{"-", 1, 0, "a"}}},
+	}
+	for _, tt := range tests {
+		if got := diffLines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("diffLines(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	// Past maxDiffCells, the text is replaced without building the table
+	var a, b strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&a, "%d\n", i)
+		fmt.Fprintf(&b, "%d\n", i+1)
+	}
+	lines := diffLines(a.String(), b.String())
+	if len(lines) != 6000 || lines[0] != (DiffLine{"-", 1, 0, "0"}) || lines[3000] != (DiffLine{"+", 0, 1, "1"}) {
+		t.Errorf("got %d lines starting %v, want 3000 removed then 3000 added", len(lines), lines[0])
+	}
+}
+
+func TestDiffImages(t *testing.T) {
+	a, cleanupA := testContainer(t, testInputs(t))
+	defer cleanupA()
+
+	inputs := testInputs(t)
+	inputs[0].Data = []byte("Bootstrap: docker\nFrom: alpine\n")
+	inputs = append(inputs[:1], inputs[2:]...)
+	inputs = append(inputs, DescriptorInput{Datatype: DataLabels, Groupid: DescrDefaultGroup, Fname: "labels", Data: []byte(`{}`)})
+	b, cleanupB := testContainer(t, inputs)
+	defer cleanupB()
+
+	d, err := DiffImages(context.Background(), a, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []string
+	for _, o := range d.Objects {
+		switch o.Change {
+		case "added":
+			changes = append(changes, "added "+o.New.Name)
+		case "removed":
+			changes = append(changes, "removed "+o.Old.Name)
+		default:
+			changes = append(changes, o.Old.Name+": "+strings.Join(o.Fields, ", "))
+		}
+	}
+	want := []string{"def: size, digest", "removed x.json", "added labels"}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got object changes %q, want %q", changes, want)
+	}
+
+	if len(d.Texts) != 2 {
+		t.Fatalf("got %d text diffs, want definition file and labels", len(d.Texts))
+	}
+	if lines := d.Texts[0].Lines; len(lines) != 2 || lines[1] != (DiffLine{"+", 0, 2, "From: alpine"}) {
+		t.Errorf("got definition file diff %v", lines)
+	}
+
+	// The test partitions aren't squashfs
+	if d.FilesError == "" {
+		t.Error("files were compared")
+	}
+	text := d.FmtDiff()
+	for _, s := range []string{"+From: alpine", "- 2 JSON.Generic \"x.json\"", "Files not compared"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("diff is missing %q:\n%s", s, text)
+		}
+	}
+
+	if same, _ := DiffImages(context.Background(), a, a, nil); !strings.Contains(same.FmtDiff(), "No differences") {
+		t.Errorf("comparing an image with itself:\n%s", same.FmtDiff())
+	}
+}
@@ -0,0 +1,124 @@
+// Build a SIF from files dropped on the page: renderBuilder shows a row of
+// options per file (data type, group, link, and partition options), and
+// returns a function giving the inputs for SifwebClient.build.
+//
+// File names come from the user, so like everything else they are only
+// inserted as text nodes (see sifweb.js).
+
+var builderOptions = {
+    datatype: ['deffile', 'labels', 'env', 'partition', 'json', 'generic'],
+    fstype: ['squashfs', 'ext3', 'raw', 'encrypted'],
+    parttype: ['primsys', 'system', 'data', 'overlay'],
+    arch: ['amd64', 'arm64', '386', 'arm', 'ppc64le', 'ppc64', 's390x',
+           'mips', 'mipsle', 'mips64', 'mips64le']
+};
+
+// guessDatatype picks the data type of a file from its name
+function guessDatatype(name) {
+    var lower = name.toLowerCase();
+    if (/\.(sqfs|squashfs|img)$/.test(lower)) {
+        return 'partition';
+    }
+    if (/labels.*\.json$/.test(lower)) {
+        return 'labels';
+    }
+    if (/\.json$/.test(lower)) {
+        return 'json';
+    }
+    if (lower === 'singularity' || /\.def$/.test(lower)) {
+        return 'deffile';
+    }
+    if (/^env|\.env$|environment/.test(lower)) {
+        return 'env';
+    }
+    return 'generic';
+}
+
+// selectElement creates a select with the given options and value
+function selectElement(options, value) {
+    var select = document.createElement('select');
+    options.forEach(function(option) {
+        var element = textElement('option', option);
+        element.value = option;
+        select.appendChild(element);
+    });
+    select.value = value;
+    return select;
+}
+
+// numberElement creates a number input with the given value
+function numberElement(value) {
+    var input = document.createElement('input');
+    input.type = 'number';
+    input.min = 0;
+    input.value = value;
+    input.className = 'number';
+    return input;
+}
+
+// renderBuilder lists files (a FileList or array of File) in container,
+// with their options. It returns a function that gives the build inputs.
+function renderBuilder(container, files) {
+    while (container.firstChild) {
+        container.removeChild(container.firstChild);
+    }
+
+    var table = document.createElement('table');
+    var head = document.createElement('tr');
+    ['File', 'Type', 'Group', 'Link', 'Partition'].forEach(function(label) {
+        head.appendChild(textElement('th', label));
+    });
+    table.appendChild(head);
+
+    var rows = Array.prototype.map.call(files, function(file) {
+        var row = {
+            file: file,
+            datatype: selectElement(builderOptions.datatype, guessDatatype(file.name)),
+            groupid: numberElement(1),
+            link: numberElement(0),
+            fstype: selectElement(builderOptions.fstype, 'squashfs'),
+            parttype: selectElement(builderOptions.parttype, 'primsys'),
+            arch: selectElement(builderOptions.arch, 'amd64')
+        };
+
+        var partition = document.createElement('td');
+        [row.fstype, row.parttype, row.arch].forEach(function(select) {
+            partition.appendChild(select);
+        });
+        function showPartition() {
+            partition.style.visibility = row.datatype.value === 'partition' ? 'visible' : 'hidden';
+        }
+        row.datatype.addEventListener('change', showPartition);
+        showPartition();
+
+        var tr = document.createElement('tr');
+        tr.appendChild(textElement('td', file.name));
+        [row.datatype, row.groupid, row.link].forEach(function(element) {
+            var td = document.createElement('td');
+            td.appendChild(element);
+            tr.appendChild(td);
+        });
+        tr.appendChild(partition);
+        table.appendChild(tr);
+        return row;
+    });
+    container.appendChild(table);
+
+    return function() {
+        return rows.map(function(row) {
+            var input = {
+                file: row.file,
+                name: row.file.name,
+                datatype: row.datatype.value,
+                groupid: Number(row.groupid.value),
+                link: Number(row.link.value)
+            };
+            if (input.datatype === 'partition') {
+                input.fstype = row.fstype.value;
+                input.parttype = row.parttype.value;
+                input.arch = row.arch.value;
+            }
+            return input;
+        });
+    };
+}
@@ -0,0 +1,225 @@
+// SifwebClient talks to the Web Worker (worker.js) running main.wasm, so
+// parsing never blocks the page. Every call returns a Promise, and takes
+// an optional onProgress(done, total) callback:
+//
+//   var client = new SifwebClient('js/worker.js');
+//   client.load(file).then(function(result) { ... });
+//   client.load('https://example.com/images/busybox.sif');
+//   client.listDir('/etc').then(function(files) { ... });
+//
+// cancel() asks the worker to stop whatever is running: pending calls are
+// rejected with an Error named 'CancelError'. If they don't stop in time,
+// the worker is restarted and the last loaded file is loaded again so the
+// other calls keep working.
+
+function SifwebClient(workerUrl) {
+    this.workerUrl = workerUrl;
+    this.nextId = 1;
+    this.pending = {};
+    this.loaded = null;
+    this.start();
+}
+
+SifwebClient.prototype.start = function() {
+    var client = this;
+    this.worker = new Worker(this.workerUrl);
+    this.worker.onmessage = function(event) {
+        var message = event.data;
+        var call = client.pending[message.id];
+        if (!call) {
+            return;
+        }
+        if (message.type === 'progress') {
+            if (call.onProgress) {
+                call.onProgress(message.done, message.total);
+            }
+            return;
+        }
+        if (message.type === 'chunk') {
+            call.onChunk(message.data);
+            return;
+        }
+        delete client.pending[message.id];
+        if (message.type === 'result') {
+            call.resolve(message.result);
+        } else {
+            call.reject(client.error(message));
+        }
+    };
+};
+
+// error returns the Error for an error message from the worker
+SifwebClient.prototype.error = function(message) {
+    var error = new Error(message.error);
+    error.code = message.code;
+    error.hint = message.hint;
+    if (message.code === 'canceled') {
+        error.name = 'CancelError';
+    }
+    return error;
+};
+
+// call posts a message to the worker and waits for its result
+SifwebClient.prototype.call = function(type, args, onProgress, onChunk) {
+    var client = this;
+    var id = this.nextId++;
+    return new Promise(function(resolve, reject) {
+        client.pending[id] = {resolve: resolve, reject: reject, onProgress: onProgress, onChunk: onChunk};
+        client.worker.postMessage({id: id, type: type, args: args});
+    });
+};
+
+// source returns the {name, file} message for a File or Blob, or for the
+// URL of an image, made absolute as the worker would resolve it against
+// its own location
+function sifwebSource(file) {
+    if (typeof file === 'string') {
+        var url = new URL(file, location.href).href;
+        return {name: url, file: url};
+    }
+    return {name: file.name, file: file};
+}
+
+// load opens a File or Blob, or the URL of an image on a server that
+// supports range requests: only the parts needed are downloaded.
+SifwebClient.prototype.load = function(file, onProgress) {
+    this.loaded = file;
+    return this.call('load', sifwebSource(file), onProgress);
+};
+
+SifwebClient.prototype.listDescriptors = function(onProgress) {
+    return this.call('listDescriptors', {}, onProgress);
+};
+
+SifwebClient.prototype.readRange = function(offset, length, onProgress) {
+    return this.call('readRange', {offset: offset, length: length}, onProgress);
+};
+
+SifwebClient.prototype.listDir = function(path, onProgress) {
+    return this.call('listDir', {path: path}, onProgress);
+};
+
+SifwebClient.prototype.extract = function(path, onProgress) {
+    return this.call('extract', {path: path}, onProgress);
+};
+
+SifwebClient.prototype.exportTar = function(path, onProgress) {
+    return this.call('exportTar', {path: path}, onProgress);
+};
+
+SifwebClient.prototype.verify = function(onProgress) {
+    return this.call('verify', {}, onProgress);
+};
+
+// lint checks the structure of the loaded image, it resolves to a list of
+// {severity, check, message, offset, context}
+SifwebClient.prototype.lint = function(onProgress) {
+    return this.call('lint', {}, onProgress);
+};
+
+// packages reads the package databases of the loaded image. It resolves
+// to {image, id, arch, distro, packages, warnings}, or given a format
+// ('spdx', 'cyclonedx' or 'json') to a Uint8Array with that document.
+SifwebClient.prototype.packages = function(format, onProgress) {
+    return this.call('packages', {format: format || ''}, onProgress);
+};
+
+// vulns matches the packages of the loaded image against advisories, a
+// list of OSV JSON files or zips of them (File or Blob). It resolves to
+// {image, advisories, packages, unmatched, counts, findings, warnings}.
+SifwebClient.prototype.vulns = function(files, onProgress) {
+    return this.call('vulns', {files: Array.prototype.slice.call(files)}, onProgress);
+};
+
+// diff compares two SIF files (File, Blob or URL), without changing the
+// loaded one. It resolves to {old, new, header, objects, texts, files}.
+SifwebClient.prototype.diff = function(oldFile, newFile, onProgress) {
+    return this.call('diff', {old: sifwebSource(oldFile), new: sifwebSource(newFile)}, onProgress);
+};
+
+// library browses a library server at url: it resolves to the entry ref
+// points to (entity, collection, container or image:tag) with the entries
+// below it, and for an image the URL to load it from. options are
+// {arch, token}.
+SifwebClient.prototype.library = function(url, ref, options) {
+    options = options || {};
+    return this.call('library', {url: url, ref: ref, arch: options.arch, token: options.token});
+};
+
+// build creates a SIF from inputs ({file, datatype, groupid, link, and for
+// partitions fstype, parttype, arch}). The image is written to writable (a
+// WritableStream, e.g. from showSaveFilePicker) if given, and the call
+// resolves to {info, blob}, with a Blob of the image if there was no stream.
+// Blob parts can be kept on disk by the browser, so neither way needs the
+// whole image in memory.
+SifwebClient.prototype.build = function(inputs, onProgress, writable) {
+    var parts = [];
+    var writer = writable ? writable.getWriter() : null;
+    var written = Promise.resolve();
+
+    function onChunk(data) {
+        if (writer) {
+            written = written.then(function() { return writer.write(data); });
+        } else {
+            parts.push(new Blob([data]));
+        }
+    }
+
+    return this.call('build', {spec: {inputs: inputs}}, onProgress, onChunk).then(function(info) {
+        if (!writer) {
+            return {info: info, blob: new Blob(parts, {type: 'application/octet-stream'})};
+        }
+        return written.then(function() { return writer.close(); }).then(function() {
+            return {info: info, blob: null};
+        });
+    }, function(error) {
+        if (writer) {
+            writer.abort(error);
+        }
+        throw error;
+    });
+};
+
+// cancelTimeout is how long (ms) cancel waits before restarting the worker
+SifwebClient.prototype.cancelTimeout = 2000;
+
+SifwebClient.prototype.cancel = function() {
+    var client = this;
+    var ids = Object.keys(this.pending);
+    ids.forEach(function(id) {
+        client.worker.postMessage({id: Number(id), type: 'cancel'});
+    });
+    if (ids.length === 0) {
+        return;
+    }
+
+    var worker = this.worker;
+    setTimeout(function() {
+        var stuck = ids.filter(function(id) { return id in client.pending; });
+        if (stuck.length === 0 || client.worker !== worker) {
+            return;
+        }
+        client.restart(stuck);
+    }, this.cancelTimeout);
+};
+
+// restart terminates the worker, rejecting the calls with the given ids,
+// and starts a new one with the last loaded file
+SifwebClient.prototype.restart = function(ids) {
+    var client = this;
+    var pending = this.pending;
+    this.worker.terminate();
+    this.pending = {};
+    ids.forEach(function(id) {
+        pending[id].reject(client.error({error: 'canceled', code: 'canceled'}));
+        delete pending[id];
+    });
+    this.start();
+    if (this.loaded) {
+        this.load(this.loaded);
+    }
+    // calls that were not canceled will never answer, fail them too
+    for (var id in pending) {
+        pending[id].reject(new Error('worker restarted'));
+    }
+};
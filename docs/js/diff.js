@@ -0,0 +1,139 @@
+// Render the result of SifwebClient.diff side by side: the old image on
+// the left, the new one on the right. Like sifweb.js, everything comes from
+// the containers, so it is only inserted as text nodes.
+
+// diffTable creates a table with an Old and a New column header
+function diffTable(oldLabel, newLabel, columns) {
+    var table = document.createElement('table');
+    table.className = 'diff';
+    var head = document.createElement('tr');
+    head.appendChild(textElement('th', oldLabel));
+    head.lastChild.colSpan = columns;
+    head.appendChild(textElement('th', newLabel));
+    head.lastChild.colSpan = columns;
+    table.appendChild(head);
+    return table;
+}
+
+// diffRow appends a row of cells to table, with the old side in class
+// oldClass and the new side in newClass
+function diffRow(table, oldCells, newCells, oldClass, newClass) {
+    var tr = document.createElement('tr');
+    oldCells.forEach(function(cell) {
+        tr.appendChild(textElement('td', cell, oldClass));
+    });
+    newCells.forEach(function(cell) {
+        tr.appendChild(textElement('td', cell, newClass));
+    });
+    table.appendChild(tr);
+}
+
+// objectCells describes a descriptor of the diff, or blanks if there is none
+function objectCells(d, digest) {
+    if (!d) {
+        return ['', '', ''];
+    }
+    var label = d.id + ' ' + d.datatype + (d.name ? ' ' + d.name : '');
+    if (d.partition) {
+        label += ' (' + [d.partition.fstype, d.partition.parttype, d.partition.arch].join(', ') + ')';
+    }
+    return [label, d.filelen, digest ? digest.substring(0, 12) : ''];
+}
+
+// fileCells describes a file of the diff, or blanks if there is none
+function fileCells(f) {
+    if (!f) {
+        return ['', '', ''];
+    }
+    return [f.mode, f.size, f.target ? '-> ' + f.target : ''];
+}
+
+// changeClasses returns the classes of the old and new side of a change
+function changeClasses(change) {
+    return {
+        added: ['', 'diff-add'],
+        removed: ['diff-del', ''],
+        changed: ['diff-del', 'diff-add'],
+        modified: ['diff-del', 'diff-add']
+    }[change];
+}
+
+// renderTextDiff shows a line diff, pairing removed lines with the added
+// lines that follow them
+function renderTextDiff(text, diff) {
+    var table = diffTable(diff.old, diff.new, 2);
+    var lines = text.lines;
+    for (var i = 0; i < lines.length;) {
+        if (lines[i].op === ' ') {
+            diffRow(table, [lines[i].old, lines[i].text], [lines[i].new, lines[i].text]);
+            i++;
+            continue;
+        }
+        var removed = [], added = [];
+        while (i < lines.length && lines[i].op === '-') {
+            removed.push(lines[i++]);
+        }
+        while (i < lines.length && lines[i].op === '+') {
+            added.push(lines[i++]);
+        }
+        for (var j = 0; j < Math.max(removed.length, added.length); j++) {
+            var r = removed[j], a = added[j];
+            diffRow(table, r ? [r.old, r.text] : ['', ''], a ? [a.new, a.text] : ['', ''],
+                    r ? 'diff-del' : '', a ? 'diff-add' : '');
+        }
+    }
+    return table;
+}
+
+// renderDiff shows the differences between two images in container
+function renderDiff(container, diff) {
+    while (container.firstChild) {
+        container.removeChild(container.firstChild);
+    }
+    var same = true;
+
+    if (diff.header.length > 0) {
+        same = false;
+        container.appendChild(textElement('h5', 'Header'));
+        var header = diffTable(diff.old, diff.new, 1);
+        diff.header.forEach(function(field) {
+            diffRow(header, [field.field + ': ' + field.old], [field.field + ': ' + field.new], 'diff-del', 'diff-add');
+        });
+        container.appendChild(header);
+    }
+
+    if (diff.objects.length > 0) {
+        same = false;
+        container.appendChild(textElement('h5', 'Objects'));
+        var objects = diffTable(diff.old, diff.new, 3);
+        diff.objects.forEach(function(o) {
+            var classes = changeClasses(o.change);
+            diffRow(objects, objectCells(o.old, o.oldDigest), objectCells(o.new, o.newDigest), classes[0], classes[1]);
+        });
+        container.appendChild(objects);
+    }
+
+    diff.texts.forEach(function(text) {
+        same = false;
+        container.appendChild(textElement('h5', text.datatype));
+        container.appendChild(renderTextDiff(text, diff));
+    });
+
+    if (diff.filesError) {
+        container.appendChild(textElement('div', 'Files not compared: ' + diff.filesError, 'error'));
+    } else if (diff.files.length > 0) {
+        same = false;
+        container.appendChild(textElement('h5', 'Files'));
+        var files = diffTable(diff.old, diff.new, 4);
+        diff.files.forEach(function(f) {
+            var classes = changeClasses(f.change);
+            diffRow(files, [f.old ? f.path : ''].concat(fileCells(f.old)),
+                    [f.new ? f.path : ''].concat(fileCells(f.new)), classes[0], classes[1]);
+        });
+        container.appendChild(files);
+    }
+
+    if (same) {
+        container.appendChild(textElement('div', 'No differences'));
+    }
+}
@@ -0,0 +1,61 @@
+// Render an entry of a library server (from SifwebClient.library): its
+// details, then the entries below it as links. Clicking one calls
+// onBrowse(ref); for an image, an Open link calls onOpen(entry).
+//
+// Names and descriptions come from the server, so like everything else
+// they are only inserted as text nodes (see sifweb.js).
+
+function libraryRows(entry) {
+    switch (entry.kind) {
+    case 'entity':
+        return [['Entity', entry.entity.name], ['ID', entry.entity.id],
+                ['Description', entry.entity.description], ['Size', entry.entity.size]];
+    case 'collection':
+        return [['Collection', entry.ref], ['ID', entry.collection.id],
+                ['Description', entry.collection.description], ['Size', entry.collection.size],
+                ['Private', entry.collection.private ? 'yes' : 'no']];
+    case 'container':
+        return [['Container', entry.ref], ['ID', entry.container.id],
+                ['Description', entry.container.description], ['Images', entry.container.images.length],
+                ['Size', entry.container.size], ['Downloads', entry.container.downloadCount]];
+    default:
+        var image = entry.image;
+        return [['Image', entry.ref], ['ID', image.id], ['Hash', image.hash], ['Arch', image.arch],
+                ['Size', image.size], ['Signed', image.signed === undefined ? 'unknown' : (image.signed ? 'yes' : 'no')],
+                ['Encrypted', image.encrypted ? 'yes' : 'no'], ['Created', image.createdAt]];
+    }
+}
+
+function renderLibrary(container, entry, onBrowse, onOpen) {
+    while (container.firstChild) {
+        container.removeChild(container.firstChild);
+    }
+
+    // the parent of entity/collection/container:tag, up to the entity
+    var parts = entry.ref.replace(/:[^\/]*$/, '').split('/');
+    if (entry.kind === 'image') {
+        parts.push('');
+    }
+    if (parts.length > 1) {
+        parts.pop();
+        var parent = parts.join('/');
+        container.appendChild(linkElement('.. ' + parent, function() { onBrowse(parent); }));
+    }
+
+    container.appendChild(renderRows(libraryRows(entry)));
+    if (entry.kind === 'image') {
+        container.appendChild(linkElement('Open in the inspector', function() { onOpen(entry); }));
+        return;
+    }
+
+    var table = document.createElement('table');
+    entry.children.forEach(function(child) {
+        var tr = document.createElement('tr');
+        var name = document.createElement('td');
+        name.appendChild(linkElement(child.name, function() { onBrowse(child.ref); }));
+        tr.appendChild(name);
+        tr.appendChild(textElement('td', child.arch ? child.arch.join(', ') : child.description));
+        table.appendChild(tr);
+    });
+    container.appendChild(table);
+}
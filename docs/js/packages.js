@@ -0,0 +1,78 @@
+// Render the packages installed in the loaded image (from
+// SifwebClient.packages): the distribution, then a row per package.
+//
+// Names, versions and licenses come from the image, so like everything
+// else they are only inserted as text nodes (see sifweb.js).
+
+function renderPackages(container, sbom) {
+    while (container.firstChild) {
+        container.removeChild(container.firstChild);
+    }
+    var title = sbom.packages.length + ' packages';
+    if (sbom.distro) {
+        title = sbom.distro.name + ', ' + title;
+    }
+    container.appendChild(textElement('div', title, 'tbtitle'));
+
+    var table = document.createElement('table');
+    sbom.packages.forEach(function(pkg) {
+        var tr = document.createElement('tr');
+        tr.appendChild(textElement('td', pkg.name));
+        tr.appendChild(textElement('td', pkg.version));
+        tr.appendChild(textElement('td', pkg.type));
+        tr.appendChild(textElement('td', pkg.license));
+        tr.title = pkg.purl;
+        table.appendChild(tr);
+    });
+    container.appendChild(table);
+
+    sbom.warnings.forEach(function(warning) {
+        container.appendChild(textElement('div', warning, 'finding-warning'));
+    });
+}
+
+// Render the vulnerabilities found in the packages (from
+// SifwebClient.vulns): a summary, then the advisories of each package,
+// most severe first.
+function renderVulns(container, report) {
+    while (container.firstChild) {
+        container.removeChild(container.firstChild);
+    }
+    var total = 0;
+    var counts = ['critical', 'high', 'medium', 'low', 'unknown'].filter(function(severity) {
+        return report.counts[severity];
+    }).map(function(severity) {
+        total += report.counts[severity];
+        return report.counts[severity] + ' ' + severity;
+    });
+    var title = total + ' vulnerabilities in ' + report.findings.length + ' of ' + report.packages +
+        ' packages, from ' + report.advisories + ' advisories';
+    if (counts.length > 0) {
+        title += ' (' + counts.join(', ') + ')';
+    }
+    container.appendChild(textElement('div', title, 'tbtitle'));
+
+    var table = document.createElement('table');
+    report.findings.forEach(function(finding) {
+        var pkg = finding.package;
+        finding.vulnerabilities.forEach(function(vuln, i) {
+            var tr = document.createElement('tr');
+            tr.appendChild(textElement('td', i === 0 ? pkg.name + ' ' + pkg.version : ''));
+            tr.appendChild(textElement('td', vuln.severity, 'severity-' + vuln.severity));
+            tr.appendChild(textElement('td', vuln.id));
+            tr.appendChild(textElement('td', vuln.fixed ? 'fixed in ' + vuln.fixed : 'no fix'));
+            tr.appendChild(textElement('td', vuln.summary));
+            tr.title = vuln.aliases.join(', ');
+            table.appendChild(tr);
+        });
+    });
+    container.appendChild(table);
+
+    if (report.unmatched > 0) {
+        container.appendChild(textElement('div', report.unmatched +
+            ' packages could not be looked up (no known ecosystem for them)', 'finding-warning'));
+    }
+    report.warnings.forEach(function(warning) {
+        container.appendChild(textElement('div', warning, 'finding-warning'));
+    });
+}
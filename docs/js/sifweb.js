@@ -0,0 +1,198 @@
+// Render the result of loadContainer (from main.wasm) into the page.
+// loadContainer(name, bytes, size) or loadContainer(url) returns a Promise
+// that resolves to {file, header, descriptors, errors}, so any page can use
+// its own view.
+//
+// Everything in the result comes from the (untrusted) container or the
+// uploaded file name, so it is only ever inserted as text nodes, never HTML.
+
+function formatTime(seconds) {
+    return new Date(seconds * 1000).toString();
+}
+
+// textElement creates an element holding value as a text node
+function textElement(tag, value, className) {
+    var element = document.createElement(tag);
+    element.textContent = (value === undefined || value === null) ? '' : String(value);
+    if (className) {
+        element.className = className;
+    }
+    return element;
+}
+
+// renderRows returns a table of [label, value] rows. A value that is
+// an object with a pre key is shown preformatted (e.g., signatures).
+function renderRows(rows) {
+    var table = document.createElement('table');
+    rows.forEach(function(row) {
+        var tr = document.createElement('tr');
+        var value = row[1];
+        tr.appendChild(textElement('td', row[0]));
+        if (value !== null && typeof value === 'object' && 'pre' in value) {
+            var td = document.createElement('td');
+            td.appendChild(textElement('pre', value.pre));
+            tr.appendChild(td);
+        } else {
+            tr.appendChild(textElement('td', value));
+        }
+        table.appendChild(tr);
+    });
+    return table;
+}
+
+function renderHeader(result) {
+    var header = result.header;
+    return renderRows([
+        ['File', result.file],
+        ['Launch', header.launch],
+        ['Magic', header.magic],
+        ['Version', header.version],
+        ['Arch', header.arch],
+        ['ID', header.id],
+        ['Ctime', formatTime(header.ctime)],
+        ['Mtime', formatTime(header.mtime)],
+        ['Dfree', header.dfree],
+        ['Dtotal', header.dtotal],
+        ['Descroff', header.descroff],
+        ['Descrlen', header.descrlen],
+        ['Dataoff', header.dataoff],
+        ['Datalen', header.datalen]
+    ]);
+}
+
+function renderDescriptor(d) {
+    var rows = [['Name', d.name], ['Datatype', d.datatype]];
+    if (d.partition) {
+        rows.push(['Fstype', d.partition.fstype]);
+        rows.push(['Parttype', d.partition.parttype]);
+        rows.push(['Arch', d.partition.arch]);
+    }
+    if (d.signature) {
+        rows.push(['Hashtype', d.signature.hashtype]);
+        rows.push(['Entity', d.signature.entity]);
+        rows.push(['Content', {pre: d.signature.content}]);
+    }
+    if (d.crypto) {
+        rows.push(['Fmttype', d.crypto.formattype]);
+        rows.push(['Msgtype', d.crypto.messagetype]);
+        rows.push(['Content', {pre: d.crypto.content}]);
+    }
+    return renderRows(rows);
+}
+
+// renderError shows an error ({code, message, hint, offset, context})
+// with the hint on what to do about it underneath.
+function renderError(error) {
+    var div = textElement('div', error.message, 'error');
+    if (error.hint) {
+        div.appendChild(textElement('div', error.hint, 'hint'));
+    }
+    return div;
+}
+
+// renderContainer fills the header, partition, signature and crypto tabs.
+// An optional root element can be given to look the tabs up in.
+function renderContainer(result, root) {
+    root = root || document;
+    var tabs = {};
+    ['header', 'partition', 'signature', 'crypto'].forEach(function(divid) {
+        tabs[divid] = root.querySelector('#' + divid);
+        while (tabs[divid].firstChild) {
+            tabs[divid].removeChild(tabs[divid].firstChild);
+        }
+    });
+
+    if (result.header) {
+        tabs.header.appendChild(renderHeader(result));
+    }
+    (result.errors || []).forEach(function(error) {
+        tabs.header.appendChild(renderError(error));
+    });
+
+    (result.descriptors || []).forEach(function(d) {
+        if (d.partition) {
+            tabs.partition.appendChild(renderDescriptor(d));
+        } else if (d.signature) {
+            tabs.signature.appendChild(renderDescriptor(d));
+        } else if (d.crypto) {
+            tabs.crypto.appendChild(renderDescriptor(d));
+        }
+    });
+}
+
+// linkElement creates a link showing value as text, calling onClick
+function linkElement(value, onClick) {
+    var link = textElement('a', value);
+    link.href = '#';
+    link.addEventListener('click', function(event) {
+        event.preventDefault();
+        onClick();
+    });
+    return link;
+}
+
+// renderFiles lists the files of dir (from listDir) in container. Clicking
+// a directory calls onOpen(path), clicking a file calls onExtract(path).
+function renderFiles(container, dir, files, onOpen, onExtract) {
+    while (container.firstChild) {
+        container.removeChild(container.firstChild);
+    }
+    container.appendChild(textElement('div', dir, 'tbtitle'));
+
+    var table = document.createElement('table');
+    if (dir !== '/') {
+        var parent = dir.replace(/\/[^\/]*\/?$/, '') || '/';
+        var up = document.createElement('tr');
+        var td = document.createElement('td');
+        td.appendChild(linkElement('..', function() { onOpen(parent); }));
+        up.appendChild(td);
+        table.appendChild(up);
+    }
+
+    files.forEach(function(f) {
+        var tr = document.createElement('tr');
+        var name = document.createElement('td');
+        if (f.isDir) {
+            name.appendChild(linkElement(f.name + '/', function() { onOpen(f.path); }));
+        } else if (f.mode.charAt(0) === '-') {
+            name.appendChild(linkElement(f.name, function() { onExtract(f.path); }));
+        } else {
+            name.textContent = f.target ? f.name + ' -> ' + f.target : f.name;
+        }
+        tr.appendChild(name);
+        tr.appendChild(textElement('td', f.mode));
+        tr.appendChild(textElement('td', f.size));
+        table.appendChild(tr);
+    });
+    container.appendChild(table);
+}
+
+// renderChecks adds the result of verify to container (the signature tab)
+function renderChecks(container, checks) {
+    checks.forEach(function(check) {
+        container.appendChild(renderRows([
+            ['Signature', check.id],
+            ['Signed objects', (check.objects || []).join(', ')],
+            ['Format', check.format],
+            ['Verified', check.verified ? 'yes' : 'no'],
+            ['Details', check.message]
+        ]));
+    });
+}
+
+// renderFindings lists the findings of lint, or says there are none
+function renderFindings(container, findings) {
+    if (findings.length === 0) {
+        container.appendChild(textElement('div', 'Structure checked, no problems found'));
+        return;
+    }
+    var table = document.createElement('table');
+    findings.forEach(function(f) {
+        var tr = document.createElement('tr');
+        tr.appendChild(textElement('td', f.severity, 'finding-' + f.severity));
+        tr.appendChild(textElement('td', f.offset));
+        tr.appendChild(textElement('td', f.context ? f.context + ': ' + f.message : f.message));
+        table.appendChild(tr);
+    });
+    container.appendChild(table);
+}
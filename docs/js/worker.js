@@ -0,0 +1,78 @@
+// Web Worker that runs main.wasm off the UI thread. Messages from the page
+// are {id, type, args}, with type one of load, listDescriptors, readRange,
+// listDir, extract, exportTar, verify, lint, packages, vulns, build, diff
+// and library. The worker answers with
+//   {id, type: 'progress', done, total}   zero or more times, then
+//   {id, type: 'result', result}          or
+//   {id, type: 'error', error, code, hint}
+// A {id, type: 'cancel'} message aborts the call with that id, which then
+// ends with an error with code 'canceled'. build also streams the new
+// image out as {id, type: 'chunk', data} messages (Uint8Arrays), in order.
+// Use SifwebClient (client.js) rather than posting messages by hand.
+
+importScripts('../wasm_exec.js');
+
+var ready = (async function() {
+    var go = new Go();
+    var response = await fetch('../main.wasm');
+    var result = await WebAssembly.instantiate(await response.arrayBuffer(), go.importObject);
+    go.run(result.instance);
+})();
+
+// handlers call into the sifweb object set by main.wasm, options are
+// {onProgress, signal} for the calls that can take a while
+var handlers = {
+    load: function(args) { return sifweb.load(args.name, args.file); },
+    listDescriptors: function() { return sifweb.listDescriptors(); },
+    readRange: function(args, options) { return sifweb.readRange(args.offset, args.length, options); },
+    listDir: function(args) { return sifweb.listDir(args.path); },
+    extract: function(args, options) { return sifweb.extract(args.path, options); },
+    exportTar: function(args, options) { return sifweb.exportTar(args.path, options); },
+    verify: function(args, options) { return sifweb.verify(options); },
+    lint: function() { return sifweb.lint(); },
+    packages: function(args, options) { return sifweb.packages(args.format, options); },
+    vulns: function(args, options) { return sifweb.vulns(args.files, options); },
+    build: function(args, options) { return sifweb.build(args.spec, options); },
+    diff: function(args, options) { return sifweb.diff(args.old, args.new, options); },
+    library: function(args) { return sifweb.library(args.url, args.ref, {arch: args.arch, token: args.token}); }
+};
+
+// controllers holds an AbortController per running call, by id
+var controllers = {};
+
+self.onmessage = async function(event) {
+    var id = event.data.id;
+    if (event.data.type === 'cancel') {
+        if (controllers[id]) {
+            controllers[id].abort();
+        }
+        return;
+    }
+
+    var handler = handlers[event.data.type];
+    var controller = new AbortController();
+    var options = {
+        signal: controller.signal,
+        onProgress: function(done, total) {
+            self.postMessage({id: id, type: 'progress', done: done, total: total});
+        },
+        onChunk: function(data) {
+            self.postMessage({id: id, type: 'chunk', data: data}, [data.buffer]);
+        }
+    };
+    controllers[id] = controller;
+
+    try {
+        await ready;
+        if (!handler) {
+            throw new Error('unknown message type ' + event.data.type);
+        }
+        var result = await handler(event.data.args || {}, options);
+        var transfer = result instanceof Uint8Array ? [result.buffer] : [];
+        self.postMessage({id: id, type: 'result', result: result}, transfer);
+    } catch (error) {
+        self.postMessage({id: id, type: 'error', error: error.message || String(error), code: error.code, hint: error.hint});
+    } finally {
+        delete controllers[id];
+    }
+};
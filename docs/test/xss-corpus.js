@@ -0,0 +1,75 @@
+// Malicious strings a crafted SIF (or file name) could carry. Each one
+// tries to run window.xssFired() if it ever gets parsed as HTML.
+var xssCorpus = [
+    '<script>window.xssFired()</script>',
+    '<img src=x onerror="window.xssFired()">',
+    '<svg onload="window.xssFired()">',
+    '<iframe src="javascript:window.xssFired()"></iframe>',
+    '"><img src=x onerror=window.xssFired()>',
+    "'><body onload=window.xssFired()>",
+    '</pre><script>window.xssFired()</script><pre>',
+    '</td></tr></table><img src=x onerror=window.xssFired()>',
+    '<a href="javascript:window.xssFired()">click</a>',
+    '<details open ontoggle=window.xssFired()>',
+    '<math><mtext><table><mglyph><style><img src=x onerror=window.xssFired()>',
+    '&lt;img src=x onerror=window.xssFired()&gt;',
+    '-----BEGIN PGP SIGNATURE-----\n<img src=x onerror=window.xssFired()>\n-----END PGP SIGNATURE-----',
+    '\u0000<script>window.xssFired()</script>'
+];
+
+// xssResult builds a loadContainer result with payload in every string
+// that comes from the container or the uploaded file.
+function xssResult(payload) {
+    return {
+        file: payload,
+        header: {
+            launch: payload, magic: payload, version: payload, arch: payload,
+            id: payload, ctime: 0, mtime: 0, dfree: 0, dtotal: 0,
+            descroff: 0, descrlen: 0, dataoff: 0, datalen: 0
+        },
+        descriptors: [
+            {id: 1, name: payload, datatype: payload,
+             partition: {fstype: payload, parttype: payload, arch: payload}},
+            {id: 2, name: payload, datatype: payload,
+             signature: {hashtype: payload, entity: payload, content: payload}},
+            {id: 3, name: payload, datatype: payload,
+             crypto: {formattype: payload, messagetype: payload, content: payload}}
+        ],
+        errors: [{code: 'error', message: payload, hint: payload, offset: 0, context: payload}]
+    };
+}
+
+// xssFiles builds a listDir result with payload in the names and targets
+function xssFiles(payload) {
+    return [
+        {name: payload, path: '/' + payload, mode: 'drwxr-xr-x', isDir: true, size: 0},
+        {name: payload, path: '/' + payload, mode: '-rw-r--r--', isDir: false, size: 1},
+        {name: payload, path: '/' + payload, mode: 'Lrwxrwxrwx', isDir: false, size: 1, target: payload}
+    ];
+}
+
+// xssChecks builds a verify result with payload in the messages
+function xssChecks(payload) {
+    return [{id: 1, objects: [2], format: payload, verified: false, entity: payload, message: payload}];
+}
+
+// xssFindings builds a lint result with payload in the messages
+function xssFindings(payload) {
+    return [{severity: payload, check: payload, message: payload, offset: 0, context: ''}];
+}
+
+// xssDiff builds a diff result with payload in the names, texts and paths
+function xssDiff(payload) {
+    var descriptor = {id: 1, name: payload, datatype: payload, filelen: 1,
+                      partition: {fstype: payload, parttype: payload, arch: payload}};
+    var file = {name: payload, path: '/' + payload, mode: payload, size: 1, target: payload};
+    return {
+        old: payload, new: payload,
+        header: [{field: payload, old: payload, new: payload}],
+        objects: [{change: 'changed', old: descriptor, new: descriptor, oldDigest: payload, newDigest: payload}],
+        texts: [{datatype: payload, lines: [{op: ' ', old: 1, new: 1, text: payload},
+                                            {op: '-', old: 2, new: 0, text: payload},
+                                            {op: '+', old: 0, new: 2, text: payload}]}],
+        files: [{change: 'modified', path: payload, old: file, new: file}]
+    };
+}
@@ -0,0 +1,461 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strconv"
+
+	uuid "github.com/google/uuid"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// Encrypted partitions are what Singularity runs with --pem-path or
+// --passphrase: a LUKS2 volume (aes-xts-plain64) holding the squashfs,
+// opened with cryptsetup. With a passphrase the user gives it at run time.
+// With an RSA key, the passphrase is random and stored encrypted for the
+// key (RSA-OAEP, SHA-256, as an ASN.1 octet string in a PEM "MESSAGE"
+// block) in a crypto message object linked to the partition.
+// https://gitlab.com/cryptsetup/LUKS2-docs
+
+// LUKS2 layout constants, as cryptsetup luksFormat writes them by default.
+const (
+	luksHeaderSize    = 16384            // binary header and JSON area, twice
+	luksBinarySize    = 4096             // binary header
+	luksDataOffset    = 16 * 1024 * 1024 // start of the encrypted data
+	luksSectorSize    = 512              // encryption sector
+	luksKeySize       = 64               // aes-xts-plain64 with AES-256
+	luksStripes       = 4000             // anti-forensic stripes of the keyslot
+	luksSaltSize      = 32               // PBKDF2 salts
+	luksIterations    = 200000           // PBKDF2 iterations of the keyslot
+	luksDigestIter    = 1000             // PBKDF2 iterations of the key digest
+	luksEncryption    = "aes-xts-plain64"
+	luksPassphraseHex = 32 // random bytes of passphrases for RSA keys
+)
+
+// EncryptionKey is what a partition is encrypted for: a passphrase or an
+// RSA public key. One of them must be set.
+type EncryptionKey struct {
+	Passphrase []byte
+	PublicKey  *rsa.PublicKey
+}
+
+// ReadPEMPublicKey reads an RSA public key in PEM (PKIX "PUBLIC KEY" or
+// PKCS#1 "RSA PUBLIC KEY") format.
+func ReadPEMPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("not an RSA public key")
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q, want a public key", block.Type)
+}
+
+// luksSegment, luksKeyslot, luksDigest and luksMetadata are the objects of
+// the LUKS2 JSON metadata we write. Sizes and offsets are strings.
+type luksSegment struct {
+	Type       string `json:"type"`
+	Offset     string `json:"offset"`
+	Size       string `json:"size"`
+	IVTweak    string `json:"iv_tweak"`
+	Encryption string `json:"encryption"`
+	SectorSize int    `json:"sector_size"`
+}
+
+type luksKDF struct {
+	Type       string `json:"type"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`
+}
+
+type luksKeyslot struct {
+	Type    string `json:"type"`
+	KeySize int    `json:"key_size"`
+	AF      struct {
+		Type    string `json:"type"`
+		Stripes int    `json:"stripes"`
+		Hash    string `json:"hash"`
+	} `json:"af"`
+	Area struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Size       string `json:"size"`
+		Encryption string `json:"encryption"`
+		KeySize    int    `json:"key_size"`
+	} `json:"area"`
+	KDF luksKDF `json:"kdf"`
+}
+
+type luksDigest struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Segments   []string `json:"segments"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       string   `json:"salt"`
+	Digest     string   `json:"digest"`
+}
+
+type luksMetadata struct {
+	Keyslots map[string]luksKeyslot `json:"keyslots"`
+	Tokens   map[string]interface{} `json:"tokens"`
+	Segments map[string]luksSegment `json:"segments"`
+	Digests  map[string]luksDigest  `json:"digests"`
+	Config   struct {
+		JSONSize     string `json:"json_size"`
+		KeyslotsSize string `json:"keyslots_size"`
+	} `json:"config"`
+}
+
+// randomBytes returns n bytes from crypto/rand.
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}
+
+// afDiffuse is the diffusion of the LUKS anti-forensic splitter: each
+// hash-sized block of b is replaced by H(block number || block).
+func afDiffuse(b []byte) {
+	h := sha256.New()
+	for i := 0; i*h.Size() < len(b); i++ {
+		block := b[i*h.Size():]
+		if len(block) > h.Size() {
+			block = block[:h.Size()]
+		}
+		var iv [4]byte
+		binary.BigEndian.PutUint32(iv[:], uint32(i))
+		h.Reset()
+		h.Write(iv[:])
+		h.Write(block)
+		copy(block, h.Sum(nil))
+	}
+}
+
+// afSplit spreads key over stripes random-looking blocks, so that the key
+// can't be recovered unless all of them are.
+func afSplit(key []byte, stripes int) ([]byte, error) {
+	split, err := randomBytes(len(key) * stripes)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, len(key))
+	for i := 0; i < stripes-1; i++ {
+		for j := range buf {
+			buf[j] ^= split[i*len(key)+j]
+		}
+		afDiffuse(buf)
+	}
+	last := split[(stripes-1)*len(key):]
+	for j := range last {
+		last[j] = buf[j] ^ key[j]
+	}
+	return split, nil
+}
+
+// xtsEncrypt encrypts data in place in sectors, numbered from first.
+func xtsEncrypt(c *xts.Cipher, data []byte, first uint64) {
+	for i := 0; i < len(data); i += luksSectorSize {
+		sector := data[i : i+luksSectorSize]
+		c.Encrypt(sector, sector, first+uint64(i/luksSectorSize))
+	}
+}
+
+// luksHeader returns the LUKS2 headers and keyslot area (everything up to
+// luksDataOffset, but the trailing zeros), for a volume with master key
+// key opened with passphrase.
+func luksHeader(key, passphrase []byte) ([]byte, error) {
+	keyslotSalt, err := randomBytes(luksSaltSize)
+	if err != nil {
+		return nil, err
+	}
+	digestSalt, err := randomBytes(luksSaltSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// The keyslot holds the master key, split and encrypted with a key
+	// derived from the passphrase
+	split, err := afSplit(key, luksStripes)
+	if err != nil {
+		return nil, err
+	}
+	areaSize := align(int64(len(split)), 4096)
+	area := make([]byte, areaSize)
+	copy(area, split)
+	slotCipher, err := xts.NewCipher(aes.NewCipher, pbkdf2.Key(passphrase, keyslotSalt, luksIterations, luksKeySize, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	xtsEncrypt(slotCipher, area, 0)
+
+	var slot luksKeyslot
+	slot.Type = "luks2"
+	slot.KeySize = luksKeySize
+	slot.AF.Type, slot.AF.Stripes, slot.AF.Hash = "luks1", luksStripes, "sha256"
+	slot.Area.Type = "raw"
+	slot.Area.Offset = strconv.Itoa(2 * luksHeaderSize)
+	slot.Area.Size = strconv.FormatInt(areaSize, 10)
+	slot.Area.Encryption, slot.Area.KeySize = luksEncryption, luksKeySize
+	slot.KDF = luksKDF{"pbkdf2", "sha256", luksIterations, base64.StdEncoding.EncodeToString(keyslotSalt)}
+
+	md := luksMetadata{
+		Keyslots: map[string]luksKeyslot{"0": slot},
+		Tokens:   map[string]interface{}{},
+		Segments: map[string]luksSegment{"0": {
+			Type:       "crypt",
+			Offset:     strconv.Itoa(luksDataOffset),
+			Size:       "dynamic",
+			IVTweak:    "0",
+			Encryption: luksEncryption,
+			SectorSize: luksSectorSize,
+		}},
+		Digests: map[string]luksDigest{"0": {
+			Type:       "pbkdf2",
+			Keyslots:   []string{"0"},
+			Segments:   []string{"0"},
+			Hash:       "sha256",
+			Iterations: luksDigestIter,
+			Salt:       base64.StdEncoding.EncodeToString(digestSalt),
+			Digest:     base64.StdEncoding.EncodeToString(pbkdf2.Key(key, digestSalt, luksDigestIter, sha256.Size, sha256.New)),
+		}},
+	}
+	md.Config.JSONSize = strconv.Itoa(luksHeaderSize - luksBinarySize)
+	md.Config.KeyslotsSize = strconv.Itoa(luksDataOffset - 2*luksHeaderSize)
+	metadata, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata) >= luksHeaderSize-luksBinarySize {
+		return nil, fmt.Errorf("LUKS2 metadata too large")
+	}
+
+	// The primary and secondary headers only differ by magic, offset and salt
+	id := uuid.New().String()
+	out := make([]byte, 2*luksHeaderSize, 2*luksHeaderSize+len(area))
+	for i, magic := range []string{"LUKS\xba\xbe", "SKUL\xba\xbe"} {
+		hdr := out[i*luksHeaderSize : (i+1)*luksHeaderSize]
+		copy(hdr[0:], magic)
+		binary.BigEndian.PutUint16(hdr[6:], 2)                            // version
+		binary.BigEndian.PutUint64(hdr[8:], luksHeaderSize)               // hdr_size
+		binary.BigEndian.PutUint64(hdr[16:], 1)                           // seqid
+		copy(hdr[72:], "sha256")                                          // checksum_alg
+		if _, err := io.ReadFull(rand.Reader, hdr[104:168]); err != nil { // salt
+			return nil, err
+		}
+		copy(hdr[168:], id)                                             // uuid
+		binary.BigEndian.PutUint64(hdr[256:], uint64(i*luksHeaderSize)) // hdr_offset
+		copy(hdr[luksBinarySize:], metadata)
+
+		sum := sha256.Sum256(hdr) // with csum (at 448) still zero
+		copy(hdr[448:], sum[:])
+	}
+	return append(out, area...), nil
+}
+
+// luksReader reads the LUKS2 volume of a plain source: the header, then
+// the data encrypted sector by sector, padded to a full sector.
+type luksReader struct {
+	header io.Reader
+	src    io.Reader
+	cipher *xts.Cipher
+	sector uint64
+	buf    []byte // encrypted data not read yet
+	eof    bool
+}
+
+func (r *luksReader) Read(p []byte) (int, error) {
+	if n, err := r.header.Read(p); err != io.EOF {
+		return n, err
+	}
+	if len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, 256*luksSectorSize)
+		n, err := io.ReadFull(r.src, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		chunk = chunk[:align(int64(n), luksSectorSize)]
+		xtsEncrypt(r.cipher, chunk, r.sector)
+		r.sector += uint64(len(chunk) / luksSectorSize)
+		r.buf = chunk
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// encryptedSize is the size of the LUKS2 volume of size bytes of data.
+func encryptedSize(size int64) int64 {
+	return luksDataOffset + align(size, luksSectorSize)
+}
+
+// Encrypt turns a squashfs partition input, with Fp or Data set, into an
+// FsEncryptedSquashfs partition for key: its data is read through LUKS2
+// encryption. For an RSA
+// key, it also returns the crypto message input with the passphrase, to be
+// added to the image linked to the partition; it is nil for a passphrase.
+func (di *DescriptorInput) Encrypt(key EncryptionKey) (*DescriptorInput, error) {
+	if di.Datatype != DataPartition {
+		return nil, fmt.Errorf("only partitions can be encrypted")
+	}
+	var pinfo Partition
+	if err := binary.Read(bytes.NewReader(di.Extra.Bytes()), binary.LittleEndian, &pinfo); err != nil {
+		return nil, fmt.Errorf("partition without SetPartExtra")
+	}
+	if pinfo.Fstype != FsSquash {
+		return nil, fmt.Errorf("only squashfs partitions can be encrypted, not %s", fstypeStr(pinfo.Fstype))
+	}
+	if di.Fp == nil && di.Data == nil {
+		return nil, fmt.Errorf("the partition to encrypt must be opened (Fp or Data)")
+	}
+	if _, err := di.openInput(); err != nil {
+		return nil, err
+	}
+
+	var message *DescriptorInput
+	passphrase := key.Passphrase
+	switch {
+	case key.PublicKey != nil:
+		random, err := randomBytes(luksPassphraseHex)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = []byte(hex.EncodeToString(random))
+		ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.PublicKey, passphrase, nil)
+		if err != nil {
+			return nil, err
+		}
+		// the PEM block holds the ciphertext as an ASN.1 octet string, as
+		// Singularity's crypt package writes (and reads) it
+		der, err := asn1.Marshal(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		message = &DescriptorInput{
+			Datatype: DataCryptoMessage,
+			Groupid:  di.Groupid,
+			Data:     pem.EncodeToMemory(&pem.Block{Type: "MESSAGE", Bytes: der}),
+		}
+		if err := message.SetCryptoMsgExtra(FormatPEM, MessageRSAOAEP); err != nil {
+			return nil, err
+		}
+	case len(passphrase) == 0:
+		return nil, fmt.Errorf("a passphrase or an RSA public key is needed to encrypt")
+	}
+
+	masterKey, err := randomBytes(luksKeySize)
+	if err != nil {
+		return nil, err
+	}
+	header, err := luksHeader(masterKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	dataCipher, err := xts.NewCipher(aes.NewCipher, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	headerReader := io.MultiReader(bytes.NewReader(header),
+		io.LimitReader(zeroReader{}, luksDataOffset-int64(len(header))))
+	di.Fp = &luksReader{header: headerReader, src: io.LimitReader(di.Fp, di.Size), cipher: dataCipher}
+	di.Size = encryptedSize(di.Size)
+
+	pinfo.Fstype = FsEncryptedSquashfs
+	di.Extra.Reset()
+	if err := binary.Write(&di.Extra, binary.LittleEndian, pinfo); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// EncryptedCopy returns the inputs of a copy of the SIF where the primary
+// system partition is encrypted for key, followed by the crypto message
+// for an RSA key. Signatures are dropped, since they can't match the
+// encrypted data anymore, with a warning; links are updated to the new IDs.
+func (fimg *FileImage) EncryptedCopy(key EncryptionKey) (*CreateInfo, []string, error) {
+	part, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return nil, nil, fmt.Errorf("primary system partition: %w", err)
+	}
+
+	var warnings []string
+	cinfo := &CreateInfo{}
+	ids := map[uint32]uint32{} // new IDs, in order of the copy
+	for _, v := range fimg.DescrArr {
+		if !v.Used {
+			continue
+		}
+		if v.Datatype == DataSignature {
+			warnings = append(warnings, fmt.Sprintf("signature %d dropped, sign the encrypted image again", v.ID))
+			continue
+		}
+		input := DescriptorInput{
+			Datatype: v.Datatype,
+			Groupid:  v.Groupid,
+			Link:     v.Link,
+			Size:     v.Filelen,
+			Fname:    trimZeroBytes(v.Name[:]),
+			Fp:       io.NewSectionReader(fimg.Reader, v.Fileoff, v.Filelen),
+		}
+		input.Extra.Write(v.Extra[:])
+		cinfo.InputDescr = append(cinfo.InputDescr, input)
+		ids[v.ID] = uint32(len(cinfo.InputDescr))
+	}
+
+	for i := range cinfo.InputDescr {
+		input := &cinfo.InputDescr[i]
+		if input.Link != 0 && input.Link&DescrGroupMask == 0 {
+			input.Link = ids[input.Link]
+		}
+	}
+
+	input := &cinfo.InputDescr[ids[part.ID]-1]
+	message, err := input.Encrypt(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if message != nil {
+		message.Link = ids[part.ID]
+		cinfo.InputDescr = append(cinfo.InputDescr, *message)
+	}
+	return cinfo, warnings, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// openPEMMessage decrypts a crypto message the way Singularity does for
+// --pem-path: PEM, then an ASN.1 octet string, then RSA-OAEP.
+func openPEMMessage(t *testing.T, key *rsa.PrivateKey, message []byte) []byte {
+	block, _ := pem.Decode(message)
+	if block == nil || block.Type != "MESSAGE" {
+		t.Fatalf("no PEM MESSAGE block in %q", message)
+	}
+	var ciphertext []byte
+	if rest, err := asn1.Unmarshal(block.Bytes, &ciphertext); err != nil || len(rest) > 0 {
+		t.Fatalf("message is not an ASN.1 octet string: %v", err)
+	}
+	passphrase, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return passphrase
+}
+
+// openLUKS returns the master key of a LUKS2 volume, as cryptsetup open
+// finds it: the header checksum, the keyslot decrypted with the passphrase,
+// merged back from its stripes and checked against the digest.
+func openLUKS(t *testing.T, volume, passphrase []byte) []byte {
+	hdr := append([]byte(nil), volume[:luksHeaderSize]...)
+	if string(hdr[:6]) != "LUKS\xba\xbe" || binary.BigEndian.Uint16(hdr[6:]) != 2 {
+		t.Fatalf("not a LUKS2 header: %q", hdr[:8])
+	}
+	csum := append([]byte(nil), hdr[448:480]...)
+	copy(hdr[448:], make([]byte, 64))
+	if sum := sha256.Sum256(hdr); !bytes.Equal(sum[:], csum) {
+		t.Fatal("bad header checksum")
+	}
+
+	var md luksMetadata
+	if err := json.Unmarshal(bytes.TrimRight(hdr[luksBinarySize:], "\x00"), &md); err != nil {
+		t.Fatal(err)
+	}
+	slot, digest := md.Keyslots["0"], md.Digests["0"]
+	salt, _ := base64.StdEncoding.DecodeString(slot.KDF.Salt)
+	slotCipher, err := xts.NewCipher(aes.NewCipher, pbkdf2.Key(passphrase, salt, slot.KDF.Iterations, slot.KeySize, sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, _ := strconv.Atoi(slot.Area.Offset)
+	size, _ := strconv.Atoi(slot.Area.Size)
+	area := append([]byte(nil), volume[offset:offset+size]...)
+	for i := 0; i < len(area); i += luksSectorSize {
+		slotCipher.Decrypt(area[i:i+luksSectorSize], area[i:i+luksSectorSize], uint64(i/luksSectorSize))
+	}
+
+	// AF merge: the inverse of afSplit
+	key := make([]byte, slot.KeySize)
+	for i := 0; i < slot.AF.Stripes; i++ {
+		for j := range key {
+			key[j] ^= area[i*len(key)+j]
+		}
+		if i < slot.AF.Stripes-1 {
+			afDiffuse(key)
+		}
+	}
+
+	salt, _ = base64.StdEncoding.DecodeString(digest.Salt)
+	want, _ := base64.StdEncoding.DecodeString(digest.Digest)
+	if got := pbkdf2.Key(key, salt, digest.Iterations, len(want), sha256.New); !bytes.Equal(got, want) {
+		t.Fatal("wrong passphrase: the master key doesn't match the digest")
+	}
+	return key
+}
+
+func TestEncryptRSA(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ReadPEMPublicKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&private.PublicKey)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("squashfs"), 1000)
+	part := DescriptorInput{Datatype: DataPartition, Data: data}
+	part.SetPartExtra(FsSquash, PartPrimSys, GetSIFArch("amd64"))
+	message, err := part.Encrypt(EncryptionKey{PublicKey: public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil {
+		t.Fatal("no crypto message for an RSA key")
+	}
+	volume, err := ioutil.ReadAll(part.Fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(volume)) != part.Size || part.Size != encryptedSize(int64(len(data))) {
+		t.Fatalf("got %d bytes, size %d, want %d", len(volume), part.Size, encryptedSize(int64(len(data))))
+	}
+
+	key := openLUKS(t, volume, openPEMMessage(t, private, message.Data))
+	dataCipher, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := volume[luksDataOffset:]
+	for i := 0; i < len(plain); i += luksSectorSize {
+		dataCipher.Decrypt(plain[i:i+luksSectorSize], plain[i:i+luksSectorSize], uint64(i/luksSectorSize))
+	}
+	if !bytes.Equal(plain[:len(data)], data) || len(bytes.Trim(plain[len(data):], "\x00")) > 0 {
+		t.Error("decrypted data doesn't match the partition")
+	}
+}
+
+func TestEncryptErrors(t *testing.T) {
+	for _, data := range []string{"", "not pem", "-----BEGIN MESSAGE-----\nAAAA\n-----END MESSAGE-----\n",
+		"-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n"} {
+		if _, err := ReadPEMPublicKey([]byte(data)); err == nil {
+			t.Errorf("%q: read as a public key", data)
+		}
+	}
+
+	deffile := DescriptorInput{Datatype: DataDeffile, Data: []byte("Bootstrap: docker")}
+	if _, err := deffile.Encrypt(EncryptionKey{Passphrase: []byte("x")}); err == nil {
+		t.Error("encrypted a definition file")
+	}
+	part := DescriptorInput{Datatype: DataPartition, Data: []byte("data")}
+	part.SetPartExtra(FsSquash, PartPrimSys, GetSIFArch("amd64"))
+	if _, err := part.Encrypt(EncryptionKey{}); err == nil {
+		t.Error("encrypted without a key")
+	}
+}
@@ -4,11 +4,164 @@
 // https://polyformproject.org/licenses/noncommercial/1.0.0
 
 package main
- 
-import "errors"
+
+import (
+	"errors"
+	"fmt"
+)
 
 // ErrNotFound is the code for when no search key is not found.
 var ErrNotFound = errors.New("no match found")
 
 // ErrMultValues is the code for when search key is not unique.
 var ErrMultValues = errors.New("lookup would return more than one match")
+
+// Kinds of problems found while reading a SIF. A ReadError carries one of
+// these, so callers can check for them with errors.Is.
+var (
+	ErrTruncated          = errors.New("file is truncated")
+	ErrBadMagic           = errors.New("bad magic")
+	ErrUnsupportedVersion = errors.New("unsupported SIF version")
+	ErrDescriptorBounds   = errors.New("descriptor out of bounds")
+	ErrBadDescriptor      = errors.New("malformed descriptor")
+	ErrIO                 = errors.New("I/O error")
+	ErrUsage              = errors.New("usage error")
+	ErrVerifyFailed       = errors.New("verification failed")
+	ErrLintFailed         = errors.New("structural errors found")
+	ErrDigestMismatch     = errors.New("digest mismatch")
+	ErrNoRanges           = errors.New("range requests not supported")
+)
+
+// ReadError describes a problem found while reading a SIF, with the offset
+// in the file and what was being read at the time.
+type ReadError struct {
+	Kind    error  // one of the ErrXxx kinds above
+	Offset  int64  // offset in the file where the problem was found
+	Context string // what was being read, e.g. "global header"
+	Err     error  // underlying error, if any
+	Detail  string // extra detail, e.g. what was expected
+}
+
+func (e *ReadError) Error() string {
+	s := fmt.Sprintf("%s at offset %d: %s", e.Context, e.Offset, e.Kind)
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Is reports whether the ReadError is of the target kind.
+func (e *ReadError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// Unwrap returns the underlying error.
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// readError is a shortcut to create a ReadError.
+func readError(kind error, offset int64, context string, err error, detail string) *ReadError {
+	return &ReadError{Kind: kind, Offset: offset, Context: context, Err: err, Detail: detail}
+}
+
+// errorList collects several errors, e.g. one per bad descriptor. It is
+// of the same kind as its first error.
+type errorList []error
+
+func (l errorList) Error() string {
+	s := l[0].Error()
+	if len(l) > 1 {
+		s += fmt.Sprintf(" (and %d more)", len(l)-1)
+	}
+	return s
+}
+
+// Unwrap returns the first error of the list.
+func (l errorList) Unwrap() error {
+	return l[0]
+}
+
+// Exit codes for the command line, one per kind of problem.
+const (
+	ExitOK                 = 0
+	ExitError              = 1 // anything not listed below
+	ExitUsage              = 2
+	ExitTruncated          = 3
+	ExitBadMagic           = 4
+	ExitUnsupportedVersion = 5
+	ExitDescriptorBounds   = 6
+	ExitBadDescriptor      = 7
+	ExitIO                 = 8
+	ExitVerifyFailed       = 9
+	ExitLintFailed         = 10
+	ExitDigestMismatch     = 11
+	ExitCanceled           = 130 // like a shell, for an interrupt
+)
+
+// errorKinds maps each kind of error to its code (used by the browser),
+// exit code (used by the command line) and a hint on what to do about it.
+var errorKinds = []struct {
+	kind error
+	code string
+	exit int
+	hint string
+}{
+	{ErrTruncated, "truncated", ExitTruncated, "the file ends early, the download or upload may be incomplete: fetch the image again"},
+	{ErrBadMagic, "bad-magic", ExitBadMagic, "this does not look like a SIF image: check that you selected the right file"},
+	{ErrUnsupportedVersion, "unsupported-version", ExitUnsupportedVersion, "the image was written by a newer SIF version than sifweb supports"},
+	{ErrDescriptorBounds, "descriptor-bounds", ExitDescriptorBounds, "a descriptor points outside of the file: the image is corrupt or truncated"},
+	{ErrBadDescriptor, "bad-descriptor", ExitBadDescriptor, "a descriptor could not be parsed: the image may be corrupt"},
+	{ErrIO, "io", ExitIO, "the file could not be read: check that it exists and is readable"},
+	{ErrUsage, "usage", ExitUsage, "run 'sifweb help' for usage"},
+	{ErrVerifyFailed, "verify-failed", ExitVerifyFailed, "the signed objects were modified after signing, or the signature is damaged"},
+	{ErrLintFailed, "lint-failed", ExitLintFailed, "the image breaks the SIF layout: rebuild it, or try to fix it with a tool that rewrites it"},
+	{ErrDigestMismatch, "digest-mismatch", ExitDigestMismatch, "the data was modified or damaged after its digest was recorded: copy or download it again"},
+	{ErrNoRanges, "no-ranges", ExitIO, "the server can't send parts of the file: serve it with one that supports HTTP Range requests (e.g., sifweb serve), or download the image and open the file"},
+	{ErrCanceled, "canceled", ExitCanceled, ""},
+}
+
+// ErrorInfo is a friendly view of an error, for the browser.
+type ErrorInfo struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+	Offset  int64  `json:"offset"`
+	Context string `json:"context,omitempty"`
+}
+
+// errorInfo converts an error into an ErrorInfo, adding a hint when the
+// kind of error is known.
+func errorInfo(err error) ErrorInfo {
+	info := ErrorInfo{Code: "error", Message: err.Error(), Offset: -1}
+
+	var rerr *ReadError
+	if errors.As(err, &rerr) {
+		info.Offset = rerr.Offset
+		info.Context = rerr.Context
+	}
+	for _, k := range errorKinds {
+		if errors.Is(err, k.kind) {
+			info.Code = k.code
+			info.Hint = k.hint
+			break
+		}
+	}
+	return info
+}
+
+// exitCode returns the command line exit code for an error.
+func exitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	for _, k := range errorKinds {
+		if errors.Is(err, k.kind) {
+			return k.exit
+		}
+	}
+	return ExitError
+}
@@ -0,0 +1,441 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Exporting a SIF as an OCI image, the other way around from oci.go: the
+// primary partition becomes a single gzip layer, next to a config made
+// from the environment, runscript and labels of the SIF. The image is
+// written as an OCI image layout, in a directory or in a tarball that
+// also has the manifest.json of `docker save`, so `docker load` takes it.
+
+// OCI media types of the exported image.
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociLayoutFile   = `{"imageLayoutVersion":"1.0.0"}`
+
+	singularityRunscript = "/.singularity.d/runscript"
+	singularityDockerEnv = "/.singularity.d/env/10-docker2singularity.sh"
+)
+
+// ociImageConfig is the image configuration written for an export.
+type ociImageConfig struct {
+	Created      string `json:"created"`
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Env    []string          `json:"Env,omitempty"`
+		Cmd    []string          `json:"Cmd,omitempty"`
+		Labels map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []struct {
+		Created   string `json:"created"`
+		CreatedBy string `json:"created_by"`
+	} `json:"history"`
+}
+
+// ociManifest is an image (or artifact) manifest.
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociImageIndex is the index.json of an image layout.
+type ociImageIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// envLine matches a variable set in an environment script.
+var envLine = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// shellUnquote returns the value of a shell word, with its single quotes,
+// double quotes and backslashes removed. It stops at unquoted blanks.
+func shellUnquote(s string) string {
+	var b strings.Builder
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("\\\"$`", c) {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case quote == 0 && (c == ' ' || c == '\t' || c == ';'):
+			return b.String()
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// parseEnvScript returns the variables set by a shell environment script,
+// as NAME=value, for the simple assignments it has. A default value
+// ("${NAME:-value}", as Singularity writes them) is taken as the value.
+func parseEnvScript(script string) []string {
+	var env []string
+	for _, line := range strings.Split(script, "\n") {
+		m := envLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		value := strings.TrimSpace(m[2])
+		prefix := "${" + m[1] + ":-"
+		if strings.HasPrefix(value, `"`+prefix) && strings.HasSuffix(value, `}"`) {
+			value = strings.TrimSuffix(strings.TrimPrefix(value, `"`+prefix), `}"`)
+		}
+		env = append(env, m[1]+"="+shellUnquote(value))
+	}
+	return env
+}
+
+// exportLabels returns the labels of the DataLabels object, as strings.
+func (fimg *FileImage) exportLabels() (map[string]string, error) {
+	content, ok, err := fimg.firstContent(DataLabels)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &raw); err != nil {
+		return nil, fmt.Errorf("labels: %s", err)
+	}
+	labels := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			labels[k] = s
+		} else {
+			b, _ := json.Marshal(v)
+			labels[k] = string(b)
+		}
+	}
+	return labels, nil
+}
+
+// exportEnv returns the environment of the image: the DataEnvVar object,
+// or else the environment Singularity made from a docker image.
+func (fimg *FileImage) exportEnv(sqfs *SquashFS) ([]string, error) {
+	content, ok, err := fimg.firstContent(DataEnvVar)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		var b bytes.Buffer
+		if sqfs.Extract(context.Background(), &b, singularityDockerEnv, nil) != nil {
+			return nil, nil
+		}
+		content = b.String()
+	}
+	return parseEnvScript(content), nil
+}
+
+// hashWriter hashes what is written to it.
+type hashWriter struct {
+	hash.Hash
+	n int64
+}
+
+func (h *hashWriter) Write(b []byte) (int, error) {
+	h.n += int64(len(b))
+	return h.Hash.Write(b)
+}
+
+func (h *hashWriter) digest() string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// ociBlob is a blob of the exported image, in memory or in a file.
+type ociBlob struct {
+	desc ociDescriptor
+	data []byte
+	file string
+}
+
+// jsonBlob returns a blob holding v as JSON.
+func jsonBlob(mediaType string, v interface{}) (ociBlob, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociBlob{}, err
+	}
+	sum := sha256.Sum256(data)
+	return ociBlob{
+		desc: ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))},
+		data: data,
+	}, nil
+}
+
+// writeLayer writes the primary partition as a gzip tar to f, and returns
+// its blob and the digest of the uncompressed tar.
+func writeLayer(ctx context.Context, sqfs *SquashFS, f *os.File, fn ProgressFunc) (ociBlob, string, error) {
+	compressed := &hashWriter{Hash: sha256.New()}
+	uncompressed := &hashWriter{Hash: sha256.New()}
+	zw := gzip.NewWriter(io.MultiWriter(f, compressed))
+	if err := sqfs.WriteTar(ctx, io.MultiWriter(zw, uncompressed), "/", fn); err != nil {
+		return ociBlob{}, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return ociBlob{}, "", err
+	}
+	desc := ociDescriptor{MediaType: ociLayerType, Digest: compressed.digest(), Size: compressed.n}
+	return ociBlob{desc: desc, file: f.Name()}, uncompressed.digest(), nil
+}
+
+// ExportOCI writes the image as an OCI image named ref (e.g.,
+// "busybox:latest"): an image layout in the directory out, or a tarball
+// for `docker load` if docker is set. Progress is reported in bytes of
+// file content.
+func (fimg *FileImage) ExportOCI(ctx context.Context, out, ref string, docker bool, fn ProgressFunc) error {
+	descr, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return fmt.Errorf("looking for the primary partition: %s", err)
+	}
+	p, err := descr.getPartition()
+	if err != nil {
+		return err
+	}
+	sqfs, err := fimg.GetPrimSquashFS()
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(path.Base(ref), ":") {
+		ref += ":latest"
+	}
+
+	// the layer goes to a temporary file, in the layout if there is one
+	dir := ""
+	if !docker {
+		dir = filepath.Join(out, "blobs", "sha256")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp, err := ioutil.TempFile(dir, "layer-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	layer, diffID, err := writeLayer(ctx, sqfs, tmp, fn)
+	if err != nil {
+		return err
+	}
+
+	created := time.Unix(fimg.Header.Ctime, 0).UTC().Format(time.RFC3339)
+	var config ociImageConfig
+	config.Created = created
+	config.Architecture = GetGoArch(trimZeroBytes(p.Arch[:]))
+	config.OS = "linux"
+	if config.Config.Env, err = fimg.exportEnv(sqfs); err != nil {
+		return err
+	}
+	config.Config.Cmd = []string{"/bin/sh"}
+	if _, err := sqfs.Lookup(singularityRunscript); err == nil {
+		config.Config.Cmd = []string{singularityRunscript}
+	}
+	if config.Config.Labels, err = fimg.exportLabels(); err != nil {
+		return err
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{diffID}
+	config.History = append(config.History, struct {
+		Created   string `json:"created"`
+		CreatedBy string `json:"created_by"`
+	}{created, "sifweb export"})
+
+	configBlob, err := jsonBlob(ociConfigType, config)
+	if err != nil {
+		return err
+	}
+	annotations := map[string]string{"org.opencontainers.image.created": created}
+	for k, v := range config.Config.Labels {
+		if k != ociRefNameAnnotation { // the index names the image
+			annotations[k] = v
+		}
+	}
+	manifestBlob, err := jsonBlob(ociManifestType, ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        configBlob.desc,
+		Layers:        []ociDescriptor{layer.desc},
+		Annotations:   annotations,
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc := manifestBlob.desc
+	manifestDesc.Annotations = map[string]string{ociRefNameAnnotation: ref}
+
+	blobs := []ociBlob{configBlob, manifestBlob, layer}
+	if !docker {
+		return writeLayout(out, blobs, manifestDesc)
+	}
+
+	index, err := json.Marshal(ociImageIndex{2, ociIndexType, []ociDescriptor{manifestDesc}})
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{"oci-layout": []byte(ociLayoutFile), "index.json": index}
+	name := func(b ociBlob) string { n, _ := blobName(b.desc.Digest); return n }
+	manifest, err := json.Marshal([]dockerManifest{{
+		Config:   name(configBlob),
+		RepoTags: []string{ref},
+		Layers:   []string{name(layer)},
+	}})
+	if err != nil {
+		return err
+	}
+	files["manifest.json"] = manifest
+	return writeLayoutTar(out, blobs, files)
+}
+
+// writeLayout writes the blobs of an image to the layout in dir, the
+// blobs in files being moved in place, and adds its manifest to the index.
+func writeLayout(dir string, blobs []ociBlob, manifest ociDescriptor) error {
+	for _, b := range blobs {
+		name, err := blobName(b.desc.Digest)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if b.file != "" {
+			err = os.Rename(b.file, dest)
+		} else {
+			err = ioutil.WriteFile(dest, b.data, 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return updateIndex(dir, manifest)
+}
+
+// updateIndex adds a manifest to the index.json of the layout in dir,
+// replacing the one with the same name if any.
+func updateIndex(dir string, manifest ociDescriptor) error {
+	index := ociImageIndex{SchemaVersion: 2, MediaType: ociIndexType}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("%s: %s", filepath.Join(dir, "index.json"), err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	ref := manifest.Annotations[ociRefNameAnnotation]
+	manifests := []ociDescriptor{}
+	for _, m := range index.Manifests {
+		if ref == "" || m.Annotations[ociRefNameAnnotation] != ref {
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = append(manifests, manifest)
+
+	if data, err = json.Marshal(index); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(ociLayoutFile), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.json"), data, 0644)
+}
+
+// writeLayoutTar writes the blobs and files of an image layout to a
+// tarball at out.
+func writeLayoutTar(out string, blobs []ociBlob, files map[string][]byte) (err error) {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+	for _, d := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: d, Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+			return err
+		}
+	}
+	add := func(name string, size int64, r io.Reader) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg, Format: tar.FormatPAX}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+	for _, b := range blobs {
+		name, err := blobName(b.desc.Digest)
+		if err != nil {
+			return err
+		}
+		if b.file == "" {
+			err = add(name, b.desc.Size, bytes.NewReader(b.data))
+		} else {
+			var lf *os.File
+			if lf, err = os.Open(b.file); err == nil {
+				err = add(name, b.desc.Size, lf)
+				lf.Close()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{"oci-layout", "index.json", "manifest.json"} {
+		if err := add(name, int64(len(files[name])), bytes.NewReader(files[name])); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testSquash returns a squashfs of files, by path, with their directories.
+func testSquash(t *testing.T, files map[string]string) []byte {
+	root := &SquashNode{Type: sqDir, Perm: 0755, Mtime: 1700000000, Entries: map[string]*SquashNode{}}
+	var buf seekBuffer
+	sw, err := NewSquashWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		dir, parts := root, strings.Split(strings.Trim(p, "/"), "/")
+		for _, name := range parts[:len(parts)-1] {
+			if dir.Entries[name] == nil {
+				dir.Entries[name] = &SquashNode{Type: sqDir, Perm: 0755, Mtime: 1700000000, Entries: map[string]*SquashNode{}}
+			}
+			dir = dir.Entries[name]
+		}
+		n := &SquashNode{Type: sqFile, Perm: 0755, Mtime: 1700000000, Size: int64(len(files[p]))}
+		if err := sw.WriteFile(n, strings.NewReader(files[p])); err != nil {
+			t.Fatal(err)
+		}
+		dir.Entries[parts[len(parts)-1]] = n
+	}
+	if _, err := sw.Finish(root, 1700000000); err != nil {
+		t.Fatal(err)
+	}
+	return buf.data
+}
+
+// testSquashInputs are the objects of a Singularity image of files: a
+// definition file, labels, an environment and the primary partition.
+func testSquashInputs(t *testing.T, files map[string]string) []DescriptorInput {
+	part := DescriptorInput{Datatype: DataPartition, Groupid: DescrDefaultGroup, Fname: "rootfs.squashfs", Data: testSquash(t, files)}
+	if err := part.SetPartExtra(FsSquash, PartPrimSys, GetSIFArch("amd64")); err != nil {
+		t.Fatal(err)
+	}
+	return []DescriptorInput{
+		{Datatype: DataDeffile, Groupid: DescrDefaultGroup, Fname: "def", Data: []byte("Bootstrap: docker\nFrom: alpine\n")},
+		{Datatype: DataLabels, Groupid: DescrDefaultGroup, Fname: "labels", Data: []byte(`{"maintainer": "me", "version": 2}`)},
+		{Datatype: DataEnvVar, Groupid: DescrDefaultGroup, Fname: "env", Data: []byte("export PATH=\"/usr/bin:/bin\"\nGREETING='hello world'\n")},
+		part,
+	}
+}
+
+func TestParseEnvScript(t *testing.T) {
+	script := `#!/bin/sh
+export PATH="/usr/local/bin:/usr/bin"
+export LANG="${LANG:-C.UTF-8}"
+A='it'\''s'
+B=plain trailing
+# C=commented
+`
+	want := []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8", "A=it's", "B=plain"}
+	if got := parseEnvScript(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExportOCI(t *testing.T) {
+	files := map[string]string{
+		"/.singularity.d/runscript": "#!/bin/sh\nexec echo hi\n",
+		"/etc/hello":                "hello\n",
+	}
+	fimg, cleanup := testContainer(t, testSquashInputs(t, files))
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "sifweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layout := filepath.Join(dir, "layout")
+	for _, ref := range []string{"test", "test:latest", "other:1"} {
+		if err := fimg.ExportOCI(context.Background(), layout, ref, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := filepath.Join(dir, "docker.tar")
+	if err := fimg.ExportOCI(context.Background(), archive, "test", true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{layout, archive} {
+		t.Run(filepath.Base(p), func(t *testing.T) {
+			// "test" and "test:latest" are the same image, "other:1" another
+			if _, err := OpenOCI(p, "", "amd64"); p == layout && err == nil {
+				t.Error("opened the layout without a ref, want an error for two images")
+			}
+			img, err := OpenOCI(p, "test:latest", "amd64")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+
+			c := img.Config
+			if c.Architecture != "amd64" || c.OS != "linux" {
+				t.Errorf("got platform %s/%s", c.OS, c.Architecture)
+			}
+			if want := []string{"PATH=/usr/bin:/bin", "GREETING=hello world"}; !reflect.DeepEqual(c.Config.Env, want) {
+				t.Errorf("got env %q, want %q", c.Config.Env, want)
+			}
+			if want := []string{singularityRunscript}; !reflect.DeepEqual(c.Config.Cmd, want) {
+				t.Errorf("got cmd %q, want %q", c.Config.Cmd, want)
+			}
+			if want := map[string]string{"maintainer": "me", "version": "2"}; !reflect.DeepEqual(c.Config.Labels, want) {
+				t.Errorf("got labels %v, want %v", c.Config.Labels, want)
+			}
+
+			var buf seekBuffer
+			if _, _, err := img.WriteSquashFS(context.Background(), &buf, nil); err != nil {
+				t.Fatal(err)
+			}
+			sqfs, err := OpenSquashFS(bytes.NewReader(buf.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			inode, err := sqfs.Lookup("/etc/hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fr, err := sqfs.Open(inode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := ioutil.ReadAll(fr); string(data) != files["/etc/hello"] {
+				t.Errorf("got /etc/hello %q", data)
+			}
+		})
+	}
+}
+
+func TestExportOCINoPartition(t *testing.T) {
+	fimg, cleanup := testContainer(t, testSquashInputs(t, nil)[:3])
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "sifweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := fimg.ExportOCI(context.Background(), dir, "test", false, nil); err == nil {
+		t.Error("exported an image without a partition")
+	}
+}
@@ -7,7 +7,6 @@ package main
  
 import (
 	"fmt"
-	"regexp"
 	"time"
 )
 
@@ -39,12 +38,6 @@ func readableSize(size uint64) string {
 	return conversion
 }
 
-// Replace newlines with another character (e.g., <br>) 
-func replaceNewLine(input string, replacement string) string {
-	re := regexp.MustCompile(`\r?\n`)
-	return re.ReplaceAllString(input, replacement)
-}
-
 func addFileName(fileName string, s string) string {
 	s = fmt.Sprintln("File:    ", fileName) + s
 	return s
@@ -169,3 +162,46 @@ func messagetypeStr(mtype Messagetype) string {
 	}
 	return "Unknown message-type"
 }
+
+// FmtDescrList formats the output of a list of all active descriptors from a SIF file.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/fmt.go#L195
+func (fimg *FileImage) FmtDescrList() string {
+	s := fmt.Sprintf("%-4s %-8s %-8s %-26s %s\n", "ID", "|GROUP", "|LINK", "|SIF POSITION (start-end)", "|TYPE")
+	s += fmt.Sprintln("------------------------------------------------------------------------------")
+
+	for _, v := range fimg.DescrArr {
+		if !v.Used {
+			continue
+		}
+
+		s += fmt.Sprintf("%-4d ", v.ID)
+		if v.Groupid == DescrUnusedGroup {
+			s += fmt.Sprintf("|%-7s ", "NONE")
+		} else {
+			s += fmt.Sprintf("|%-7d ", v.Groupid&^DescrGroupMask)
+		}
+		if v.Link == DescrUnusedLink {
+			s += fmt.Sprintf("|%-7s ", "NONE")
+		} else if v.Link&DescrGroupMask == DescrGroupMask {
+			s += fmt.Sprintf("|%-3d (G) ", v.Link&^DescrGroupMask)
+		} else {
+			s += fmt.Sprintf("|%-7d ", v.Link)
+		}
+
+		fposbuf := fmt.Sprintf("|%d-%d ", v.Fileoff, v.Fileoff+v.Filelen-1)
+		s += fmt.Sprintf("%-26s ", fposbuf)
+
+		switch v.Datatype {
+		case DataPartition:
+			s += fmt.Sprintf("|%s", datatypeStr(v.Datatype))
+			if pinfo, err := parsePartition(v); err == nil {
+				s += fmt.Sprintf(" (%s/%s/%s)", pinfo.Fstype, pinfo.Parttype, pinfo.Arch)
+			}
+			s += "\n"
+		default:
+			s += fmt.Sprintf("|%s\n", datatypeStr(v.Datatype))
+		}
+	}
+
+	return s
+}
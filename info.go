@@ -0,0 +1,203 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ContainerInfo is the structured result of loading a SIF. It is handed
+// back to the host page (as a plain object) so that it can do the rendering.
+type ContainerInfo struct {
+	File        string           `json:"file"`
+	Header      *HeaderInfo      `json:"header"`
+	Descriptors []DescriptorInfo `json:"descriptors"`
+	Errors      []ErrorInfo      `json:"errors"`
+
+	errs []error // the errors behind Errors
+}
+
+// HeaderInfo is a friendly view of the SIF global header.
+type HeaderInfo struct {
+	Launch   string `json:"launch"`
+	Magic    string `json:"magic"`
+	Version  string `json:"version"`
+	Arch     string `json:"arch"`
+	ID       string `json:"id"`
+	Ctime    int64  `json:"ctime"`
+	Mtime    int64  `json:"mtime"`
+	Dfree    int64  `json:"dfree"`
+	Dtotal   int64  `json:"dtotal"`
+	Descroff int64  `json:"descroff"`
+	Descrlen int64  `json:"descrlen"`
+	Dataoff  int64  `json:"dataoff"`
+	Datalen  int64  `json:"datalen"`
+}
+
+// DescriptorInfo is a friendly view of a used data object descriptor. Only
+// one of Partition, Signature or Crypto is set, depending on the Datatype.
+type DescriptorInfo struct {
+	ID       uint32 `json:"id"`
+	Name     string `json:"name"`
+	Datatype string `json:"datatype"`
+	Groupid  uint32 `json:"groupid"`
+	Link     uint32 `json:"link"`
+	Fileoff  int64  `json:"fileoff"`
+	Filelen  int64  `json:"filelen"`
+	Storelen int64  `json:"storelen"`
+	Ctime    int64  `json:"ctime"`
+	Mtime    int64  `json:"mtime"`
+
+	Partition *PartitionInfo `json:"partition,omitempty"`
+	Signature *SignatureInfo `json:"signature,omitempty"`
+	Crypto    *CryptoInfo    `json:"crypto,omitempty"`
+}
+
+// PartitionInfo holds the Extra fields of a DataPartition descriptor.
+type PartitionInfo struct {
+	Fstype   string `json:"fstype"`
+	Parttype string `json:"parttype"`
+	Arch     string `json:"arch"`
+}
+
+// SignatureInfo holds the Extra fields and content of a DataSignature descriptor.
+type SignatureInfo struct {
+	Hashtype string `json:"hashtype"`
+	Entity   string `json:"entity"`
+	Content  string `json:"content"`
+}
+
+// CryptoInfo holds the Extra fields and content of a DataCryptoMessage descriptor.
+type CryptoInfo struct {
+	Formattype  string `json:"formattype"`
+	Messagetype string `json:"messagetype"`
+	Content     string `json:"content"`
+}
+
+// headerInfo returns the loaded global header as a HeaderInfo
+func (fimg *FileImage) headerInfo() *HeaderInfo {
+	return &HeaderInfo{
+		Launch:   trimZeroBytes(fimg.Header.Launch[:]),
+		Magic:    trimZeroBytes(fimg.Header.Magic[:]),
+		Version:  trimZeroBytes(fimg.Header.Version[:]),
+		Arch:     GetGoArch(trimZeroBytes(fimg.Header.Arch[:])),
+		ID:       fimg.Header.ID.String(),
+		Ctime:    fimg.Header.Ctime,
+		Mtime:    fimg.Header.Mtime,
+		Dfree:    fimg.Header.Dfree,
+		Dtotal:   fimg.Header.Dtotal,
+		Descroff: fimg.Header.Descroff,
+		Descrlen: fimg.Header.Descrlen,
+		Dataoff:  fimg.Header.Dataoff,
+		Datalen:  fimg.Header.Datalen,
+	}
+}
+
+// descriptorInfo returns the common fields of a descriptor as a DescriptorInfo
+func descriptorInfo(v Descriptor) DescriptorInfo {
+	return DescriptorInfo{
+		ID:       v.ID,
+		Name:     strings.TrimRight(string(v.Name[:]), "\000"),
+		Datatype: datatypeStr(v.Datatype),
+		Groupid:  v.Groupid,
+		Link:     v.Link,
+		Fileoff:  v.Fileoff,
+		Filelen:  v.Filelen,
+		Storelen: v.Storelen,
+		Ctime:    v.Ctime,
+		Mtime:    v.Mtime,
+	}
+}
+
+// Parse the data partition Extra bytes into a PartitionInfo
+func parsePartition(v Descriptor) (*PartitionInfo, error) {
+	var pinfo Partition
+
+	b := bytes.NewReader(v.Extra[:])
+	if err := binary.Read(b, binary.LittleEndian, &pinfo); err != nil {
+		return nil, readError(ErrBadDescriptor, v.Fileoff, descriptorContext(v), err, "partition extra info")
+	}
+
+	return &PartitionInfo{
+		Fstype:   fstypeStr(pinfo.Fstype),
+		Parttype: parttypeStr(pinfo.Parttype),
+		Arch:     GetGoArch(trimZeroBytes(pinfo.Arch[:])),
+	}, nil
+}
+
+// parse the Signature Extra bytes and content into a SignatureInfo
+func (fimg *FileImage) parseSignature(v Descriptor) (*SignatureInfo, error) {
+	var sinfo Signature
+
+	b := bytes.NewReader(v.Extra[:])
+	if err := binary.Read(b, binary.LittleEndian, &sinfo); err != nil {
+		return nil, readError(ErrBadDescriptor, v.Fileoff, descriptorContext(v), err, "signature extra info")
+	}
+
+	content, err := fimg.readDescriptorContent(v.Fileoff, v.Filelen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignatureInfo{
+		Hashtype: hashtypeStr(sinfo.Hashtype),
+		Entity:   fmt.Sprintf("%0X", sinfo.Entity[:20]),
+		Content:  content,
+	}, nil
+}
+
+// parseCryptoMessage Extra bytes and content into a CryptoInfo
+func (fimg *FileImage) parseCryptoMessage(v Descriptor) (*CryptoInfo, error) {
+	var cinfo CryptoMessage
+
+	b := bytes.NewReader(v.Extra[:])
+	if err := binary.Read(b, binary.LittleEndian, &cinfo); err != nil {
+		return nil, readError(ErrBadDescriptor, v.Fileoff, descriptorContext(v), err, "crypto message extra info")
+	}
+
+	content, err := fimg.readDescriptorContent(v.Fileoff, v.Filelen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CryptoInfo{
+		Formattype:  formattypeStr(cinfo.Formattype),
+		Messagetype: messagetypeStr(cinfo.Messagetype),
+		Content:     content,
+	}, nil
+}
+
+// FileInfo is a friendly view of a file in a squashfs partition.
+type FileInfo struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Mode   string `json:"mode"`
+	IsDir  bool   `json:"isDir"`
+	Size   int64  `json:"size"`
+	UID    uint32 `json:"uid"`
+	GID    uint32 `json:"gid"`
+	Mtime  int64  `json:"mtime"`
+	Target string `json:"target,omitempty"`
+}
+
+// fileInfo returns the FileInfo for the inode found at p
+func fileInfo(p string, inode *SquashInode) FileInfo {
+	return FileInfo{
+		Name:   path.Base(p),
+		Path:   p,
+		Mode:   inode.Mode.String(),
+		IsDir:  inode.IsDir(),
+		Size:   inode.Size,
+		UID:    inode.UID,
+		GID:    inode.GID,
+		Mtime:  inode.Mtime,
+		Target: inode.Target,
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InventoryEntry describes an image found in a directory: what its header
+// and descriptors say, and what lint found. Partitions are never read.
+// Error is set instead if the image could not be loaded.
+type InventoryEntry struct {
+	Path       string     `json:"path"`
+	ID         string     `json:"id"`
+	Arch       string     `json:"arch"`
+	Ctime      int64      `json:"ctime"`
+	Mtime      int64      `json:"mtime"`
+	Size       int64      `json:"size"`
+	Partitions int        `json:"partitions"`
+	Signed     bool       `json:"signed"`
+	Encrypted  bool       `json:"encrypted"`
+	PrimaryFs  string     `json:"primaryFs"`
+	Errors     int        `json:"errors"`
+	Warnings   int        `json:"warnings"`
+	Findings   []Finding  `json:"findings"`
+	Error      *ErrorInfo `json:"error,omitempty"`
+}
+
+// walkFiles returns the regular files under dir, following links to files.
+// Files and directories that can't be read are passed to onError.
+func walkFiles(dir string, onError func(p string, err error)) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil && p == dir {
+			return err
+		}
+		if err != nil {
+			onError(p, err)
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			fi, err = os.Stat(p)
+			if err != nil {
+				return nil // a dangling link
+			}
+		}
+		if fi.Mode().IsRegular() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// parallel calls fn(i) for i from 0 to n-1, with up to workers calls at a
+// time, and stops early if ctx is canceled. done(i) is called after each,
+// one at a time.
+func parallel(ctx context.Context, n, workers int, fn func(i int), done func(i int)) error {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+				mu.Lock()
+				done(i)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ErrCanceled
+	}
+	return nil
+}
+
+// Inventory walks dir and inspects the images found, with up to workers at
+// a time. Files that are not SIFs are skipped, unless their name ends in
+// .sif: those are listed with the error, like directories that could not
+// be read. Progress is reported in files.
+func Inventory(ctx context.Context, dir string, workers int, fn ProgressFunc) ([]InventoryEntry, error) {
+	result := []InventoryEntry{}
+	files, err := walkFiles(dir, func(p string, err error) {
+		info := errorInfo(err)
+		result = append(result, InventoryEntry{Path: p, Findings: []Finding{}, Error: &info})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*InventoryEntry, len(files))
+	p := newProgress(ctx, int64(len(files)), fn)
+	err = parallel(ctx, len(files), workers, func(i int) {
+		entries[i] = inventoryEntry(files[i])
+	}, func(int) { p.add(1) })
+	p.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e != nil {
+			result = append(result, *e)
+		}
+	}
+	return result, nil
+}
+
+// inventoryEntry inspects the image at p, or returns nil for a file that
+// is not a SIF.
+func inventoryEntry(p string) *InventoryEntry {
+	entry := &InventoryEntry{Path: p, Findings: []Finding{}}
+	fimg, err := LoadContainer(p, true)
+	if err != nil {
+		if (errors.Is(err, ErrBadMagic) || errors.Is(err, ErrTruncated)) && !strings.EqualFold(filepath.Ext(p), ".sif") {
+			return nil
+		}
+		info := errorInfo(err)
+		entry.Error = &info
+		if fi, err := os.Stat(p); err == nil {
+			entry.Size = fi.Size()
+		}
+		return entry
+	}
+	defer fimg.UnloadContainer()
+
+	h := fimg.headerInfo()
+	entry.ID, entry.Arch, entry.Ctime, entry.Mtime, entry.Size = h.ID, h.Arch, h.Ctime, h.Mtime, fimg.Filesize
+	for _, v := range fimg.DescrArr {
+		if !v.Used {
+			continue
+		}
+		switch v.Datatype {
+		case DataSignature:
+			entry.Signed = true
+		case DataCryptoMessage:
+			entry.Encrypted = true
+		case DataPartition:
+			entry.Partitions++
+			part, err := v.getPartition()
+			if err != nil || part.Parttype != PartPrimSys || entry.PrimaryFs != "" {
+				continue
+			}
+			entry.PrimaryFs = fstypeStr(part.Fstype)
+			if part.Fstype == FsEncryptedSquashfs {
+				entry.Encrypted = true
+			}
+		}
+	}
+
+	entry.Findings = fimg.Lint()
+	if entry.Findings == nil {
+		entry.Findings = []Finding{}
+	}
+	for _, f := range entry.Findings {
+		if f.Severity == SeverityError {
+			entry.Errors++
+		} else {
+			entry.Warnings++
+		}
+	}
+	return entry
+}
+
+// inventoryColumns are the columns of the CSV inventory.
+var inventoryColumns = []string{"path", "id", "arch", "ctime", "mtime", "size", "partitions",
+	"signed", "encrypted", "primary_fs", "errors", "warnings", "findings", "error"}
+
+// WriteInventoryCSV writes the inventory as CSV, with a header line. Times
+// are in RFC 3339, and the findings are joined in one column.
+func WriteInventoryCSV(w io.Writer, entries []InventoryEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write(inventoryColumns)
+	for _, e := range entries {
+		var findings []string
+		for _, f := range e.Findings {
+			findings = append(findings, fmt.Sprintf("%s: %s at offset %d: %s", f.Severity, f.Check, f.Offset, f.Message))
+		}
+		errMessage := ""
+		if e.Error != nil {
+			errMessage = e.Error.Message
+		}
+		timeStr := func(t int64) string {
+			if e.Error != nil {
+				return ""
+			}
+			return time.Unix(t, 0).UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			e.Path, e.ID, e.Arch, timeStr(e.Ctime), timeStr(e.Mtime),
+			strconv.FormatInt(e.Size, 10), strconv.Itoa(e.Partitions),
+			strconv.FormatBool(e.Signed), strconv.FormatBool(e.Encrypted), e.PrimaryFs,
+			strconv.Itoa(e.Errors), strconv.Itoa(e.Warnings), strings.Join(findings, "; "), errMessage,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles writes files, by path relative to dir, and their directories.
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInventory(t *testing.T) {
+	image := testImage(t)
+	fimg, _, cleanup := testSigned(t)
+	signed, err := ioutil.ReadFile(fimg.Fp.Name())
+	cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "sifweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string][]byte{
+		"a/clean.sif":   image,
+		"a/b/signed":    signed,
+		"warn.sif":      editImage(t, image, func(h *Header, d []Descriptor) { h.Dfree++ }),
+		"broken.sif":    image[:100],
+		"notes.txt":     []byte("notes\n"),
+		"truncated.img": image[:100],
+	})
+	for link, target := range map[string]string{"link.sif": "a/clean.sif", "dangling.sif": "missing"} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := Inventory(context.Background(), dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		path             string
+		arch             string
+		partitions       int
+		signed           bool
+		primaryFs        string
+		errors, warnings int
+		failed           bool
+	}
+	var got []summary
+	for _, e := range entries {
+		rel, _ := filepath.Rel(dir, e.Path)
+		got = append(got, summary{filepath.ToSlash(rel), e.Arch, e.Partitions, e.Signed, e.PrimaryFs, e.Errors, e.Warnings, e.Error != nil})
+	}
+	want := []summary{
+		{"a/b/signed", "amd64", 1, true, "Squashfs", 0, 0, false},
+		{"a/clean.sif", "amd64", 1, false, "Squashfs", 0, 0, false},
+		{"broken.sif", "", 0, false, "", 0, 0, true},
+		{"link.sif", "amd64", 1, false, "Squashfs", 0, 0, false},
+		{"warn.sif", "amd64", 1, false, "Squashfs", 0, 1, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteInventoryCSV(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(entries)+1 || !reflect.DeepEqual(records[0], inventoryColumns) {
+		t.Fatalf("got %d records, header %q", len(records), records[0])
+	}
+	if r := records[3]; r[0] != entries[2].Path || r[3] != "" || r[len(r)-1] == "" {
+		t.Errorf("broken.sif: got %q, want no times and an error", r)
+	}
+	if r := records[5]; r[10] != "0" || r[11] != "1" || r[12] == "" {
+		t.Errorf("warn.sif: got %q, want a warning", r)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Inventory(ctx, dir, 1, nil); err != ErrCanceled {
+		t.Errorf("got %v, want ErrCanceled", err)
+	}
+	if _, err := Inventory(context.Background(), filepath.Join(dir, "missing"), 1, nil); err == nil {
+		t.Error("no error for a missing directory")
+	}
+}
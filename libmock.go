@@ -0,0 +1,270 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LibraryMock serves the read-only part of the Library API from a directory
+// laid out as entity/collection/container/tag.sif, for testing offline.
+// Tags that are links to the same file are the same image; the arch of
+// each image is read from its header. IDs are made up from the paths.
+type LibraryMock struct {
+	entities    map[string]*LibraryEntity
+	collections map[string]*LibraryCollection
+	containers  map[string]*LibraryContainer
+	images      map[string]*LibraryImage
+	files       map[string]string // image ID to file
+}
+
+// mockID makes up a library-like ID (24 hex digits) for name.
+func mockID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:12])
+}
+
+// NewLibraryMock indexes the images of dir.
+func NewLibraryMock(dir string) (*LibraryMock, error) {
+	m := &LibraryMock{
+		entities:    make(map[string]*LibraryEntity),
+		collections: make(map[string]*LibraryCollection),
+		containers:  make(map[string]*LibraryContainer),
+		images:      make(map[string]*LibraryImage),
+		files:       make(map[string]string),
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*", "*", "*.sif"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		rel, _ := filepath.Rel(dir, file)
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if err := m.add(file, parts[0], parts[1], parts[2], strings.TrimSuffix(parts[3], ".sif")); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// add adds the image in file as entity/collection/container:tag.
+func (m *LibraryMock) add(file, entity, collection, container, tag string) error {
+	e := m.entities[entity]
+	if e == nil {
+		e = &LibraryEntity{ID: mockID(entity), Name: entity, Collections: []string{}}
+		m.entities[entity] = e
+	}
+	colRef := entity + "/" + collection
+	col := m.collections[colRef]
+	if col == nil {
+		col = &LibraryCollection{ID: mockID(colRef), Name: collection, Entity: e.ID, EntityName: entity, Containers: []string{}}
+		m.collections[colRef] = col
+		e.Collections = append(e.Collections, col.ID)
+	}
+	ctRef := colRef + "/" + container
+	ct := m.containers[ctRef]
+	if ct == nil {
+		ct = &LibraryContainer{
+			ID:             mockID(ctRef),
+			Name:           container,
+			Collection:     col.ID,
+			EntityName:     entity,
+			CollectionName: collection,
+			Images:         []string{},
+			ImageTags:      map[string]string{},
+			ArchTags:       map[string]map[string]string{},
+		}
+		m.containers[ctRef] = ct
+		col.Containers = append(col.Containers, ct.ID)
+	}
+
+	fimg, err := LoadContainer(file, true)
+	if err != nil {
+		return err
+	}
+	arch := fimg.headerInfo().Arch
+	fi, err := fimg.Fp.(*os.File).Stat()
+	if err != nil {
+		fimg.UnloadContainer()
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(fimg.Reader, 0, fimg.Filesize))
+	fimg.UnloadContainer()
+	if err != nil {
+		return err
+	}
+	hash := "sha256." + hex.EncodeToString(h.Sum(nil))
+
+	id := mockID(ctRef + "@" + hash)
+	if m.images[id] == nil {
+		m.images[id] = &LibraryImage{
+			ID:             id,
+			Hash:           hash,
+			Container:      ct.ID,
+			EntityName:     entity,
+			CollectionName: collection,
+			ContainerName:  container,
+			Arch:           arch,
+			Size:           fi.Size(),
+			Uploaded:       true,
+			CreatedAt:      fi.ModTime().UTC(),
+		}
+		m.files[id] = file
+		ct.Images = append(ct.Images, id)
+		ct.Size += fi.Size()
+		col.Size += fi.Size()
+		e.Size += fi.Size()
+	}
+	if ct.ArchTags[arch] == nil {
+		ct.ArchTags[arch] = map[string]string{}
+	}
+	ct.ArchTags[arch][tag] = id
+	if arch == "amd64" {
+		ct.ImageTags[tag] = id
+	}
+	return nil
+}
+
+// image finds the image of ref ("entity/collection/container:tag", the tag
+// possibly a hash) for arch (amd64 by default), or by ID.
+func (m *LibraryMock) image(ref, arch string) *LibraryImage {
+	if img := m.images[ref]; img != nil {
+		return img
+	}
+	i := strings.LastIndex(ref, ":")
+	if i < 0 {
+		return nil
+	}
+	ct := m.containers[ref[:i]]
+	if ct == nil {
+		return nil
+	}
+	tag := ref[i+1:]
+	if strings.HasPrefix(tag, "sha256.") {
+		for _, id := range ct.Images {
+			if img := m.images[id]; img.Hash == tag && (arch == "" || img.Arch == arch) {
+				return img
+			}
+		}
+		return nil
+	}
+	if arch == "" {
+		arch = "amd64"
+	}
+	return m.images[ct.ArchTags[arch][tag]]
+}
+
+// ServeHTTP answers GET /version and /v1/{entities,collections,containers,
+// images,imagefile}/{ref}, where ref is an ID or a path.
+func (m *LibraryMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Accept-Ranges")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Range")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		m.error(w, http.StatusMethodNotAllowed, "the mock library is read-only")
+		return
+	}
+	if r.URL.Path == "/version" {
+		m.data(w, map[string]string{"version": "sifweb-mock", "apiVersion": "2.0.0"})
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/"), "/", 2)
+	if len(parts) != 2 || !strings.HasPrefix(r.URL.Path, "/v1/") {
+		m.error(w, http.StatusNotFound, "no such endpoint")
+		return
+	}
+	kind, ref := parts[0], parts[1]
+	arch := r.URL.Query().Get("arch")
+
+	var found interface{}
+	switch kind {
+	case "entities":
+		if e := m.entities[ref]; e != nil {
+			found = e
+		}
+		for _, e := range m.entities {
+			if e.ID == ref {
+				found = e
+			}
+		}
+	case "collections":
+		if col := m.collections[ref]; col != nil {
+			found = col
+		}
+		for _, col := range m.collections {
+			if col.ID == ref {
+				found = col
+			}
+		}
+	case "containers":
+		if ct := m.containers[ref]; ct != nil {
+			found = ct
+		}
+		for _, ct := range m.containers {
+			if ct.ID == ref {
+				found = ct
+			}
+		}
+	case "images":
+		if img := m.image(ref, arch); img != nil {
+			found = img
+		}
+	case "imagefile":
+		img := m.image(ref, arch)
+		if img == nil {
+			break
+		}
+		f, err := os.Open(m.files[img.ID])
+		if err != nil {
+			m.error(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, img.ContainerName+".sif", img.CreatedAt, f)
+		return
+	default:
+		m.error(w, http.StatusNotFound, "no such endpoint")
+		return
+	}
+	if found == nil {
+		m.error(w, http.StatusNotFound, fmt.Sprintf("%s not found", ref))
+		return
+	}
+	m.data(w, found)
+}
+
+// data answers {"data": v}.
+func (m *LibraryMock) data(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": v})
+}
+
+// error answers {"error": {code, status, message}}.
+func (m *LibraryMock) error(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]*LibraryError{"error": {code, http.StatusText(code), message}})
+}
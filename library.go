@@ -0,0 +1,496 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A client for the Library API of Singularity (v1), as served by the
+// Sylabs Cloud and self-hosted library servers: entities hold collections,
+// which hold containers, whose tags point to images for each arch.
+// https://github.com/sylabs/scs-library-client
+
+// DefaultLibraryURL is the library used when none is given.
+const DefaultLibraryURL = "https://library.sylabs.io"
+
+// LibraryEntity is an entity (a user or organization) of the library.
+type LibraryEntity struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Collections []string `json:"collections"`
+	Size        int64    `json:"size"`
+}
+
+// LibraryCollection is a collection of containers.
+type LibraryCollection struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Entity      string   `json:"entity"`
+	EntityName  string   `json:"entityName"`
+	Containers  []string `json:"containers"`
+	Size        int64    `json:"size"`
+	Private     bool     `json:"private"`
+}
+
+// LibraryContainer is a container, with the image ID of each tag, per arch
+// in ArchTags (ImageTags is the older, amd64 only map).
+type LibraryContainer struct {
+	ID             string                       `json:"id"`
+	Name           string                       `json:"name"`
+	Description    string                       `json:"description"`
+	Collection     string                       `json:"collection"`
+	EntityName     string                       `json:"entityName"`
+	CollectionName string                       `json:"collectionName"`
+	Images         []string                     `json:"images"`
+	ImageTags      map[string]string            `json:"imageTags"`
+	ArchTags       map[string]map[string]string `json:"archTags"`
+	Size           int64                        `json:"size"`
+	DownloadCount  int64                        `json:"downloadCount"`
+}
+
+// LibraryImage is an image of a container. Hash is "sha256.<hex>" of the
+// SIF file.
+type LibraryImage struct {
+	ID             string    `json:"id"`
+	Hash           string    `json:"hash"`
+	Description    string    `json:"description"`
+	Container      string    `json:"container"`
+	EntityName     string    `json:"entityName"`
+	CollectionName string    `json:"collectionName"`
+	ContainerName  string    `json:"containerName"`
+	Arch           string    `json:"arch"`
+	Size           int64     `json:"size"`
+	Uploaded       bool      `json:"uploaded"`
+	Signed         *bool     `json:"signed,omitempty"`
+	Encrypted      bool      `json:"encrypted"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// LibraryError is an error answered by the library.
+type LibraryError struct {
+	Code    int    `json:"code"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+func (e *LibraryError) Error() string {
+	return fmt.Sprintf("library: %d %s", e.Code, e.Message)
+}
+
+// Is makes a 404 from the library match os.ErrNotExist.
+func (e *LibraryError) Is(target error) bool {
+	return target == os.ErrNotExist && e.Code == http.StatusNotFound
+}
+
+// LibraryRef is a parsed library:// reference, as far as it goes: an
+// entity, a collection, a container, or an image of a container with a
+// tag (or "sha256.<hex>" hash).
+type LibraryRef struct {
+	Entity     string
+	Collection string
+	Container  string
+	Tag        string
+}
+
+// ParseLibraryRef parses "library://entity/collection/container:tag", or
+// a part of it. A lone container with a tag is in library/default, as in
+// Singularity.
+func ParseLibraryRef(s string) (LibraryRef, error) {
+	var ref LibraryRef
+	s = strings.Trim(strings.TrimPrefix(s, "library://"), "/")
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		s, ref.Tag = s[:i], s[i+1:]
+		if ref.Tag == "" {
+			return ref, fmt.Errorf("library reference %q: empty tag", s)
+		}
+	}
+	parts := strings.Split(s, "/")
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return ref, fmt.Errorf("library reference %q: bad path", s)
+		}
+	}
+
+	switch {
+	case len(parts) == 1 && ref.Tag != "":
+		ref.Entity, ref.Collection, ref.Container = "library", "default", parts[0]
+	case len(parts) == 1:
+		ref.Entity = parts[0]
+	case len(parts) == 2 && ref.Tag == "":
+		ref.Entity, ref.Collection = parts[0], parts[1]
+	case len(parts) == 3:
+		ref.Entity, ref.Collection, ref.Container = parts[0], parts[1], parts[2]
+	default:
+		return ref, fmt.Errorf("library reference %q: expected entity[/collection[/container[:tag]]]", s)
+	}
+	return ref, nil
+}
+
+// String returns the reference without the library:// prefix.
+func (r LibraryRef) String() string {
+	s := strings.Join(r.path(), "/")
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	return s
+}
+
+// path returns the parts of the reference that are set.
+func (r LibraryRef) path() []string {
+	var parts []string
+	for _, p := range []string{r.Entity, r.Collection, r.Container} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// Image returns the reference of an image: like Singularity, a lone name
+// is a container of library/default, and the tag defaults to latest.
+func (r LibraryRef) Image() (string, error) {
+	if r.Collection == "" {
+		r.Entity, r.Collection, r.Container = "library", "default", r.Entity
+	}
+	if r.Container == "" {
+		return "", fmt.Errorf("library reference %q is a collection, not an image", r)
+	}
+	if r.Tag == "" {
+		r.Tag = "latest"
+	}
+	return r.String(), nil
+}
+
+// LibraryClient talks to a library server.
+type LibraryClient struct {
+	BaseURL string
+	Token   string // bearer token, for private entries
+	HTTP    *http.Client
+}
+
+// NewLibraryClient returns a client of the library at baseURL (the
+// default library if empty).
+func NewLibraryClient(baseURL, token string) *LibraryClient {
+	if baseURL == "" {
+		baseURL = DefaultLibraryURL
+	}
+	return &LibraryClient{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token, HTTP: http.DefaultClient}
+}
+
+// url returns the URL of an API path, with the arch as query if set.
+func (c *LibraryClient) url(kind, ref, arch string) string {
+	u := c.BaseURL + "/v1/" + kind + "/" + ref
+	if arch != "" {
+		u += "?arch=" + url.QueryEscape(arch)
+	}
+	return u
+}
+
+// get sends a GET request, and checks the answer is a success.
+func (c *LibraryClient) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Error *LibraryError `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) != nil || body.Error == nil {
+		body.Error = &LibraryError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	if body.Error.Code == 0 {
+		body.Error.Code = resp.StatusCode
+	}
+	if body.Error.Message == "" {
+		body.Error.Message = http.StatusText(resp.StatusCode)
+	}
+	return nil, fmt.Errorf("%s: %w", u, body.Error)
+}
+
+// getJSON gets an API object, answered as {"data": ...}.
+func (c *LibraryClient) getJSON(ctx context.Context, kind, ref, arch string, v interface{}) error {
+	resp, err := c.get(ctx, c.url(kind, ref, arch))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body := struct {
+		Data interface{} `json:"data"`
+	}{v}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("%s: %s", c.url(kind, ref, arch), err)
+	}
+	return nil
+}
+
+// Entity gets an entity by name or ID.
+func (c *LibraryClient) Entity(ctx context.Context, ref string) (*LibraryEntity, error) {
+	var e LibraryEntity
+	return &e, c.getJSON(ctx, "entities", ref, "", &e)
+}
+
+// Collection gets a collection by "entity/collection" or ID.
+func (c *LibraryClient) Collection(ctx context.Context, ref string) (*LibraryCollection, error) {
+	var col LibraryCollection
+	return &col, c.getJSON(ctx, "collections", ref, "", &col)
+}
+
+// Container gets a container by "entity/collection/container" or ID.
+func (c *LibraryClient) Container(ctx context.Context, ref string) (*LibraryContainer, error) {
+	var ct LibraryContainer
+	return &ct, c.getJSON(ctx, "containers", ref, "", &ct)
+}
+
+// Image gets the image of "entity/collection/container:tag" for arch, or
+// an image by ID. The tag can be a "sha256.<hex>" hash.
+func (c *LibraryClient) Image(ctx context.Context, ref, arch string) (*LibraryImage, error) {
+	var img LibraryImage
+	return &img, c.getJSON(ctx, "images", ref, arch, &img)
+}
+
+// ImageURL returns the download URL of an image.
+func (c *LibraryClient) ImageURL(ref, arch string) string {
+	return c.url("imagefile", ref, arch)
+}
+
+// Download copies the SIF of an image to w, and checks it against the
+// hash of the image. Progress is reported in bytes.
+func (c *LibraryClient) Download(ctx context.Context, w io.Writer, ref, arch string, fn ProgressFunc) (*LibraryImage, error) {
+	img, err := c.Image(ctx, ref, arch)
+	if err != nil {
+		return nil, err
+	}
+	if !img.Uploaded {
+		return img, fmt.Errorf("%s: the image was not uploaded", ref)
+	}
+	resp, err := c.get(ctx, c.ImageURL(ref, arch))
+	if err != nil {
+		return img, err
+	}
+	defer resp.Body.Close()
+
+	h := &hashWriter{Hash: sha256.New()}
+	p := newProgress(ctx, img.Size, fn)
+	_, err = copyProgress(io.MultiWriter(w, h), resp.Body, p)
+	p.finish()
+	if err != nil {
+		return img, err
+	}
+	if img.Size > 0 && h.n != img.Size {
+		return img, fmt.Errorf("%s: %d bytes, the library says %d: %w", ref, h.n, img.Size, ErrDigestMismatch)
+	}
+	if strings.HasPrefix(img.Hash, "sha256.") {
+		if got := "sha256." + strings.TrimPrefix(h.digest(), "sha256:"); got != img.Hash {
+			return img, fmt.Errorf("%s: %s, the library says %s: %w", ref, got, img.Hash, ErrDigestMismatch)
+		}
+	}
+	return img, nil
+}
+
+// LibraryChild is an entry below the one browsed: a collection, a
+// container, or a tag with its image.
+type LibraryChild struct {
+	Name        string   `json:"name"`
+	Ref         string   `json:"ref"`
+	Description string   `json:"description,omitempty"`
+	Arch        []string `json:"arch,omitempty"`
+	Image       string   `json:"image,omitempty"`
+}
+
+// LibraryEntry is what a reference points to, with the entries below it.
+// Kind is "entity", "collection", "container" or "image"; for an image,
+// URL is where to download it.
+type LibraryEntry struct {
+	Ref        string             `json:"ref"`
+	Kind       string             `json:"kind"`
+	Entity     *LibraryEntity     `json:"entity,omitempty"`
+	Collection *LibraryCollection `json:"collection,omitempty"`
+	Container  *LibraryContainer  `json:"container,omitempty"`
+	Image      *LibraryImage      `json:"image,omitempty"`
+	Children   []LibraryChild     `json:"children"`
+	URL        string             `json:"url,omitempty"`
+}
+
+// Browse gets the entry of ref, and lists what is below it: the
+// collections of an entity, the containers of a collection, or the tags of
+// a container (for arch, or all of them if empty).
+func (c *LibraryClient) Browse(ctx context.Context, s, arch string) (*LibraryEntry, error) {
+	ref, err := ParseLibraryRef(s)
+	if err != nil {
+		return nil, err
+	}
+	entry := &LibraryEntry{Ref: ref.String(), Children: []LibraryChild{}}
+
+	switch {
+	case ref.Tag != "":
+		entry.Kind = "image"
+		if entry.Image, err = c.Image(ctx, ref.String(), arch); err != nil {
+			return nil, err
+		}
+		entry.URL = c.ImageURL(ref.String(), entry.Image.Arch)
+	case ref.Container != "":
+		entry.Kind = "container"
+		if entry.Container, err = c.Container(ctx, ref.String()); err != nil {
+			return nil, err
+		}
+		entry.Children = containerTags(ref, entry.Container, arch)
+	case ref.Collection != "":
+		entry.Kind = "collection"
+		if entry.Collection, err = c.Collection(ctx, ref.String()); err != nil {
+			return nil, err
+		}
+		for _, id := range entry.Collection.Containers {
+			ct, err := c.Container(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			entry.Children = append(entry.Children, LibraryChild{
+				Name:        ct.Name,
+				Ref:         ref.String() + "/" + ct.Name,
+				Description: ct.Description,
+			})
+		}
+	default:
+		entry.Kind = "entity"
+		if entry.Entity, err = c.Entity(ctx, ref.String()); err != nil {
+			return nil, err
+		}
+		for _, id := range entry.Entity.Collections {
+			col, err := c.Collection(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			entry.Children = append(entry.Children, LibraryChild{
+				Name:        col.Name,
+				Ref:         ref.String() + "/" + col.Name,
+				Description: col.Description,
+			})
+		}
+	}
+	sort.Slice(entry.Children, func(i, j int) bool { return entry.Children[i].Name < entry.Children[j].Name })
+	return entry, nil
+}
+
+// containerTags lists the tags of a container, with the arches they are
+// available for, and the image if there is only one.
+func containerTags(ref LibraryRef, ct *LibraryContainer, arch string) []LibraryChild {
+	tags := ct.ArchTags
+	if len(tags) == 0 && len(ct.ImageTags) > 0 {
+		tags = map[string]map[string]string{"amd64": ct.ImageTags}
+	}
+	byTag := map[string]*LibraryChild{}
+	for a, m := range tags {
+		if arch != "" && a != arch {
+			continue
+		}
+		for tag, id := range m {
+			child := byTag[tag]
+			if child == nil {
+				r := ref
+				r.Tag = tag
+				child = &LibraryChild{Name: tag, Ref: r.String(), Image: id}
+				byTag[tag] = child
+			} else if child.Image != id {
+				child.Image = ""
+			}
+			child.Arch = append(child.Arch, a)
+		}
+	}
+	children := []LibraryChild{}
+	for _, child := range byTag {
+		sort.Strings(child.Arch)
+		children = append(children, *child)
+	}
+	return children
+}
+
+// FmtEntry formats a browsed entry for the command line.
+func (e *LibraryEntry) FmtEntry() string {
+	var b strings.Builder
+	switch e.Kind {
+	case "entity":
+		fmt.Fprintf(&b, "Entity:      %s (%s)\n", e.Entity.Name, e.Entity.ID)
+		fmt.Fprintf(&b, "Size:        %d bytes\n", e.Entity.Size)
+	case "collection":
+		fmt.Fprintf(&b, "Collection:  %s (%s)\n", e.Ref, e.Collection.ID)
+		fmt.Fprintf(&b, "Size:        %d bytes\n", e.Collection.Size)
+	case "container":
+		fmt.Fprintf(&b, "Container:   %s (%s)\n", e.Ref, e.Container.ID)
+		fmt.Fprintf(&b, "Images:      %d, %d bytes\n", len(e.Container.Images), e.Container.Size)
+		fmt.Fprintf(&b, "Downloads:   %d\n", e.Container.DownloadCount)
+	case "image":
+		img := e.Image
+		signed := "unknown"
+		if img.Signed != nil {
+			signed = fmt.Sprint(*img.Signed)
+		}
+		fmt.Fprintf(&b, "Image:       %s (%s)\n", e.Ref, img.ID)
+		fmt.Fprintf(&b, "Hash:        %s\n", img.Hash)
+		fmt.Fprintf(&b, "Arch:        %s\n", img.Arch)
+		fmt.Fprintf(&b, "Size:        %d bytes\n", img.Size)
+		fmt.Fprintf(&b, "Signed:      %s\n", signed)
+		fmt.Fprintf(&b, "Encrypted:   %v\n", img.Encrypted)
+		fmt.Fprintf(&b, "Created:     %s\n", img.CreatedAt.Format(time.RFC3339))
+		fmt.Fprintf(&b, "Download:    %s\n", e.URL)
+	}
+
+	if d := e.description(); d != "" {
+		fmt.Fprintf(&b, "Description: %s\n", d)
+	}
+	if len(e.Children) == 0 {
+		return b.String()
+	}
+	b.WriteString("\n")
+	for _, c := range e.Children {
+		detail := c.Description
+		if len(c.Arch) > 0 {
+			detail = strings.Join(c.Arch, ",")
+		}
+		b.WriteString(strings.TrimRight(fmt.Sprintf("  %-30s %s", c.Ref, detail), " ") + "\n")
+	}
+	return b.String()
+}
+
+// description returns the description of what the entry points to.
+func (e *LibraryEntry) description() string {
+	switch {
+	case e.Entity != nil:
+		return e.Entity.Description
+	case e.Collection != nil:
+		return e.Collection.Description
+	case e.Container != nil:
+		return e.Container.Description
+	case e.Image != nil:
+		return e.Image.Description
+	}
+	return ""
+}
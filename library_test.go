@@ -0,0 +1,191 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLibraryRef(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  LibraryRef
+		image string
+	}{
+		{"library://alice", LibraryRef{Entity: "alice"}, "library/default/alice:latest"},
+		{"alice/tools", LibraryRef{Entity: "alice", Collection: "tools"}, ""},
+		{"alice/tools/lolcow", LibraryRef{"alice", "tools", "lolcow", ""}, "alice/tools/lolcow:latest"},
+		{"library://alice/tools/lolcow:1.0", LibraryRef{"alice", "tools", "lolcow", "1.0"}, "alice/tools/lolcow:1.0"},
+		{"lolcow:latest", LibraryRef{"library", "default", "lolcow", "latest"}, "library/default/lolcow:latest"},
+	}
+	for _, tt := range tests {
+		ref, err := ParseLibraryRef(tt.in)
+		if err != nil || ref != tt.want {
+			t.Errorf("ParseLibraryRef(%q) = %+v, %v; want %+v", tt.in, ref, err, tt.want)
+			continue
+		}
+		if image, err := ref.Image(); image != tt.image || (err == nil) != (tt.image != "") {
+			t.Errorf("%q: got image %q, %v; want %q", tt.in, image, err, tt.image)
+		}
+	}
+
+	for _, in := range []string{"alice/tools:1.0", "a/b/c/d", "alice//lolcow", "alice/../x", "lolcow:"} {
+		if ref, err := ParseLibraryRef(in); err == nil {
+			t.Errorf("ParseLibraryRef(%q) = %+v, want an error", in, ref)
+		}
+	}
+}
+
+// testLibrary serves a mock library of alice/tools/lolcow, with the tags
+// latest and 1.0 of the same amd64 image, and arm of an arm64 image.
+func testLibrary(t *testing.T, handler func(m *LibraryMock) http.Handler) (*LibraryClient, []byte, func()) {
+	dir, err := ioutil.TempDir("", "sifweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := func(err error) {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	container := filepath.Join(dir, "alice", "tools", "lolcow")
+	if err := os.MkdirAll(container, 0755); err != nil {
+		fail(err)
+	}
+
+	amd64, cleanup := testContainer(t, testInputs(t))
+	image, err := ioutil.ReadFile(amd64.Fp.Name())
+	cleanup()
+	if err != nil {
+		fail(err)
+	}
+	inputs := testInputs(t)
+	if err := inputs[2].SetPartExtra(FsSquash, PartPrimSys, GetSIFArch("arm64")); err != nil {
+		fail(err)
+	}
+	arm64, cleanup := testContainer(t, inputs)
+	armImage, err := ioutil.ReadFile(arm64.Fp.Name())
+	cleanup()
+	if err != nil {
+		fail(err)
+	}
+	for name, data := range map[string][]byte{"latest.sif": image, "arm.sif": armImage} {
+		if err := ioutil.WriteFile(filepath.Join(container, name), data, 0644); err != nil {
+			fail(err)
+		}
+	}
+	if err := os.Link(filepath.Join(container, "latest.sif"), filepath.Join(container, "1.0.sif")); err != nil {
+		fail(err)
+	}
+
+	m, err := NewLibraryMock(dir)
+	if err != nil {
+		fail(err)
+	}
+	var h http.Handler = m
+	if handler != nil {
+		h = handler(m)
+	}
+	ts := httptest.NewServer(h)
+	return NewLibraryClient(ts.URL+"/", "secret"), image, func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLibraryBrowse(t *testing.T) {
+	c, _, cleanup := testLibrary(t, nil)
+	defer cleanup()
+	ctx := context.Background()
+
+	children := func(e *LibraryEntry) []string {
+		var refs []string
+		for _, c := range e.Children {
+			refs = append(refs, c.Ref+" "+strings.Join(c.Arch, ","))
+		}
+		return refs
+	}
+	tests := []struct {
+		ref, arch, kind string
+		children        []string
+	}{
+		{"alice", "", "entity", []string{"alice/tools "}},
+		{"alice/tools", "", "collection", []string{"alice/tools/lolcow "}},
+		{"alice/tools/lolcow", "", "container", []string{"alice/tools/lolcow:1.0 amd64", "alice/tools/lolcow:arm arm64", "alice/tools/lolcow:latest amd64"}},
+		{"alice/tools/lolcow", "arm64", "container", []string{"alice/tools/lolcow:arm arm64"}},
+		{"alice/tools/lolcow:arm", "arm64", "image", nil},
+	}
+	for _, tt := range tests {
+		e, err := c.Browse(ctx, tt.ref, tt.arch)
+		if err != nil {
+			t.Errorf("%s: %v", tt.ref, err)
+			continue
+		}
+		if e.Kind != tt.kind || !reflect.DeepEqual(children(e), tt.children) {
+			t.Errorf("%s: got %s %q, want %s %q", tt.ref, e.Kind, children(e), tt.kind, tt.children)
+		}
+		if !strings.Contains(e.FmtEntry(), tt.ref) {
+			t.Errorf("%s: not in the formatted entry:\n%s", tt.ref, e.FmtEntry())
+		}
+	}
+
+	latest, err := c.Image(ctx, "alice/tools/lolcow:latest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, err := c.Image(ctx, "alice/tools/lolcow:"+latest.Hash, ""); err != nil || same.ID != latest.ID {
+		t.Errorf("by hash: got %+v, %v; want image %s", same, err, latest.ID)
+	}
+	for _, ref := range []string{"bob", "alice/tools/lolcow:arm", "alice/tools/lolcow:2.0"} {
+		if _, err := c.Browse(ctx, ref, ""); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: got %v, want os.ErrNotExist", ref, err)
+		}
+	}
+}
+
+func TestLibraryDownload(t *testing.T) {
+	var auth string
+	c, image, cleanup := testLibrary(t, func(m *LibraryMock) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+			if strings.HasPrefix(r.URL.Path, "/v1/imagefile/") && r.URL.Query().Get("arch") == "arm64" {
+				w.Write([]byte("not the image")) // and not the arm64 image either
+				return
+			}
+			m.ServeHTTP(w, r)
+		})
+	})
+	defer cleanup()
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	img, err := c.Download(ctx, &buf, "alice/tools/lolcow:1.0", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), image) || img.Arch != "amd64" || img.Size != int64(len(image)) {
+		t.Errorf("got image %+v, %d bytes", img, buf.Len())
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("got authorization %q", auth)
+	}
+
+	if _, err := c.Download(ctx, ioutil.Discard, "alice/tools/lolcow:arm", "arm64", nil); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("got %v, want ErrDigestMismatch", err)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Severities of lint findings. Errors are images that Singularity or the
+// SIF library would refuse or misread, warnings are inconsistencies they
+// tolerate.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Finding is a problem found by Lint, at an offset in the file.
+type Finding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"` // what was checked, e.g. "overlap"
+	Message  string `json:"message"`
+	Offset   int64  `json:"offset"`
+	Context  string `json:"context,omitempty"`
+}
+
+// Offsets of the global header fields, for findings.
+const (
+	hdrArchOff     = HdrLaunchLen + HdrMagicLen + HdrVersionLen
+	hdrDfreeOff    = 80
+	hdrDtotalOff   = 88
+	hdrDescroffOff = 96
+	hdrDescrlenOff = 104
+	hdrDataoffOff  = 112
+	hdrDatalenOff  = 120
+)
+
+// linter collects the findings of Lint.
+type linter struct {
+	fimg     *FileImage
+	findings []Finding
+}
+
+func (l *linter) add(severity, check string, offset int64, context, format string, a ...interface{}) {
+	l.findings = append(l.findings, Finding{
+		Severity: severity,
+		Check:    check,
+		Message:  fmt.Sprintf(format, a...),
+		Offset:   offset,
+		Context:  context,
+	})
+}
+
+// descriptorOffset returns where descriptor index is in the file.
+func (l *linter) descriptorOffset(index int) int64 {
+	return l.fimg.Header.Descroff + int64(index*binary.Size(Descriptor{}))
+}
+
+// checkHeader checks the header fields against each other and the file size.
+func (l *linter) checkHeader(used int64) {
+	h := l.fimg.Header
+	size := l.fimg.Filesize
+	headerSize := int64(binary.Size(h))
+	descrSize := int64(binary.Size(Descriptor{}))
+
+	if h.Descroff < headerSize {
+		l.add(SeverityError, "header", hdrDescroffOff, "global header",
+			"descriptors start at %d, inside the %d bytes header", h.Descroff, headerSize)
+	}
+	if end := h.Descroff + h.Dtotal*descrSize; end > h.Dataoff {
+		l.add(SeverityError, "header", hdrDataoffOff, "global header",
+			"data starts at %d, inside the descriptor table (%d to %d)", h.Dataoff, h.Descroff, end)
+	}
+	if h.Descrlen != used*descrSize && h.Descrlen != h.Dtotal*descrSize {
+		l.add(SeverityWarning, "header", hdrDescrlenOff, "global header",
+			"descrlen is %d, want %d for %d descriptors", h.Descrlen, h.Dtotal*descrSize, h.Dtotal)
+	}
+	if h.Dataoff > size {
+		l.add(SeverityError, "header", hdrDataoffOff, "global header",
+			"data starts at %d, after the end of the file (%d bytes)", h.Dataoff, size)
+	}
+	if h.Datalen < 0 || h.Dataoff > size-h.Datalen {
+		l.add(SeverityError, "header", hdrDatalenOff, "global header",
+			"data is %d bytes from %d, file is %d bytes", h.Datalen, h.Dataoff, size)
+	}
+	if h.Dfree != h.Dtotal-used {
+		l.add(SeverityWarning, "header", hdrDfreeOff, "global header",
+			"dfree is %d, but %d of %d descriptors are free", h.Dfree, h.Dtotal-used, h.Dtotal)
+	}
+	if h.Dtotal == 0 {
+		l.add(SeverityWarning, "header", hdrDtotalOff, "global header", "no descriptors")
+	}
+	if arch := trimZeroBytes(h.Arch[:]); arch != HdrArchUnknown && GetGoArch(arch) == "unknown" {
+		l.add(SeverityWarning, "enum", hdrArchOff, "global header", "unknown arch code %q", arch)
+	}
+}
+
+// checkExtra checks the enum values in the Extra field of a descriptor.
+func (l *linter) checkExtra(v Descriptor, offset int64) {
+	context := descriptorContext(v)
+	r := bytes.NewReader(v.Extra[:])
+	switch v.Datatype {
+	case DataPartition:
+		var p Partition
+		binary.Read(r, binary.LittleEndian, &p)
+		if p.Fstype < FsSquash || p.Fstype > FsEncryptedSquashfs {
+			l.add(SeverityWarning, "enum", offset, context, "unknown file system type %d", p.Fstype)
+		}
+		if p.Parttype < PartSystem || p.Parttype > PartOverlay {
+			l.add(SeverityWarning, "enum", offset, context, "unknown partition type %d", p.Parttype)
+		}
+		if arch := trimZeroBytes(p.Arch[:]); arch != HdrArchUnknown && GetGoArch(arch) == "unknown" {
+			l.add(SeverityWarning, "enum", offset, context, "unknown arch code %q", arch)
+		}
+	case DataSignature:
+		var s Signature
+		binary.Read(r, binary.LittleEndian, &s)
+		if s.Hashtype < HashSHA256 || s.Hashtype > HashBLAKE2B {
+			l.add(SeverityWarning, "enum", offset, context, "unknown hash type %d", s.Hashtype)
+		}
+	case DataCryptoMessage:
+		var c CryptoMessage
+		binary.Read(r, binary.LittleEndian, &c)
+		if c.Formattype != FormatOpenPGP && c.Formattype != FormatPEM {
+			l.add(SeverityWarning, "enum", offset, context, "unknown message format %d", c.Formattype)
+		}
+		if c.Messagetype != MessageClearSignature && c.Messagetype != MessageRSAOAEP {
+			l.add(SeverityWarning, "enum", offset, context, "unknown message type %#x", c.Messagetype)
+		}
+	}
+}
+
+// checkDescriptors checks each used descriptor, and the references
+// between them.
+func (l *linter) checkDescriptors() {
+	h := l.fimg.Header
+	ids := map[uint32]int{}
+	groups := map[uint32]bool{}
+	for i, v := range l.fimg.DescrArr {
+		if !v.Used {
+			continue
+		}
+		if first, ok := ids[v.ID]; ok {
+			l.add(SeverityError, "id", l.descriptorOffset(i), descriptorContext(v),
+				"ID %d is already used by table entry %d", v.ID, first)
+		} else {
+			ids[v.ID] = i
+		}
+		if v.Groupid != DescrUnusedGroup {
+			groups[v.Groupid] = true
+		}
+	}
+
+	var primaries []Descriptor
+	var dataEnd int64
+	for i, v := range l.fimg.DescrArr {
+		if !v.Used {
+			continue
+		}
+		offset, context := l.descriptorOffset(i), descriptorContext(v)
+
+		if v.ID == 0 {
+			l.add(SeverityError, "id", offset, context, "ID 0 is reserved for no link")
+		}
+		if v.Datatype < DataDeffile || v.Datatype > DataCryptoMessage {
+			l.add(SeverityError, "enum", offset, context, "unknown data type %#x", int32(v.Datatype))
+		}
+
+		// data
+		switch {
+		case v.Fileoff < h.Dataoff || v.Filelen < 0 || v.Fileoff > l.fimg.Filesize-v.Filelen:
+			l.add(SeverityError, "bounds", v.Fileoff, context,
+				"data is %d bytes at %d, outside of the data area (%d to %d)", v.Filelen, v.Fileoff, h.Dataoff, l.fimg.Filesize)
+		case v.Fileoff+v.Filelen > h.Dataoff+h.Datalen:
+			l.add(SeverityWarning, "bounds", v.Fileoff, context,
+				"data ends at %d, after datalen (%d from %d)", v.Fileoff+v.Filelen, h.Datalen, h.Dataoff)
+		}
+		if v.Fileoff+v.Filelen > dataEnd {
+			dataEnd = v.Fileoff + v.Filelen
+		}
+		if v.Storelen < v.Filelen {
+			l.add(SeverityError, "storelen", offset, context,
+				"storelen %d is less than the data length %d", v.Storelen, v.Filelen)
+		} else if start := v.Fileoff + v.Filelen - v.Storelen; start < h.Dataoff {
+			l.add(SeverityWarning, "storelen", offset, context,
+				"storelen %d reaches before the data area, to %d", v.Storelen, start)
+		}
+		if v.Datatype == DataPartition && v.Fileoff%defaultAlignment != 0 {
+			l.add(SeverityWarning, "alignment", v.Fileoff, context,
+				"partition at %d is not aligned to %d bytes", v.Fileoff, defaultAlignment)
+		}
+
+		// references
+		if v.Groupid != DescrUnusedGroup && v.Groupid&DescrGroupMask != DescrGroupMask {
+			l.add(SeverityWarning, "group", offset, context,
+				"group %#x does not have the group mask %#x set", v.Groupid, DescrGroupMask)
+		}
+		switch {
+		case v.Link == DescrUnusedLink:
+		case v.Link&DescrGroupMask == DescrGroupMask:
+			if !groups[v.Link] {
+				l.add(SeverityWarning, "link", offset, context, "linked to group %d, which has no objects", v.Link&^DescrGroupMask)
+			}
+		default:
+			if _, ok := ids[v.Link]; !ok {
+				severity := SeverityWarning
+				if v.Datatype == DataSignature || v.Datatype == DataCryptoMessage {
+					severity = SeverityError
+				}
+				l.add(severity, "link", offset, context, "linked to object %d, which does not exist", v.Link)
+			} else if v.Link == v.ID {
+				l.add(SeverityWarning, "link", offset, context, "linked to itself")
+			}
+		}
+
+		l.checkExtra(v, offset)
+		if v.Datatype == DataPartition {
+			if ptype, err := v.GetPartType(); err == nil && ptype == PartPrimSys {
+				primaries = append(primaries, v)
+			}
+		}
+	}
+
+	if dataEnd > 0 && dataEnd < h.Dataoff+h.Datalen {
+		l.add(SeverityWarning, "header", hdrDatalenOff, "global header",
+			"datalen %d goes past the last object, which ends at %d", h.Datalen, dataEnd)
+	}
+
+	// primary partition and arch
+	if len(primaries) > 1 {
+		for _, v := range primaries[1:] {
+			l.add(SeverityError, "primary", v.Fileoff, descriptorContext(v),
+				"another primary system partition, after descriptor %d", primaries[0].ID)
+		}
+	}
+	arch := trimZeroBytes(h.Arch[:])
+	if len(primaries) > 0 {
+		p, _ := primaries[0].getPartition()
+		if partArch := trimZeroBytes(p.Arch[:]); partArch != arch {
+			l.add(SeverityError, "arch", hdrArchOff, "global header",
+				"arch %s, but the primary partition is %s", GetGoArch(arch), GetGoArch(partArch))
+		}
+	} else if arch != HdrArchUnknown {
+		l.add(SeverityWarning, "arch", hdrArchOff, "global header",
+			"arch %s, but there is no primary partition", GetGoArch(arch))
+	}
+}
+
+// checkOverlaps reports objects whose data overlap.
+func (l *linter) checkOverlaps() {
+	var used []Descriptor
+	for _, v := range l.fimg.DescrArr {
+		if v.Used && v.Filelen > 0 {
+			used = append(used, v)
+		}
+	}
+	if len(used) == 0 {
+		return
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].Fileoff < used[j].Fileoff })
+	prev := used[0]
+
+	// compare each object with the one that goes furthest before it
+	for i := 1; i < len(used); i++ {
+		v, prevEnd := used[i], prev.Fileoff+prev.Filelen
+		if v.Fileoff < prevEnd {
+			l.add(SeverityError, "overlap", v.Fileoff, descriptorContext(v),
+				"data overlaps descriptor %d (%d to %d)", prev.ID, prev.Fileoff, prevEnd)
+		} else if start := v.Fileoff + v.Filelen - v.Storelen; v.Storelen >= v.Filelen && start < prevEnd {
+			l.add(SeverityWarning, "storelen", v.Fileoff, descriptorContext(v),
+				"storelen %d reaches into the data of descriptor %d, which ends at %d", v.Storelen, prev.ID, prevEnd)
+		}
+		if v.Fileoff+v.Filelen > prevEnd {
+			prev = v
+		}
+	}
+}
+
+// Lint reads the header and descriptors of the image and checks them in
+// depth: header fields against each other and the file size, descriptor
+// bounds, overlaps and alignment, unique IDs, links and groups, primary
+// partitions, arch and enum values. Problems that stop the reading are
+// returned as the only finding.
+func (fimg *FileImage) Lint() []Finding {
+	l := &linter{fimg: fimg}
+
+	for _, read := range []func() error{fimg.readHeader, fimg.isValidSif, fimg.readDescriptors} {
+		if err := read(); err != nil {
+			// the message already says what was being read
+			info := errorInfo(err)
+			l.add(SeverityError, info.Code, info.Offset, "", "%s", info.Message)
+			return l.findings
+		}
+	}
+
+	var used int64
+	for _, v := range fimg.DescrArr {
+		if v.Used {
+			used++
+		}
+	}
+	l.checkHeader(used)
+	l.checkDescriptors()
+	l.checkOverlaps()
+
+	sort.SliceStable(l.findings, func(i, j int) bool { return l.findings[i].Offset < l.findings[j].Offset })
+	return l.findings
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// testImage returns the bytes of a SIF of testInputs.
+func testImage(t *testing.T) []byte {
+	fimg, cleanup := testContainer(t, testInputs(t))
+	defer cleanup()
+	image, err := ioutil.ReadFile(fimg.Fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// editImage returns a copy of image with its header and descriptor table
+// changed by edit.
+func editImage(t *testing.T, image []byte, edit func(h *Header, descrs []Descriptor)) []byte {
+	var h Header
+	if err := binary.Read(bytes.NewReader(image), binary.LittleEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	descrs := make([]Descriptor, h.Dtotal)
+	if err := binary.Read(bytes.NewReader(image[h.Descroff:]), binary.LittleEndian, descrs); err != nil {
+		t.Fatal(err)
+	}
+	edit(&h, descrs)
+
+	var table bytes.Buffer
+	binary.Write(&table, binary.LittleEndian, h)
+	out := append(append([]byte(nil), table.Bytes()...), image[table.Len():]...)
+	table.Reset()
+	binary.Write(&table, binary.LittleEndian, descrs)
+	copy(out[h.Descroff:], table.Bytes())
+	return out
+}
+
+// lintBytes lints a SIF in memory.
+func lintBytes(image []byte) []Finding {
+	fimg := &FileImage{}
+	fimg.loadReader(bytes.NewReader(image), int64(len(image)))
+	return fimg.Lint()
+}
+
+func TestLint(t *testing.T) {
+	image := testImage(t)
+	descrSize := int64(binary.Size(Descriptor{}))
+
+	tests := []struct {
+		name     string
+		edit     func(h *Header, d []Descriptor)
+		severity string
+		check    string
+	}{
+		{"clean", func(h *Header, d []Descriptor) {}, "", ""},
+		{"descrlen of used descriptors", func(h *Header, d []Descriptor) { h.Descrlen = 3 * descrSize }, "", ""},
+		{"descrlen", func(h *Header, d []Descriptor) { h.Descrlen = 7 }, SeverityWarning, "header"},
+		{"dfree", func(h *Header, d []Descriptor) { h.Dfree++ }, SeverityWarning, "header"},
+		{"data inside the table", func(h *Header, d []Descriptor) { h.Dataoff = h.Descroff + 10 }, SeverityError, "header"},
+		{"duplicate ID", func(h *Header, d []Descriptor) { d[1].ID = d[0].ID }, SeverityError, "id"},
+		{"data type", func(h *Header, d []Descriptor) { d[1].Datatype = 0x1234 }, SeverityError, "enum"},
+		{"bounds", func(h *Header, d []Descriptor) { d[1].Filelen = 1 << 40 }, SeverityError, "bounds"},
+		{"overlap", func(h *Header, d []Descriptor) { d[1].Fileoff = d[0].Fileoff }, SeverityError, "overlap"},
+		{"storelen", func(h *Header, d []Descriptor) { d[2].Storelen = d[2].Filelen - 1 }, SeverityError, "storelen"},
+		{"alignment", func(h *Header, d []Descriptor) { d[2].Fileoff++; d[2].Filelen-- }, SeverityWarning, "alignment"},
+		{"group", func(h *Header, d []Descriptor) { d[0].Groupid = 5 }, SeverityWarning, "group"},
+		{"link", func(h *Header, d []Descriptor) { d[0].Link = 40 }, SeverityWarning, "link"},
+		{"arch", func(h *Header, d []Descriptor) { copy(h.Arch[:], HdrArchARM64) }, SeverityError, "arch"},
+		{"second primary", func(h *Header, d []Descriptor) { d[3] = d[2]; d[3].ID = 4 }, SeverityError, "primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := lintBytes(editImage(t, image, tt.edit))
+			if tt.check == "" {
+				if len(findings) > 0 {
+					t.Errorf("got findings %+v", findings)
+				}
+				return
+			}
+			for _, f := range findings {
+				if f.Severity == tt.severity && f.Check == tt.check {
+					return
+				}
+			}
+			t.Errorf("got findings %+v, want a %s %q", findings, tt.severity, tt.check)
+		})
+	}
+}
+
+func TestLintUnreadable(t *testing.T) {
+	findings := lintBytes(testImage(t)[:100])
+	if len(findings) != 1 || findings[0].Severity != SeverityError {
+		t.Errorf("got findings %+v, want a single error", findings)
+	}
+}
@@ -4,43 +4,80 @@
 // https://polyformproject.org/licenses/noncommercial/1.0.0
 
 package main
- 
+
 import (
-	"encoding/binary"
 	"bytes"
+	"encoding/binary"
 	"fmt"
-	"syscall/js"
-	"strings"
-	"time"
+	"io"
+	"os"
 )
 
+// LoadContainer opens the SIF at path and reads its global header and
+// descriptors. The file is opened read-write unless rdonly is set.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/load.go#L150
+func LoadContainer(path string, rdonly bool) (*FileImage, error) {
+	flag := os.O_RDWR
+	if rdonly {
+		flag = os.O_RDONLY
+	}
+
+	fp, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, readError(ErrIO, 0, path, err, "")
+	}
 
-// loadBytes loads an imageString from the browser and populates FileImage with data.
-func (fimg *FileImage) loadBytes(value js.Value, size int) error {
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, readError(ErrIO, 0, path, err, "")
+	}
 
-	// We can use CopyBytesToGo, need golang 1.13+
-	sif := make([]byte, size)
-	fmt.Println(value)
-	howmany := js.CopyBytesToGo(sif, value)
-	fmt.Println("Found", howmany, "bytes")
+	fimg := &FileImage{Fp: fp}
+	fimg.loadReader(fp, fi.Size())
 
-	// Read in the string to bytes, n should equal size
-	reader := bytes.NewReader(sif)
-        n, _ := reader.Read(sif)
+	if err := fimg.readHeader(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if err := fimg.isValidSif(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if err := fimg.readDescriptors(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return fimg, nil
+}
 
-	// Save the data and size to the FileImage
-	fimg.Filesize = int64(n)
-	fimg.Filedata = sif
-	fimg.Reader = bytes.NewReader(fimg.Filedata)
+// UnloadContainer closes the file opened by LoadContainer.
+func (fimg *FileImage) UnloadContainer() error {
+	if fimg.Fp == nil {
+		return nil
+	}
+	return fimg.Fp.Close()
+}
 
-	return nil
+// loadReader sets up the FileImage to read size bytes from r, which
+// may be an opened file or bytes loaded in the browser.
+func (fimg *FileImage) loadReader(r io.ReaderAt, size int64) {
+	fimg.Filesize = size
+	fimg.Reader = io.NewSectionReader(r, 0, size)
 }
 
 // Read the global header from the container file.
 // https://github.com/sylabs/sif/blob/master/pkg/sif/load.go#L20
 func (fimg *FileImage) readHeader() error {
+	if err := fimg.seek(0); err != nil {
+		return err
+	}
 	if err := binary.Read(fimg.Reader, binary.LittleEndian, &fimg.Header); err != nil {
-		return fmt.Errorf("reading global header from container file: %s", err)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return readError(ErrTruncated, 0, "global header", nil,
+				fmt.Sprintf("need %d bytes, file is %d bytes", binary.Size(fimg.Header), fimg.Filesize))
+		}
+		return readError(ErrIO, 0, "global header", err, "")
 	}
 	return nil
 }
@@ -49,225 +86,166 @@ func (fimg *FileImage) readHeader() error {
 func (fimg *FileImage) isValidSif() error {
 
 	// check various header fields
-	if trimZeroBytes(fimg.Header.Magic[:]) != HdrMagic {
-		return fmt.Errorf("invalid SIF file: Magic |%s| want |%s|", fimg.Header.Magic, HdrMagic)
+	if magic := trimZeroBytes(fimg.Header.Magic[:]); magic != HdrMagic {
+		return readError(ErrBadMagic, HdrLaunchLen, "global header", nil,
+			fmt.Sprintf("found %q, want %q", magic, HdrMagic))
 	}
-	if trimZeroBytes(fimg.Header.Version[:]) > HdrVersion {
-		return fmt.Errorf("invalid SIF file: Version %s want <= %s", fimg.Header.Version, HdrVersion)
+	if version := trimZeroBytes(fimg.Header.Version[:]); version > HdrVersion {
+		return readError(ErrUnsupportedVersion, HdrLaunchLen+HdrMagicLen, "global header", nil,
+			fmt.Sprintf("found %q, want <= %q", version, HdrVersion))
 	}
 
 	return nil
 }
 
-// Seek to a particular spot in the Reader, exit on error
+// Seek to a particular spot in the Reader
 func (fimg *FileImage) seek(offset int64) error {
-
-	_, err := fimg.Reader.Seek(offset, 0); 
-	if err != nil {
-		return fmt.Errorf("seek() to offset:%s %s", offset, err)
+	if _, err := fimg.Reader.Seek(offset, io.SeekStart); err != nil {
+		return readError(ErrIO, offset, "seek", err, "")
 	}
 	return nil
-
 }
 
-
 // Read descriptors from the SIF
 // https://github.com/sylabs/sif/blob/master/pkg/sif/load.go#L29
 func (fimg *FileImage) readDescriptors() error {
 
+	// Make sure the descriptor table is inside the file before reading it
+	size := int64(binary.Size(Descriptor{}))
+	if fimg.Header.Descroff < 0 || fimg.Header.Dtotal < 0 {
+		return readError(ErrDescriptorBounds, fimg.Header.Descroff, "descriptor table", nil,
+			fmt.Sprintf("descroff %d, dtotal %d", fimg.Header.Descroff, fimg.Header.Dtotal))
+	}
+	// (compared this way round, a huge dtotal can't overflow)
+	if fimg.Header.Descroff > fimg.Filesize || fimg.Header.Dtotal > (fimg.Filesize-fimg.Header.Descroff)/size {
+		return readError(ErrTruncated, fimg.Header.Descroff, "descriptor table", nil,
+			fmt.Sprintf("%d descriptors at %d don't fit in the file (%d bytes)", fimg.Header.Dtotal, fimg.Header.Descroff, fimg.Filesize))
+	}
 
-	fmt.Println("fimg.Header.Descroff", fimg.Header.Descroff)
-	fimg.seek(fimg.Header.Descroff)
+	if err := fimg.seek(fimg.Header.Descroff); err != nil {
+		return err
+	}
 
-	fmt.Println("fimg.Header.Dtotal", fimg.Header.Dtotal)
+	// Initialize descriptor array (slice) and read them all from file
+	fimg.DescrArr = make([]Descriptor, fimg.Header.Dtotal)
+	if err := binary.Read(fimg.Reader, binary.LittleEndian, &fimg.DescrArr); err != nil {
+		fimg.DescrArr = nil
+		return readError(ErrIO, fimg.Header.Descroff, "descriptor table", err, "")
+	}
 
 	descr, _, err := fimg.GetPartPrimSys()
 	if err == nil {
 		fimg.PrimPartID = descr.ID
 	}
 
-	fmt.Println("fimg.PrimPartID", fimg.PrimPartID)
+	return nil
+}
 
-	// Initialize descriptor array (slice) and read them all from file
-	// This seems to be too much for the browser	
-	fimg.DescrArr = make([]Descriptor, DescrNumEntries)// fimg.Header.Dtotal)
-	if err := binary.Read(fimg.Reader, binary.LittleEndian, &fimg.DescrArr); err != nil {
-		fimg.DescrArr = nil
-		return fmt.Errorf("reading descriptor array from container file: %s", err)
-	}
+// descriptorContext names a descriptor for error messages
+func descriptorContext(v Descriptor) string {
+	return fmt.Sprintf("descriptor %d (%s)", v.ID, trimZeroBytes(v.Name[:]))
+}
 
+// checkBounds makes sure the data of a descriptor is inside the file.
+func (fimg *FileImage) checkBounds(v Descriptor) error {
+	if v.Fileoff < 0 || v.Filelen < 0 || v.Fileoff > fimg.Filesize-v.Filelen {
+		return readError(ErrDescriptorBounds, v.Fileoff, descriptorContext(v), nil,
+			fmt.Sprintf("data is %d bytes at offset %d, file is %d bytes", v.Filelen, v.Fileoff, fimg.Filesize))
+	}
 	return nil
 }
 
-// getDescriptors in a human friendly map (strings) from the SIF
-// The keys are used to map the data to the web interface (div ids)
-func (fimg *FileImage) getDescriptors() map[string]string {
+// getDescriptors returns the used descriptors from the SIF in a friendly
+// format. Descriptors that fail to parse are skipped and reported as errors.
+func (fimg *FileImage) getDescriptors() ([]DescriptorInfo, []error) {
 
-	descriptors := make(map[string]string)
+	var descriptors []DescriptorInfo
+	var errs []error
 
 	for _, v := range fimg.DescrArr {
 		if !v.Used {
 			continue
-		} else {
-
-			// Data Partition
-			if v.Datatype == DataPartition {
-				descriptors["partition"] = fimg.parseDataPartition(v)
-
-			// Data Signatures
-			} else if v.Datatype == DataSignature {
-				descriptors["signature"] = fimg.parseSignature(v)
-
-			// Data Crypto Message
-			} else if v.Datatype == DataCryptoMessage {
-				descriptors["crypto"] = fimg.parseCryptoMessage(v)
-			}
 		}
-	}
-
-	return descriptors
-}
 
-// Parse the data partition to a user friendly string
-func (fimg *FileImage) parseDataPartition(v Descriptor) string {
+		d := descriptorInfo(v)
+		err := fimg.checkBounds(v)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
-	name := strings.TrimRight(string(v.Name[:]), "\000")
-	var pinfo Partition
-	var s string
+		switch v.Datatype {
+		case DataPartition:
+			d.Partition, err = parsePartition(v)
+		case DataSignature:
+			d.Signature, err = fimg.parseSignature(v)
+		case DataCryptoMessage:
+			d.Crypto, err = fimg.parseCryptoMessage(v)
+		}
 
-	b := bytes.NewReader(v.Extra[:])
-	if err := binary.Read(b, binary.LittleEndian, &pinfo); err != nil {
-		fmt.Println("Error reading partition type %s", err)
-		return ""
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		descriptors = append(descriptors, d)
 	}
 
-	s += fmt.Sprintln("  Name:     ", name)
-	s += fmt.Sprintln("  Datatype: ", datatypeStr(v.Datatype))
-	s += fmt.Sprintln("  Fstype:   ", fstypeStr(pinfo.Fstype))
-	s += fmt.Sprintln("  Parttype: ", parttypeStr(pinfo.Parttype))
-	s += fmt.Sprintln("  Arch:     ", GetGoArch(trimZeroBytes(pinfo.Arch[:])))
-	return s
+	return descriptors, errs
 }
 
-// parse the Signature block from the sif
-func (fimg *FileImage) parseSignature(v Descriptor) string {
-
-	name := strings.TrimRight(string(v.Name[:]), "\000")
-	var sinfo Signature
-	var s string
-
-	b := bytes.NewReader(v.Extra[:])
-	if err := binary.Read(b, binary.LittleEndian, &sinfo); err != nil {
-		fmt.Println("Error while extracting Signature extra info: %s", err)
-		return ""
+// Read content based on a seek location and length, inside the file
+func (fimg *FileImage) readDescriptorContent(fileOffset int64, fileLen int64) (string, error) {
+	if fileOffset < 0 || fileLen < 0 || fileOffset > fimg.Filesize-fileLen {
+		return "", readError(ErrDescriptorBounds, fileOffset, "descriptor content", nil,
+			fmt.Sprintf("data is %d bytes at offset %d, file is %d bytes", fileLen, fileOffset, fimg.Filesize))
 	}
-
-	s += fmt.Sprintln("  Name:     ", name)
-	s += fmt.Sprintln("  Datatype: ", datatypeStr(v.Datatype))
-	s += fmt.Sprintln("  Hashtype: ", hashtypeStr(sinfo.Hashtype))
-	s += fmt.Sprintln("  Entity:   ", "%0X", sinfo.Entity[:20])
-	s += fmt.Sprintln("  Content:  ", fimg.readDescriptorContent(v.Fileoff, v.Filelen))
-
-	return s
-}
-
-// parseCryptoMessage descriptor into a string
-func (fimg *FileImage) parseCryptoMessage(v Descriptor) string {
-
-	name := strings.TrimRight(string(v.Name[:]), "\000")
-	var s string
-	var cinfo CryptoMessage
-	b := bytes.NewReader(v.Extra[:])
-	if err := binary.Read(b, binary.LittleEndian, &cinfo); err != nil {
-		fmt.Println("Error while extracting Crypto extra info: %s", err)
-		return ""
-	}
-
-	s += fmt.Sprintln("  Name:     ", name)
-	s += fmt.Sprintln("  DataType:  ", datatypeStr(v.Datatype))
-	s += fmt.Sprintln("  Fmttype:  ", formattypeStr(cinfo.Formattype))
-	s += fmt.Sprintln("  Msgtype:  ", messagetypeStr(cinfo.Messagetype))
-	s += fmt.Sprintln("  Content:  ", fimg.readDescriptorContent(v.Fileoff, v.Filelen))
-	return s
-
-}
-
-// Read content based on a seek location and length
-func (fimg *FileImage) readDescriptorContent(fileOffset int64, fileLen int64) string {
-	fimg.seek(fileOffset)
 	content := make([]byte, fileLen)
-        fimg.Reader.Read(content)
-	return string(content)
+	if _, err := fimg.Reader.ReadAt(content, fileOffset); err != nil {
+		return "", readError(ErrIO, fileOffset, "descriptor content", err, "")
+	}
+	return string(content), nil
 }
 
-// returnResult back to the browser, in the innerHTML of the result element
-func returnResult(output string, divid string) {
-	js.Global().Get("document").
-		Call("getElementById", divid).
-		Set("innerHTML", output)
-}
+// getInfo reads the header and descriptors of the loaded SIF and returns
+// them as a ContainerInfo. A failure to read or validate the header stops
+// early, while descriptor problems are collected in the Errors list.
+func (fimg *FileImage) getInfo(fileName string) *ContainerInfo {
 
-// loadContainer is linked with the JavaScript function of the same name.
-// It takes as input the binary data from the SIF image, and attempts
-// to read the header. This has to be modified to compile with wasm.
-func loadContainer(this js.Value, val []js.Value) interface{} {
-	fmt.Println("The container binary is:", val[0])
-        fmt.Println("Size:", val[2].Int())
-	fmt.Println("ArrayBuffer:", val[1])
-	
-	fimg := FileImage{}
-
-	// read the string of given size to bytes from the SIF file
-	if err := fimg.loadBytes(val[1], val[2].Int()); err != nil {
-		returnResult("Error loading bytes.", "header")
-		return nil
-	}
+	info := &ContainerInfo{File: fileName, Errors: []ErrorInfo{}}
 
 	// read global header from SIF file
 	if err := fimg.readHeader(); err != nil {
-		returnResult("Error reading header.", "header")
-		return nil
+		info.addError(err)
+		return info
 	}
 
 	// validate global header
 	if err := fimg.isValidSif(); err != nil {
-		returnResult("This is not a valid sif", "header")
-		return nil
+		info.addError(err)
+		return info
 	}
+	info.Header = fimg.headerInfo()
 
 	// read descriptor data
 	if err := fimg.readDescriptors(); err != nil {
-		fmt.Println("Skipping reading descriptors: ", err)
+		info.addError(err)
+		return info
 	}
 
 	// parse descriptor data
-	descriptors := fimg.getDescriptors()
-	fmt.Println(descriptors)
-
-	// header with newlines
-	header := fimg.FmtHeader()
-
-	// Add file info
-	header = addFileName(val[0].String(), header)
-
-	// Print header, and descriptors to console
-	fmt.Print(header)
-
-	// Replace with breaks
-	header = replaceNewLine(header, "<br>")
+	descriptors, errs := fimg.getDescriptors()
+	info.Descriptors = descriptors
+	for _, err := range errs {
+		info.addError(err)
+	}
 
-	fmt.Println("Container id:", fimg.Header.ID)
-	fmt.Println("Created on:  ", time.Unix(fimg.Header.Ctime, 0))
-	fmt.Println("Modified on: ", time.Unix(fimg.Header.Mtime, 0))
-	fmt.Println("----------------------------------------------------")
+	return info
+}
 
-	// Send result back to browser, key is div id, content is string
-	returnResult(header, "header")
-	for divid, content := range descriptors { 
-		content = replaceNewLine(content, "<br>")
-		returnResult(content, divid)
-	}
-	return nil
+// addError records an error in the ContainerInfo
+func (info *ContainerInfo) addError(err error) {
+	info.errs = append(info.errs, err)
+	info.Errors = append(info.Errors, errorInfo(err))
 }
 
 func trimZeroBytes(str []byte) string {
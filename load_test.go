@@ -0,0 +1,165 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// testSIF builds a SIF with a definition file, a JSON object and a
+// primary partition, laid out the way Singularity writes it.
+func testSIF(t *testing.T) []byte {
+	objects := []struct {
+		datatype Datatype
+		name     string
+		data     []byte
+		extra    interface{}
+	}{
+		{DataDeffile, "def", []byte("Bootstrap: docker\n"), nil},
+		{DataGenericJSON, "x.json", []byte(`{"a": 1}`), nil},
+		{DataPartition, "root.sqfs", bytes.Repeat([]byte{1}, 5000), Partition{Fstype: FsSquash, Parttype: PartPrimSys, Arch: [HdrArchLen]byte{'0', '2'}}},
+	}
+
+	h := Header{Dtotal: DescrNumEntries, Dfree: DescrNumEntries, Descroff: DescrStartOffset, Dataoff: DataStartOffset}
+	copy(h.Launch[:], HdrLaunch)
+	copy(h.Magic[:], HdrMagic)
+	copy(h.Version[:], HdrVersion)
+	copy(h.Arch[:], HdrArchAMD64)
+	h.Descrlen = h.Dtotal * int64(binary.Size(Descriptor{}))
+
+	descrs := make([]Descriptor, DescrNumEntries)
+	var data bytes.Buffer
+	for i, o := range objects {
+		d := &descrs[i]
+		d.Datatype, d.Used, d.ID, d.Groupid = o.datatype, true, uint32(i+1), DescrDefaultGroup
+		d.Fileoff, d.Filelen, d.Storelen = h.Dataoff+int64(data.Len()), int64(len(o.data)), int64(len(o.data))
+		copy(d.Name[:], o.name)
+		if o.extra != nil {
+			var extra bytes.Buffer
+			binary.Write(&extra, binary.LittleEndian, o.extra)
+			copy(d.Extra[:], extra.Bytes())
+		}
+		data.Write(o.data)
+		h.Dfree--
+	}
+	h.Datalen = int64(data.Len())
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	buf.Write(make([]byte, h.Descroff-int64(buf.Len())))
+	binary.Write(&buf, binary.LittleEndian, descrs)
+	buf.Write(make([]byte, h.Dataoff-int64(buf.Len())))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+// loadBytes reads the header and descriptors of a SIF in memory.
+func loadBytes(data []byte) (*FileImage, *ContainerInfo) {
+	fimg := &FileImage{}
+	fimg.loadReader(bytes.NewReader(data), int64(len(data)))
+	return fimg, fimg.getInfo("test.sif")
+}
+
+func TestLoadRoundTrip(t *testing.T) {
+	fimg, info := loadBytes(testSIF(t))
+	if len(info.Errors) > 0 {
+		t.Fatalf("got errors %+v", info.Errors)
+	}
+	if info.Header.Arch != "amd64" || info.Header.Dtotal != DescrNumEntries || info.Header.Dfree != DescrNumEntries-3 {
+		t.Errorf("got header %+v", info.Header)
+	}
+
+	want := []struct {
+		name, datatype string
+		size           int64
+	}{
+		{"def", "Def.FILE", 18},
+		{"x.json", "JSON.Generic", 8},
+		{"root.sqfs", "FS", 5000},
+	}
+	if len(info.Descriptors) != len(want) {
+		t.Fatalf("got %d descriptors, want %d", len(info.Descriptors), len(want))
+	}
+	for i, d := range info.Descriptors {
+		if d.ID != uint32(i+1) || d.Name != want[i].name || d.Datatype != want[i].datatype || d.Filelen != want[i].size {
+			t.Errorf("descriptor %d: got %+v, want %+v", i, d, want[i])
+		}
+	}
+	if p := info.Descriptors[2].Partition; p == nil || p.Fstype != "Squashfs" || p.Arch != "amd64" {
+		t.Errorf("got partition %+v", p)
+	}
+	if fimg.PrimPartID != 3 {
+		t.Errorf("got primary partition %d, want 3", fimg.PrimPartID)
+	}
+	if content, err := fimg.readDescriptorContent(info.Descriptors[0].Fileoff, info.Descriptors[0].Filelen); err != nil || content != "Bootstrap: docker\n" {
+		t.Errorf("got content %q, %v", content, err)
+	}
+	for _, r := range [][2]int64{{-1, 1}, {0, -1}, {int64(len(testSIF(t))), 1}, {1, math.MaxInt64}} {
+		if _, err := fimg.readDescriptorContent(r[0], r[1]); !errors.Is(err, ErrDescriptorBounds) {
+			t.Errorf("read %d bytes at %d: got %v, want %v", r[1], r[0], err, ErrDescriptorBounds)
+		}
+	}
+}
+
+func TestLoadMalformed(t *testing.T) {
+	image := testSIF(t)
+	var h Header
+	binary.Read(bytes.NewReader(image), binary.LittleEndian, &h)
+	descrSize := binary.Size(Descriptor{})
+
+	// withHeader and withDescriptor return a copy of image with the header
+	// or first descriptor changed
+	withHeader := func(edit func(*Header)) []byte {
+		h := h
+		edit(&h)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, h)
+		return append(buf.Bytes(), image[buf.Len():]...)
+	}
+	withDescriptor := func(edit func(*Descriptor)) []byte {
+		var d Descriptor
+		binary.Read(bytes.NewReader(image[h.Descroff:]), binary.LittleEndian, &d)
+		edit(&d)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, d)
+		out := append([]byte(nil), image...)
+		copy(out[h.Descroff:], buf.Bytes())
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		image []byte
+		want  error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"short header", image[:100], ErrTruncated},
+		{"bad magic", append(make([]byte, 200), image[200:]...), ErrBadMagic},
+		{"truncated descriptors", image[:int(h.Descroff)+descrSize], ErrTruncated},
+		{"huge dtotal", withHeader(func(h *Header) { h.Dtotal = math.MaxInt64 / 2 }), ErrTruncated},
+		{"overflowing dtotal", withHeader(func(h *Header) { h.Dtotal = math.MaxInt64/int64(descrSize) + 2 }), ErrTruncated},
+		{"negative dtotal", withHeader(func(h *Header) { h.Dtotal = -1 }), ErrDescriptorBounds},
+		{"descroff after the end", withHeader(func(h *Header) { h.Descroff, h.Dtotal = int64(len(image))+1, 0 }), ErrTruncated},
+		{"data after the end", withDescriptor(func(d *Descriptor) { d.Fileoff = int64(len(image)) }), ErrDescriptorBounds},
+		{"overflowing data", withDescriptor(func(d *Descriptor) { d.Fileoff, d.Filelen = math.MaxInt64-10, 100 }), ErrDescriptorBounds},
+		{"negative length", withDescriptor(func(d *Descriptor) { d.Filelen = -1 }), ErrDescriptorBounds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, info := loadBytes(tt.image)
+			for _, err := range info.errs {
+				if errors.Is(err, tt.want) {
+					return
+				}
+			}
+			t.Errorf("got errors %v, want %v", info.errs, tt.want)
+		})
+	}
+}
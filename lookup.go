@@ -4,33 +4,45 @@
 // https://polyformproject.org/licenses/noncommercial/1.0.0
 
 package main
- 
+
 import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
 )
 
+// goArchs maps the SIF arch codes to go runtime arch codes.
+var goArchs = map[string]string{
+	HdrArch386:      "386",
+	HdrArchAMD64:    "amd64",
+	HdrArchARM:      "arm",
+	HdrArchARM64:    "arm64",
+	HdrArchPPC64:    "ppc64",
+	HdrArchPPC64le:  "ppc64le",
+	HdrArchMIPS:     "mips",
+	HdrArchMIPSle:   "mipsle",
+	HdrArchMIPS64:   "mips64",
+	HdrArchMIPS64le: "mips64le",
+	HdrArchS390x:    "s390x",
+}
+
+// GetSIFArch returns the SIF arch code from the go runtime arch code.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/lookup.go
+func GetSIFArch(goarch string) (sifarch string) {
+	for sifarch, arch := range goArchs {
+		if arch == goarch {
+			return sifarch
+		}
+	}
+	return HdrArchUnknown
+}
+
 // GetGoArch returns the go runtime arch code from the SIF arch code.
 // https://github.com/sylabs/sif/blob/master/pkg/sif/lookup.go#L48
 func GetGoArch(sifarch string) (goarch string) {
 	var ok bool
 
-	archMap := map[string]string{
-		HdrArch386:      "386",
-		HdrArchAMD64:    "amd64",
-		HdrArchARM:      "arm",
-		HdrArchARM64:    "arm64",
-		HdrArchPPC64:    "ppc64",
-		HdrArchPPC64le:  "ppc64le",
-		HdrArchMIPS:     "mips",
-		HdrArchMIPSle:   "mipsle",
-		HdrArchMIPS64:   "mips64",
-		HdrArchMIPS64le: "mips64le",
-		HdrArchS390x:    "s390x",
-	}
-
-	if goarch, ok = archMap[sifarch]; !ok {
+	if goarch, ok = goArchs[sifarch]; !ok {
 		goarch = "unknown"
 	}
 	return goarch
@@ -85,3 +97,27 @@ func (d *Descriptor) GetPartType() (Parttype, error) {
 
 	return pinfo.Parttype, nil
 }
+
+// getPartition extracts the Partition fields from the Extra field of a Partition Descriptor.
+func (d *Descriptor) getPartition() (Partition, error) {
+	var pinfo Partition
+	if d.Datatype != DataPartition {
+		return pinfo, fmt.Errorf("expected DataPartition, got %v", d.Datatype)
+	}
+
+	b := bytes.NewReader(d.Extra[:])
+	if err := binary.Read(b, binary.LittleEndian, &pinfo); err != nil {
+		return pinfo, fmt.Errorf("while extracting Partition extra info: %s", err)
+	}
+	return pinfo, nil
+}
+
+// setPartition stores the Partition fields in the Extra field of a Partition Descriptor.
+func (d *Descriptor) setPartition(pinfo Partition) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, pinfo); err != nil {
+		return err
+	}
+	copy(d.Extra[:], buf.Bytes())
+	return nil
+}
@@ -3,6 +3,9 @@
 // that can be found in the LICENSE file and available at
 // https://polyformproject.org/licenses/noncommercial/1.0.0
 
+//go:build js && wasm
+// +build js,wasm
+
 package main
  
 import "syscall/js"
@@ -11,5 +14,6 @@ func main() {
 
 	c := make(chan struct{}, 0)
 	js.Global().Set("loadContainer", js.FuncOf(loadContainer))
+	registerAPI()
 	<-c
 }
@@ -0,0 +1,487 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// A minimal squashfs 4.0 writer, the counterpart of the reader in
+// squashfs.go: gzip compression, 128KiB blocks, tail ends packed in
+// fragments, no xattrs or export table. File contents are written first,
+// in any order, then the tree of SquashNodes as metadata.
+// https://dr-emann.github.io/squashfs/
+
+// Squashfs writer constants.
+const (
+	squashBlockSize = 128 * 1024
+	squashBlockLog  = 17
+
+	squashFlagNoXattrs = 0x0200
+	squashNoTable      = math.MaxUint64 // start of a missing (optional) table
+)
+
+// SquashNode is a file, directory or other entry of a squashfs image
+// being written.
+type SquashNode struct {
+	Type    uint16 // basic inode type, sqDir to sqSocket
+	Perm    uint16 // permission bits, with setuid, setgid and sticky
+	UID     uint32
+	GID     uint32
+	Mtime   int64
+	Size    int64                  // regular files
+	Target  string                 // symlinks
+	Rdev    uint32                 // block and char devices
+	Entries map[string]*SquashNode // directories
+
+	// set as the image is written
+	nlink       uint32
+	number      uint32
+	ref         uint64 // metadata block and offset of the inode
+	written     bool
+	blocksStart uint64
+	blockSizes  []uint32
+	fragment    uint32
+	fragOffset  uint32
+}
+
+// SquashWriter writes a squashfs image.
+type SquashWriter struct {
+	w       io.WriteSeeker
+	off     int64 // bytes written
+	zw      *zlib.Writer
+	zbuf    bytes.Buffer
+	frags   []squashFragment
+	fragBuf []byte
+	ids     []uint32
+	idIndex map[uint32]uint16
+}
+
+// NewSquashWriter starts a squashfs image at the current position of w,
+// leaving room for the superblock.
+func NewSquashWriter(w io.WriteSeeker) (*SquashWriter, error) {
+	sw := &SquashWriter{w: w, idIndex: make(map[uint32]uint16)}
+	sw.zw = zlib.NewWriter(&sw.zbuf)
+	if err := sw.write(make([]byte, binary.Size(squashSuperblock{}))); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *SquashWriter) write(b []byte) error {
+	n, err := sw.w.Write(b)
+	sw.off += int64(n)
+	return err
+}
+
+// compress returns block compressed, or nil if that doesn't make it smaller.
+func (sw *SquashWriter) compress(block []byte) ([]byte, error) {
+	sw.zbuf.Reset()
+	sw.zw.Reset(&sw.zbuf)
+	if _, err := sw.zw.Write(block); err != nil {
+		return nil, err
+	}
+	if err := sw.zw.Close(); err != nil {
+		return nil, err
+	}
+	if sw.zbuf.Len() >= len(block) {
+		return nil, nil
+	}
+	return sw.zbuf.Bytes(), nil
+}
+
+// writeBlock writes a data or fragment block and returns its on-disk size,
+// with squashUncompressedBit if it is stored as is.
+func (sw *SquashWriter) writeBlock(block []byte) (uint32, error) {
+	c, err := sw.compress(block)
+	if err != nil {
+		return 0, err
+	}
+	if c == nil {
+		return uint32(len(block)) | squashUncompressedBit, sw.write(block)
+	}
+	return uint32(len(c)), sw.write(c)
+}
+
+// isZero reports whether b is all zero bytes.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteFile writes the content of the regular file n, n.Size bytes read
+// from r: full blocks go to the data area (all zero blocks are sparse),
+// the tail end to a fragment.
+func (sw *SquashWriter) WriteFile(n *SquashNode, r io.Reader) error {
+	n.blocksStart = uint64(sw.off)
+	n.blockSizes = nil
+	n.fragment = squashNoFragment
+
+	block := make([]byte, squashBlockSize)
+	for left := n.Size; left > 0; {
+		chunk := block
+		if left < squashBlockSize {
+			chunk = block[:left]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+		left -= int64(len(chunk))
+
+		switch {
+		case len(chunk) < squashBlockSize:
+			if len(sw.fragBuf)+len(chunk) > squashBlockSize {
+				if err := sw.flushFragment(); err != nil {
+					return err
+				}
+			}
+			n.fragment, n.fragOffset = uint32(len(sw.frags)), uint32(len(sw.fragBuf))
+			sw.fragBuf = append(sw.fragBuf, chunk...)
+		case isZero(chunk):
+			n.blockSizes = append(n.blockSizes, 0)
+		default:
+			size, err := sw.writeBlock(chunk)
+			if err != nil {
+				return err
+			}
+			n.blockSizes = append(n.blockSizes, size)
+		}
+	}
+	return nil
+}
+
+// flushFragment writes the pending tail ends as a fragment block.
+func (sw *SquashWriter) flushFragment() error {
+	if len(sw.fragBuf) == 0 {
+		return nil
+	}
+	start := uint64(sw.off)
+	size, err := sw.writeBlock(sw.fragBuf)
+	if err != nil {
+		return err
+	}
+	sw.frags = append(sw.frags, squashFragment{Start: start, Size: size})
+	sw.fragBuf = sw.fragBuf[:0]
+	return nil
+}
+
+// id returns the index of a uid or gid in the id table.
+func (sw *SquashWriter) id(id uint32) (uint16, error) {
+	if i, ok := sw.idIndex[id]; ok {
+		return i, nil
+	}
+	if len(sw.ids) == math.MaxUint16 {
+		return 0, fmt.Errorf("more than %d different uids and gids", math.MaxUint16)
+	}
+	i := uint16(len(sw.ids))
+	sw.ids = append(sw.ids, id)
+	sw.idIndex[id] = i
+	return i, nil
+}
+
+// metadataWriter packs a stream into compressed metadata blocks.
+type metadataWriter struct {
+	sw  *SquashWriter
+	out bytes.Buffer // finished blocks
+	buf []byte       // the block being filled
+}
+
+// pos returns the offset of the current block in the stream and the
+// offset in that block, where the next write goes.
+func (m *metadataWriter) pos() (uint32, uint16) {
+	return uint32(m.out.Len()), uint16(len(m.buf))
+}
+
+func (m *metadataWriter) Write(b []byte) (int, error) {
+	m.buf = append(m.buf, b...)
+	for len(m.buf) >= SquashMetadataSize {
+		if err := m.flush(m.buf[:SquashMetadataSize]); err != nil {
+			return 0, err
+		}
+		m.buf = append(m.buf[:0], m.buf[SquashMetadataSize:]...)
+	}
+	return len(b), nil
+}
+
+func (m *metadataWriter) flush(block []byte) error {
+	c, err := m.sw.compress(block)
+	if err != nil {
+		return err
+	}
+	size := uint16(len(c))
+	if c == nil {
+		c, size = block, uint16(len(block))|squashMetaUncompBit
+	}
+	binary.Write(&m.out, binary.LittleEndian, size)
+	m.out.Write(c)
+	return nil
+}
+
+// finish flushes the last block and returns the whole stream.
+func (m *metadataWriter) finish() ([]byte, error) {
+	if len(m.buf) > 0 {
+		if err := m.flush(m.buf); err != nil {
+			return nil, err
+		}
+		m.buf = nil
+	}
+	return m.out.Bytes(), nil
+}
+
+// writeTable writes a lookup table: the entries in metadata blocks, then
+// the list of pointers to those blocks. It returns the table start.
+func (sw *SquashWriter) writeTable(entries interface{}) (uint64, error) {
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.LittleEndian, entries)
+
+	var ptrs []uint64
+	for b := raw.Bytes(); len(b) > 0; {
+		n := len(b)
+		if n > SquashMetadataSize {
+			n = SquashMetadataSize
+		}
+		m := &metadataWriter{sw: sw}
+		m.Write(b[:n])
+		data, err := m.finish()
+		if err != nil {
+			return 0, err
+		}
+		ptrs = append(ptrs, uint64(sw.off))
+		if err := sw.write(data); err != nil {
+			return 0, err
+		}
+		b = b[n:]
+	}
+
+	start := uint64(sw.off)
+	var p bytes.Buffer
+	binary.Write(&p, binary.LittleEndian, ptrs)
+	return start, sw.write(p.Bytes())
+}
+
+// number gives inode numbers to the tree under n, depth first, and counts
+// the links to every inode.
+func (sw *SquashWriter) number(n *SquashNode, count *uint32) {
+	n.nlink++
+	if n.number != 0 {
+		return // hard link
+	}
+	*count++
+	n.number = *count
+	if n.Type != sqDir {
+		return
+	}
+	n.nlink++ // .
+	for _, name := range n.names() {
+		child := n.Entries[name]
+		if child.Type == sqDir {
+			n.nlink++ // ..
+		}
+		sw.number(child, count)
+	}
+}
+
+// names returns the entries of a directory in byte order, as squashfs
+// requires.
+func (n *SquashNode) names() []string {
+	names := make([]string, 0, len(n.Entries))
+	for name := range n.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeInode writes the tree under n to the inode and directory tables,
+// children first since a directory refers to their inodes.
+func (sw *SquashWriter) writeInode(n *SquashNode, parent uint32, inodes, dirs *metadataWriter) error {
+	if n.written {
+		return nil
+	}
+	n.written = true
+
+	var listing bytes.Buffer
+	var dirBlock uint32
+	var dirOffset uint16
+	if n.Type == sqDir {
+		names := n.names()
+		for _, name := range names {
+			if err := sw.writeInode(n.Entries[name], n.number, inodes, dirs); err != nil {
+				return err
+			}
+		}
+
+		// Entries are grouped under headers giving the metadata block of
+		// their inodes and a base inode number, for at most 256 entries.
+		for i := 0; i < len(names); {
+			first := n.Entries[names[i]]
+			j := i + 1
+			for ; j < len(names) && j-i < 256; j++ {
+				e := n.Entries[names[j]]
+				diff := int64(e.number) - int64(first.number)
+				if e.ref>>16 != first.ref>>16 || diff < math.MinInt16 || diff > math.MaxInt16 {
+					break
+				}
+			}
+			binary.Write(&listing, binary.LittleEndian, []uint32{uint32(j - i - 1), uint32(first.ref >> 16), first.number})
+			for _, name := range names[i:j] {
+				if len(name) > 256 {
+					return fmt.Errorf("%s: name longer than 256 bytes", name)
+				}
+				e := n.Entries[name]
+				binary.Write(&listing, binary.LittleEndian, struct {
+					Offset      uint16
+					InodeOffset int16
+					Type        uint16
+					NameSize    uint16
+				}{uint16(e.ref), int16(int64(e.number) - int64(first.number)), e.Type, uint16(len(name) - 1)})
+				listing.WriteString(name)
+			}
+			i = j
+		}
+		dirBlock, dirOffset = dirs.pos()
+		dirs.Write(listing.Bytes())
+	}
+
+	uid, err := sw.id(n.UID)
+	if err != nil {
+		return err
+	}
+	gid, err := sw.id(n.GID)
+	if err != nil {
+		return err
+	}
+
+	var inode bytes.Buffer
+	put := func(v ...interface{}) {
+		for _, x := range v {
+			binary.Write(&inode, binary.LittleEndian, x)
+		}
+	}
+	typ := n.Type
+	switch n.Type {
+	case sqDir:
+		size := listing.Len() + 3 // for . and ..
+		if size > math.MaxUint16 {
+			typ = sqExtDir
+			put(n.nlink, uint32(size), dirBlock, parent, uint16(0), dirOffset, uint32(math.MaxUint32))
+		} else {
+			put(dirBlock, n.nlink, uint16(size), dirOffset, parent)
+		}
+	case sqFile:
+		if n.nlink > 1 || n.blocksStart > math.MaxUint32 || n.Size > math.MaxUint32 {
+			typ = sqExtFile
+			put(n.blocksStart, uint64(n.Size), uint64(0), n.nlink, n.fragment, n.fragOffset, uint32(math.MaxUint32))
+		} else {
+			put(uint32(n.blocksStart), n.fragment, n.fragOffset, uint32(n.Size))
+		}
+		put(n.blockSizes)
+	case sqSymlink:
+		put(n.nlink, uint32(len(n.Target)))
+		inode.WriteString(n.Target)
+	case sqBlockDev, sqCharDev:
+		put(n.nlink, n.Rdev)
+	case sqFifo, sqSocket:
+		put(n.nlink)
+	default:
+		return fmt.Errorf("unknown squashfs inode type %d", n.Type)
+	}
+
+	block, offset := inodes.pos()
+	n.ref = uint64(block)<<16 | uint64(offset)
+	binary.Write(inodes, binary.LittleEndian, struct {
+		Type   uint16
+		Perm   uint16
+		UID    uint16
+		GID    uint16
+		Mtime  uint32
+		Number uint32
+	}{typ, n.Perm, uid, gid, uint32(n.Mtime), n.number})
+	_, err = inodes.Write(inode.Bytes())
+	return err
+}
+
+// Finish writes the tree under root (whose files must all have been
+// written with WriteFile), the lookup tables and the superblock, and pads
+// the image to 4KiB. It returns the size of the image.
+func (sw *SquashWriter) Finish(root *SquashNode, mtime int64) (int64, error) {
+	if err := sw.flushFragment(); err != nil {
+		return 0, err
+	}
+
+	var count uint32
+	sw.number(root, &count)
+	inodes := &metadataWriter{sw: sw}
+	dirs := &metadataWriter{sw: sw}
+	if err := sw.writeInode(root, count+1, inodes, dirs); err != nil {
+		return 0, err
+	}
+
+	sb := squashSuperblock{
+		Magic:             SquashMagic,
+		InodeCount:        count,
+		ModificationTime:  uint32(mtime),
+		BlockSize:         squashBlockSize,
+		CompressionID:     squashCompGzip,
+		BlockLog:          squashBlockLog,
+		Flags:             squashFlagNoXattrs,
+		VersionMajor:      4,
+		RootInodeRef:      root.ref,
+		XattrIDTableStart: squashNoTable,
+		ExportTableStart:  squashNoTable,
+	}
+
+	for _, m := range []struct {
+		w     *metadataWriter
+		start *uint64
+	}{{inodes, &sb.InodeTableStart}, {dirs, &sb.DirectoryTableStart}} {
+		data, err := m.w.finish()
+		if err != nil {
+			return 0, err
+		}
+		*m.start = uint64(sw.off)
+		if err := sw.write(data); err != nil {
+			return 0, err
+		}
+	}
+
+	var err error
+	sb.FragmentTableStart = squashNoTable
+	if len(sw.frags) > 0 {
+		sb.FragmentEntryCount = uint32(len(sw.frags))
+		if sb.FragmentTableStart, err = sw.writeTable(sw.frags); err != nil {
+			return 0, err
+		}
+	}
+	sb.IDCount = uint16(len(sw.ids))
+	if sb.IDTableStart, err = sw.writeTable(sw.ids); err != nil {
+		return 0, err
+	}
+	sb.BytesUsed = uint64(sw.off)
+
+	if err := sw.write(make([]byte, align(sw.off, 4096)-sw.off)); err != nil {
+		return 0, err
+	}
+	size := sw.off
+	if _, err := sw.w.Seek(-size, io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(sw.w, binary.LittleEndian, sb); err != nil {
+		return 0, err
+	}
+	_, err = sw.w.Seek(size-int64(binary.Size(sb)), io.SeekCurrent)
+	return size, err
+}
@@ -0,0 +1,169 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// seekBuffer is an in-memory io.WriteSeeker.
+type seekBuffer struct {
+	data []byte
+	pos  int64
+}
+
+func (b *seekBuffer) Write(p []byte) (int, error) {
+	if end := b.pos + int64(len(p)); end > int64(len(b.data)) {
+		b.data = append(b.data, make([]byte, end-int64(len(b.data)))...)
+	}
+	n := copy(b.data[b.pos:], p)
+	b.pos += int64(n)
+	return n, nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		b.pos = offset
+	case io.SeekCurrent:
+		b.pos += offset
+	case io.SeekEnd:
+		b.pos = int64(len(b.data)) + offset
+	}
+	return b.pos, nil
+}
+
+func TestSquashWriterRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	// big has two full blocks, a sparse one and a tail end in a fragment
+	big := append(append(random(2*squashBlockSize), make([]byte, squashBlockSize)...), random(1000)...)
+	contents := map[string][]byte{
+		"/big":            big,
+		"/etc/os-release": []byte("ID=alpine\nVERSION_ID=3.19.1\n"),
+		"/empty":          nil,
+	}
+
+	file := func(content []byte, perm uint16) *SquashNode {
+		return &SquashNode{Type: sqFile, Perm: perm, UID: 1000, GID: 100, Mtime: 1700000000, Size: int64(len(content))}
+	}
+	dir := func(entries map[string]*SquashNode) *SquashNode {
+		return &SquashNode{Type: sqDir, Perm: 0755, Mtime: 1700000000, Entries: entries}
+	}
+	osRelease := file(contents["/etc/os-release"], 0644)
+	many := map[string]*SquashNode{}
+	for i := 0; i < 500; i++ {
+		many[fmt.Sprintf("entry-%03d", i)] = &SquashNode{Type: sqSymlink, Perm: 0777, Target: "../big"}
+	}
+	root := dir(map[string]*SquashNode{
+		"big":   file(big, 04755),
+		"empty": file(nil, 0600),
+		"etc": dir(map[string]*SquashNode{
+			"os-release": osRelease,
+			"hardlink":   osRelease,
+		}),
+		"many": dir(many),
+		"null": &SquashNode{Type: sqCharDev, Perm: 0666, Rdev: 1<<8 | 3},
+		"link": &SquashNode{Type: sqSymlink, Perm: 0777, Target: "etc/os-release"},
+		"loop": &SquashNode{Type: sqSymlink, Perm: 0777, Target: "/loop"},
+		"void": dir(nil),
+	})
+
+	var buf seekBuffer
+	sw, err := NewSquashWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []struct {
+		node *SquashNode
+		path string
+	}{{root.Entries["big"], "/big"}, {osRelease, "/etc/os-release"}, {root.Entries["empty"], "/empty"}} {
+		if err := sw.WriteFile(n.node, bytes.NewReader(contents[n.path])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, err := sw.Finish(root, 1700000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(buf.data)) || size%4096 != 0 {
+		t.Fatalf("got size %d for %d bytes", size, len(buf.data))
+	}
+
+	fs, err := OpenSquashFS(bytes.NewReader(buf.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	err = fs.Walk("/", func(p string, inode *SquashInode) error {
+		if p == "/many" || len(p) < 6 || p[:6] != "/many/" {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/", "/big", "/empty", "/etc", "/etc/hardlink", "/etc/os-release", "/link", "/loop", "/many", "/null", "/void"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("walked %q, want %q", paths, want)
+	}
+
+	for p, content := range contents {
+		inode, err := fs.Lookup(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !inode.IsRegular() || inode.Size != int64(len(content)) || inode.UID != 1000 || inode.GID != 100 || inode.Mtime != 1700000000 {
+			t.Errorf("%s: got %+v", p, inode)
+			continue
+		}
+		fr, err := fs.Open(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadAll(fr); err != nil || !bytes.Equal(data, content) {
+			t.Errorf("%s: read %d bytes (%v), want %d", p, len(data), err, len(content))
+		}
+	}
+
+	tests := []struct {
+		path  string
+		check func(*SquashInode) bool
+	}{
+		{"/big", func(i *SquashInode) bool { return i.Mode.Perm() == 0755 && i.Mode&os.ModeSetuid != 0 }},
+		{"/etc/hardlink", func(i *SquashInode) bool { return i.Nlink == 2 && i.Number == osRelease.number }},
+		{"/link", func(i *SquashInode) bool { return i.Mode&os.ModeSymlink != 0 && i.Target == "etc/os-release" }},
+		{"/null", func(i *SquashInode) bool { return i.Type == sqCharDev && i.Rdev == 1<<8|3 }},
+		{"/void", func(i *SquashInode) bool { return i.IsDir() && i.Nlink == 2 }},
+		{"/many/entry-499", func(i *SquashInode) bool { return i.Mode&os.ModeSymlink != 0 && i.Target == "../big" }},
+	}
+	for _, tt := range tests {
+		inode, err := fs.Lookup(tt.path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+		} else if !tt.check(inode) {
+			t.Errorf("%s: got %+v", tt.path, inode)
+		}
+	}
+	if _, err := fs.Lookup("/loop/x"); err == nil {
+		t.Error("looked up a symlink loop")
+	}
+	if _, err := fs.Lookup("/missing"); err == nil {
+		t.Error("looked up a missing file")
+	}
+}
@@ -0,0 +1,909 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Converting an OCI image to a SIF, without a daemon or the network: the
+// image is read from an OCI image layout (a directory, or a tarball of
+// one) or a `docker save` tarball. The layers are applied in a first pass
+// that only builds the tree of the root file system, handling whiteouts;
+// a second pass writes the content of the files that are left into a
+// squashfs. https://github.com/opencontainers/image-spec
+
+// OCI media types of indexes, annotations and whiteout names.
+const (
+	ociIndexType         = "application/vnd.oci.image.index.v1+json"
+	dockerListType       = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// ociDescriptor points to a blob of an OCI image.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+// ociIndex is an image index (index.json), or a manifest, which have
+// the same shape for what is needed here.
+type ociIndex struct {
+	MediaType   string            `json:"mediaType"`
+	Manifests   []ociDescriptor   `json:"manifests"`
+	Config      ociDescriptor     `json:"config"`
+	Layers      []ociDescriptor   `json:"layers"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// dockerManifest is an entry of the manifest.json of a docker save tarball.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// OCIConfig is the part of an image configuration used for the SIF.
+type OCIConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Created      string `json:"created,omitempty"`
+	Config       struct {
+		User       string            `json:"User,omitempty"`
+		Env        []string          `json:"Env,omitempty"`
+		Entrypoint []string          `json:"Entrypoint,omitempty"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		WorkingDir string            `json:"WorkingDir,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+}
+
+// ociSource gives access to the files of an image layout or tarball.
+type ociSource interface {
+	open(name string) (io.ReadCloser, int64, error)
+}
+
+// ociDir is an image layout directory.
+type ociDir string
+
+func (d ociDir) open(name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// ociTar is a tarball, indexed so its files can be read in any order.
+type ociTar struct {
+	f     *os.File
+	files map[string][2]int64 // offset and size of regular files
+	links map[string]string   // symlinks, to the path they point to
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// openOCITar indexes the tarball f. The tar reader doesn't read ahead, so
+// the data of an entry starts where the bytes read so far end.
+func openOCITar(f *os.File) (*ociTar, error) {
+	t := &ociTar{f: f, files: make(map[string][2]int64), links: make(map[string]string)}
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s", f.Name(), err)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			t.files[name] = [2]int64{cr.n, hdr.Size}
+		case tar.TypeSymlink:
+			t.links[name] = strings.TrimPrefix(path.Join("/", path.Dir(name), hdr.Linkname), "/")
+		}
+	}
+}
+
+func (t *ociTar) open(name string) (io.ReadCloser, int64, error) {
+	for i := 0; i < 40; i++ {
+		if f, ok := t.files[name]; ok {
+			return ioutil.NopCloser(io.NewSectionReader(t.f, f[0], f[1])), f[1], nil
+		}
+		target, ok := t.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return nil, 0, fmt.Errorf("%s: %s: %w", t.f.Name(), name, os.ErrNotExist)
+}
+
+// ociLayer is a layer blob, with its digest if it should be checked.
+type ociLayer struct {
+	name   string
+	digest string
+}
+
+// OCIImage is an image to convert, opened by OpenOCI.
+type OCIImage struct {
+	Source      string            // what it was opened from
+	Format      string            // "oci" or "docker-archive"
+	Config      OCIConfig         // the image configuration
+	Annotations map[string]string // manifest (and index) annotations
+
+	src    ociSource
+	closer io.Closer
+	layers []ociLayer
+}
+
+// blobName returns the path of a blob in an image layout.
+func blobName(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[1], "/\\.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return path.Join("blobs", parts[0], parts[1]), nil
+}
+
+// digestReader checks the sha256 digest of what's read from r at EOF.
+type digestReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+}
+
+func (d *digestReader) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	d.h.Write(b[:n])
+	if err == io.EOF {
+		if got := "sha256:" + hex.EncodeToString(d.h.Sum(nil)); got != d.want {
+			return n, fmt.Errorf("digest mismatch: %s, expected %s", got, d.want)
+		}
+	}
+	return n, err
+}
+
+// openBlob opens a file of the source, checking its digest as it is read
+// if it is a sha256 one.
+func (img *OCIImage) openBlob(name, digest string) (io.ReadCloser, int64, error) {
+	rc, size, err := img.src.open(name)
+	if err != nil || !strings.HasPrefix(digest, "sha256:") {
+		return rc, size, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&digestReader{r: rc, h: sha256.New(), want: digest}, rc}, size, nil
+}
+
+// readJSON reads a JSON file of the source into v.
+func (img *OCIImage) readJSON(name, digest string, v interface{}) error {
+	rc, _, err := img.openBlob(name, digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+// OpenOCI opens the image at p, an image layout directory, or a tarball of
+// one or from `docker save`. If there are several images, ref picks one by
+// name (the ref.name annotation or a repo tag), and arch (a go arch name)
+// picks one of a multi-arch image.
+func OpenOCI(p, ref, arch string) (*OCIImage, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	img := &OCIImage{Source: p, Format: "oci"}
+	if fi.IsDir() {
+		img.src = ociDir(p)
+	} else {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		t, err := openOCITar(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		img.src, img.closer = t, f
+		if _, ok := t.files["manifest.json"]; ok {
+			img.Format = "docker-archive"
+		}
+	}
+
+	if img.Format == "docker-archive" {
+		err = img.openDocker(ref)
+	} else {
+		err = img.openLayout(ref, arch)
+	}
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// Close closes the tarball the image was opened from.
+func (img *OCIImage) Close() error {
+	if img.closer != nil {
+		return img.closer.Close()
+	}
+	return nil
+}
+
+// openDocker reads the manifest.json of a docker save tarball.
+func (img *OCIImage) openDocker(ref string) error {
+	var manifests []dockerManifest
+	if err := img.readJSON("manifest.json", "", &manifests); err != nil {
+		return err
+	}
+	var found []dockerManifest
+	for _, m := range manifests {
+		if ref == "" {
+			found = append(found, m)
+		}
+		for _, tag := range m.RepoTags {
+			if refMatches(tag, ref) {
+				found = append(found, m)
+				break
+			}
+		}
+	}
+	m, err := pickOne(len(found), ref, func(i int) string { return strings.Join(found[i].RepoTags, ", ") })
+	if err != nil {
+		return err
+	}
+	if len(found[m].RepoTags) > 0 {
+		img.Annotations = map[string]string{ociRefNameAnnotation: found[m].RepoTags[0]}
+	}
+	for _, l := range found[m].Layers {
+		img.layers = append(img.layers, ociLayer{name: l})
+	}
+	return img.readJSON(found[m].Config, "", &img.Config)
+}
+
+// refMatches reports whether ref names the image called name (e.g.,
+// "busybox:latest"): the whole name, its repository or its tag.
+func refMatches(name, ref string) bool {
+	if name == ref {
+		return true
+	}
+	i := strings.LastIndex(name, ":")
+	if i < 0 || strings.Contains(name[i:], "/") {
+		return false
+	}
+	return name[:i] == ref || name[i+1:] == ref
+}
+
+// pickOne returns 0 if there is a single candidate, or an error listing
+// them.
+func pickOne(n int, ref string, name func(int) string) (int, error) {
+	switch {
+	case n == 1:
+		return 0, nil
+	case n == 0 && ref != "":
+		return 0, fmt.Errorf("no image named %q", ref)
+	case n == 0:
+		return 0, fmt.Errorf("no image found")
+	}
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, name(i))
+	}
+	return 0, fmt.Errorf("%d images, choose one with -ref: %s", n, strings.Join(names, "; "))
+}
+
+// openLayout reads the index.json of an image layout and the manifest
+// and config it points to, going through nested indexes.
+func (img *OCIImage) openLayout(ref, arch string) error {
+	var index ociIndex
+	if err := img.readJSON("index.json", "", &index); err != nil {
+		return err
+	}
+	manifests := index.Manifests
+	if ref != "" {
+		var found []ociDescriptor
+		for _, m := range manifests {
+			if refMatches(m.Annotations[ociRefNameAnnotation], ref) {
+				found = append(found, m)
+			}
+		}
+		manifests = found
+	}
+
+	annotations := map[string]string{}
+	for depth := 0; ; depth++ {
+		if depth > 8 {
+			return fmt.Errorf("too many nested image indexes")
+		}
+		if len(manifests) > 1 {
+			manifests = matchPlatform(manifests, arch)
+		}
+		i, err := pickOne(len(manifests), ref, func(i int) string {
+			if name := manifests[i].Annotations[ociRefNameAnnotation]; name != "" {
+				return name
+			}
+			return manifests[i].Digest
+		})
+		if err != nil {
+			return err
+		}
+		desc := manifests[i]
+		for k, v := range desc.Annotations {
+			annotations[k] = v
+		}
+
+		name, err := blobName(desc.Digest)
+		if err != nil {
+			return err
+		}
+		var m ociIndex
+		if err := img.readJSON(name, desc.Digest, &m); err != nil {
+			return err
+		}
+		for k, v := range m.Annotations {
+			annotations[k] = v
+		}
+		if desc.MediaType == ociIndexType || desc.MediaType == dockerListType || m.MediaType == ociIndexType || len(m.Manifests) > 0 {
+			manifests = m.Manifests
+			continue
+		}
+
+		img.Annotations = annotations
+		for _, l := range m.Layers {
+			if strings.Contains(l.MediaType, "zstd") {
+				return fmt.Errorf("layer %s: zstd compression is not supported", l.Digest)
+			}
+			name, err := blobName(l.Digest)
+			if err != nil {
+				return err
+			}
+			img.layers = append(img.layers, ociLayer{name: name, digest: l.Digest})
+		}
+		name, err = blobName(m.Config.Digest)
+		if err != nil {
+			return err
+		}
+		return img.readJSON(name, m.Config.Digest, &img.Config)
+	}
+}
+
+// matchPlatform keeps the manifests for linux on arch, or returns them
+// all if none has a platform.
+func matchPlatform(manifests []ociDescriptor, arch string) []ociDescriptor {
+	var found []ociDescriptor
+	for _, m := range manifests {
+		if m.Platform == nil {
+			return manifests
+		}
+		if m.Platform.OS == "linux" && m.Platform.Architecture == arch {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// Labels returns the labels of the SIF: the labels of the image config,
+// and the annotations of the manifest.
+func (img *OCIImage) Labels() map[string]string {
+	labels := map[string]string{}
+	for k, v := range img.Config.Config.Labels {
+		labels[k] = v
+	}
+	for k, v := range img.Annotations {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Created returns when the image was created, or now if the config
+// doesn't tell.
+func (img *OCIImage) Created() time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, img.Config.Created); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// openLayer returns a reader of the (uncompressed) tar of layer i. The
+// bytes of the blob read are counted by p.
+func (img *OCIImage) openLayer(i int, p *progress) (io.Reader, io.Closer, error) {
+	l := img.layers[i]
+	rc, _, err := img.openBlob(l.name, l.digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(&progressReader{r: rc, p: p})
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, nil, fmt.Errorf("layer %s: %s", l.name, err)
+		}
+		return zr, rc, nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		rc.Close()
+		return nil, nil, fmt.Errorf("layer %s: zstd compression is not supported", l.name)
+	}
+	return br, rc, nil
+}
+
+// layerEntry is the position of a file in the layers.
+type layerEntry struct {
+	layer, index int
+}
+
+// rootfs is the tree of the root file system as the layers are applied.
+type rootfs struct {
+	root     *SquashNode
+	layer    int                        // layer being applied
+	added    map[*SquashNode]int        // layer each node comes from
+	sources  map[*SquashNode]layerEntry // where the content of files is
+	content  map[*SquashNode][]byte     // content of generated files
+	warnings []string
+}
+
+// newDir returns a directory node.
+func newDir(perm uint16, mtime int64) *SquashNode {
+	return &SquashNode{Type: sqDir, Perm: perm, Mtime: mtime, Entries: map[string]*SquashNode{}}
+}
+
+// dir returns the directory at p, following symlinks. Missing directories
+// are created if create is set, else nil is returned.
+func (fs *rootfs) dir(p string, create bool, mtime int64) *SquashNode {
+	return fs.walk([]*SquashNode{fs.root}, strings.Split(p, "/"), create, mtime, 0)
+}
+
+// walk follows the path parts from the directories of stack, the current
+// one last, and returns the directory reached.
+func (fs *rootfs) walk(stack []*SquashNode, parts []string, create bool, mtime int64, depth int) *SquashNode {
+	stack = append([]*SquashNode(nil), stack...)
+	for _, name := range parts {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		cur := stack[len(stack)-1]
+		next := cur.Entries[name]
+		if next != nil && next.Type == sqSymlink && depth < 40 {
+			base := stack
+			if path.IsAbs(next.Target) {
+				base = stack[:1]
+			}
+			if d := fs.walk(base, strings.Split(next.Target, "/"), false, 0, depth+1); d != nil {
+				stack = append(stack, d)
+				continue
+			}
+		}
+		if next == nil || next.Type != sqDir {
+			if !create {
+				return nil
+			}
+			next = newDir(0755, mtime)
+			cur.Entries[name] = next
+			fs.added[next] = fs.layer
+		}
+		stack = append(stack, next)
+	}
+	return stack[len(stack)-1]
+}
+
+// lookup returns the node at p, without following a symlink at the end.
+func (fs *rootfs) lookup(p string) *SquashNode {
+	dir, base := path.Split(p)
+	parent := fs.dir(dir, false, 0)
+	if parent == nil {
+		return nil
+	}
+	if base == "" {
+		return parent
+	}
+	return parent.Entries[base]
+}
+
+// warn records a problem that doesn't stop the conversion.
+func (fs *rootfs) warn(format string, a ...interface{}) {
+	fs.warnings = append(fs.warnings, fmt.Sprintf(format, a...))
+}
+
+// makeDevice encodes a device number the Linux "new" way, like squashfs.
+func makeDevice(major, minor int64) uint32 {
+	return uint32(minor&0xff | major<<8 | (minor&^0xff)<<12)
+}
+
+// apply adds the entry hdr of layer fs.layer to the tree.
+func (fs *rootfs) apply(hdr *tar.Header, index int) {
+	p := path.Clean("/" + hdr.Name)
+	dir, base := path.Split(p)
+	mtime := hdr.ModTime.Unix()
+
+	switch {
+	case p == "/":
+		if hdr.Typeflag == tar.TypeDir {
+			fs.root.Perm, fs.root.UID, fs.root.GID, fs.root.Mtime = uint16(hdr.Mode&07777), uint32(hdr.Uid), uint32(hdr.Gid), mtime
+		}
+		return
+	case base == whiteoutOpaque:
+		// hide what lower layers have in the directory
+		if d := fs.dir(dir, true, mtime); d != nil {
+			for name, n := range d.Entries {
+				if fs.added[n] < fs.layer {
+					delete(d.Entries, name)
+				}
+			}
+		}
+		return
+	case strings.HasPrefix(base, whiteoutPrefix+whiteoutPrefix):
+		return // other aufs metadata
+	case strings.HasPrefix(base, whiteoutPrefix):
+		if d := fs.dir(dir, false, 0); d != nil {
+			delete(d.Entries, strings.TrimPrefix(base, whiteoutPrefix))
+		}
+		return
+	}
+
+	parent := fs.dir(dir, true, mtime)
+	n := &SquashNode{Perm: uint16(hdr.Mode & 07777), UID: uint32(hdr.Uid), GID: uint32(hdr.Gid), Mtime: mtime}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if old := parent.Entries[base]; old != nil && old.Type == sqDir {
+			// a directory again keeps what's in it
+			old.Perm, old.UID, old.GID, old.Mtime = n.Perm, n.UID, n.GID, n.Mtime
+			fs.added[old] = fs.layer
+			return
+		}
+		n.Type, n.Entries = sqDir, map[string]*SquashNode{}
+	case tar.TypeReg, tar.TypeRegA:
+		n.Type, n.Size = sqFile, hdr.Size
+		fs.sources[n] = layerEntry{fs.layer, index}
+	case tar.TypeSymlink:
+		n.Type, n.Target = sqSymlink, hdr.Linkname
+	case tar.TypeLink:
+		target := fs.lookup(path.Clean("/" + hdr.Linkname))
+		if target == nil || target.Type == sqDir {
+			fs.warn("%s: hard link to missing %s, skipped", p, hdr.Linkname)
+			return
+		}
+		parent.Entries[base] = target
+		return
+	case tar.TypeChar:
+		n.Type, n.Rdev = sqCharDev, makeDevice(hdr.Devmajor, hdr.Devminor)
+	case tar.TypeBlock:
+		n.Type, n.Rdev = sqBlockDev, makeDevice(hdr.Devmajor, hdr.Devminor)
+	case tar.TypeFifo:
+		n.Type = sqFifo
+	default:
+		fs.warn("%s: unsupported tar entry type %q, skipped", p, hdr.Typeflag)
+		return
+	}
+	parent.Entries[base] = n
+	fs.added[n] = fs.layer
+}
+
+// addFile adds a generated file at p, unless the image has one already.
+func (fs *rootfs) addFile(p string, perm uint16, content string, mtime int64) {
+	dir, base := path.Split(p)
+	parent := fs.dir(dir, true, mtime)
+	if parent.Entries[base] != nil {
+		return
+	}
+	n := &SquashNode{Type: sqFile, Perm: perm, Mtime: mtime, Size: int64(len(content))}
+	parent.Entries[base] = n
+	fs.content[n] = []byte(content)
+}
+
+// addSymlink adds a generated symlink at p, unless the image has one already.
+func (fs *rootfs) addSymlink(p, target string, mtime int64) {
+	dir, base := path.Split(p)
+	parent := fs.dir(dir, true, mtime)
+	if parent.Entries[base] == nil {
+		parent.Entries[base] = &SquashNode{Type: sqSymlink, Perm: 0777, Mtime: mtime, Target: target}
+	}
+}
+
+// shellQuote quotes s for a shell, in single quotes.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellEscape escapes s to go between double quotes in a shell.
+func shellEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return r.Replace(s)
+}
+
+// quoteAll quotes every word of a command.
+func quoteAll(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = shellQuote(w)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// envScript returns the environment script made from the image config,
+// like Singularity's: PATH is set, the rest only if not set already.
+func (img *OCIImage) envScript() string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	for _, e := range img.Config.Config.Env {
+		kv := strings.SplitN(e, "=", 2)
+		switch {
+		case len(kv) == 1:
+			fmt.Fprintf(&b, "export %s=\"${%s:-}\"\n", kv[0], kv[0])
+		case kv[0] == "PATH":
+			fmt.Fprintf(&b, "export %s=\"%s\"\n", kv[0], shellEscape(kv[1]))
+		default:
+			fmt.Fprintf(&b, "export %s=\"${%s:-\"%s\"}\"\n", kv[0], kv[0], shellEscape(kv[1]))
+		}
+	}
+	return b.String()
+}
+
+// runscript returns the runscript made from the entrypoint and command of
+// the image config: arguments replace the command, as with docker run.
+func (img *OCIImage) runscript() string {
+	entrypoint, cmd := quoteAll(img.Config.Config.Entrypoint), quoteAll(img.Config.Config.Cmd)
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	if wd := img.Config.Config.WorkingDir; wd != "" {
+		fmt.Fprintf(&b, "cd %s || exit 1\n", shellQuote(wd))
+	}
+	switch {
+	case entrypoint == "" && cmd == "":
+		b.WriteString("if [ $# -gt 0 ]; then\n    exec \"$@\"\nfi\nexec /bin/sh\n")
+	case entrypoint == "":
+		fmt.Fprintf(&b, "if [ $# -gt 0 ]; then\n    exec \"$@\"\nfi\nexec %s\n", cmd)
+	case cmd == "":
+		fmt.Fprintf(&b, "exec %s \"$@\"\n", entrypoint)
+	default:
+		fmt.Fprintf(&b, "if [ $# -gt 0 ]; then\n    exec %s \"$@\"\nfi\nexec %s %s\n", entrypoint, entrypoint, cmd)
+	}
+	return b.String()
+}
+
+// addSingularity adds the files Singularity expects in a container: the
+// environment and runscript from the config, the labels, and the mount
+// points.
+func (img *OCIImage) addSingularity(fs *rootfs, mtime int64) error {
+	labels, err := json.MarshalIndent(img.Labels(), "", "\t")
+	if err != nil {
+		return err
+	}
+	for _, d := range []string{"/.singularity.d/actions", "/.singularity.d/env", "/.singularity.d/libs",
+		"/dev", "/proc", "/sys", "/tmp", "/var/tmp", "/home", "/root", "/etc"} {
+		if fs.dir(d, false, 0) == nil {
+			n := fs.dir(d, true, mtime)
+			if strings.HasSuffix(d, "tmp") {
+				n.Perm = 01777
+			}
+		}
+	}
+
+	fs.addFile("/.singularity.d/env/10-docker2singularity.sh", 0755, img.envScript(), mtime)
+	fs.addFile("/.singularity.d/env/90-environment.sh", 0755, "#!/bin/sh\n# Custom environment shell code should follow\n", mtime)
+	fs.addFile("/.singularity.d/runscript", 0755, img.runscript(), mtime)
+	fs.addFile("/.singularity.d/labels.json", 0644, string(labels)+"\n", mtime)
+	fs.addFile("/etc/hosts", 0644, "", mtime)
+	fs.addFile("/etc/resolv.conf", 0644, "", mtime)
+	fs.addSymlink("/singularity", ".singularity.d/runscript", mtime)
+	fs.addSymlink("/environment", ".singularity.d/env/90-environment.sh", mtime)
+	return nil
+}
+
+// WriteSquashFS writes the root file system of the image to w as a
+// squashfs, and returns its size and what was skipped. Progress is
+// reported in bytes of layers read, which are read twice.
+func (img *OCIImage) WriteSquashFS(ctx context.Context, w io.WriteSeeker, fn ProgressFunc) (int64, []string, error) {
+	var total int64
+	for _, l := range img.layers {
+		rc, size, err := img.src.open(l.name)
+		if err != nil {
+			return 0, nil, err
+		}
+		rc.Close()
+		total += 2 * size
+	}
+	p := newProgress(ctx, total, fn)
+	defer p.finish()
+
+	mtime := img.Created().Unix()
+	fs := &rootfs{
+		root:    newDir(0755, mtime),
+		added:   map[*SquashNode]int{},
+		sources: map[*SquashNode]layerEntry{},
+		content: map[*SquashNode][]byte{},
+	}
+
+	// first pass: the tree
+	for i := range img.layers {
+		fs.layer = i
+		err := img.readLayer(i, p, func(hdr *tar.Header, index int, r io.Reader) error {
+			fs.apply(hdr, index)
+			return nil
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := img.addSingularity(fs, mtime); err != nil {
+		return 0, nil, err
+	}
+
+	// second pass: the content of the files left in the tree
+	wanted := map[layerEntry]*SquashNode{}
+	var generated []*SquashNode
+	var walk func(n *SquashNode)
+	walk = func(n *SquashNode) {
+		if src, ok := fs.sources[n]; ok {
+			wanted[src] = n
+		}
+		if _, ok := fs.content[n]; ok {
+			generated = append(generated, n)
+		}
+		for _, name := range n.names() {
+			walk(n.Entries[name])
+		}
+	}
+	walk(fs.root)
+
+	sw, err := NewSquashWriter(w)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range img.layers {
+		err := img.readLayer(i, p, func(hdr *tar.Header, index int, r io.Reader) error {
+			if n, ok := wanted[layerEntry{i, index}]; ok {
+				delete(wanted, layerEntry{i, index})
+				if err := sw.WriteFile(n, r); err != nil {
+					return fmt.Errorf("%s: %s", hdr.Name, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	for _, n := range generated {
+		if err := sw.WriteFile(n, bytes.NewReader(fs.content[n])); err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(wanted) > 0 {
+		return 0, nil, fmt.Errorf("%d files changed between the two reads of the layers", len(wanted))
+	}
+
+	size, err := sw.Finish(fs.root, mtime)
+	return size, fs.warnings, err
+}
+
+// readLayer calls fn for every entry of layer i, with its index in the
+// layer and a reader of its content.
+func (img *OCIImage) readLayer(i int, p *progress, fn func(*tar.Header, int, io.Reader) error) error {
+	r, closer, err := img.openLayer(i, p)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// read what's after the end of the archive, for the digest check
+			if _, err = io.Copy(ioutil.Discard, r); err == nil {
+				return nil
+			}
+		}
+		if err != nil {
+			if err == ErrCanceled {
+				return err
+			}
+			return fmt.Errorf("layer %s: %s", img.layers[i].name, err)
+		}
+		if err := fn(hdr, index, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Deffile returns a definition file recording where the image came from.
+func (img *OCIImage) Deffile() string {
+	bootstrap := "oci"
+	if img.Format == "docker-archive" {
+		bootstrap = "docker-archive"
+	}
+	from, err := filepath.Abs(img.Source)
+	if err != nil {
+		from = img.Source
+	}
+	return fmt.Sprintf("bootstrap: %s\nfrom: %s\n", bootstrap, from)
+}
+
+// SIFInputs returns the inputs of a SIF holding the image: the definition
+// file, the labels and the squashfs root file system read from rootfs.
+func (img *OCIImage) SIFInputs(rootfs io.Reader, size int64) ([]DescriptorInput, error) {
+	labels, err := json.MarshalIndent(img.Labels(), "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	arch := img.Config.Architecture
+	sifarch := GetSIFArch(arch)
+	if sifarch == HdrArchUnknown {
+		return nil, fmt.Errorf("image arch %q has no SIF arch code", arch)
+	}
+
+	inputs := []DescriptorInput{
+		{Datatype: DataDeffile, Groupid: DescrDefaultGroup, Data: []byte(img.Deffile())},
+		{Datatype: DataLabels, Groupid: DescrDefaultGroup, Data: labels},
+		{Datatype: DataPartition, Groupid: DescrDefaultGroup, Fname: "rootfs.squashfs", Fp: rootfs, Size: size},
+	}
+	if err := inputs[2].SetPartExtra(FsSquash, PartPrimSys, sifarch); err != nil {
+		return nil, err
+	}
+	return inputs, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ProgressFunc is called during long operations (hashing a partition,
+// walking a file system, ...) with the amount of work done so far and the
+// total, in bytes or entries depending on the operation. It may be nil.
+type ProgressFunc func(done, total int64)
+
+// ErrCanceled is returned by operations stopped with their context.
+var ErrCanceled = errors.New("operation canceled")
+
+// progressInterval is how often progress is reported, at most.
+const progressInterval = 100 * time.Millisecond
+
+// yield gives the host a chance to run while a long operation is going
+// on. It does nothing natively; in the browser it lets JavaScript deliver
+// events such as a cancel request (see wasm.go).
+var yield = func() {}
+
+// progress tracks a long operation: it reports progress (not too often)
+// and tells when the operation was canceled.
+type progress struct {
+	ctx   context.Context
+	fn    ProgressFunc
+	done  int64
+	total int64
+	last  time.Time
+}
+
+// newProgress starts tracking an operation of total bytes or entries.
+func newProgress(ctx context.Context, total int64, fn ProgressFunc) *progress {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &progress{ctx: ctx, fn: fn, total: total}
+}
+
+// add records n more bytes or entries done. It returns ErrCanceled if the
+// operation was canceled.
+func (p *progress) add(n int64) error {
+	p.done += n
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		p.report()
+		yield()
+	}
+	if p.ctx.Err() != nil {
+		return ErrCanceled
+	}
+	return nil
+}
+
+// report calls the progress function with the current state.
+func (p *progress) report() {
+	if p.fn != nil {
+		p.fn(p.done, p.total)
+	}
+}
+
+// finish reports the final state of the operation.
+func (p *progress) finish() {
+	p.report()
+}
+
+// progressReader is an io.Reader that reports what was read to a progress.
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if perr := pr.p.add(int64(n)); perr != nil {
+		return n, perr
+	}
+	return n, err
+}
+
+// copyProgress copies src to dst like io.Copy, tracking progress and
+// stopping when the operation is canceled.
+func copyProgress(dst io.Writer, src io.Reader, p *progress) (int64, error) {
+	return io.Copy(dst, &progressReader{r: src, p: p})
+}
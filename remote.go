@@ -0,0 +1,185 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall/js"
+)
+
+// Remote images are read with fetch and HTTP Range requests, in blocks
+// that are kept in a cache, so that only the header, the descriptors and
+// the parts of the objects actually looked at are downloaded.
+const (
+	remoteBlockSize   = 64 << 10
+	remoteCacheBlocks = 512 // 32 MiB
+)
+
+// remoteReader reads ranges of an image at url on demand.
+type remoteReader struct {
+	url  string
+	size int64
+
+	mu     sync.Mutex
+	blocks map[int64][]byte // cached blocks, by number
+	order  []int64          // cached block numbers, oldest first
+}
+
+// openRemote fetches the first block of the image at url, which tells
+// its size and whether the server supports range requests.
+func openRemote(url string) (*remoteReader, error) {
+	r := &remoteReader{url: url, blocks: make(map[int64][]byte)}
+	data, err := r.fetch(0, remoteBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	r.store(0, data)
+	return r, nil
+}
+
+// await blocks until promise settles. It must not be called from a
+// JavaScript callback, only from a goroutine (see newPromise).
+func await(promise js.Value) (js.Value, error) {
+	var value js.Value
+	var err error
+	done := make(chan struct{})
+	onResolve := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		value = args[0]
+		close(done)
+		return nil
+	})
+	onReject := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		err = errors.New(args[0].Call("toString").String())
+		close(done)
+		return nil
+	})
+	defer onResolve.Release()
+	defer onReject.Release()
+
+	promise.Call("then", onResolve, onReject)
+	<-done
+	return value, err
+}
+
+// fetch gets length bytes at off (fewer at the end of the file). The
+// first fetch sets the size of the image, the others check it.
+func (r *remoteReader) fetch(off, length int64) ([]byte, error) {
+	headers := map[string]interface{}{"Range": fmt.Sprintf("bytes=%d-%d", off, off+length-1)}
+	resp, err := await(js.Global().Call("fetch", r.url, map[string]interface{}{"headers": headers}))
+	if err != nil {
+		return nil, readError(ErrIO, off, r.url, err, "")
+	}
+
+	switch status := resp.Get("status").Int(); status {
+	case 206:
+	case 200:
+		// the whole file is coming, stop it
+		if body := resp.Get("body"); body.Type() == js.TypeObject {
+			body.Call("cancel")
+		}
+		return nil, readError(ErrNoRanges, off, r.url, nil, "the server sent the whole file")
+	default:
+		return nil, readError(ErrIO, off, r.url, nil, fmt.Sprintf("HTTP %d %s", status, resp.Get("statusText").String()))
+	}
+
+	// Cross-origin, the header is only readable if the server exposes it
+	contentRange := resp.Get("headers").Call("get", "Content-Range")
+	if contentRange.Type() != js.TypeString {
+		return nil, readError(ErrNoRanges, off, r.url, nil, "no Content-Range header (a server on another origin must list it in Access-Control-Expose-Headers)")
+	}
+	var first, last, total int64
+	if _, err := fmt.Sscanf(contentRange.String(), "bytes %d-%d/%d", &first, &last, &total); err != nil || first != off || last < first {
+		return nil, readError(ErrNoRanges, off, r.url, nil, fmt.Sprintf("unexpected Content-Range %q", contentRange.String()))
+	}
+	if r.size == 0 {
+		r.size = total
+	} else if total != r.size {
+		return nil, readError(ErrIO, off, r.url, nil, fmt.Sprintf("the file changed on the server (%d bytes, was %d)", total, r.size))
+	}
+
+	buf, err := await(resp.Call("arrayBuffer"))
+	if err != nil {
+		return nil, readError(ErrIO, off, r.url, err, "")
+	}
+	data := make([]byte, buf.Get("byteLength").Int())
+	js.CopyBytesToGo(data, js.Global().Get("Uint8Array").New(buf))
+	if int64(len(data)) != last-first+1 {
+		return nil, readError(ErrTruncated, off, r.url, nil, fmt.Sprintf("got %d bytes of %d", len(data), last-first+1))
+	}
+	return data, nil
+}
+
+// store caches block b, dropping the oldest block if the cache is full.
+func (r *remoteReader) store(b int64, data []byte) {
+	if len(r.order) >= remoteCacheBlocks {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.blocks[b] = data
+	r.order = append(r.order, b)
+}
+
+// ReadAt copies from the cached blocks, fetching each run of missing
+// blocks with a single request.
+func (r *remoteReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if off+want > r.size {
+		want = r.size - off
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := int64(0)
+	first, last := off/remoteBlockSize, (off+want-1)/remoteBlockSize
+	for b := first; b <= last; {
+		if data, ok := r.blocks[b]; ok {
+			n += int64(copy(p[n:want], data[off+n-b*remoteBlockSize:]))
+			b++
+			continue
+		}
+
+		e := b
+		for e < last {
+			if _, ok := r.blocks[e+1]; ok {
+				break
+			}
+			e++
+		}
+		start := b * remoteBlockSize
+		end := (e + 1) * remoteBlockSize
+		if end > r.size {
+			end = r.size
+		}
+		data, err := r.fetch(start, end-start)
+		if err != nil {
+			return int(n), err
+		}
+		for i := b; i <= e; i++ {
+			lo := (i - b) * remoteBlockSize
+			hi := lo + remoteBlockSize
+			if hi > int64(len(data)) {
+				hi = int64(len(data))
+			}
+			r.store(i, data[lo:hi:hi])
+		}
+		n += int64(copy(p[n:want], data[off+n-start:]))
+		b = e + 1
+	}
+
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
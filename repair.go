@@ -0,0 +1,120 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Fix is a change made by Repair to the header or a descriptor.
+type Fix struct {
+	Offset  int64  `json:"offset"`
+	Context string `json:"context"`
+	Message string `json:"message"`
+}
+
+// Repair fixes the common corruptions of truncated or hand-edited images
+// in the loaded header and descriptors (not in the file, see
+// WriteRepaired): descriptors whose data is past the end of the file are
+// cleared, with the links to them, Dfree and Datalen are recomputed, as is
+// Descrlen if Lint warns about it, and the arch is taken from the primary
+// partition. It returns what was changed, nothing if the image was fine.
+func (fimg *FileImage) Repair() []Fix {
+	var fixes []Fix
+	fix := func(offset int64, context, format string, a ...interface{}) {
+		fixes = append(fixes, Fix{offset, context, fmt.Sprintf(format, a...)})
+	}
+	descrSize := int64(binary.Size(Descriptor{}))
+	h := &fimg.Header
+
+	// descriptors past the end of the file
+	cleared := map[uint32]bool{}
+	for i, v := range fimg.DescrArr {
+		if v.Used && fimg.checkBounds(v) != nil {
+			fix(h.Descroff+int64(i)*descrSize, descriptorContext(v),
+				"cleared, its %d bytes of data at %d are past the end of the file (%d bytes)", v.Filelen, v.Fileoff, fimg.Filesize)
+			cleared[v.ID] = true
+			fimg.DescrArr[i] = Descriptor{}
+		}
+	}
+	for i, v := range fimg.DescrArr {
+		if v.Used && v.Link&DescrGroupMask == 0 && cleared[v.Link] {
+			fix(h.Descroff+int64(i)*descrSize, descriptorContext(v), "link to cleared object %d removed", v.Link)
+			fimg.DescrArr[i].Link = DescrUnusedLink
+		}
+	}
+
+	// header fields computed from the descriptors
+	var used int64
+	end := h.Dataoff
+	for _, v := range fimg.DescrArr {
+		if v.Used {
+			used++
+			if v.Fileoff+v.Filelen > end {
+				end = v.Fileoff + v.Filelen
+			}
+		}
+	}
+	if dfree := h.Dtotal - used; h.Dfree != dfree {
+		fix(hdrDfreeOff, "global header", "dfree %d -> %d", h.Dfree, dfree)
+		h.Dfree = dfree
+	}
+	// descrlen is left alone if it is one of the sizes Lint accepts
+	if descrlen := h.Dtotal * descrSize; h.Descrlen != descrlen && h.Descrlen != used*descrSize {
+		fix(hdrDescrlenOff, "global header", "descrlen %d -> %d", h.Descrlen, descrlen)
+		h.Descrlen = descrlen
+	}
+	if datalen := end - h.Dataoff; h.Datalen != datalen {
+		fix(hdrDatalenOff, "global header", "datalen %d -> %d", h.Datalen, datalen)
+		h.Datalen = datalen
+	}
+
+	// arch of the primary partition
+	fimg.PrimPartID = 0
+	if primary, _, err := fimg.GetPartPrimSys(); err == nil {
+		fimg.PrimPartID = primary.ID
+		p, err := primary.getPartition()
+		if arch := trimZeroBytes(p.Arch[:]); err == nil && arch != trimZeroBytes(h.Arch[:]) {
+			fix(hdrArchOff, "global header", "arch %s -> %s, from the primary partition",
+				GetGoArch(trimZeroBytes(h.Arch[:])), GetGoArch(arch))
+			h.Arch = p.Arch
+		}
+	}
+	return fixes
+}
+
+// WriteRepaired writes a copy of the image to w, with the header and
+// descriptors as they are loaded (e.g., after Repair) and the rest of the
+// file unchanged. Progress is reported in bytes written.
+func (fimg *FileImage) WriteRepaired(ctx context.Context, w io.Writer, fn ProgressFunc) error {
+	var header, descriptors bytes.Buffer
+	if err := binary.Write(&header, binary.LittleEndian, fimg.Header); err != nil {
+		return err
+	}
+	if err := binary.Write(&descriptors, binary.LittleEndian, fimg.DescrArr); err != nil {
+		return err
+	}
+	tableEnd := fimg.Header.Descroff + int64(descriptors.Len())
+	if fimg.Header.Descroff < int64(header.Len()) || tableEnd > fimg.Filesize {
+		return readError(ErrDescriptorBounds, fimg.Header.Descroff, "descriptor table", nil,
+			"the descriptor table overlaps the header or the end of the file")
+	}
+
+	r := io.MultiReader(
+		&header,
+		io.NewSectionReader(fimg.Reader, int64(header.Len()), fimg.Header.Descroff-int64(header.Len())),
+		&descriptors,
+		io.NewSectionReader(fimg.Reader, tableEnd, fimg.Filesize-tableEnd),
+	)
+	p := newProgress(ctx, fimg.Filesize, fn)
+	defer p.finish()
+	_, err := copyProgress(w, r, p)
+	return err
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// repairBytes repairs a SIF in memory, and returns the fixes and the
+// repaired image.
+func repairBytes(t *testing.T, image []byte) ([]Fix, []byte) {
+	fimg, _ := loadBytes(image)
+	fixes := fimg.Repair()
+	var out bytes.Buffer
+	if err := fimg.WriteRepaired(context.Background(), &out, nil); err != nil {
+		t.Fatal(err)
+	}
+	return fixes, out.Bytes()
+}
+
+func TestRepairClean(t *testing.T) {
+	image := testImage(t)
+	descrSize := int64(binary.Size(Descriptor{}))
+
+	for _, descrlen := range []int64{DescrNumEntries * descrSize, 3 * descrSize} {
+		in := editImage(t, image, func(h *Header, d []Descriptor) { h.Descrlen = descrlen })
+		fixes, out := repairBytes(t, in)
+		if len(fixes) > 0 {
+			t.Errorf("descrlen %d: got fixes %+v", descrlen, fixes)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("descrlen %d: the image was changed", descrlen)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	image := editImage(t, testImage(t), func(h *Header, d []Descriptor) {
+		h.Descrlen = 7
+		h.Dfree = 0
+		h.Datalen += 100
+		copy(h.Arch[:], HdrArchARM64)
+		d[1].Filelen = 1 << 40
+		d[0].Link = d[1].ID
+	})
+	if len(lintBytes(image)) == 0 {
+		t.Fatal("the broken image lints clean")
+	}
+
+	fixes, out := repairBytes(t, image)
+	want := []int64{
+		DescrStartOffset + 585, // x.json cleared
+		DescrStartOffset,       // link to it removed
+		hdrDfreeOff,
+		hdrDescrlenOff,
+		hdrDatalenOff,
+		hdrArchOff,
+	}
+	if len(fixes) != len(want) {
+		t.Fatalf("got fixes %+v, want %d", fixes, len(want))
+	}
+	for i, f := range fixes {
+		if f.Offset != want[i] {
+			t.Errorf("fix %d: got %q at %d, want offset %d", i, f.Message, f.Offset, want[i])
+		}
+	}
+
+	checkDescriptorTable(t, out)
+	if findings := lintBytes(out); len(findings) > 0 {
+		t.Errorf("got findings after repair %+v", findings)
+	}
+	if fixes, _ := repairBytes(t, out); len(fixes) > 0 {
+		t.Errorf("repairing again: got fixes %+v", fixes)
+	}
+}
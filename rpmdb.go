@@ -0,0 +1,492 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The RPM database holds a header blob per installed package, in a SQLite
+// database (rpmdb.sqlite, RPM 4.16 and later) or a Berkeley DB hash
+// database (Packages). Both are read here directly, only as far as needed
+// to get the blobs.
+
+// RPM header tags and types used for packages.
+const (
+	rpmTagName      = 1000
+	rpmTagVersion   = 1001
+	rpmTagRelease   = 1002
+	rpmTagEpoch     = 1003
+	rpmTagVendor    = 1011
+	rpmTagLicense   = 1014
+	rpmTagArch      = 1022
+	rpmTagSourceRPM = 1044
+
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// errNotRpmHeader is returned for a database value that is not a header.
+var errNotRpmHeader = errors.New("not an RPM header")
+
+// parseRpmHeader reads the package fields of an RPM header blob, as stored
+// in the database: index length, data length, index entries, data. The
+// version is [epoch:]version-release.
+func parseRpmHeader(blob []byte) (Package, error) {
+	pkg := Package{Type: "rpm"}
+	if len(blob) < 8 {
+		return pkg, errNotRpmHeader
+	}
+	il := int64(binary.BigEndian.Uint32(blob[0:4]))
+	dl := int64(binary.BigEndian.Uint32(blob[4:8]))
+	if il < 1 || 8+il*16+dl > int64(len(blob)) {
+		return pkg, errNotRpmHeader
+	}
+	data := blob[8+il*16 : 8+il*16+dl]
+
+	var epoch, release string
+	for i := int64(0); i < il; i++ {
+		entry := blob[8+i*16 : 8+i*16+16]
+		tag := binary.BigEndian.Uint32(entry[0:4])
+		typ := binary.BigEndian.Uint32(entry[4:8])
+		off := int64(binary.BigEndian.Uint32(entry[8:12]))
+		if off >= int64(len(data)) {
+			continue
+		}
+
+		var value string
+		switch typ {
+		case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+			value = string(data[off:])
+			if end := strings.IndexByte(value, 0); end >= 0 {
+				value = value[:end]
+			}
+		case rpmTypeInt32:
+			if off+4 > int64(len(data)) {
+				continue
+			}
+			value = strconv.FormatUint(uint64(binary.BigEndian.Uint32(data[off:])), 10)
+		default:
+			continue
+		}
+
+		switch tag {
+		case rpmTagName:
+			pkg.Name = value
+		case rpmTagVersion:
+			pkg.Version = value
+		case rpmTagRelease:
+			release = value
+		case rpmTagEpoch:
+			epoch = value
+		case rpmTagVendor:
+			pkg.Supplier = value
+		case rpmTagLicense:
+			pkg.License = value
+		case rpmTagArch:
+			pkg.Arch = value
+		case rpmTagSourceRPM:
+			pkg.Source = sourceRpmName(value)
+		}
+	}
+	if pkg.Name == "" || pkg.Version == "" {
+		return pkg, errNotRpmHeader
+	}
+	if release != "" {
+		pkg.Version += "-" + release
+	}
+	if epoch != "" && epoch != "0" {
+		pkg.Version = epoch + ":" + pkg.Version
+	}
+	return pkg, nil
+}
+
+// sourceRpmName returns the name of the package of a source RPM file name,
+// name-version-release.src.rpm.
+func sourceRpmName(file string) string {
+	s := strings.TrimSuffix(strings.TrimSuffix(file, ".rpm"), ".src")
+	for i := 0; i < 2; i++ {
+		if j := strings.LastIndexByte(s, '-'); j > 0 {
+			s = s[:j]
+		}
+	}
+	return s
+}
+
+// rpmPackages reads the packages of an RPM database, either format.
+func rpmPackages(db []byte) ([]Package, error) {
+	var blobs [][]byte
+	var err error
+	if bytes.HasPrefix(db, []byte(sqliteMagic)) {
+		blobs, err = sqliteRpmBlobs(db)
+	} else {
+		blobs, err = bdbHashValues(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgs []Package
+	for _, blob := range blobs {
+		pkg, err := parseRpmHeader(blob)
+		if err != nil || pkg.Name == "gpg-pubkey" {
+			continue // the count record, or an imported key
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// sqliteMagic starts every SQLite database file.
+const sqliteMagic = "SQLite format 3\x00"
+
+// sqliteDB reads the table b-trees of a SQLite database in memory.
+type sqliteDB struct {
+	data     []byte
+	pageSize int
+	usable   int
+	seen     map[uint32]bool // pages of the table being read
+}
+
+// sqliteRpmBlobs returns the blob column of the Packages table.
+func sqliteRpmBlobs(data []byte) ([][]byte, error) {
+	if len(data) < 100 {
+		return nil, fmt.Errorf("sqlite: file too short")
+	}
+	db := &sqliteDB{data: data, pageSize: int(binary.BigEndian.Uint16(data[16:18]))}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	db.usable = db.pageSize - int(data[20])
+	if db.pageSize < 512 || db.usable < 480 {
+		return nil, fmt.Errorf("sqlite: bad page size %d", db.pageSize)
+	}
+
+	// sqlite_schema: type, name, tbl_name, rootpage, sql
+	var root int64
+	err := db.table(1, func(row []interface{}) {
+		if len(row) >= 4 && row[0] == "table" && row[1] == "Packages" {
+			root, _ = row[3].(int64)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root == 0 {
+		return nil, fmt.Errorf("sqlite: no Packages table")
+	}
+
+	var blobs [][]byte
+	err = db.table(uint32(root), func(row []interface{}) {
+		if len(row) >= 2 {
+			if blob, ok := row[1].([]byte); ok {
+				blobs = append(blobs, blob)
+			}
+		}
+	})
+	return blobs, err
+}
+
+// page returns page n (from 1).
+func (db *sqliteDB) page(n uint32) ([]byte, error) {
+	off := int64(n-1) * int64(db.pageSize)
+	if n == 0 || off+int64(db.pageSize) > int64(len(db.data)) {
+		return nil, fmt.Errorf("sqlite: page %d out of the file", n)
+	}
+	return db.data[off : off+int64(db.pageSize)], nil
+}
+
+// table calls fn with the columns of every row of the table b-tree at
+// page root, in rowid order.
+func (db *sqliteDB) table(root uint32, fn func(row []interface{})) error {
+	db.seen = make(map[uint32]bool)
+	return db.walk(root, 0, fn)
+}
+
+func (db *sqliteDB) walk(n uint32, depth int, fn func(row []interface{})) error {
+	if depth > 20 || db.seen[n] {
+		return fmt.Errorf("sqlite: page %d: loop in the b-tree", n)
+	}
+	db.seen[n] = true
+	page, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	hdr := 0
+	if n == 1 {
+		hdr = 100 // the database header
+	}
+	if hdr+12 > len(page) {
+		return fmt.Errorf("sqlite: page %d too short", n)
+	}
+	kind := page[hdr]
+	cells := int(binary.BigEndian.Uint16(page[hdr+3:]))
+	ptrs := hdr + 8
+	if kind == 0x05 {
+		ptrs = hdr + 12
+	}
+	if ptrs+2*cells > len(page) {
+		return fmt.Errorf("sqlite: page %d: bad cell count", n)
+	}
+
+	for i := 0; i < cells; i++ {
+		off := int(binary.BigEndian.Uint16(page[ptrs+2*i:]))
+		if off >= len(page) {
+			return fmt.Errorf("sqlite: page %d: cell out of the page", n)
+		}
+		switch kind {
+		case 0x05: // interior: left child, key
+			if off+4 > len(page) {
+				return fmt.Errorf("sqlite: page %d: cell out of the page", n)
+			}
+			if err := db.walk(binary.BigEndian.Uint32(page[off:]), depth+1, fn); err != nil {
+				return err
+			}
+		case 0x0d: // leaf: payload size, rowid, payload
+			payload, err := db.payload(page, off)
+			if err != nil {
+				return fmt.Errorf("sqlite: page %d: %s", n, err)
+			}
+			row, err := sqliteRecord(payload)
+			if err != nil {
+				return fmt.Errorf("sqlite: page %d: %s", n, err)
+			}
+			fn(row)
+		default:
+			return fmt.Errorf("sqlite: page %d is not a table page (type %#x)", n, kind)
+		}
+	}
+	if kind == 0x05 {
+		return db.walk(binary.BigEndian.Uint32(page[hdr+8:]), depth+1, fn)
+	}
+	return nil
+}
+
+// payload returns the payload of the leaf cell at off, following the
+// overflow pages if it doesn't fit in the page.
+func (db *sqliteDB) payload(page []byte, off int) ([]byte, error) {
+	size, n := sqliteVarint(page[off:])
+	off += n
+	_, n = sqliteVarint(page[off:]) // rowid
+	off += n
+
+	u := int64(db.usable)
+	local := size
+	if max := u - 35; size > max {
+		m := (u-12)*32/255 - 23
+		local = m + (size-m)%(u-4)
+		if local > max {
+			local = m
+		}
+	}
+	if size < 0 || int64(off)+local > int64(len(page)) || size > int64(len(db.data)) {
+		return nil, fmt.Errorf("cell out of the page")
+	}
+	payload := append([]byte(nil), page[off:off+int(local)]...)
+	if local == size {
+		return payload, nil
+	}
+
+	if off+int(local)+4 > len(page) {
+		return nil, fmt.Errorf("cell out of the page")
+	}
+	next := binary.BigEndian.Uint32(page[off+int(local):])
+	for int64(len(payload)) < size {
+		if next == 0 {
+			return nil, fmt.Errorf("overflow chain too short")
+		}
+		ovf, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		next = binary.BigEndian.Uint32(ovf)
+		chunk := ovf[4:db.usable]
+		if rest := size - int64(len(payload)); int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		payload = append(payload, chunk...)
+	}
+	return payload, nil
+}
+
+// sqliteVarint decodes a SQLite variable-length integer, returning it and
+// its length.
+func sqliteVarint(b []byte) (int64, int) {
+	var v int64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | int64(b[i]), 9
+		}
+		v = v<<7 | int64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
+
+// sqliteRecord decodes a record into nil, int64, string or []byte values
+// (floats are left as their bits).
+func sqliteRecord(payload []byte) ([]interface{}, error) {
+	hdrLen, n := sqliteVarint(payload)
+	if hdrLen > int64(len(payload)) || hdrLen < int64(n) {
+		return nil, fmt.Errorf("bad record header")
+	}
+	var types []int64
+	for pos := n; pos < int(hdrLen); {
+		t, n := sqliteVarint(payload[pos:hdrLen])
+		types = append(types, t)
+		pos += n
+	}
+
+	var row []interface{}
+	body := payload[hdrLen:]
+	for _, t := range types {
+		size := int64(0)
+		switch {
+		case t >= 1 && t <= 4:
+			size = t
+		case t == 5:
+			size = 6
+		case t == 6 || t == 7:
+			size = 8
+		case t >= 12:
+			size = (t - 12) / 2
+		}
+		if size > int64(len(body)) {
+			return nil, fmt.Errorf("record out of the cell")
+		}
+		v := body[:size]
+		body = body[size:]
+
+		switch {
+		case t == 0:
+			row = append(row, nil)
+		case t >= 1 && t <= 7:
+			var x int64
+			if len(v) > 0 && v[0]&0x80 != 0 {
+				x = -1
+			}
+			for _, c := range v {
+				x = x<<8 | int64(c)
+			}
+			row = append(row, x)
+		case t == 8 || t == 9:
+			row = append(row, t-8)
+		case t >= 12 && t%2 == 0:
+			row = append(row, v)
+		case t >= 13:
+			row = append(row, string(v))
+		default:
+			return nil, fmt.Errorf("bad serial type %d", t)
+		}
+	}
+	return row, nil
+}
+
+// Berkeley DB hash databases: a metadata page, then pages of key/data
+// items. Values too large for a page, like RPM headers, are kept in
+// chains of overflow pages.
+const (
+	bdbHashMagic    = 0x061561
+	bdbPageHash     = 13
+	bdbPageHashOld  = 2 // unsorted hash pages
+	bdbPageOverflow = 7
+	bdbItemKeyData  = 1
+	bdbItemOffPage  = 3
+	bdbPageHeader   = 26
+)
+
+// bdbHashValues returns the data items of a Berkeley DB hash database.
+func bdbHashValues(data []byte) ([][]byte, error) {
+	if len(data) < 512 {
+		return nil, fmt.Errorf("not a Berkeley DB hash database")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(data[12:]) != bdbHashMagic {
+		order = binary.BigEndian
+		if order.Uint32(data[12:]) != bdbHashMagic {
+			return nil, fmt.Errorf("not a Berkeley DB hash database")
+		}
+	}
+	pageSize := int(order.Uint32(data[20:]))
+	if pageSize < 512 || pageSize > 65536 {
+		return nil, fmt.Errorf("bdb: bad page size %d", pageSize)
+	}
+
+	var values [][]byte
+	for off := pageSize; off+pageSize <= len(data); off += pageSize {
+		page := data[off : off+pageSize]
+		if page[25] != bdbPageHash && page[25] != bdbPageHashOld {
+			continue
+		}
+		entries := int(order.Uint16(page[20:]))
+		if bdbPageHeader+2*entries > pageSize {
+			continue
+		}
+		// keys and data alternate; items are stored from the end of the page
+		for i := 1; i < entries; i += 2 {
+			itemOff := int(order.Uint16(page[bdbPageHeader+2*i:]))
+			end := int(order.Uint16(page[bdbPageHeader+2*(i-1):]))
+			if itemOff >= pageSize || end > pageSize || end <= itemOff {
+				continue
+			}
+			switch page[itemOff] {
+			case bdbItemKeyData:
+				values = append(values, page[itemOff+1:end])
+			case bdbItemOffPage:
+				if itemOff+12 > pageSize {
+					continue
+				}
+				value, err := bdbOverflow(data, pageSize, order, order.Uint32(page[itemOff+4:]), order.Uint32(page[itemOff+8:]))
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			}
+		}
+	}
+	return values, nil
+}
+
+// bdbOverflow reads a value of length bytes from the overflow pages
+// starting at page n.
+func bdbOverflow(data []byte, pageSize int, order binary.ByteOrder, n, length uint32) ([]byte, error) {
+	if int64(length) > int64(len(data)) {
+		return nil, fmt.Errorf("bdb: overflow value larger than the file")
+	}
+	value := make([]byte, 0, length)
+	for uint32(len(value)) < length {
+		off := int64(n) * int64(pageSize)
+		if n == 0 || off+int64(pageSize) > int64(len(data)) {
+			return nil, fmt.Errorf("bdb: overflow page %d out of the file", n)
+		}
+		page := data[off : off+int64(pageSize)]
+		if page[25] != bdbPageOverflow {
+			return nil, fmt.Errorf("bdb: page %d is not an overflow page", n)
+		}
+		used := int(order.Uint16(page[22:])) // hf_offset holds the length
+		if bdbPageHeader+used > pageSize {
+			return nil, fmt.Errorf("bdb: overflow page %d: bad length", n)
+		}
+		value = append(value, page[bdbPageHeader:bdbPageHeader+used]...)
+		n = order.Uint32(page[16:])
+		if used == 0 {
+			break
+		}
+	}
+	if uint32(len(value)) < length {
+		return nil, fmt.Errorf("bdb: overflow chain too short")
+	}
+	return value[:length], nil
+}
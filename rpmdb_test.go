@@ -0,0 +1,260 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rpmHeaderBlob encodes string tags as an RPM header blob.
+func rpmHeaderBlob(tags map[uint32]string) []byte {
+	var index, data bytes.Buffer
+	for _, tag := range []uint32{rpmTagName, rpmTagVersion, rpmTagRelease, rpmTagEpoch, rpmTagLicense, rpmTagArch, rpmTagSourceRPM} {
+		value, ok := tags[tag]
+		if !ok {
+			continue
+		}
+		binary.Write(&index, binary.BigEndian, [4]uint32{tag, rpmTypeString, uint32(data.Len()), 1})
+		data.WriteString(value + "\x00")
+	}
+	var blob bytes.Buffer
+	binary.Write(&blob, binary.BigEndian, [2]uint32{uint32(index.Len() / 16), uint32(data.Len())})
+	blob.Write(index.Bytes())
+	blob.Write(data.Bytes())
+	return blob.Bytes()
+}
+
+// sqliteVarintBytes encodes v as a SQLite varint.
+func sqliteVarintBytes(v int64) []byte {
+	if uint64(v) > 1<<56-1 {
+		b := make([]byte, 9)
+		b[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			b[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return b
+	}
+	var b []byte
+	for {
+		b = append([]byte{byte(v & 0x7f)}, b...)
+		if v >>= 7; v == 0 {
+			break
+		}
+	}
+	for i := 0; i < len(b)-1; i++ {
+		b[i] |= 0x80
+	}
+	return b
+}
+
+// sqliteRecordBytes encodes a record of int64, string and []byte values.
+func sqliteRecordBytes(values ...interface{}) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case int64:
+			types = append(types, 1)
+			body = append(body, byte(v))
+		case string:
+			types = append(types, sqliteVarintBytes(int64(13+2*len(v)))...)
+			body = append(body, v...)
+		case []byte:
+			types = append(types, sqliteVarintBytes(int64(12+2*len(v)))...)
+			body = append(body, v...)
+		}
+	}
+	hdr := append(sqliteVarintBytes(int64(len(types)+1)), types...)
+	return append(hdr, body...)
+}
+
+// craftSqlite builds a SQLite database of 512 byte pages with a Packages
+// table holding blobs, spilling into overflow pages as SQLite does.
+func craftSqlite(blobs [][]byte) []byte {
+	const pageSize = 512
+	var pages [][]byte
+	newPage := func() []byte {
+		pages = append(pages, make([]byte, pageSize))
+		return pages[len(pages)-1]
+	}
+	// leaf writes cells to a table leaf page, the header at hdr
+	leaf := func(page []byte, hdr int, cells [][]byte) {
+		page[hdr] = 0x0d
+		binary.BigEndian.PutUint16(page[hdr+3:], uint16(len(cells)))
+		end := pageSize
+		for i, c := range cells {
+			end -= len(c)
+			copy(page[end:], c)
+			binary.BigEndian.PutUint16(page[hdr+8+2*i:], uint16(end))
+		}
+	}
+
+	schema := newPage()
+	copy(schema, sqliteMagic)
+	binary.BigEndian.PutUint16(schema[16:], pageSize)
+	table := newPage()
+	leaf(schema, 100, [][]byte{append(append(sqliteVarintBytes(int64(len(sqliteRecordBytes("table", "Packages", "Packages", int64(2), "")))), 1),
+		sqliteRecordBytes("table", "Packages", "Packages", int64(2), "")...)})
+
+	var cells [][]byte
+	for i, blob := range blobs {
+		payload := sqliteRecordBytes(int64(i+1), blob)
+		size := int64(len(payload))
+		local := size
+		if size > pageSize-35 {
+			m := int64((pageSize-12)*32/255 - 23)
+			if local = m + (size-m)%(pageSize-4); local > pageSize-35 {
+				local = m
+			}
+		}
+		cell := append(sqliteVarintBytes(size), byte(i+1))
+		cell = append(cell, payload[:local]...)
+		if local < size {
+			cell = append(cell, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(cell[len(cell)-4:], uint32(len(pages)+1))
+			for rest := payload[local:]; len(rest) > 0; {
+				page := newPage()
+				n := copy(page[4:], rest)
+				if rest = rest[n:]; len(rest) > 0 {
+					binary.BigEndian.PutUint32(page, uint32(len(pages)+1))
+				}
+			}
+		}
+		cells = append(cells, cell)
+	}
+	leaf(table, 0, cells)
+	return bytes.Join(pages, nil)
+}
+
+// craftBdb builds a little-endian Berkeley DB hash database of 512 byte
+// pages with one hash page: the count record inline, then the values in
+// overflow pages.
+func craftBdb(values [][]byte) []byte {
+	const pageSize = 512
+	le := binary.LittleEndian
+	meta := make([]byte, pageSize)
+	le.PutUint32(meta[12:], bdbHashMagic)
+	le.PutUint32(meta[20:], pageSize)
+	hash := make([]byte, pageSize)
+	hash[25] = bdbPageHash
+
+	var items [][]byte
+	var overflow []byte
+	items = append(items, []byte{bdbItemKeyData, 0, 0, 0, 0}, []byte{bdbItemKeyData, 0, 0, 0, 0})
+	for i, v := range values {
+		item := make([]byte, 12)
+		item[0] = bdbItemOffPage
+		le.PutUint32(item[4:], uint32(2+len(overflow)/pageSize))
+		le.PutUint32(item[8:], uint32(len(v)))
+		items = append(items, []byte{bdbItemKeyData, byte(i + 1), 0, 0, 0}, item)
+		for rest := v; len(rest) > 0; {
+			page := make([]byte, pageSize)
+			page[25] = bdbPageOverflow
+			n := copy(page[bdbPageHeader:], rest)
+			le.PutUint16(page[22:], uint16(n))
+			if rest = rest[n:]; len(rest) > 0 {
+				le.PutUint32(page[16:], uint32(2+len(overflow)/pageSize+1))
+			}
+			overflow = append(overflow, page...)
+		}
+	}
+	le.PutUint16(hash[20:], uint16(len(items)))
+	end := pageSize
+	for i, item := range items {
+		end -= len(item)
+		copy(hash[end:], item)
+		le.PutUint16(hash[bdbPageHeader+2*i:], uint16(end))
+	}
+	return append(append(meta, hash...), overflow...)
+}
+
+// testRpmPackages are the packages in the crafted databases, one with a
+// header long enough for overflow pages.
+var testRpmPackages = []Package{
+	{Name: "bash", Version: "5.1.8-6.el9", Type: "rpm", Arch: "x86_64", License: "GPLv3+", Source: "bash"},
+	{Name: "kernel", Version: "1:5.14.0-362.el9", Type: "rpm", Arch: "x86_64", License: strings.Repeat("GPLv2 and ", 100) + "MIT", Source: "kernel"},
+}
+
+func testRpmBlobs() [][]byte {
+	var blobs [][]byte
+	for _, p := range testRpmPackages {
+		tags := map[uint32]string{rpmTagName: p.Name, rpmTagArch: p.Arch, rpmTagLicense: p.License, rpmTagSourceRPM: p.Source + "-1-1.src.rpm"}
+		version := p.Version
+		if i := strings.IndexByte(version, ':'); i >= 0 {
+			tags[rpmTagEpoch], version = version[:i], version[i+1:]
+		}
+		i := strings.LastIndexByte(version, '-')
+		tags[rpmTagVersion], tags[rpmTagRelease] = version[:i], version[i+1:]
+		blobs = append(blobs, rpmHeaderBlob(tags))
+	}
+	return blobs
+}
+
+func TestRpmPackages(t *testing.T) {
+	for name, db := range map[string][]byte{"sqlite": craftSqlite(testRpmBlobs()), "bdb": craftBdb(testRpmBlobs())} {
+		t.Run(name, func(t *testing.T) {
+			pkgs, err := rpmPackages(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pkgs, testRpmPackages) {
+				t.Errorf("got %+v, want %+v", pkgs, testRpmPackages)
+			}
+		})
+	}
+}
+
+func TestRpmPackagesMalformed(t *testing.T) {
+	// a leaf cell whose 9-byte payload size varint is negative
+	negative := craftSqlite(testRpmBlobs()[:1])
+	cell := int(binary.BigEndian.Uint16(negative[512+8:]))
+	copy(negative[512+cell:], sqliteVarintBytes(-20))
+
+	// a hash page item that ends where it starts
+	empty := craftBdb(testRpmBlobs()[:1])
+	hash := empty[512:1024]
+	binary.LittleEndian.PutUint16(hash[bdbPageHeader+2*3:], binary.LittleEndian.Uint16(hash[bdbPageHeader+2*2:]))
+
+	for name, db := range map[string][]byte{"negative payload size": negative, "empty item": empty} {
+		t.Run(name, func(t *testing.T) {
+			pkgs, err := rpmPackages(db)
+			if err == nil && len(pkgs) != 0 {
+				t.Errorf("got %+v, want no packages", pkgs)
+			}
+		})
+	}
+}
+
+// TestRpmPackagesCorrupt truncates and scribbles over the crafted
+// databases: errors are fine, panics are not.
+func TestRpmPackagesCorrupt(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for name, db := range map[string][]byte{"sqlite": craftSqlite(testRpmBlobs()), "bdb": craftBdb(testRpmBlobs())} {
+		for n := 0; n < len(db); n += 7 {
+			rpmPackages(db[:n])
+		}
+		for i := 0; i < 2000; i++ {
+			corrupt := append([]byte(nil), db...)
+			for j := 0; j < 1+r.Intn(8); j++ {
+				corrupt[r.Intn(len(corrupt))] = byte(r.Intn(256))
+			}
+			func() {
+				defer func() {
+					if p := recover(); p != nil {
+						t.Fatalf("%s: panic on corrupted database (%d): %v", name, i, p)
+					}
+				}()
+				rpmPackages(corrupt)
+			}()
+		}
+	}
+}
@@ -0,0 +1,570 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// Package is a software package installed in the image, as its package
+// manager recorded it. Version is the full version the package manager
+// compares, with the epoch and release if any.
+type Package struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	Type          string `json:"type"` // deb, rpm, apk, pypi or conda
+	Arch          string `json:"arch,omitempty"`
+	Source        string `json:"source,omitempty"` // the source package
+	SourceVersion string `json:"sourceVersion,omitempty"`
+	License       string `json:"license,omitempty"`
+	Supplier      string `json:"supplier,omitempty"` // maintainer or vendor
+	Location      string `json:"location"`           // the database it was found in
+	PURL          string `json:"purl"`
+}
+
+// Distro identifies the distribution of the image, from os-release.
+type Distro struct {
+	ID        string `json:"id"`
+	VersionID string `json:"versionId"`
+	Name      string `json:"name"`
+}
+
+// SBOM is the list of packages installed in the primary partition of an
+// image. Warnings tell about package databases that could not be read.
+type SBOM struct {
+	Image    string    `json:"image"`
+	ID       string    `json:"id"`
+	Arch     string    `json:"arch"`
+	Distro   *Distro   `json:"distro,omitempty"`
+	Packages []Package `json:"packages"`
+	Warnings []string  `json:"warnings"`
+}
+
+// Package databases at fixed paths.
+const (
+	dpkgStatus    = "/var/lib/dpkg/status"
+	dpkgStatusDir = "/var/lib/dpkg/status.d" // distroless images
+	apkInstalled  = "/lib/apk/db/installed"
+)
+
+// rpmDatabases are where RPM keeps its database, newest first.
+var rpmDatabases = []string{
+	"/usr/lib/sysimage/rpm/rpmdb.sqlite",
+	"/var/lib/rpm/rpmdb.sqlite",
+	"/usr/lib/sysimage/rpm/Packages",
+	"/var/lib/rpm/Packages",
+}
+
+// readImageFile returns the content of the file at p in fs, following
+// symbolic links.
+func readImageFile(fs *SquashFS, p string) ([]byte, error) {
+	for i := 0; i < 40; i++ {
+		inode, err := fs.Lookup(p)
+		if err != nil {
+			return nil, err
+		}
+		if inode.Mode&os.ModeSymlink == 0 {
+			r, err := fs.Open(inode)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", p, err)
+			}
+			return ioutil.ReadAll(r)
+		}
+		if path.IsAbs(inode.Target) {
+			p = inode.Target
+		} else {
+			p = path.Join(path.Dir(p), inode.Target)
+		}
+	}
+	return nil, fmt.Errorf("%s: too many levels of symbolic links", p)
+}
+
+// Packages reads the package databases of the primary partition: dpkg,
+// apk and RPM, and the Python and conda packages found anywhere. Progress
+// is reported in inodes walked.
+func (fimg *FileImage) Packages(ctx context.Context, name string, fn ProgressFunc) (*SBOM, error) {
+	fs, err := fimg.GetPrimSquashFS()
+	if err != nil {
+		return nil, err
+	}
+	h := fimg.headerInfo()
+	sbom := &SBOM{Image: name, ID: h.ID, Arch: h.Arch, Packages: []Package{}, Warnings: []string{}}
+	sbom.Distro = readDistro(fs)
+
+	// found adds the packages of a database, or a warning if it's broken
+	found := func(location string, pkgs []Package, err error) {
+		if err != nil {
+			sbom.Warnings = append(sbom.Warnings, fmt.Sprintf("%s: %s", location, err))
+		}
+		for _, pkg := range pkgs {
+			pkg.Location = location
+			sbom.Packages = append(sbom.Packages, pkg)
+		}
+	}
+
+	if data, err := readImageFile(fs, dpkgStatus); err == nil {
+		found(dpkgStatus, parseDpkgStatus(data, true), nil)
+	}
+	if data, err := readImageFile(fs, apkInstalled); err == nil {
+		found(apkInstalled, parseApkInstalled(data), nil)
+	}
+	for _, p := range rpmDatabases {
+		data, err := readImageFile(fs, p)
+		if err != nil {
+			continue
+		}
+		pkgs, err := rpmPackages(data)
+		found(p, pkgs, err)
+		break
+	}
+
+	// the other databases are files in directories that can be anywhere
+	prog := newProgress(ctx, int64(fs.sb.InodeCount), fn)
+	err = fs.Walk("/", func(p string, inode *SquashInode) error {
+		if err := prog.add(1); err != nil {
+			return err
+		}
+		if !inode.IsRegular() {
+			return nil
+		}
+		dir, base := path.Split(p)
+		switch {
+		case dir == dpkgStatusDir+"/" && !strings.HasSuffix(base, ".md5sums"):
+			data, err := readImageFile(fs, p)
+			found(p, parseDpkgStatus(data, false), err)
+		case strings.HasSuffix(dir, ".dist-info/") && base == "METADATA",
+			strings.HasSuffix(dir, ".egg-info/") && base == "PKG-INFO",
+			strings.HasSuffix(base, ".egg-info") && strings.Contains(dir, "-packages/"):
+			data, err := readImageFile(fs, p)
+			if err != nil {
+				found(p, nil, err)
+			} else if pkg, ok := parsePythonMetadata(data); ok {
+				found(p, []Package{pkg}, nil)
+			}
+		case strings.HasSuffix(dir, "/conda-meta/") && strings.HasSuffix(base, ".json"):
+			data, err := readImageFile(fs, p)
+			if err == nil {
+				var pkg Package
+				pkg, err = parseCondaMeta(data)
+				if err == nil {
+					found(p, []Package{pkg}, nil)
+					return nil
+				}
+			}
+			found(p, nil, err)
+		}
+		return nil
+	})
+	prog.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sbom.Packages {
+		sbom.Packages[i].PURL = packageURL(sbom.Packages[i], sbom.Distro)
+	}
+	sort.SliceStable(sbom.Packages, func(i, j int) bool {
+		a, b := sbom.Packages[i], sbom.Packages[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Name < b.Name
+	})
+	return sbom, nil
+}
+
+// readDistro reads os-release, or returns nil if there is none.
+func readDistro(fs *SquashFS) *Distro {
+	data, err := readImageFile(fs, "/etc/os-release")
+	if err != nil {
+		if data, err = readImageFile(fs, "/usr/lib/os-release"); err != nil {
+			return nil
+		}
+	}
+	d := &Distro{}
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		value := shellUnquote(strings.TrimSpace(line[i+1:]))
+		switch strings.TrimSpace(line[:i]) {
+		case "ID":
+			d.ID = value
+		case "VERSION_ID":
+			d.VersionID = value
+		case "PRETTY_NAME":
+			d.Name = value
+		}
+	}
+	if d.ID == "" {
+		return nil
+	}
+	return d
+}
+
+// parseControl splits RFC 822 style paragraphs (dpkg status, Python
+// metadata) into fields. Continuation lines are joined with newlines.
+func parseControl(data []byte) []map[string]string {
+	var paragraphs []map[string]string
+	var cur map[string]string
+	var last string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			cur = nil
+		case line[0] == ' ' || line[0] == '\t':
+			if cur != nil && last != "" {
+				cur[last] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			i := strings.IndexByte(line, ':')
+			if i < 0 {
+				continue
+			}
+			if cur == nil {
+				cur = map[string]string{}
+				paragraphs = append(paragraphs, cur)
+			}
+			last = line[:i]
+			if _, dup := cur[last]; !dup {
+				cur[last] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return paragraphs
+}
+
+// parseDpkgStatus reads the packages of a dpkg status file. If installed,
+// only those with an installed status are kept (status.d files have none).
+func parseDpkgStatus(data []byte, installed bool) []Package {
+	var pkgs []Package
+	for _, p := range parseControl(data) {
+		if p["Package"] == "" || installed && !strings.HasSuffix(p["Status"], " installed") {
+			continue
+		}
+		pkg := Package{Name: p["Package"], Version: p["Version"], Type: "deb", Arch: p["Architecture"], Supplier: p["Maintainer"]}
+		if src := p["Source"]; src != "" {
+			// "name" or "name (version)"
+			if i := strings.Index(src, " ("); i > 0 {
+				pkg.SourceVersion = strings.TrimSuffix(src[i+2:], ")")
+				src = src[:i]
+			}
+			pkg.Source = src
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// parseApkInstalled reads the packages of the apk database: records of
+// "X:value" lines separated by blank lines.
+func parseApkInstalled(data []byte) []Package {
+	var pkgs []Package
+	var pkg Package
+	flush := func() {
+		if pkg.Name != "" {
+			pkg.Type = "apk"
+			pkgs = append(pkgs, pkg)
+		}
+		pkg = Package{}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) < 2 || line[1] != ':' {
+			if strings.TrimSpace(line) == "" {
+				flush()
+			}
+			continue
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'P':
+			pkg.Name = value
+		case 'V':
+			pkg.Version = value
+		case 'A':
+			pkg.Arch = value
+		case 'L':
+			pkg.License = value
+		case 'o':
+			pkg.Source = value
+		case 'm':
+			pkg.Supplier = value
+		}
+	}
+	flush()
+	return pkgs
+}
+
+// parsePythonMetadata reads the name and version of a Python distribution
+// from its METADATA or PKG-INFO file.
+func parsePythonMetadata(data []byte) (Package, bool) {
+	paragraphs := parseControl(data)
+	if len(paragraphs) == 0 {
+		return Package{}, false
+	}
+	p := paragraphs[0]
+	pkg := Package{Name: p["Name"], Version: p["Version"], Type: "pypi", License: p["License-Expression"], Supplier: p["Author"]}
+	if pkg.License == "" && !strings.Contains(p["License"], "\n") && p["License"] != "UNKNOWN" {
+		pkg.License = p["License"]
+	}
+	return pkg, pkg.Name != "" && pkg.Version != ""
+}
+
+// parseCondaMeta reads a package record of a conda environment.
+func parseCondaMeta(data []byte) (Package, error) {
+	var meta struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+		Build   string `json:"build"`
+		License string `json:"license"`
+		Subdir  string `json:"subdir"`
+		Channel string `json:"channel"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return Package{}, err
+	}
+	if meta.Name == "" || meta.Version == "" {
+		return Package{}, fmt.Errorf("not a conda package record")
+	}
+	return Package{Name: meta.Name, Version: meta.Version, Type: "conda", Arch: meta.Subdir, License: meta.License, Supplier: meta.Channel}, nil
+}
+
+// pythonNameSeparators are normalized to "-" in Python package names.
+var pythonNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// packageURL returns the package URL (purl) of a package.
+func packageURL(pkg Package, distro *Distro) string {
+	namespace := map[string]string{"deb": "debian", "rpm": "redhat", "apk": "alpine"}[pkg.Type]
+	qualifiers := url.Values{}
+	if pkg.Arch != "" {
+		qualifiers.Set("arch", pkg.Arch)
+	}
+	if distro != nil && namespace != "" {
+		namespace = distro.ID
+		qualifiers.Set("distro", distro.ID+"-"+distro.VersionID)
+	}
+
+	name, version := pkg.Name, pkg.Version
+	switch pkg.Type {
+	case "rpm":
+		if i := strings.IndexByte(version, ':'); i > 0 {
+			qualifiers.Set("epoch", version[:i])
+			version = version[i+1:]
+		}
+	case "pypi":
+		name = strings.ToLower(pythonNameSeparators.ReplaceAllString(name, "-"))
+	case "conda":
+		qualifiers.Del("arch")
+		if pkg.Arch != "" {
+			qualifiers.Set("subdir", pkg.Arch)
+		}
+	}
+	if pkg.Source != "" && pkg.Source != pkg.Name {
+		qualifiers.Set("upstream", pkg.Source)
+	}
+
+	purl := "pkg:" + pkg.Type + "/"
+	if namespace != "" {
+		purl += url.PathEscape(namespace) + "/"
+	}
+	purl += url.PathEscape(name) + "@" + url.PathEscape(version)
+	if len(qualifiers) > 0 {
+		// Encode sorts the keys, as the purl spec wants
+		purl += "?" + strings.Replace(qualifiers.Encode(), "+", "%20", -1)
+	}
+	return purl
+}
+
+// SPDX returns the packages as an SPDX 2.3 JSON document, describing the
+// image as a package that contains the others.
+func (s *SBOM) SPDX(created time.Time) ([]byte, error) {
+	type externalRef struct {
+		Category string `json:"referenceCategory"`
+		Type     string `json:"referenceType"`
+		Locator  string `json:"referenceLocator"`
+	}
+	type spdxPackage struct {
+		SPDXID           string        `json:"SPDXID"`
+		Name             string        `json:"name"`
+		VersionInfo      string        `json:"versionInfo,omitempty"`
+		Supplier         string        `json:"supplier,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		FilesAnalyzed    bool          `json:"filesAnalyzed"`
+		LicenseConcluded string        `json:"licenseConcluded"`
+		LicenseDeclared  string        `json:"licenseDeclared"`
+		LicenseComments  string        `json:"licenseComments,omitempty"`
+		SourceInfo       string        `json:"sourceInfo,omitempty"`
+		Purpose          string        `json:"primaryPackagePurpose,omitempty"`
+		ExternalRefs     []externalRef `json:"externalRefs,omitempty"`
+	}
+	type relationship struct {
+		Element string `json:"spdxElementId"`
+		Type    string `json:"relationshipType"`
+		Related string `json:"relatedSpdxElement"`
+	}
+
+	image := spdxPackage{
+		SPDXID:           "SPDXRef-Image",
+		Name:             s.Image,
+		VersionInfo:      s.ID,
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		Purpose:          "CONTAINER",
+	}
+	packages := []spdxPackage{image}
+	relationships := []relationship{{"SPDXRef-DOCUMENT", "DESCRIBES", image.SPDXID}}
+	for i, pkg := range s.Packages {
+		p := spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%s-%d", pkg.Type, i+1),
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			// package managers don't always use SPDX license expressions
+			LicenseDeclared: "NOASSERTION",
+			LicenseComments: pkg.License,
+			SourceInfo:      "found in " + pkg.Location,
+			Purpose:         "LIBRARY",
+			ExternalRefs:    []externalRef{{"PACKAGE-MANAGER", "purl", pkg.PURL}},
+		}
+		if pkg.Supplier != "" {
+			p.Supplier = "Organization: " + strings.Replace(pkg.Supplier, "\n", " ", -1)
+		}
+		packages = append(packages, p)
+		relationships = append(relationships, relationship{image.SPDXID, "CONTAINS", p.SPDXID})
+	}
+
+	doc := map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              s.Image,
+		"documentNamespace": "https://spdx.org/spdxdocs/sifweb-" + path.Base(s.Image) + "-" + uuid.New().String(),
+		"creationInfo": map[string]interface{}{
+			"created":  created.UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: sifweb"},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// CycloneDX returns the packages as a CycloneDX 1.5 JSON document, with
+// the image as its metadata component.
+func (s *SBOM) CycloneDX(created time.Time) ([]byte, error) {
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type license struct {
+		License map[string]string `json:"license"`
+	}
+	type component struct {
+		Type       string     `json:"type"`
+		BOMRef     string     `json:"bom-ref"`
+		Name       string     `json:"name"`
+		Version    string     `json:"version,omitempty"`
+		Publisher  string     `json:"publisher,omitempty"`
+		PURL       string     `json:"purl,omitempty"`
+		Licenses   []license  `json:"licenses,omitempty"`
+		Properties []property `json:"properties,omitempty"`
+	}
+
+	image := component{Type: "container", BOMRef: "image", Name: s.Image, Version: s.ID}
+	components := []component{}
+	refs := []string{}
+	for i, pkg := range s.Packages {
+		c := component{
+			Type:       "library",
+			BOMRef:     fmt.Sprintf("%s-%d", pkg.Type, i+1),
+			Name:       pkg.Name,
+			Version:    pkg.Version,
+			Publisher:  strings.Replace(pkg.Supplier, "\n", " ", -1),
+			PURL:       pkg.PURL,
+			Properties: []property{{"sifweb:location", pkg.Location}},
+		}
+		if pkg.License != "" {
+			c.Licenses = []license{{map[string]string{"name": pkg.License}}}
+		}
+		components = append(components, c)
+		refs = append(refs, c.BOMRef)
+	}
+
+	doc := map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + uuid.New().String(),
+		"version":      1,
+		"metadata": map[string]interface{}{
+			"timestamp": created.UTC().Format(time.RFC3339),
+			"tools": map[string]interface{}{
+				"components": []map[string]string{{"type": "application", "name": "sifweb"}},
+			},
+			"component": image,
+		},
+		"components":   components,
+		"dependencies": []map[string]interface{}{{"ref": image.BOMRef, "dependsOn": refs}},
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// sbomObjects are the names of the SBOM documents added to images.
+var sbomObjects = map[string]string{"json": "sbom.json", "spdx": "sbom.spdx.json", "cyclonedx": "sbom.cdx.json"}
+
+// Document returns the packages in format (json, spdx or cyclonedx), and
+// the name of the object to store it as in the image.
+func (s *SBOM) Document(format string, created time.Time) ([]byte, string, error) {
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(s, "", "  ")
+	case "spdx":
+		data, err = s.SPDX(created)
+	case "cyclonedx":
+		data, err = s.CycloneDX(created)
+	default:
+		return nil, "", fmt.Errorf("unknown SBOM format %q: %w", format, ErrUsage)
+	}
+	return data, sbomObjects[format], err
+}
+
+// FmtPackages returns the packages as a table.
+func (s *SBOM) FmtPackages() string {
+	var b strings.Builder
+	if s.Distro != nil {
+		fmt.Fprintf(&b, "Distro: %s\n", s.Distro.Name)
+	}
+	fmt.Fprintf(&b, "%-32s %-28s %-6s %s\n", "NAME", "VERSION", "TYPE", "ARCH")
+	for _, pkg := range s.Packages {
+		fmt.Fprintf(&b, "%-32s %-28s %-6s %s\n", pkg.Name, pkg.Version, pkg.Type, pkg.Arch)
+	}
+	fmt.Fprintf(&b, "%d packages\n", len(s.Packages))
+	for _, w := range s.Warnings {
+		fmt.Fprintf(&b, "warning: %s\n", w)
+	}
+	return b.String()
+}
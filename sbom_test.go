@@ -0,0 +1,78 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDpkgStatus(t *testing.T) {
+	status := `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Source: glibc (2.36-9+deb12u4)
+Version: 2.36-9+deb12u4
+Description: GNU C Library
+ continued line: not a field
+
+Package: removed
+Status: deinstall ok config-files
+Version: 1.0
+
+garbage without a colon
+Status: install ok installed
+
+Package: tzdata
+Status: install ok installed
+Version: 2024a-0+deb12u1
+Package: duplicate field ignored
+`
+	want := []Package{
+		{Name: "libc6", Version: "2.36-9+deb12u4", Type: "deb", Arch: "amd64", Source: "glibc", SourceVersion: "2.36-9+deb12u4"},
+		{Name: "tzdata", Version: "2024a-0+deb12u1", Type: "deb"},
+	}
+	if got := parseDpkgStatus([]byte(status), true); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for _, data := range []string{"", "\n\n", ":", " :\n\t", "Package:\n"} {
+		if got := parseDpkgStatus([]byte(data), false); len(got) != 0 {
+			t.Errorf("%q: got %+v, want no packages", data, got)
+		}
+	}
+}
+
+func TestParseApkInstalled(t *testing.T) {
+	installed := "C:Q1abc=\nP:musl\nV:1.2.4-r2\nA:x86_64\nL:MIT\no:musl\n\nP\nV:no name\n\nx\n:\nP:busybox\nV:1.36.1-r5"
+	want := []Package{
+		{Name: "musl", Version: "1.2.4-r2", Type: "apk", Arch: "x86_64", License: "MIT", Source: "musl"},
+		{Name: "busybox", Version: "1.36.1-r5", Type: "apk"},
+	}
+	if got := parseApkInstalled([]byte(installed)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPackageURL(t *testing.T) {
+	debian := &Distro{ID: "debian", VersionID: "12"}
+	tests := []struct {
+		pkg    Package
+		distro *Distro
+		want   string
+	}{
+		{Package{Name: "libc6", Version: "2.36-9", Type: "deb", Arch: "amd64", Source: "glibc"}, debian,
+			"pkg:deb/debian/libc6@2.36-9?arch=amd64&distro=debian-12&upstream=glibc"},
+		{Package{Name: "bash", Version: "1:5.1-6.el9", Type: "rpm", Arch: "x86_64"}, nil,
+			"pkg:rpm/redhat/bash@5.1-6.el9?arch=x86_64&epoch=1"},
+		{Package{Name: "Foo_Bar.baz", Version: "1.0", Type: "pypi"}, debian, "pkg:pypi/foo-bar-baz@1.0"},
+		{Package{Name: "numpy", Version: "1.26.4", Type: "conda", Arch: "linux-64"}, nil, "pkg:conda/numpy@1.26.4?subdir=linux-64"},
+	}
+	for _, tt := range tests {
+		if got := packageURL(tt.pkg, tt.distro); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.pkg.Name, got, tt.want)
+		}
+	}
+}
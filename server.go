@@ -0,0 +1,291 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The server mode: the web UI, plus a read-only JSON API over the SIFs of
+// a directory. Images are opened for each request and only the ranges
+// needed are read, so large images are cheap to inspect.
+//
+//	GET /images                          the images, as ImageEntry
+//	GET /images/{name}                   the SIF itself (Range supported)
+//	GET /images/{name}/header            HeaderInfo
+//	GET /images/{name}/descriptors       DescriptorInfo list
+//	GET /images/{name}/objects/{id}      the data of an object (Range supported)
+//	GET /images/{name}/files/{path}      a directory of the primary partition
+//	                                     as FileInfo, or the content of a file
+
+// ImageEntry is an image of the served directory.
+type ImageEntry struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+	ID    string `json:"id"`
+	Arch  string `json:"arch"`
+}
+
+// Server serves the images of Dir, and the web UI from the UI directory
+// if set.
+type Server struct {
+	Dir  string
+	UI   string
+	CORS string // origin allowed to read the API from a browser, if any
+}
+
+// Handler returns the handler of the server's routes.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images", s.serveImages)
+	mux.HandleFunc("/images/", s.serveImage)
+	if s.UI != "" {
+		mux.Handle("/", http.FileServer(http.Dir(s.UI)))
+	}
+	return logRequests(s.readOnly(mux))
+}
+
+// readOnly rejects anything but GET and HEAD, and sets the CORS headers.
+func (s *Server) readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.CORS != "" {
+			w.Header().Set("Access-Control-Allow-Origin", s.CORS)
+			w.Header().Set("Access-Control-Allow-Headers", "Range")
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Accept-Ranges, ETag")
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// statusWriter records the status of a response, for the log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests logs every request with its status and duration.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		log.Printf("%s %s %d %s", r.Method, r.URL.Path, sw.status, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// writeJSON sends v as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError sends err as {"error": ErrorInfo}. A status of 0 is chosen
+// from the error: 404 for missing files, 422 for broken images.
+func writeError(w http.ResponseWriter, status int, err error) {
+	var rerr *ReadError
+	switch {
+	case status != 0:
+	case errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrUsage):
+		status = http.StatusBadRequest
+	case errors.As(err, &rerr) && rerr.Kind != ErrIO:
+		status = http.StatusUnprocessableEntity
+	default:
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]ErrorInfo{"error": errorInfo(err)})
+}
+
+// imagePath returns the path of the image name in the served directory,
+// which must be a plain file name.
+func (s *Server) imagePath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid image name %q: %w", name, os.ErrNotExist)
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+// serveImages lists the SIFs of the directory, skipping other files.
+func (s *Server) serveImages(w http.ResponseWriter, r *http.Request) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		writeError(w, 0, err)
+		return
+	}
+	images := []ImageEntry{}
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		fimg, err := LoadContainer(filepath.Join(s.Dir, fi.Name()), true)
+		if err != nil {
+			continue
+		}
+		h := fimg.headerInfo()
+		images = append(images, ImageEntry{fi.Name(), fimg.Filesize, h.Mtime, h.ID, h.Arch})
+		fimg.UnloadContainer()
+	}
+	writeJSON(w, images)
+}
+
+// serveImage serves the routes under /images/{name}.
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/images/"), "/", 3)
+	p, err := s.imagePath(parts[0])
+	if err != nil {
+		writeError(w, 0, err)
+		return
+	}
+	fimg, err := LoadContainer(p, true)
+	if err != nil {
+		writeError(w, 0, err)
+		return
+	}
+	defer fimg.UnloadContainer()
+	fi, err := fimg.Fp.(*os.File).Stat()
+	if err != nil {
+		writeError(w, 0, err)
+		return
+	}
+	etag := fmt.Sprintf("%s-%d-%d", fimg.headerInfo().ID, fi.Size(), fi.ModTime().UnixNano())
+
+	route := ""
+	if len(parts) > 1 {
+		route = parts[1]
+	}
+	switch {
+	case len(parts) == 1:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", strconv.Quote(etag))
+		http.ServeContent(w, r, parts[0], fi.ModTime(), fimg.Reader)
+	case route == "header" && len(parts) == 2:
+		writeJSON(w, fimg.headerInfo())
+	case route == "descriptors" && len(parts) == 2:
+		descriptors, _ := fimg.getDescriptors()
+		if descriptors == nil {
+			descriptors = []DescriptorInfo{}
+		}
+		writeJSON(w, descriptors)
+	case route == "objects" && len(parts) == 3:
+		s.serveObject(w, r, fimg, parts[2], etag, fi.ModTime())
+	case route == "files":
+		file := "/"
+		if len(parts) == 3 {
+			file = "/" + parts[2]
+		}
+		s.serveFile(w, r, fimg, file)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", r.URL.Path, os.ErrNotExist))
+	}
+}
+
+// serveObject sends the data of an object.
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, fimg *FileImage, id, etag string, mtime time.Time) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		writeError(w, 0, fmt.Errorf("invalid object ID %q: %w", id, ErrUsage))
+		return
+	}
+	i, err := fimg.descriptorIndex(uint32(n))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	v := fimg.DescrArr[i]
+	if err := fimg.checkBounds(v); err != nil {
+		writeError(w, 0, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", strconv.Quote(fmt.Sprintf("%s-%d", etag, v.ID)))
+	name := trimZeroBytes(v.Name[:])
+	if name == "" {
+		name = fmt.Sprintf("object-%d", v.ID)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+	http.ServeContent(w, r, "", mtime, io.NewSectionReader(fimg.Reader, v.Fileoff, v.Filelen))
+}
+
+// serveFile sends a directory listing of the primary partition, the
+// content of a regular file, or the FileInfo of anything else.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, fimg *FileImage, file string) {
+	sqfs, err := fimg.GetPrimSquashFS()
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	inode, err := sqfs.Lookup(file)
+	if err != nil {
+		writeError(w, 0, err)
+		return
+	}
+
+	switch {
+	case inode.IsDir():
+		entries, err := sqfs.ReadDir(inode)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		files := []FileInfo{}
+		for _, e := range entries {
+			files = append(files, fileInfo(path.Join(file, e.Name), e.Inode))
+		}
+		writeJSON(w, files)
+	case inode.IsRegular():
+		rd, err := sqfs.Open(inode)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(inode.Size, 10))
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := io.Copy(w, rd); err != nil {
+			log.Printf("%s: %s", file, err)
+		}
+	default:
+		writeJSON(w, fileInfo(file, inode))
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testServer serves a directory with test.sif, a file that isn't a SIF
+// and a hidden SIF.
+func testServer(t *testing.T) (*httptest.Server, []byte, func()) {
+	fimg, cleanup := testContainer(t, testSquashInputs(t, map[string]string{"/etc/hello": "hello\n"}))
+	defer cleanup()
+	image, err := ioutil.ReadFile(fimg.Fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "sifweb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"test.sif": image, ".hidden.sif": image, "notes.txt": []byte("notes\n")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	log.SetOutput(ioutil.Discard)
+	ts := httptest.NewServer((&Server{Dir: dir, CORS: "*"}).Handler())
+	return ts, image, func() {
+		ts.Close()
+		log.SetOutput(os.Stderr)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServer(t *testing.T) {
+	ts, image, cleanup := testServer(t)
+	defer cleanup()
+
+	tests := []struct {
+		method, path, rng string
+		status            int
+		body              string // a part of the body
+	}{
+		{"GET", "/images", "", http.StatusOK, `"name": "test.sif"`},
+		{"GET", "/images/test.sif", "bytes=0-9", http.StatusPartialContent, string(image[:10])},
+		{"GET", "/images/test.sif/header", "", http.StatusOK, `"arch": "amd64"`},
+		{"GET", "/images/test.sif/descriptors", "", http.StatusOK, `"name": "rootfs.squashfs"`},
+		{"GET", "/images/test.sif/objects/1", "", http.StatusOK, "Bootstrap: docker\nFrom: alpine\n"},
+		{"GET", "/images/test.sif/objects/1", "bytes=11-16", http.StatusPartialContent, "docker"},
+		{"GET", "/images/test.sif/objects/9", "", http.StatusNotFound, `"error"`},
+		{"GET", "/images/test.sif/objects/x", "", http.StatusBadRequest, `"error"`},
+		{"GET", "/images/test.sif/files/", "", http.StatusOK, `"path": "/etc"`},
+		{"GET", "/images/test.sif/files/etc/hello", "", http.StatusOK, "hello\n"},
+		{"GET", "/images/test.sif/files/etc/nothing", "", http.StatusNotFound, `"error"`},
+		{"GET", "/images/test.sif/other", "", http.StatusNotFound, `"error"`},
+		{"GET", "/images/notes.txt/header", "", http.StatusUnprocessableEntity, `"error"`},
+		{"GET", "/images/.hidden.sif", "", http.StatusNotFound, `"error"`},
+		{"GET", "/images/missing.sif", "", http.StatusNotFound, `"error"`},
+		{"POST", "/images/test.sif", "", http.StatusMethodNotAllowed, `"error"`},
+		{"OPTIONS", "/images/test.sif", "", http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status || !strings.Contains(string(body), tt.body) {
+			t.Errorf("%s %s: got %d %.200q, want %d with %q", tt.method, tt.path, resp.StatusCode, body, tt.status, tt.body)
+		}
+		if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("%s %s: no CORS header", tt.method, tt.path)
+		}
+	}
+}
+
+func TestServerImages(t *testing.T) {
+	ts, image, cleanup := testServer(t)
+	defer cleanup()
+
+	resp, err := http.Get(ts.URL + "/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var images []ImageEntry
+	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Name != "test.sif" || images[0].Size != int64(len(image)) || images[0].Arch != "amd64" {
+		t.Errorf("got %+v, want test.sif alone", images)
+	}
+}
@@ -300,14 +300,14 @@ type ReadWriter interface {
 
 // FileImage describes the representation of a SIF file in memory.
 type FileImage struct {
-	Header     Header        // the loaded SIF global header
-	Fp         ReadWriter    // file pointer of opened SIF file
-	Filesize   int64         // file size of the opened SIF file
-	Filedata   []byte        // the content of the opened file
-	Amodebuf   bool          // access mode: mmap = false, buffered = true
-	Reader     *bytes.Reader // reader on top of Mapdata
-	DescrArr   []Descriptor  // slice of loaded descriptors from SIF file
-	PrimPartID uint32        // ID of primary system partition if present
+	Header     Header            // the loaded SIF global header
+	Fp         ReadWriter        // file pointer of opened SIF file
+	Filesize   int64             // file size of the opened SIF file
+	Filedata   []byte            // the content of the opened file
+	Amodebuf   bool              // access mode: mmap = false, buffered = true
+	Reader     *io.SectionReader // reader on top of Filedata or Fp
+	DescrArr   []Descriptor      // slice of loaded descriptors from SIF file
+	PrimPartID uint32            // ID of primary system partition if present
 }
 
 // CreateInfo wraps all SIF file creation info needed.
@@ -0,0 +1,134 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Signing writes the same signatures as Singularity 3.6 and later: JSON
+// image metadata (see verify.go), clear-signed with an OpenPGP key, in a
+// DataSignature object linked to the signed group, with the key
+// fingerprint as entity.
+// https://github.com/sylabs/sif/blob/master/pkg/integrity/sign.go
+
+// readSigningKey returns the first key with a private part of an OpenPGP
+// key ring (armored or binary, e.g., from gpg --export-secret-keys),
+// decrypted with passphrase if needed.
+func readSigningKey(r io.Reader, passphrase []byte) (*openpgp.Entity, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		if keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("reading key: %s", err)
+		}
+	}
+
+	for _, e := range keyring {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			if len(passphrase) == 0 {
+				return nil, fmt.Errorf("key %X is encrypted, a passphrase is needed", e.PrimaryKey.Fingerprint)
+			}
+			if err := e.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, fmt.Errorf("decrypting key %X: %s", e.PrimaryKey.Fingerprint, err)
+			}
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("no private key found")
+}
+
+// imageMetadata returns the metadata signed for objects, with digests of hash h.
+func (fimg *FileImage) imageMetadata(objects []Descriptor, h crypto.Hash, p *progress) (imageMetadata, error) {
+	md := imageMetadata{Version: 1}
+	md.Header.Digest = fimg.headerDigest(h)
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].ID < objects[j].ID })
+	min := minID(objects)
+	for _, o := range objects {
+		om, err := fimg.objectMetadata(o, min, h, p)
+		if err != nil {
+			return md, err
+		}
+		md.Objects = append(md.Objects, om)
+	}
+	return md, nil
+}
+
+// Sign signs the objects of group groupid of the SIF opened read-write with
+// the private key of entity, and adds the signature linked to the group, as
+// Singularity does. It returns the ID of the signature object. Progress is
+// reported in bytes hashed.
+func (fimg *FileImage) Sign(ctx context.Context, entity *openpgp.Entity, groupid uint32, hash Hashtype, fn ProgressFunc) (uint32, error) {
+	h, ok := hashtypes[hash]
+	if !ok {
+		return 0, fmt.Errorf("unsupported hash type %s", hashtypeStr(hash))
+	}
+	if entity.PrivateKey == nil || entity.PrivateKey.Encrypted {
+		return 0, fmt.Errorf("key %X has no usable private key", entity.PrimaryKey.Fingerprint)
+	}
+
+	link := DescrGroupMask | groupid
+	objects := fimg.signedObjects(Descriptor{Link: link})
+	if len(objects) == 0 {
+		return 0, fmt.Errorf("group %d: %w", groupid, ErrNotFound)
+	}
+
+	var total int64
+	for _, o := range objects {
+		total += o.Filelen
+	}
+	p := newProgress(ctx, total, fn)
+	defer p.finish()
+
+	md, err := fimg.imageMetadata(objects, h, p)
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, entity.PrivateKey, &packet.Config{DefaultHash: h})
+	if err != nil {
+		return 0, err
+	}
+	if err := json.NewEncoder(w).Encode(md); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+
+	input := DescriptorInput{
+		Datatype: DataSignature,
+		Groupid:  DescrUnusedGroup,
+		Link:     link,
+		Data:     buf.Bytes(),
+	}
+	if err := input.SetSignExtra(hash, entity.PrimaryKey.Fingerprint[:]); err != nil {
+		return 0, err
+	}
+	if err := fimg.AddObject(ctx, &input, nil); err != nil {
+		return 0, err
+	}
+	return input.Descr.ID, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// testSigned creates a SIF with an object of group 2 followed by the
+// objects of testInputs in group 1, and signs group 1 with a new key.
+func testSigned(t *testing.T) (*FileImage, *openpgp.Entity, func()) {
+	inputs := append([]DescriptorInput{
+		{Datatype: DataGeneric, Groupid: DescrGroupMask | 2, Fname: "other", Data: []byte("other")},
+	}, testInputs(t)...)
+	fimg, cleanup := testContainer(t, inputs)
+
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if _, err := fimg.Sign(context.Background(), entity, 1, HashSHA256, nil); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return fimg, entity, cleanup
+}
+
+func TestSign(t *testing.T) {
+	fimg, entity, cleanup := testSigned(t)
+	defer cleanup()
+
+	loaded, _ := reload(t, fimg)
+	sigs := loaded.signatures()
+	if len(sigs) != 1 {
+		t.Fatalf("got %d signatures, want 1", len(sigs))
+	}
+	sig := sigs[0]
+	if sig.Link != DescrGroupMask|1 || sig.Groupid != DescrUnusedGroup {
+		t.Errorf("got link %#x, group %#x; want the signature linked to group 1", sig.Link, sig.Groupid)
+	}
+
+	// Relative IDs count from the first object of the group, as in sif
+	content, err := loaded.readDescriptorContent(sig.Fileoff, sig.Filelen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := clearSignedText([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md imageMetadata
+	if err := json.Unmarshal([]byte(text), &md); err != nil {
+		t.Fatal(err)
+	}
+	if len(md.Objects) != 3 {
+		t.Fatalf("got %d signed objects, want 3", len(md.Objects))
+	}
+	for i, om := range md.Objects {
+		if om.RelativeID != uint32(i) {
+			t.Errorf("object %d: got relative ID %d", i, om.RelativeID)
+		}
+	}
+
+	checks, err := loaded.Verify(context.Background(), openpgp.EntityList{entity}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 1 || !checks[0].Verified || checks[0].Format != "metadata" {
+		t.Fatalf("got %+v, want a verified metadata signature", checks)
+	}
+	if got := checks[0].Objects; len(got) != 3 || got[0] != 2 || got[2] != 4 {
+		t.Errorf("got signed objects %v, want [2 3 4]", got)
+	}
+
+	if _, err := fimg.Sign(context.Background(), entity, 3, HashSHA256, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("signing a missing group: got %v, want ErrNotFound", err)
+	}
+}
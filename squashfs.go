@@ -0,0 +1,780 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A minimal, read-only squashfs 4.0 reader, enough to list and extract
+// the files of a partition. Only gzip compression (the Singularity default)
+// is supported, since it's the one available in the standard library.
+// https://dr-emann.github.io/squashfs/
+
+// Squashfs constants.
+const (
+	SquashMagic        = 0x73717368 // "hsqs"
+	SquashMetadataSize = 8192       // uncompressed size of a metadata block
+
+	squashCompGzip = 1
+
+	squashNoFragment      = 0xffffffff
+	squashUncompressedBit = 1 << 24 // in data block sizes
+	squashMetaUncompBit   = 1 << 15 // in metadata block headers
+)
+
+// Squashfs inode types.
+const (
+	sqDir = iota + 1
+	sqFile
+	sqSymlink
+	sqBlockDev
+	sqCharDev
+	sqFifo
+	sqSocket
+	sqExtDir
+	sqExtFile
+	sqExtSymlink
+	sqExtBlockDev
+	sqExtCharDev
+	sqExtFifo
+	sqExtSocket
+)
+
+// ErrUnsupportedCompression is returned for squashfs images not using gzip.
+var ErrUnsupportedCompression = errors.New("unsupported squashfs compression")
+
+// squashSuperblock is the squashfs superblock, found at offset 0.
+type squashSuperblock struct {
+	Magic               uint32
+	InodeCount          uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	FragmentEntryCount  uint32
+	CompressionID       uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInodeRef        uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrIDTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+// squashFragment is an entry of the fragment table.
+type squashFragment struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+// SquashFS is an opened squashfs image.
+type SquashFS struct {
+	r     io.ReaderAt
+	size  int64 // of the image, nothing read from it can be larger
+	sb    squashSuperblock
+	ids   []uint32
+	frags []squashFragment
+	cache map[int64]metadataBlock // decompressed metadata blocks by offset
+}
+
+// metadataBlock is a decompressed metadata block and the offset of the next one.
+type metadataBlock struct {
+	data []byte
+	next int64
+}
+
+// SquashInode is a file, directory or other entry of a squashfs image.
+type SquashInode struct {
+	Type   uint16
+	Mode   os.FileMode
+	UID    uint32
+	GID    uint32
+	Mtime  int64
+	Number uint32
+	Size   int64  // file size, or directory listing size
+	Target string // symlink target
+	Nlink  uint32
+	Rdev   uint32 // device number for block and char devices
+
+	// file data
+	blocksStart uint64
+	blockSizes  []uint32
+	fragment    uint32
+	fragOffset  uint32
+
+	// directory listing
+	dirBlock  uint32
+	dirOffset uint16
+}
+
+// IsDir reports whether the inode is a directory.
+func (i *SquashInode) IsDir() bool {
+	return i.Type == sqDir || i.Type == sqExtDir
+}
+
+// IsRegular reports whether the inode is a regular file.
+func (i *SquashInode) IsRegular() bool {
+	return i.Type == sqFile || i.Type == sqExtFile
+}
+
+// SquashEntry is an entry of a directory listing.
+type SquashEntry struct {
+	Name  string
+	Inode *SquashInode
+}
+
+// OpenSquashFS reads the superblock and lookup tables of the squashfs in r.
+func OpenSquashFS(r io.ReaderAt) (*SquashFS, error) {
+	fs := &SquashFS{r: r, cache: make(map[int64]metadataBlock)}
+
+	sr := io.NewSectionReader(r, 0, int64(binary.Size(fs.sb)))
+	if err := binary.Read(sr, binary.LittleEndian, &fs.sb); err != nil {
+		return nil, fmt.Errorf("reading squashfs superblock: %s", err)
+	}
+	if fs.sb.Magic != SquashMagic {
+		return nil, fmt.Errorf("not a squashfs image: magic %#x", fs.sb.Magic)
+	}
+	if fs.sb.VersionMajor != 4 {
+		return nil, fmt.Errorf("unsupported squashfs version %d.%d", fs.sb.VersionMajor, fs.sb.VersionMinor)
+	}
+	if fs.sb.CompressionID != squashCompGzip {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, squashCompressionStr(fs.sb.CompressionID))
+	}
+	if fs.sb.BlockLog > 20 || fs.sb.BlockSize != 1<<fs.sb.BlockLog || fs.sb.BlockSize < 4096 {
+		return nil, fmt.Errorf("bad squashfs block size %d (log %d)", fs.sb.BlockSize, fs.sb.BlockLog)
+	}
+
+	// a partition is read through a SectionReader, which knows its size
+	fs.size = int64(fs.sb.BytesUsed)
+	if sr, ok := r.(interface{ Size() int64 }); ok {
+		fs.size = sr.Size()
+	}
+
+	// uid/gid lookup table
+	ids, err := fs.readTable(int64(fs.sb.IDTableStart), int(fs.sb.IDCount), 4)
+	if err != nil {
+		return nil, fmt.Errorf("reading squashfs id table: %s", err)
+	}
+	fs.ids = make([]uint32, fs.sb.IDCount)
+	if err := binary.Read(bytes.NewReader(ids), binary.LittleEndian, fs.ids); err != nil {
+		return nil, err
+	}
+
+	// fragment table
+	if fs.sb.FragmentEntryCount > 0 {
+		frags, err := fs.readTable(int64(fs.sb.FragmentTableStart), int(fs.sb.FragmentEntryCount), 16)
+		if err != nil {
+			return nil, fmt.Errorf("reading squashfs fragment table: %s", err)
+		}
+		fs.frags = make([]squashFragment, fs.sb.FragmentEntryCount)
+		if err := binary.Read(bytes.NewReader(frags), binary.LittleEndian, fs.frags); err != nil {
+			return nil, err
+		}
+	}
+
+	return fs, nil
+}
+
+// squashCompressionStr returns the name of a squashfs compression id.
+func squashCompressionStr(id uint16) string {
+	switch id {
+	case 1:
+		return "gzip"
+	case 2:
+		return "lzma"
+	case 3:
+		return "lzo"
+	case 4:
+		return "xz"
+	case 5:
+		return "lz4"
+	case 6:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown (%d)", id)
+}
+
+// Compression returns the name of the compression used by the image.
+func (fs *SquashFS) Compression() string {
+	return squashCompressionStr(fs.sb.CompressionID)
+}
+
+// BlockSize returns the data block size of the image.
+func (fs *SquashFS) BlockSize() uint32 {
+	return fs.sb.BlockSize
+}
+
+// decompress inflates a gzip (zlib) compressed block of up to max bytes.
+func (fs *SquashFS) decompress(data []byte, max int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err == nil && len(out) > max {
+		err = fmt.Errorf("block inflates to more than %d bytes", max)
+	}
+	return out, err
+}
+
+// readMetadataBlock reads and decompresses the metadata block at offset.
+func (fs *SquashFS) readMetadataBlock(offset int64) (metadataBlock, error) {
+	if b, ok := fs.cache[offset]; ok {
+		return b, nil
+	}
+
+	var hdr [2]byte
+	if _, err := fs.r.ReadAt(hdr[:], offset); err != nil {
+		return metadataBlock{}, err
+	}
+	size := binary.LittleEndian.Uint16(hdr[:])
+	compressed := size&squashMetaUncompBit == 0
+	size &^= squashMetaUncompBit
+	if size > SquashMetadataSize {
+		return metadataBlock{}, fmt.Errorf("metadata block at %d is too large (%d)", offset, size)
+	}
+
+	data := make([]byte, size)
+	if _, err := fs.r.ReadAt(data, offset+2); err != nil {
+		return metadataBlock{}, err
+	}
+	if compressed {
+		var err error
+		if data, err = fs.decompress(data, SquashMetadataSize); err != nil {
+			return metadataBlock{}, fmt.Errorf("metadata block at %d: %s", offset, err)
+		}
+	}
+
+	b := metadataBlock{data: data, next: offset + 2 + int64(size)}
+	fs.cache[offset] = b
+	return b, nil
+}
+
+// metadataReader reads a stream of metadata that spans consecutive blocks.
+type metadataReader struct {
+	fs     *SquashFS
+	block  metadataBlock
+	offset int
+}
+
+// newMetadataReader returns a reader starting at offset bytes into the
+// (decompressed) metadata block found at start.
+func (fs *SquashFS) newMetadataReader(start int64, offset int) (*metadataReader, error) {
+	b, err := fs.readMetadataBlock(start)
+	if err != nil {
+		return nil, err
+	}
+	return &metadataReader{fs: fs, block: b, offset: offset}, nil
+}
+
+func (m *metadataReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if m.offset >= len(m.block.data) {
+			b, err := m.fs.readMetadataBlock(m.block.next)
+			if err != nil {
+				return n, err
+			}
+			m.block, m.offset = b, 0
+			if len(b.data) == 0 {
+				return n, io.ErrUnexpectedEOF
+			}
+		}
+		c := copy(p[n:], m.block.data[m.offset:])
+		m.offset += c
+		n += c
+	}
+	return n, nil
+}
+
+// readTable reads count entries of size bytes from a lookup table, which
+// is a list of pointers to the metadata blocks holding the entries.
+func (fs *SquashFS) readTable(start int64, count int, size int) ([]byte, error) {
+	if int64(count)*int64(size) > fs.size {
+		return nil, fmt.Errorf("table of %d entries is larger than the image", count)
+	}
+	total := count * size
+	nblocks := (total + SquashMetadataSize - 1) / SquashMetadataSize
+
+	ptrs := make([]uint64, nblocks)
+	sr := io.NewSectionReader(fs.r, start, int64(nblocks*8))
+	if err := binary.Read(sr, binary.LittleEndian, ptrs); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for _, p := range ptrs {
+		b, err := fs.readMetadataBlock(int64(p))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b.data...)
+	}
+	if len(data) < total {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data[:total], nil
+}
+
+// id returns the uid or gid at index of the id table.
+func (fs *SquashFS) id(index uint16) uint32 {
+	if int(index) < len(fs.ids) {
+		return fs.ids[index]
+	}
+	return 0
+}
+
+// squashModeType maps inode types to the type bits of an os.FileMode.
+var squashModeType = map[uint16]os.FileMode{
+	sqDir:         os.ModeDir,
+	sqSymlink:     os.ModeSymlink,
+	sqBlockDev:    os.ModeDevice,
+	sqCharDev:     os.ModeDevice | os.ModeCharDevice,
+	sqFifo:        os.ModeNamedPipe,
+	sqSocket:      os.ModeSocket,
+	sqExtDir:      os.ModeDir,
+	sqExtSymlink:  os.ModeSymlink,
+	sqExtBlockDev: os.ModeDevice,
+	sqExtCharDev:  os.ModeDevice | os.ModeCharDevice,
+	sqExtFifo:     os.ModeNamedPipe,
+	sqExtSocket:   os.ModeSocket,
+}
+
+// unixMode converts the permission bits of an inode to an os.FileMode.
+func unixMode(perm uint16) os.FileMode {
+	mode := os.FileMode(perm & 0777)
+	if perm&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// readInode reads the inode at ref, which is the offset of its metadata
+// block in the inode table (upper bits) and the offset in that block.
+func (fs *SquashFS) readInode(ref uint64) (*SquashInode, error) {
+	start := int64(fs.sb.InodeTableStart) + int64(ref>>16)
+	m, err := fs.newMetadataReader(start, int(ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr struct {
+		Type   uint16
+		Perm   uint16
+		UID    uint16
+		GID    uint16
+		Mtime  uint32
+		Number uint32
+	}
+	if err := binary.Read(m, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+
+	inode := &SquashInode{
+		Type:   hdr.Type,
+		Mode:   unixMode(hdr.Perm) | squashModeType[hdr.Type],
+		UID:    fs.id(hdr.UID),
+		GID:    fs.id(hdr.GID),
+		Mtime:  int64(hdr.Mtime),
+		Number: hdr.Number,
+	}
+
+	read := func(v ...interface{}) error {
+		for _, x := range v {
+			if err := binary.Read(m, binary.LittleEndian, x); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var u16 uint16
+	var u32, size32, xattr uint32
+	var u64 uint64
+
+	switch hdr.Type {
+	case sqDir:
+		var parent uint32
+		err = read(&inode.dirBlock, &inode.Nlink, &u16, &inode.dirOffset, &parent)
+		inode.Size = int64(u16)
+	case sqExtDir:
+		var parent uint32
+		var indexCount uint16
+		err = read(&inode.Nlink, &size32, &inode.dirBlock, &parent, &indexCount, &inode.dirOffset, &xattr)
+		inode.Size = int64(size32)
+	case sqFile:
+		err = read(&u32, &inode.fragment, &inode.fragOffset, &size32)
+		inode.blocksStart, inode.Size, inode.Nlink = uint64(u32), int64(size32), 1
+	case sqExtFile:
+		var sparse uint64
+		err = read(&inode.blocksStart, &u64, &sparse, &inode.Nlink, &inode.fragment, &inode.fragOffset, &xattr)
+		inode.Size = int64(u64)
+	case sqSymlink, sqExtSymlink:
+		if err = read(&inode.Nlink, &size32); err == nil && int64(size32) > fs.size {
+			err = fmt.Errorf("symlink target of %d bytes is larger than the image", size32)
+		} else if err == nil {
+			target := make([]byte, size32)
+			if _, err = io.ReadFull(m, target); err == nil {
+				inode.Target = string(target)
+				inode.Size = int64(size32)
+			}
+		}
+	case sqBlockDev, sqCharDev, sqExtBlockDev, sqExtCharDev:
+		err = read(&inode.Nlink, &inode.Rdev)
+	case sqFifo, sqSocket, sqExtFifo, sqExtSocket:
+		err = read(&inode.Nlink)
+	default:
+		return nil, fmt.Errorf("unknown squashfs inode type %d", hdr.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading squashfs inode %d: %s", hdr.Number, err)
+	}
+
+	// A file has one block size per full block, plus one for the tail end
+	// unless it is stored in a fragment.
+	if inode.IsRegular() {
+		nblocks := inode.Size / int64(fs.sb.BlockSize)
+		if inode.fragment == squashNoFragment && inode.Size%int64(fs.sb.BlockSize) != 0 {
+			nblocks++
+		}
+		if inode.Size < 0 || nblocks > fs.size/4 {
+			return nil, fmt.Errorf("squashfs inode %d: file size %d doesn't fit the image", hdr.Number, inode.Size)
+		}
+		inode.blockSizes = make([]uint32, nblocks)
+		if err := read(inode.blockSizes); err != nil {
+			return nil, fmt.Errorf("reading squashfs inode %d block list: %s", hdr.Number, err)
+		}
+	}
+
+	return inode, nil
+}
+
+// Root returns the root directory inode.
+func (fs *SquashFS) Root() (*SquashInode, error) {
+	return fs.readInode(fs.sb.RootInodeRef)
+}
+
+// ReadDir returns the entries of a directory inode, sorted by name.
+func (fs *SquashFS) ReadDir(dir *SquashInode) ([]SquashEntry, error) {
+	if !dir.IsDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+
+	// the listing size includes 3 bytes for the implicit . and .. entries
+	remaining := dir.Size - 3
+	if remaining <= 0 {
+		return nil, nil
+	}
+
+	start := int64(fs.sb.DirectoryTableStart) + int64(dir.dirBlock)
+	m, err := fs.newMetadataReader(start, int(dir.dirOffset))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []SquashEntry
+	for remaining > 0 {
+		var hdr struct {
+			Count  uint32
+			Start  uint32
+			Number uint32
+		}
+		if err := binary.Read(m, binary.LittleEndian, &hdr); err != nil {
+			return nil, err
+		}
+		remaining -= 12
+
+		for i := uint32(0); i <= hdr.Count && remaining > 0; i++ {
+			var ent struct {
+				Offset      uint16
+				InodeOffset int16
+				Type        uint16
+				NameSize    uint16
+			}
+			if err := binary.Read(m, binary.LittleEndian, &ent); err != nil {
+				return nil, err
+			}
+			name := make([]byte, int(ent.NameSize)+1)
+			if _, err := io.ReadFull(m, name); err != nil {
+				return nil, err
+			}
+			remaining -= 8 + int64(len(name))
+
+			inode, err := fs.readInode(uint64(hdr.Start)<<16 | uint64(ent.Offset))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, SquashEntry{Name: string(name), Inode: inode})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// Lookup returns the inode at path, following symlinks in the leading
+// directories (but not in the last element).
+func (fs *SquashFS) Lookup(p string) (*SquashInode, error) {
+	return fs.lookup(p, 0)
+}
+
+func (fs *SquashFS) lookup(p string, depth int) (*SquashInode, error) {
+	if depth > 40 {
+		return nil, fmt.Errorf("%s: too many levels of symbolic links", p)
+	}
+
+	inode, err := fs.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return inode, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, part := range parts {
+		if inode.Mode&os.ModeSymlink != 0 {
+			target := inode.Target
+			if !path.IsAbs(target) && i > 0 {
+				target = path.Join("/", path.Join(parts[:i-1]...), target)
+			}
+			if inode, err = fs.lookup(target, depth+1); err != nil {
+				return nil, err
+			}
+		}
+
+		entries, err := fs.ReadDir(inode)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path.Join(parts[:i]...), err)
+		}
+
+		found := false
+		for _, e := range entries {
+			if e.Name == part {
+				inode, found = e.Inode, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+		}
+	}
+	return inode, nil
+}
+
+// Open returns a reader of the content of a regular file inode.
+func (fs *SquashFS) Open(inode *SquashInode) (io.Reader, error) {
+	if !inode.IsRegular() {
+		return nil, fmt.Errorf("not a regular file")
+	}
+	return &squashFileReader{fs: fs, inode: inode, offset: int64(inode.blocksStart)}, nil
+}
+
+// squashFileReader reads the content of a file block by block.
+type squashFileReader struct {
+	fs     *SquashFS
+	inode  *SquashInode
+	block  int    // next block to read
+	offset int64  // offset of the next block in the image
+	done   int64  // bytes returned so far
+	buf    []byte // what's left of the current block
+}
+
+func (f *squashFileReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.done >= f.inode.Size {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	f.done += int64(n)
+	return n, nil
+}
+
+// next loads the next data block, or the tail end from the fragment.
+func (f *squashFileReader) next() error {
+	fs := f.fs
+	bsize := int64(fs.sb.BlockSize)
+
+	if f.block < len(f.inode.blockSizes) {
+		size := f.inode.blockSizes[f.block]
+		f.block++
+
+		want := bsize
+		if left := f.inode.Size - f.done; left < want {
+			want = left
+		}
+
+		// a size of zero is a sparse block
+		if size == 0 {
+			f.buf = make([]byte, want)
+			return nil
+		}
+
+		disk := int64(size &^ squashUncompressedBit)
+		if disk > bsize {
+			return fmt.Errorf("data block at %d is larger than the block size (%d)", f.offset, disk)
+		}
+		data := make([]byte, disk)
+		if _, err := fs.r.ReadAt(data, f.offset); err != nil {
+			return err
+		}
+		f.offset += disk
+
+		if size&squashUncompressedBit == 0 {
+			var err error
+			if data, err = fs.decompress(data, int(bsize)); err != nil {
+				return fmt.Errorf("data block at %d: %s", f.offset-disk, err)
+			}
+		}
+		if int64(len(data)) > want {
+			data = data[:want]
+		}
+		f.buf = data
+		return nil
+	}
+
+	if f.inode.fragment == squashNoFragment || int(f.inode.fragment) >= len(fs.frags) {
+		return io.ErrUnexpectedEOF
+	}
+	data, err := fs.readFragment(f.inode.fragment)
+	if err != nil {
+		return err
+	}
+	start := int64(f.inode.fragOffset)
+	end := start + f.inode.Size - f.done
+	if end > int64(len(data)) {
+		return io.ErrUnexpectedEOF
+	}
+	f.buf = data[start:end]
+	return nil
+}
+
+// readFragment reads and decompresses a fragment block.
+func (fs *SquashFS) readFragment(index uint32) ([]byte, error) {
+	frag := fs.frags[index]
+	disk := frag.Size &^ squashUncompressedBit
+	if disk > fs.sb.BlockSize {
+		return nil, fmt.Errorf("fragment %d is larger than the block size (%d)", index, disk)
+	}
+	data := make([]byte, disk)
+	if _, err := fs.r.ReadAt(data, int64(frag.Start)); err != nil {
+		return nil, err
+	}
+	if frag.Size&squashUncompressedBit != 0 {
+		return data, nil
+	}
+	return fs.decompress(data, int(fs.sb.BlockSize))
+}
+
+// Walk calls fn for every entry under the directory at root, depth first
+// and in name order. The paths given to fn are absolute.
+func (fs *SquashFS) Walk(root string, fn func(p string, inode *SquashInode) error) error {
+	inode, err := fs.Lookup(root)
+	if err != nil {
+		return err
+	}
+	return fs.walk(path.Clean("/"+root), inode, fn, map[uint64]bool{})
+}
+
+// walk keeps the directory listings it has been through in visited: there
+// are no hard links to directories, so a listing seen twice is a loop
+// (empty directories have no listing, and may share its location).
+func (fs *SquashFS) walk(p string, inode *SquashInode, fn func(string, *SquashInode) error, visited map[uint64]bool) error {
+	if err := fn(p, inode); err != nil {
+		return err
+	}
+	if !inode.IsDir() {
+		return nil
+	}
+	listing := uint64(inode.dirBlock)<<16 | uint64(inode.dirOffset)
+	if inode.Size > 3 {
+		if visited[listing] {
+			return fmt.Errorf("%s: directory loop", p)
+		}
+		visited[listing] = true
+	}
+	entries, err := fs.ReadDir(inode)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+	for _, e := range entries {
+		if err := fs.walk(path.Join(p, e.Name), e.Inode, fn, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPrimSquashFS opens the primary system partition of the image as a squashfs.
+func (fimg *FileImage) GetPrimSquashFS() (*SquashFS, error) {
+	descr, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return nil, fmt.Errorf("looking for the primary partition: %s", err)
+	}
+	if err := fimg.checkBounds(*descr); err != nil {
+		return nil, err
+	}
+
+	var pinfo Partition
+	if err := binary.Read(bytes.NewReader(descr.Extra[:]), binary.LittleEndian, &pinfo); err != nil {
+		return nil, readError(ErrBadDescriptor, descr.Fileoff, descriptorContext(*descr), err, "partition extra info")
+	}
+	if pinfo.Fstype != FsSquash {
+		return nil, fmt.Errorf("primary partition is %s, not squashfs", fstypeStr(pinfo.Fstype))
+	}
+
+	return OpenSquashFS(io.NewSectionReader(fimg.Reader, descr.Fileoff, descr.Filelen))
+}
+
+// Extract writes the content of the file at p to w. Progress is reported
+// in bytes.
+func (fs *SquashFS) Extract(ctx context.Context, w io.Writer, p string, fn ProgressFunc) error {
+	inode, err := fs.Lookup(p)
+	if err != nil {
+		return err
+	}
+	r, err := fs.Open(inode)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+
+	prog := newProgress(ctx, inode.Size, fn)
+	defer prog.finish()
+	_, err = copyProgress(w, r, prog)
+	return err
+}
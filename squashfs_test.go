@@ -0,0 +1,179 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// craftSquash builds a squashfs image by hand, with uncompressed metadata:
+// inodes is the inode table (the root inode first) and dirs the directory
+// table. edit can change the superblock before it is written.
+func craftSquash(inodes, dirs []byte, edit func(*squashSuperblock)) []byte {
+	var body bytes.Buffer
+	block := func(data []byte) int64 {
+		off := int64(binary.Size(squashSuperblock{}) + body.Len())
+		binary.Write(&body, binary.LittleEndian, uint16(len(data))|squashMetaUncompBit)
+		body.Write(data)
+		return off
+	}
+
+	sb := squashSuperblock{
+		Magic:              SquashMagic,
+		InodeCount:         1,
+		BlockSize:          squashBlockSize,
+		CompressionID:      squashCompGzip,
+		BlockLog:           squashBlockLog,
+		IDCount:            1,
+		VersionMajor:       4,
+		XattrIDTableStart:  squashNoTable,
+		FragmentTableStart: squashNoTable,
+		ExportTableStart:   squashNoTable,
+	}
+	sb.InodeTableStart = uint64(block(inodes))
+	sb.DirectoryTableStart = uint64(block(dirs))
+	ids := block([]byte{0, 0, 0, 0})
+	sb.IDTableStart = uint64(binary.Size(sb) + body.Len())
+	binary.Write(&body, binary.LittleEndian, uint64(ids))
+	sb.BytesUsed = uint64(binary.Size(sb) + body.Len())
+	if edit != nil {
+		edit(&sb)
+	}
+
+	var image bytes.Buffer
+	binary.Write(&image, binary.LittleEndian, sb)
+	image.Write(body.Bytes())
+	return image.Bytes()
+}
+
+// inodeBytes encodes an inode header of type typ followed by fields.
+func inodeBytes(typ uint16, fields ...interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, [2]uint16{typ, 0755})
+	binary.Write(&b, binary.LittleEndian, [2]uint16{0, 0})
+	binary.Write(&b, binary.LittleEndian, [2]uint32{0, 1})
+	for _, f := range fields {
+		binary.Write(&b, binary.LittleEndian, f)
+	}
+	return b.Bytes()
+}
+
+// dirInode is a directory inode with a listing of size bytes at the start
+// of the directory table.
+func dirInode(size int) []byte {
+	return inodeBytes(sqDir, uint32(0), uint32(2), uint16(size+3), uint16(0), uint32(1))
+}
+
+// dirListing is a directory listing with one entry, name, for the inode
+// at offset of the first inode block.
+func dirListing(name string, offset uint16, typ uint16) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, [3]uint32{0, 0, 2})
+	binary.Write(&b, binary.LittleEndian, [4]uint16{offset, 0, typ, uint16(len(name) - 1)})
+	b.WriteString(name)
+	return b.Bytes()
+}
+
+func TestSquashFSCrafted(t *testing.T) {
+	file := inodeBytes(sqFile, uint32(0), uint32(squashNoFragment), uint32(0), uint32(5))
+	root := dirInode(len(dirListing("file", 0, sqFile)))
+	image := craftSquash(append(root, file...), dirListing("file", uint16(len(root)), sqFile), nil)
+
+	fs, err := OpenSquashFS(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err := fs.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inode.IsRegular() || inode.Size != 5 || len(inode.blockSizes) != 1 {
+		t.Errorf("got %+v, want a regular file of 5 bytes in 1 block", inode)
+	}
+}
+
+// TestSquashFSMalformed checks that broken images are reported as errors,
+// without panics or allocations sized by the image.
+func TestSquashFSMalformed(t *testing.T) {
+	loop := dirListing("loop", 0, sqDir)
+	tests := []struct {
+		name  string
+		image []byte
+		op    string // what fails: open, root, lookup or walk
+		want  string
+	}{
+		{
+			name:  "zero block size",
+			image: craftSquash(dirInode(0), nil, func(sb *squashSuperblock) { sb.BlockSize, sb.BlockLog = 0, 0 }),
+			op:    "open",
+			want:  "block size",
+		},
+		{
+			name:  "block size not a power of two",
+			image: craftSquash(dirInode(0), nil, func(sb *squashSuperblock) { sb.BlockSize = 100000 }),
+			op:    "open",
+			want:  "block size",
+		},
+		{
+			name:  "block size too large",
+			image: craftSquash(dirInode(0), nil, func(sb *squashSuperblock) { sb.BlockSize, sb.BlockLog = 1<<24, 24 }),
+			op:    "open",
+			want:  "block size",
+		},
+		{
+			name:  "huge fragment table",
+			image: craftSquash(dirInode(0), nil, func(sb *squashSuperblock) { sb.FragmentEntryCount, sb.FragmentTableStart = 1<<31, 0 }),
+			op:    "open",
+			want:  "larger than the image",
+		},
+		{
+			name:  "huge file",
+			image: craftSquash(inodeBytes(sqExtFile, uint64(0), uint64(1)<<62, uint64(0), uint32(1), uint32(squashNoFragment), uint32(0), uint32(0)), nil, nil),
+			op:    "root",
+			want:  "doesn't fit the image",
+		},
+		{
+			name:  "huge symlink target",
+			image: craftSquash(inodeBytes(sqSymlink, uint32(1), uint32(0xffffffff)), nil, nil),
+			op:    "root",
+			want:  "larger than the image",
+		},
+		{
+			name:  "symlink as the root",
+			image: craftSquash(append(inodeBytes(sqSymlink, uint32(1), uint32(1)), 'x'), nil, nil),
+			op:    "lookup",
+			want:  "too many levels",
+		},
+		{
+			name:  "directory loop",
+			image: craftSquash(dirInode(len(loop)), loop, nil),
+			op:    "walk",
+			want:  "directory loop",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := OpenSquashFS(bytes.NewReader(tt.image))
+			if err == nil && tt.op != "open" {
+				switch tt.op {
+				case "root":
+					_, err = fs.Root()
+				case "lookup":
+					_, err = fs.Lookup("/a/b")
+				case "walk":
+					err = fs.Walk("/", func(string, *SquashInode) error { return nil })
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%s: got error %v, want %q", tt.op, err, tt.want)
+			}
+		})
+	}
+}
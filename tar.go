@@ -0,0 +1,135 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// squashDevice splits a squashfs device number into major and minor,
+// which use the Linux "new" encoding.
+func squashDevice(rdev uint32) (int64, int64) {
+	major := (rdev & 0xfff00) >> 8
+	minor := (rdev & 0xff) | ((rdev >> 12) & 0xfff00)
+	return int64(major), int64(minor)
+}
+
+// tarHeader returns the tar header for the inode at p. Sockets can't be
+// stored in a tar, so they return nil.
+func tarHeader(p string, inode *SquashInode) *tar.Header {
+	hdr := &tar.Header{
+		Name:    strings.TrimPrefix(p, "/"),
+		Mode:    int64(inode.Mode.Perm()),
+		Uid:     int(inode.UID),
+		Gid:     int(inode.GID),
+		ModTime: time.Unix(inode.Mtime, 0),
+		Format:  tar.FormatPAX,
+	}
+	if inode.Mode&os.ModeSetuid != 0 {
+		hdr.Mode |= 04000
+	}
+	if inode.Mode&os.ModeSetgid != 0 {
+		hdr.Mode |= 02000
+	}
+	if inode.Mode&os.ModeSticky != 0 {
+		hdr.Mode |= 01000
+	}
+
+	switch {
+	case inode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case inode.IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = inode.Size
+	case inode.Mode&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = inode.Target
+	case inode.Mode&os.ModeCharDevice != 0:
+		hdr.Typeflag = tar.TypeChar
+		hdr.Devmajor, hdr.Devminor = squashDevice(inode.Rdev)
+	case inode.Mode&os.ModeDevice != 0:
+		hdr.Typeflag = tar.TypeBlock
+		hdr.Devmajor, hdr.Devminor = squashDevice(inode.Rdev)
+	case inode.Mode&os.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil
+	}
+	return hdr
+}
+
+// WriteTar writes the tree under root to w as a tar archive. Files that
+// are hard linked are stored once, then as links. Progress is reported in
+// bytes of file content.
+func (fs *SquashFS) WriteTar(ctx context.Context, w io.Writer, root string, fn ProgressFunc) error {
+	// A first pass over the (metadata only) tree gives the total size
+	var total int64
+	err := fs.Walk(root, func(p string, inode *SquashInode) error {
+		if inode.IsRegular() {
+			total += inode.Size
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ErrCanceled
+		}
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	prog := newProgress(ctx, total, fn)
+	defer prog.finish()
+
+	links := make(map[uint32]string) // inode number to first path
+	err = fs.Walk(root, func(p string, inode *SquashInode) error {
+		if p == "/" {
+			return nil
+		}
+
+		hdr := tarHeader(p, inode)
+		if hdr == nil {
+			return nil
+		}
+		if inode.IsRegular() && inode.Nlink > 1 {
+			if first, ok := links[inode.Number]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				links[inode.Number] = hdr.Name
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("%s: %s", p, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		r, err := fs.Open(inode)
+		if err != nil {
+			return fmt.Errorf("%s: %s", p, err)
+		}
+		if _, err := copyProgress(tw, r, prog); err != nil {
+			if err == ErrCanceled {
+				return err
+			}
+			return fmt.Errorf("%s: %s", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
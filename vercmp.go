@@ -0,0 +1,487 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version comparison, the way each package manager does it. Every compare
+// function returns -1, 0 or 1 as a is older than, the same as, or newer
+// than b.
+
+// cmpInt compares two ints.
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// cmpDigits compares two strings of digits as numbers, of any length.
+func cmpDigits(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if c := cmpInt(len(a), len(b)); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isAlpha(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+// compareDpkg compares Debian versions, [epoch:]upstream[-revision].
+func compareDpkg(a, b string) int {
+	ea, ua, ra := splitDpkg(a)
+	eb, ub, rb := splitDpkg(b)
+	if c := cmpDigits(ea, eb); c != 0 {
+		return c
+	}
+	if c := dpkgVerrevcmp(ua, ub); c != 0 {
+		return c
+	}
+	return dpkgVerrevcmp(ra, rb)
+}
+
+// splitDpkg splits a Debian version into its epoch, upstream version and
+// revision.
+func splitDpkg(v string) (epoch, upstream, revision string) {
+	epoch = "0"
+	if i := strings.IndexByte(v, ':'); i >= 0 {
+		epoch, v = v[:i], v[i+1:]
+	}
+	if i := strings.LastIndexByte(v, '-'); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
+
+// dpkgOrder is the weight of a character in the non-digit parts of a
+// Debian version: ~ before the end, before letters, before the rest.
+func dpkgOrder(s string) int {
+	switch {
+	case s == "":
+		return 0
+	case isDigit(s[0]):
+		return 0
+	case isAlpha(s[0]):
+		return int(s[0])
+	case s[0] == '~':
+		return -1
+	}
+	return int(s[0]) + 256
+}
+
+// dpkgVerrevcmp compares upstream versions or revisions, alternating
+// non-digit parts (compared by dpkgOrder) and numbers.
+func dpkgVerrevcmp(a, b string) int {
+	for a != "" || b != "" {
+		for a != "" && !isDigit(a[0]) || b != "" && !isDigit(b[0]) {
+			if c := cmpInt(dpkgOrder(a), dpkgOrder(b)); c != 0 {
+				return c
+			}
+			if a != "" {
+				a = a[1:]
+			}
+			if b != "" {
+				b = b[1:]
+			}
+		}
+		i, j := 0, 0
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		if c := cmpDigits(a[:i], b[:j]); c != 0 {
+			return c
+		}
+		a, b = a[i:], b[j:]
+	}
+	return 0
+}
+
+// compareRpm compares RPM versions, [epoch:]version[-release].
+func compareRpm(a, b string) int {
+	ea, va, ra := splitRpm(a)
+	eb, vb, rb := splitRpm(b)
+	if c := cmpDigits(ea, eb); c != 0 {
+		return c
+	}
+	if c := rpmvercmp(va, vb); c != 0 {
+		return c
+	}
+	return rpmvercmp(ra, rb)
+}
+
+// splitRpm splits an RPM version into its epoch, version and release.
+func splitRpm(v string) (epoch, version, release string) {
+	epoch = "0"
+	if i := strings.IndexByte(v, ':'); i >= 0 {
+		epoch, v = v[:i], v[i+1:]
+	}
+	if i := strings.LastIndexByte(v, '-'); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
+
+// rpmvercmp compares versions or releases like rpm does: by segments of
+// digits or letters, with ~ sorting before anything and ^ after the end.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	skip := func(s string) string {
+		for s != "" && !isDigit(s[0]) && !isAlpha(s[0]) && s[0] != '~' && s[0] != '^' {
+			s = s[1:]
+		}
+		return s
+	}
+	for a != "" || b != "" {
+		a, b = skip(a), skip(b)
+
+		if a != "" && a[0] == '~' || b != "" && b[0] == '~' {
+			if a == "" || a[0] != '~' {
+				return 1
+			}
+			if b == "" || b[0] != '~' {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if a != "" && a[0] == '^' || b != "" && b[0] == '^' {
+			if a == "" {
+				return -1
+			}
+			if b == "" {
+				return 1
+			}
+			if a[0] != '^' {
+				return 1
+			}
+			if b[0] != '^' {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if a == "" || b == "" {
+			break
+		}
+
+		numeric := isDigit(a[0])
+		class := isAlpha
+		if numeric {
+			class = isDigit
+		}
+		i, j := 0, 0
+		for i < len(a) && class(a[i]) {
+			i++
+		}
+		for j < len(b) && class(b[j]) {
+			j++
+		}
+		if j == 0 {
+			// segments of different kinds: numbers are newer
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		var c int
+		if numeric {
+			c = cmpDigits(a[:i], b[:j])
+		} else {
+			c = strings.Compare(a[:i], b[:j])
+		}
+		if c != 0 {
+			return c
+		}
+		a, b = a[i:], b[j:]
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// apkVersion is an Alpine version: numbers, a letter, suffixes and a
+// revision, as in 1.2.3a_rc1_p2-r4.
+type apkVersion struct {
+	numbers  []string
+	letter   byte
+	suffixes [][2]int // rank, number
+	revision int
+}
+
+// apkSuffixes rank the suffixes of Alpine versions; no suffix is 4.
+var apkSuffixes = map[string]int{"alpha": 0, "beta": 1, "pre": 2, "rc": 3, "cvs": 5, "svn": 6, "git": 7, "hg": 8, "p": 9}
+
+var apkVersionRe = regexp.MustCompile(`^(\d+(?:\.\d+)*)([a-z]?)((?:_[a-z]+\d*)*)(?:~[0-9a-f]+)?(?:-r(\d+))?$`)
+
+// parseApk parses an Alpine version.
+func parseApk(v string) (apkVersion, bool) {
+	m := apkVersionRe.FindStringSubmatch(v)
+	if m == nil {
+		return apkVersion{}, false
+	}
+	av := apkVersion{numbers: strings.Split(m[1], ".")}
+	if m[2] != "" {
+		av.letter = m[2][0]
+	}
+	for _, s := range strings.Split(m[3], "_")[1:] {
+		i := 0
+		for i < len(s) && isAlpha(s[i]) {
+			i++
+		}
+		rank, ok := apkSuffixes[s[:i]]
+		if !ok {
+			return apkVersion{}, false
+		}
+		n, _ := strconv.Atoi(s[i:])
+		av.suffixes = append(av.suffixes, [2]int{rank, n})
+	}
+	av.revision, _ = strconv.Atoi(m[4])
+	return av, true
+}
+
+// compareApk compares Alpine versions, or falls back to rpmvercmp for
+// versions it can't parse.
+func compareApk(a, b string) int {
+	va, oka := parseApk(a)
+	vb, okb := parseApk(b)
+	if !oka || !okb {
+		return rpmvercmp(a, b)
+	}
+	for i := 0; i < len(va.numbers) || i < len(vb.numbers); i++ {
+		if i >= len(va.numbers) {
+			return -1
+		}
+		if i >= len(vb.numbers) {
+			return 1
+		}
+		x, y := va.numbers[i], vb.numbers[i]
+		var c int
+		if i > 0 && (x[0] == '0' || y[0] == '0') {
+			c = strings.Compare(x, y) // a fraction, as in 1.01
+		} else {
+			c = cmpDigits(x, y)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	if c := cmpInt(int(va.letter), int(vb.letter)); c != 0 {
+		return c
+	}
+	for i := 0; i < len(va.suffixes) || i < len(vb.suffixes); i++ {
+		x, y := [2]int{4, 0}, [2]int{4, 0}
+		if i < len(va.suffixes) {
+			x = va.suffixes[i]
+		}
+		if i < len(vb.suffixes) {
+			y = vb.suffixes[i]
+		}
+		if c := cmpInt(x[0], y[0]); c != 0 {
+			return c
+		}
+		if c := cmpInt(x[1], y[1]); c != 0 {
+			return c
+		}
+	}
+	return cmpInt(va.revision, vb.revision)
+}
+
+// compareSemver compares semantic versions, leniently: a leading v and
+// missing minor or patch numbers are accepted, build metadata is ignored.
+func compareSemver(a, b string) int {
+	split := func(v string) ([]string, string) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexByte(v, '+'); i >= 0 {
+			v = v[:i]
+		}
+		pre := ""
+		if i := strings.IndexByte(v, '-'); i >= 0 {
+			v, pre = v[:i], v[i+1:]
+		}
+		core := strings.Split(v, ".")
+		for len(core) < 3 {
+			core = append(core, "0")
+		}
+		return core, pre
+	}
+	ca, pa := split(a)
+	cb, pb := split(b)
+	for i := 0; i < len(ca) || i < len(cb); i++ {
+		x, y := "0", "0"
+		if i < len(ca) {
+			x = ca[i]
+		}
+		if i < len(cb) {
+			y = cb[i]
+		}
+		if c := cmpDigits(x, y); c != 0 {
+			return c
+		}
+	}
+
+	// a pre-release is older than the release
+	switch {
+	case pa == pb:
+		return 0
+	case pa == "":
+		return 1
+	case pb == "":
+		return -1
+	}
+	ia, ib := strings.Split(pa, "."), strings.Split(pb, ".")
+	for i := 0; i < len(ia) && i < len(ib); i++ {
+		x, y := ia[i], ib[i]
+		_, errx := strconv.ParseUint(x, 10, 64)
+		_, erry := strconv.ParseUint(y, 10, 64)
+		var c int
+		switch {
+		case errx == nil && erry == nil:
+			c = cmpDigits(x, y)
+		case errx == nil:
+			c = -1 // numbers before names
+		case erry == nil:
+			c = 1
+		default:
+			c = strings.Compare(x, y)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmpInt(len(ia), len(ib))
+}
+
+// pep440Re is the version pattern of PEP 440, in its permissive form:
+// epoch, release, pre-release, post-release (-N or .postN), dev, local.
+var pep440Re = regexp.MustCompile(`^v?(?:(\d+)!)?(\d+(?:\.\d+)*)` +
+	`(?:[-_.]?(a|alpha|b|beta|c|rc|pre|preview)[-_.]?(\d*))?` +
+	`(?:(-(\d+))|([-_.]?(?:post|rev|r)[-_.]?(\d*)))?` +
+	`(?:([-_.]?dev[-_.]?(\d*)))?` +
+	`(?:\+([a-z0-9]+(?:[-_.][a-z0-9]+)*))?$`)
+
+// pep440LocalSeparators split the local part of a Python version.
+var pep440LocalSeparators = regexp.MustCompile(`[-_.]`)
+
+// pep440Key is what PEP 440 versions are ordered by. Missing pre-release,
+// post-release and dev parts get ranks that sort them as the spec says.
+type pep440Key struct {
+	epoch   int
+	release []int
+	pre     [2]int // rank (dev only -1, a 0, b 1, rc 2, none 3), number
+	post    int    // -1 for none
+	dev     int    // a big number for none
+	local   []string
+}
+
+// parsePep440 parses a Python version.
+func parsePep440(v string) (pep440Key, bool) {
+	m := pep440Re.FindStringSubmatch(strings.ToLower(strings.TrimSpace(v)))
+	if m == nil {
+		return pep440Key{}, false
+	}
+	atoi := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	k := pep440Key{epoch: atoi(m[1]), pre: [2]int{3, 0}, post: -1, dev: 1 << 30}
+	for _, part := range strings.Split(m[2], ".") {
+		k.release = append(k.release, atoi(part))
+	}
+	for len(k.release) > 1 && k.release[len(k.release)-1] == 0 {
+		k.release = k.release[:len(k.release)-1]
+	}
+	switch m[3] {
+	case "":
+	case "a", "alpha":
+		k.pre = [2]int{0, atoi(m[4])}
+	case "b", "beta":
+		k.pre = [2]int{1, atoi(m[4])}
+	default:
+		k.pre = [2]int{2, atoi(m[4])}
+	}
+	if m[5] != "" || m[7] != "" {
+		k.post = atoi(m[6] + m[8])
+	}
+	if m[9] != "" {
+		k.dev = atoi(m[10])
+		if m[3] == "" && k.post < 0 {
+			k.pre = [2]int{-1, 0} // 1.0.dev1 comes before 1.0a1
+		}
+	}
+	if m[11] != "" {
+		k.local = pep440LocalSeparators.Split(m[11], -1)
+	}
+	return k, true
+}
+
+// comparePep440 compares Python versions, or falls back to rpmvercmp for
+// versions that don't follow PEP 440.
+func comparePep440(a, b string) int {
+	ka, oka := parsePep440(a)
+	kb, okb := parsePep440(b)
+	if !oka || !okb {
+		return rpmvercmp(a, b)
+	}
+	if c := cmpInt(ka.epoch, kb.epoch); c != 0 {
+		return c
+	}
+	for i := 0; i < len(ka.release) || i < len(kb.release); i++ {
+		x, y := 0, 0
+		if i < len(ka.release) {
+			x = ka.release[i]
+		}
+		if i < len(kb.release) {
+			y = kb.release[i]
+		}
+		if c := cmpInt(x, y); c != 0 {
+			return c
+		}
+	}
+	for _, c := range []int{cmpInt(ka.pre[0], kb.pre[0]), cmpInt(ka.pre[1], kb.pre[1]),
+		cmpInt(ka.post, kb.post), cmpInt(ka.dev, kb.dev)} {
+		if c != 0 {
+			return c
+		}
+	}
+	// local versions: numbers after names, then by length
+	for i := 0; i < len(ka.local) && i < len(kb.local); i++ {
+		x, y := ka.local[i], kb.local[i]
+		_, errx := strconv.Atoi(x)
+		_, erry := strconv.Atoi(y)
+		var c int
+		switch {
+		case errx == nil && erry == nil:
+			c = cmpDigits(x, y)
+		case errx == nil:
+			c = 1
+		case erry == nil:
+			c = -1
+		default:
+			c = strings.Compare(x, y)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmpInt(len(ka.local), len(kb.local))
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		scheme string
+		cmp    func(a, b string) int
+		a, b   string
+		want   int
+	}{
+		{"dpkg", compareDpkg, "1.0", "1.0", 0},
+		{"dpkg", compareDpkg, "1.0~rc1", "1.0", -1},
+		{"dpkg", compareDpkg, "0.9~beta", "0.9~alpha", 1},
+		{"dpkg", compareDpkg, "1:1.0", "2.0", 1},
+		{"dpkg", compareDpkg, "2.36-9+deb12u4", "2.36-9+deb12u10", -1},
+		{"dpkg", compareDpkg, "2.36-9+deb12u4", "2.36-9", 1},
+		{"dpkg", compareDpkg, "1.0a", "1.0+", -1},
+		{"dpkg", compareDpkg, "1.0", "1.0.1", -1},
+		{"dpkg", compareDpkg, "1.0-1", "1.0", 1},
+		{"dpkg", compareDpkg, "1.2.13.dfsg-1", "1.2.13.dfsg-1+deb12u1", -1},
+
+		{"rpm", compareRpm, "1.0-1.el9", "1.0-2.el9", -1},
+		{"rpm", compareRpm, "1:1.0-1", "2.0-1", 1},
+		{"rpm", compareRpm, "1.0~rc1-1", "1.0-1", -1},
+		{"rpm", compareRpm, "1.0^git1-1", "1.0-1", 1},
+		{"rpm", compareRpm, "1.0^git1", "1.0.1", -1},
+		{"rpm", compareRpm, "2.28-189.el9", "2.28-189.el9_1", -1},
+		{"rpm", compareRpm, "1.0a", "1.0", 1},
+		{"rpm", compareRpm, "1.0a", "1.01", -1},
+		{"rpm", compareRpm, "5.5p1", "5.5.1", -1},
+
+		{"apk", compareApk, "3.1.4-r5", "3.1.4-r5", 0},
+		{"apk", compareApk, "1.2.4-r2", "1.2.4-r10", -1},
+		{"apk", compareApk, "1.36.1-r5", "1.36.1-r15", -1},
+		{"apk", compareApk, "1.2.4_rc1-r0", "1.2.4-r0", -1},
+		{"apk", compareApk, "1.2.4_p1-r0", "1.2.4-r0", 1},
+		{"apk", compareApk, "1.2.4a-r0", "1.2.4-r0", 1},
+		{"apk", compareApk, "1.10", "1.9", 1},
+
+		{"semver", compareSemver, "v1.2.3", "1.2.3", 0},
+		{"semver", compareSemver, "1.2", "1.2.0", 0},
+		{"semver", compareSemver, "1.2.3", "1.2.10", -1},
+		{"semver", compareSemver, "1.0.0-alpha", "1.0.0", -1},
+		{"semver", compareSemver, "1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"semver", compareSemver, "1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"semver", compareSemver, "1.0.0-beta.11", "1.0.0-beta.2", 1},
+		{"semver", compareSemver, "1.0.0-rc.1", "1.0.0-beta.11", 1},
+
+		{"pep440", comparePep440, "1.0", "1.0.0", 0},
+		{"pep440", comparePep440, "1.0-1", "1.0.post1", 0},
+		{"pep440", comparePep440, "1.0-r2", "1.0.post2", 0},
+		{"pep440", comparePep440, "1.0c1", "1.0rc1", 0},
+		{"pep440", comparePep440, "1.0.dev1", "1.0a1", -1},
+		{"pep440", comparePep440, "1.0a1.dev1", "1.0a1", -1},
+		{"pep440", comparePep440, "1.0a1", "1.0b1", -1},
+		{"pep440", comparePep440, "1.0rc1", "1.0", -1},
+		{"pep440", comparePep440, "1.0.0.dev0", "1.0.0", -1},
+		{"pep440", comparePep440, "1.0", "1.0.post1", -1},
+		{"pep440", comparePep440, "1.0.post1.dev1", "1.0.post1", -1},
+		{"pep440", comparePep440, "1.0.post1", "1.1.dev0", -1},
+		{"pep440", comparePep440, "1!0.1", "2.0", 1},
+		{"pep440", comparePep440, "1.0+local.1", "1.0", 1},
+		{"pep440", comparePep440, "1.0+abc", "1.0+1", -1},
+		{"pep440", comparePep440, "2.31.0", "2.4.0", 1},
+	}
+	for _, tt := range tests {
+		if got := tt.cmp(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: %s vs %s: got %d, want %d", tt.scheme, tt.a, tt.b, got, tt.want)
+		}
+		if got := tt.cmp(tt.b, tt.a); got != -tt.want {
+			t.Errorf("%s: %s vs %s: got %d, want %d", tt.scheme, tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
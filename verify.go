@@ -0,0 +1,399 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// Signature objects hold an OpenPGP clear-signed message. Singularity 3.0
+// to 3.5 signed "SIFHASH:\n<sha384 of the data>", later versions sign JSON
+// image metadata with digests of the header and of each object. Checking
+// the digests tells us whether the signed objects were modified; checking
+// the OpenPGP signature itself needs the signer's public key.
+
+// SignatureCheck is the result of checking the digests of one signature.
+type SignatureCheck struct {
+	ID       uint32   `json:"id"`               // ID of the signature descriptor
+	Entity   string   `json:"entity"`           // fingerprint of the signing key
+	Format   string   `json:"format"`           // "sifhash" (legacy) or "metadata"
+	Objects  []uint32 `json:"objects"`          // IDs of the signed objects
+	Verified bool     `json:"verified"`         // whether all digests (and the signature, with a keyring) match
+	Signer   string   `json:"signer,omitempty"` // fingerprint of the key the signature was checked with
+	Message  string   `json:"message"`
+}
+
+// digest is a hash value, in JSON as {"sha256": "<hex>"}.
+type digest struct {
+	hash  crypto.Hash
+	value []byte
+}
+
+// digestNames are the JSON names of the hash algorithms.
+var digestNames = map[crypto.Hash]string{
+	crypto.SHA256: "sha256",
+	crypto.SHA384: "sha384",
+	crypto.SHA512: "sha512",
+}
+
+func (d digest) MarshalJSON() ([]byte, error) {
+	name, ok := digestNames[d.hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash %v", d.hash)
+	}
+	return json.Marshal(map[string]string{name: hex.EncodeToString(d.value)})
+}
+
+func (d *digest) UnmarshalJSON(b []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for h, name := range digestNames {
+		if v, ok := m[name]; ok {
+			value, err := hex.DecodeString(v)
+			if err != nil {
+				return err
+			}
+			d.hash, d.value = h, value
+			return nil
+		}
+	}
+	return fmt.Errorf("no supported digest in %s", b)
+}
+
+// imageMetadata is the signed JSON of newer signatures.
+type imageMetadata struct {
+	Version int `json:"version"`
+	Header  struct {
+		Digest digest `json:"digest"`
+	} `json:"header"`
+	Objects []objectMetadata `json:"objects"`
+}
+
+// objectMetadata holds the digests of one signed object. The relative ID
+// is the ID of the object minus the lowest ID of the signed objects.
+type objectMetadata struct {
+	RelativeID       uint32 `json:"relativeId"`
+	DescriptorDigest digest `json:"descriptorDigest"`
+	ObjectDigest     digest `json:"objectDigest"`
+}
+
+// hashtypes maps the SIF hash types to the hashes we link in.
+var hashtypes = map[Hashtype]crypto.Hash{
+	HashSHA256: crypto.SHA256,
+	HashSHA384: crypto.SHA384,
+	HashSHA512: crypto.SHA512,
+}
+
+// headerIntegrity returns the fields of the header covered by the header
+// digest: the ones that don't change when objects are added or removed.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/sif.go
+func headerIntegrity(h Header) io.Reader {
+	return io.MultiReader(
+		bytes.NewReader(h.Launch[:]),
+		bytes.NewReader(h.Magic[:]),
+		bytes.NewReader(h.Version[:]),
+		bytes.NewReader(h.ID[:]),
+	)
+}
+
+// descriptorIntegrity returns the fields of a descriptor covered by its
+// digest, with its ID relative to the lowest signed ID, so the digest
+// doesn't depend on where the object sits in the descriptor table.
+// https://github.com/sylabs/sif/blob/master/pkg/sif/sif.go
+func descriptorIntegrity(d Descriptor, relativeID uint32) io.Reader {
+	fields := []interface{}{
+		d.Datatype,
+		d.Used,
+		relativeID,
+		d.Link,
+		d.Filelen,
+		d.Ctime,
+		d.UID,
+		d.Gid,
+	}
+
+	var data bytes.Buffer
+	for _, f := range fields {
+		binary.Write(&data, binary.LittleEndian, f) // writes to a bytes.Buffer don't fail
+	}
+	return io.MultiReader(&data, bytes.NewReader(d.Name[:]), bytes.NewReader(d.Extra[:]))
+}
+
+// minID returns the lowest ID of objects, the base of relative IDs.
+func minID(objects []Descriptor) uint32 {
+	id := objects[0].ID
+	for _, o := range objects {
+		if o.ID < id {
+			id = o.ID
+		}
+	}
+	return id
+}
+
+// objectMetadata returns the digests of the descriptor and data of o.
+func (fimg *FileImage) objectMetadata(o Descriptor, min uint32, h crypto.Hash, p *progress) (objectMetadata, error) {
+	om := objectMetadata{RelativeID: o.ID - min}
+
+	dh := hasher(h)
+	io.Copy(dh, descriptorIntegrity(o, om.RelativeID))
+	om.DescriptorDigest = digest{h, dh.Sum(nil)}
+
+	oh := hasher(h)
+	if err := fimg.hashObject(oh, o, p); err != nil {
+		return om, err
+	}
+	om.ObjectDigest = digest{h, oh.Sum(nil)}
+	return om, nil
+}
+
+// headerDigest returns the digest of the header fields covered by signatures.
+func (fimg *FileImage) headerDigest(h crypto.Hash) digest {
+	hh := hasher(h)
+	io.Copy(hh, headerIntegrity(fimg.Header))
+	return digest{h, hh.Sum(nil)}
+}
+
+// checkSigner checks the OpenPGP signature of a clear-signed message with
+// the keys of keyring, and returns the fingerprint of the signing key.
+func checkSigner(content []byte, keyring openpgp.KeyRing) (string, error) {
+	block, _ := clearsign.Decode(content)
+	if block == nil {
+		return "", fmt.Errorf("not a clear-signed message")
+	}
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return "", fmt.Errorf("OpenPGP signature: %s", err)
+	}
+	return strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint[:])), nil
+}
+
+// hasher returns a new hash.Hash for h, from the hashes we link in.
+func hasher(h crypto.Hash) hash.Hash {
+	switch h {
+	case crypto.SHA384:
+		return sha512.New384()
+	case crypto.SHA512:
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// clearSignedText returns the text of an OpenPGP clear-signed message.
+// https://tools.ietf.org/html/rfc4880#section-7
+func clearSignedText(msg []byte) (string, error) {
+	s := strings.Replace(string(msg), "\r\n", "\n", -1)
+
+	begin := strings.Index(s, "-----BEGIN PGP SIGNED MESSAGE-----\n")
+	if begin < 0 {
+		return "", fmt.Errorf("not a clear-signed message")
+	}
+	s = s[begin:]
+
+	// skip the armor headers (Hash: ...) up to the first empty line
+	blank := strings.Index(s, "\n\n")
+	end := strings.Index(s, "\n-----BEGIN PGP SIGNATURE-----")
+	if blank < 0 || end < 0 || end < blank {
+		return "", fmt.Errorf("malformed clear-signed message")
+	}
+	text := s[blank+2 : end]
+
+	// undo dash-escaping
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimPrefix(l, "- ")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// signedObjects returns the descriptors a signature links to: a single
+// object, or every object of a group.
+func (fimg *FileImage) signedObjects(sig Descriptor) []Descriptor {
+	var objects []Descriptor
+	for _, v := range fimg.DescrArr {
+		if !v.Used || v.Datatype == DataSignature {
+			continue
+		}
+		if sig.Link&DescrGroupMask == DescrGroupMask {
+			if v.Groupid == sig.Link {
+				objects = append(objects, v)
+			}
+		} else if v.ID == sig.Link {
+			objects = append(objects, v)
+		}
+	}
+	return objects
+}
+
+// hashObject writes the data of a descriptor to h.
+func (fimg *FileImage) hashObject(h io.Writer, v Descriptor, p *progress) error {
+	if err := fimg.checkBounds(v); err != nil {
+		return err
+	}
+	_, err := copyProgress(h, io.NewSectionReader(fimg.Reader, v.Fileoff, v.Filelen), p)
+	return err
+}
+
+// signatures returns the signature descriptors of the image.
+func (fimg *FileImage) signatures() []Descriptor {
+	var sigs []Descriptor
+	for _, v := range fimg.DescrArr {
+		if v.Used && v.Datatype == DataSignature {
+			sigs = append(sigs, v)
+		}
+	}
+	return sigs
+}
+
+// VerifyDigests checks, for every signature of the image, that the digests
+// it holds match the signed objects. Progress is reported in bytes hashed.
+func (fimg *FileImage) VerifyDigests(ctx context.Context, fn ProgressFunc) ([]SignatureCheck, error) {
+	return fimg.Verify(ctx, nil, fn)
+}
+
+// Verify checks the digests of every signature of the image and, if a
+// keyring is given, that the OpenPGP signatures were made by one of its
+// keys. Progress is reported in bytes hashed.
+func (fimg *FileImage) Verify(ctx context.Context, keyring openpgp.KeyRing, fn ProgressFunc) ([]SignatureCheck, error) {
+	var checks []SignatureCheck
+
+	var total int64
+	for _, v := range fimg.signatures() {
+		for _, o := range fimg.signedObjects(v) {
+			total += o.Filelen
+		}
+	}
+	p := newProgress(ctx, total, fn)
+	defer p.finish()
+
+	for _, v := range fimg.signatures() {
+
+		check := SignatureCheck{ID: v.ID}
+		if sinfo, err := fimg.parseSignature(v); err == nil {
+			check.Entity = sinfo.Entity
+		}
+
+		objects := fimg.signedObjects(v)
+		for _, o := range objects {
+			check.Objects = append(check.Objects, o.ID)
+		}
+
+		if err := fimg.verifySignature(v, objects, &check, keyring, p); err != nil {
+			if err == ErrCanceled {
+				return nil, err
+			}
+			check.Verified = false
+			check.Message = err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// verifySignature checks the digests of one signature against its objects,
+// and the OpenPGP signature if there is a keyring.
+func (fimg *FileImage) verifySignature(sig Descriptor, objects []Descriptor, check *SignatureCheck, keyring openpgp.KeyRing, p *progress) error {
+	if len(objects) == 0 {
+		return fmt.Errorf("signature links to %d, which doesn't exist", sig.Link)
+	}
+
+	content, err := fimg.readDescriptorContent(sig.Fileoff, sig.Filelen)
+	if err != nil {
+		return err
+	}
+	text, err := clearSignedText([]byte(content))
+	if err != nil {
+		return err
+	}
+
+	check.Format = "metadata"
+	if strings.HasPrefix(text, "SIFHASH:\n") {
+		check.Format = "sifhash"
+	}
+	if keyring != nil {
+		if check.Signer, err = checkSigner([]byte(content), keyring); err != nil {
+			return err
+		}
+	}
+	signed := "OpenPGP signature not checked"
+	if check.Signer != "" {
+		signed = "signed by " + check.Signer
+	}
+
+	// Legacy signatures: SIFHASH of all the signed data
+	if check.Format == "sifhash" {
+		h := sha512.New384()
+		for _, o := range objects {
+			if err := fimg.hashObject(h, o, p); err != nil {
+				return err
+			}
+		}
+		want := strings.TrimSpace(strings.TrimPrefix(text, "SIFHASH:\n"))
+		if got := hex.EncodeToString(h.Sum(nil)); got != want {
+			return fmt.Errorf("data digest %s does not match signed digest %s", got, want)
+		}
+		check.Verified = true
+		check.Message = fmt.Sprintf("data digest matches (%s)", signed)
+		return nil
+	}
+
+	// Newer signatures: JSON metadata with digests of the header and objects
+	var md imageMetadata
+	if err := json.Unmarshal([]byte(text), &md); err != nil {
+		return fmt.Errorf("unknown signature format: %s", err)
+	}
+
+	if hd := fimg.headerDigest(md.Header.Digest.hash); !bytes.Equal(hd.value, md.Header.Digest.value) {
+		return fmt.Errorf("header digest does not match the signed digest")
+	}
+
+	min := minID(objects)
+	for _, om := range md.Objects {
+		var o *Descriptor
+		for i := range objects {
+			if objects[i].ID-min == om.RelativeID {
+				o = &objects[i]
+			}
+		}
+		if o == nil {
+			return fmt.Errorf("signed object %d is missing", min+om.RelativeID)
+		}
+
+		got, err := fimg.objectMetadata(*o, min, om.ObjectDigest.hash, p)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got.DescriptorDigest.value, om.DescriptorDigest.value) {
+			return fmt.Errorf("object %d: descriptor digest does not match the signed digest", o.ID)
+		}
+		if !bytes.Equal(got.ObjectDigest.value, om.ObjectDigest.value) {
+			return fmt.Errorf("object %d: data digest does not match the signed digest", o.ID)
+		}
+	}
+	if len(md.Objects) != len(objects) {
+		return fmt.Errorf("%d object(s) signed, %d linked to the signature", len(md.Objects), len(objects))
+	}
+
+	check.Verified = true
+	check.Message = fmt.Sprintf("%d object digest(s) match (%s)", len(md.Objects), signed)
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestVerifyTampered(t *testing.T) {
+	fimg, entity, cleanup := testSigned(t)
+	defer cleanup()
+
+	image, err := ioutil.ReadFile(fimg.Fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := fimg.DescrArr[3]
+
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(fimg *FileImage, image []byte)
+		keyring openpgp.KeyRing
+		want    string
+	}{
+		{"data", func(fimg *FileImage, image []byte) { image[part.Fileoff+10] ^= 0xff }, nil, "object 4: data digest"},
+		{"descriptor", func(fimg *FileImage, image []byte) { fimg.DescrArr[1].Name[0] = 'x' }, nil, "object 2: descriptor digest"},
+		{"header", func(fimg *FileImage, image []byte) { fimg.Header.ID[0] ^= 0xff }, nil, "header digest"},
+		{"key", func(fimg *FileImage, image []byte) {}, openpgp.EntityList{other}, "OpenPGP signature"},
+		{"no tampering", func(fimg *FileImage, image []byte) {}, openpgp.EntityList{entity}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), image...)
+			loaded, _ := loadBytes(data)
+			tt.tamper(loaded, data)
+
+			checks, err := loaded.Verify(context.Background(), tt.keyring, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(checks) != 1 {
+				t.Fatalf("got %d checks, want 1", len(checks))
+			}
+			if tt.want == "" {
+				if !checks[0].Verified {
+					t.Errorf("got %q, want verified", checks[0].Message)
+				}
+			} else if checks[0].Verified || !strings.Contains(checks[0].Message, tt.want) {
+				t.Errorf("got verified %v, %q; want an error with %q", checks[0].Verified, checks[0].Message, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyHugeSignature(t *testing.T) {
+	fimg, _, cleanup := testSigned(t)
+	defer cleanup()
+
+	loaded, _ := reload(t, fimg)
+	sig := loaded.signatures()[0]
+	for i := range loaded.DescrArr {
+		if loaded.DescrArr[i].ID == sig.ID {
+			loaded.DescrArr[i].Filelen = math.MaxInt64 - sig.Fileoff
+		}
+	}
+
+	// The signature is never read: its length is past the end of the file
+	if _, err := loaded.parseSignature(loaded.signatures()[0]); !errors.Is(err, ErrDescriptorBounds) {
+		t.Errorf("parseSignature: got %v, want ErrDescriptorBounds", err)
+	}
+	checks, err := loaded.VerifyDigests(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 1 || checks[0].Verified {
+		t.Fatalf("got %+v, want an unverified signature", checks)
+	}
+}
@@ -0,0 +1,651 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Vulnerabilities are matched offline, against advisories in the OSV
+// format (https://ossf.github.io/osv-schema/), such as the all.zip
+// exports of osv.dev for an ecosystem, or a directory of JSON files.
+
+// osvEntry is the part of an OSV advisory used for matching.
+type osvEntry struct {
+	ID               string                 `json:"id"`
+	Summary          string                 `json:"summary"`
+	Details          string                 `json:"details"`
+	Aliases          []string               `json:"aliases"`
+	Withdrawn        string                 `json:"withdrawn"`
+	Severity         []osvSeverity          `json:"severity"`
+	Affected         []osvAffected          `json:"affected"`
+	DatabaseSpecific map[string]interface{} `json:"database_specific"`
+}
+
+type osvSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+		Purl      string `json:"purl"`
+	} `json:"package"`
+	Severity          []osvSeverity          `json:"severity"`
+	Ranges            []osvRange             `json:"ranges"`
+	Versions          []string               `json:"versions"`
+	EcosystemSpecific map[string]interface{} `json:"ecosystem_specific"`
+	DatabaseSpecific  map[string]interface{} `json:"database_specific"`
+}
+
+type osvRange struct {
+	Type   string `json:"type"`
+	Events []struct {
+		Introduced   string `json:"introduced"`
+		Fixed        string `json:"fixed"`
+		LastAffected string `json:"last_affected"`
+	} `json:"events"`
+}
+
+// osvRef is an affected package of an advisory.
+type osvRef struct {
+	entry    *osvEntry
+	affected *osvAffected
+}
+
+// AdvisoryDB holds advisories indexed by ecosystem and package name, and
+// by package URL. Warnings tell about files that could not be read.
+type AdvisoryDB struct {
+	Advisories int
+	Warnings   []string
+	byName     map[string][]osvRef // "ecosystem/name", the ecosystem without its release
+	byPurl     map[string][]osvRef // "pkg:type/namespace/name"
+}
+
+// NewAdvisoryDB returns an empty database.
+func NewAdvisoryDB() *AdvisoryDB {
+	return &AdvisoryDB{Warnings: []string{}, byName: map[string][]osvRef{}, byPurl: map[string][]osvRef{}}
+}
+
+// LoadAdvisoryDB reads the advisories of a JSON file, a zip of JSON files,
+// or a directory tree of those.
+func LoadAdvisoryDB(p string) (*AdvisoryDB, error) {
+	db := NewAdvisoryDB()
+	err := filepath.Walk(p, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(file))
+		if fi.IsDir() || file != p && ext != ".json" && ext != ".zip" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		db.Add(file, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Add adds the advisories of a file: an OSV entry, a JSON array of them,
+// or a zip of such files.
+func (db *AdvisoryDB) Add(name string, data []byte) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			db.Warnings = append(db.Warnings, fmt.Sprintf("%s: %s", name, err))
+			return
+		}
+		for _, f := range zr.File {
+			if !strings.HasSuffix(strings.ToLower(f.Name), ".json") {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				db.Warnings = append(db.Warnings, fmt.Sprintf("%s: %s: %s", name, f.Name, err))
+				continue
+			}
+			content, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				db.Warnings = append(db.Warnings, fmt.Sprintf("%s: %s: %s", name, f.Name, err))
+				continue
+			}
+			db.Add(name+":"+f.Name, content)
+		}
+		return
+	}
+
+	var entries []*osvEntry
+	data = bytes.TrimSpace(data)
+	var err error
+	if bytes.HasPrefix(data, []byte("[")) {
+		err = json.Unmarshal(data, &entries)
+	} else {
+		var e osvEntry
+		err = json.Unmarshal(data, &e)
+		entries = []*osvEntry{&e}
+	}
+	if err != nil {
+		db.Warnings = append(db.Warnings, fmt.Sprintf("%s: %s", name, err))
+		return
+	}
+	for _, e := range entries {
+		if e == nil || e.ID == "" || e.Withdrawn != "" {
+			continue
+		}
+		db.Advisories++
+		for i := range e.Affected {
+			a := &e.Affected[i]
+			ref := osvRef{e, a}
+			if a.Package.Name != "" {
+				key := ecosystemBase(a.Package.Ecosystem) + "/" + normalizeName(a.Package.Ecosystem, a.Package.Name)
+				db.byName[key] = append(db.byName[key], ref)
+			}
+			if base := purlBase(a.Package.Purl); base != "" {
+				db.byPurl[base] = append(db.byPurl[base], ref)
+			}
+		}
+	}
+}
+
+// ecosystemBase returns an OSV ecosystem without its release, Debian for
+// Debian:12.
+func ecosystemBase(ecosystem string) string {
+	if i := strings.IndexByte(ecosystem, ':'); i >= 0 {
+		return ecosystem[:i]
+	}
+	return ecosystem
+}
+
+// normalizeName returns the name of a package as compared in ecosystem.
+func normalizeName(ecosystem, name string) string {
+	if ecosystemBase(ecosystem) == "PyPI" {
+		return strings.ToLower(pythonNameSeparators.ReplaceAllString(name, "-"))
+	}
+	return name
+}
+
+// purlBase returns a package URL without its version, qualifiers and
+// subpath.
+func purlBase(purl string) string {
+	if !strings.HasPrefix(purl, "pkg:") {
+		return ""
+	}
+	if i := strings.IndexAny(purl, "?#"); i >= 0 {
+		purl = purl[:i]
+	}
+	if i := strings.LastIndexByte(purl, '@'); i >= 0 {
+		purl = purl[:i]
+	}
+	return strings.ToLower(purl)
+}
+
+// rpmEcosystems are the OSV ecosystems of RPM distributions, by os-release ID.
+var rpmEcosystems = map[string]string{
+	"rhel":                "Red Hat",
+	"almalinux":           "AlmaLinux",
+	"rocky":               "Rocky Linux",
+	"opensuse-leap":       "openSUSE",
+	"opensuse-tumbleweed": "openSUSE",
+	"sles":                "SUSE",
+	"mariner":             "Mariner",
+	"azurelinux":          "Azure Linux",
+}
+
+// packageEcosystem returns the OSV ecosystem of pkg: the base ecosystem
+// and the release advisories must be for ("" for any), or "" if pkg can't
+// be matched by ecosystem.
+func packageEcosystem(pkg Package, distro *Distro) (base, release string) {
+	major := ""
+	if distro != nil {
+		major = strings.SplitN(distro.VersionID, ".", 2)[0]
+	}
+	switch pkg.Type {
+	case "pypi":
+		return "PyPI", ""
+	case "deb":
+		switch {
+		case distro == nil:
+			return "", ""
+		case distro.ID == "debian":
+			return "Debian", major
+		case distro.ID == "ubuntu":
+			return "Ubuntu", distro.VersionID
+		}
+	case "apk":
+		if distro != nil && distro.ID == "alpine" {
+			parts := strings.SplitN(distro.VersionID, ".", 3)
+			if len(parts) >= 2 {
+				return "Alpine", "v" + parts[0] + "." + parts[1]
+			}
+			return "Alpine", ""
+		}
+	case "rpm":
+		if distro != nil && rpmEcosystems[distro.ID] != "" {
+			switch distro.ID {
+			case "almalinux", "rocky":
+				return rpmEcosystems[distro.ID], major
+			}
+			return rpmEcosystems[distro.ID], ""
+		}
+	}
+	return "", ""
+}
+
+// sameRelease tells if the advisories of an OSV ecosystem are for release,
+// as Ubuntu:22.04:LTS is for 22.04. Advisories without a release are for
+// all of them.
+func sameRelease(ecosystem, release string) bool {
+	parts := strings.Split(ecosystem, ":")
+	if release == "" || len(parts) == 1 {
+		return true
+	}
+	for _, p := range parts[1:] {
+		if p == release {
+			return true
+		}
+	}
+	return false
+}
+
+// compareFunc returns the version comparison of an OSV ecosystem and
+// range type.
+func compareFunc(ecosystem, rangeType string) func(a, b string) int {
+	if rangeType == "SEMVER" {
+		return compareSemver
+	}
+	switch ecosystemBase(ecosystem) {
+	case "Debian", "Ubuntu":
+		return compareDpkg
+	case "Alpine":
+		return compareApk
+	case "PyPI":
+		return comparePep440
+	case "Red Hat", "AlmaLinux", "Rocky Linux", "openSUSE", "SUSE", "Mariner", "Azure Linux":
+		return compareRpm
+	}
+	return rpmvercmp
+}
+
+// packageCompareFunc returns the version comparison of a package type,
+// for advisories matched by package URL.
+func packageCompareFunc(pkgType string) func(a, b string) int {
+	switch pkgType {
+	case "deb":
+		return compareDpkg
+	case "rpm":
+		return compareRpm
+	case "apk":
+		return compareApk
+	case "pypi":
+		return comparePep440
+	}
+	return rpmvercmp
+}
+
+// affects tells if version is affected, and the first version with the
+// fix if there is one. Ranges are evaluated as the OSV spec says: events
+// in version order, an introduced event starts an affected range, fixed
+// and last_affected events end it.
+func (a *osvAffected) affects(version string, cmp func(a, b string) int, ecosystem string) (bool, string) {
+	for _, v := range a.Versions {
+		if v == version {
+			return true, ""
+		}
+	}
+
+	for _, r := range a.Ranges {
+		if r.Type != "ECOSYSTEM" && r.Type != "SEMVER" {
+			continue // GIT ranges are about commits
+		}
+		rangeCmp := cmp
+		if r.Type == "SEMVER" {
+			rangeCmp = compareFunc(ecosystem, r.Type)
+		}
+
+		type event struct {
+			kind, version string
+		}
+		var events []event
+		for _, e := range r.Events {
+			switch {
+			case e.Introduced != "":
+				events = append(events, event{"introduced", e.Introduced})
+			case e.Fixed != "":
+				events = append(events, event{"fixed", e.Fixed})
+			case e.LastAffected != "":
+				events = append(events, event{"last_affected", e.LastAffected})
+			}
+		}
+		less := func(x, y string) bool {
+			if x == "0" || y == "0" {
+				return x == "0" && y != "0"
+			}
+			return rangeCmp(x, y) < 0
+		}
+		sort.SliceStable(events, func(i, j int) bool { return less(events[i].version, events[j].version) })
+
+		affected, fixed := false, ""
+		for _, e := range events {
+			switch e.kind {
+			case "introduced":
+				if e.version == "0" || rangeCmp(version, e.version) >= 0 {
+					affected = true
+				}
+			case "fixed":
+				if rangeCmp(version, e.version) >= 0 {
+					affected = false
+				} else if fixed == "" {
+					fixed = e.version
+				}
+			case "last_affected":
+				if rangeCmp(version, e.version) > 0 {
+					affected = false
+				}
+			}
+		}
+		if affected {
+			return true, fixed
+		}
+	}
+	return false, ""
+}
+
+// Vulnerability is an advisory that affects a package.
+type Vulnerability struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases"`
+	Summary  string   `json:"summary"`
+	Severity string   `json:"severity"`        // critical, high, medium, low or unknown
+	Score    float64  `json:"score,omitempty"` // CVSS v3 base score, if known
+	Fixed    string   `json:"fixed,omitempty"` // the first version with the fix
+}
+
+// PackageVulns lists the vulnerabilities of a package, most severe first.
+type PackageVulns struct {
+	Package         Package         `json:"package"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+}
+
+// VulnReport is the result of matching the packages of an image against
+// an advisory database. Unmatched counts the packages that could not be
+// looked up: no known ecosystem for them and no advisory by package URL.
+type VulnReport struct {
+	Image      string         `json:"image"`
+	Advisories int            `json:"advisories"`
+	Packages   int            `json:"packages"`
+	Unmatched  int            `json:"unmatched"`
+	Counts     map[string]int `json:"counts"`
+	Findings   []PackageVulns `json:"findings"`
+	Warnings   []string       `json:"warnings"`
+}
+
+// severityRanks orders severities, most severe first.
+var severityRanks = map[string]int{"critical": 0, "high": 1, "medium": 2, "low": 3, "unknown": 4}
+
+// Match looks up every package of s in the database.
+func (db *AdvisoryDB) Match(s *SBOM) *VulnReport {
+	report := &VulnReport{
+		Image:      s.Image,
+		Advisories: db.Advisories,
+		Packages:   len(s.Packages),
+		Counts:     map[string]int{},
+		Findings:   []PackageVulns{},
+		Warnings:   append(db.Warnings, s.Warnings...),
+	}
+
+	for _, pkg := range s.Packages {
+		base, release := packageEcosystem(pkg, s.Distro)
+		byPurl := db.byPurl[purlBase(pkg.PURL)]
+		if base == "" && len(byPurl) == 0 {
+			report.Unmatched++
+			continue
+		}
+
+		var vulns []Vulnerability
+		seen := map[string]bool{}
+		check := func(ref osvRef, version string, cmp func(a, b string) int) {
+			if seen[ref.entry.ID] {
+				return
+			}
+			if ok, fixed := ref.affected.affects(version, cmp, ref.affected.Package.Ecosystem); ok {
+				seen[ref.entry.ID] = true
+				v := Vulnerability{ID: ref.entry.ID, Aliases: ref.entry.Aliases, Summary: ref.entry.Summary, Fixed: fixed}
+				if v.Aliases == nil {
+					v.Aliases = []string{}
+				}
+				if v.Summary == "" {
+					v.Summary = strings.SplitN(strings.TrimSpace(ref.entry.Details), "\n", 2)[0]
+				}
+				v.Severity, v.Score = advisorySeverity(ref)
+				vulns = append(vulns, v)
+			}
+		}
+
+		if base != "" {
+			// distributions publish advisories for source packages
+			names := [][2]string{{pkg.Name, pkg.Version}}
+			if pkg.Source != "" && pkg.Source != pkg.Name {
+				version := pkg.Version
+				if pkg.SourceVersion != "" {
+					version = pkg.SourceVersion
+				}
+				names = append(names, [2]string{pkg.Source, version})
+			}
+			for _, n := range names {
+				for _, ref := range db.byName[base+"/"+normalizeName(base, n[0])] {
+					eco := ref.affected.Package.Ecosystem
+					if !sameRelease(eco, release) {
+						continue // another release of the distribution
+					}
+					check(ref, n[1], compareFunc(eco, ""))
+				}
+			}
+		}
+		for _, ref := range byPurl {
+			check(ref, pkg.Version, packageCompareFunc(pkg.Type))
+		}
+
+		if len(vulns) == 0 {
+			continue
+		}
+		sort.SliceStable(vulns, func(i, j int) bool {
+			a, b := vulns[i], vulns[j]
+			if a.Severity != b.Severity {
+				return severityRanks[a.Severity] < severityRanks[b.Severity]
+			}
+			return a.ID < b.ID
+		})
+		for _, v := range vulns {
+			report.Counts[v.Severity]++
+		}
+		report.Findings = append(report.Findings, PackageVulns{Package: pkg, Vulnerabilities: vulns})
+	}
+	return report
+}
+
+// advisorySeverity returns the severity of an advisory for a package: from
+// a CVSS v3 vector if there is one, else from the severity the database
+// gives.
+func advisorySeverity(ref osvRef) (string, float64) {
+	severities := append(append([]osvSeverity{}, ref.affected.Severity...), ref.entry.Severity...)
+	for _, s := range severities {
+		if s.Type == "CVSS_V3" {
+			if score, ok := cvss3Score(s.Score); ok {
+				return cvssSeverity(score), score
+			}
+		}
+	}
+
+	var named []string
+	for _, m := range []map[string]interface{}{ref.affected.EcosystemSpecific, ref.affected.DatabaseSpecific, ref.entry.DatabaseSpecific} {
+		for _, key := range []string{"severity", "urgency"} {
+			if v, ok := m[key].(string); ok {
+				named = append(named, v)
+			}
+		}
+	}
+	for _, s := range severities {
+		if s.Type == "Ubuntu" {
+			named = append(named, s.Score)
+		}
+	}
+	for _, n := range named {
+		switch n = strings.ToLower(strings.TrimSpace(n)); n {
+		case "critical", "high", "medium", "low":
+			return n, 0
+		case "important":
+			return "high", 0
+		case "moderate":
+			return "medium", 0
+		case "negligible", "unimportant":
+			return "low", 0
+		}
+	}
+	return "unknown", 0
+}
+
+// cvssSeverity returns the qualitative severity of a CVSS v3 score.
+func cvssSeverity(score float64) string {
+	switch {
+	case score >= 9:
+		return "critical"
+	case score >= 7:
+		return "high"
+	case score >= 4:
+		return "medium"
+	case score > 0:
+		return "low"
+	}
+	return "unknown"
+}
+
+// cvss3Weights are the weights of the CVSS v3 base metrics.
+var cvss3Weights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// cvss3Score computes the base score of a CVSS v3.0 or v3.1 vector, as in
+// CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H.
+func cvss3Score(vector string) (float64, bool) {
+	parts := strings.Split(vector, "/")
+	if len(parts) < 9 || !strings.HasPrefix(parts[0], "CVSS:3") {
+		return 0, false
+	}
+	metrics := map[string]string{}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) == 2 {
+			metrics[kv[0]] = kv[1]
+		}
+	}
+	w := map[string]float64{}
+	for m, values := range cvss3Weights {
+		v, ok := values[metrics[m]]
+		if !ok {
+			return 0, false
+		}
+		w[m] = v
+	}
+	changed := metrics["S"] == "C"
+	if metrics["S"] != "U" && !changed {
+		return 0, false
+	}
+	if changed {
+		w["PR"] = map[string]float64{"N": 0.85, "L": 0.68, "H": 0.5}[metrics["PR"]]
+	}
+
+	iss := 1 - (1-w["C"])*(1-w["I"])*(1-w["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, true
+	}
+	exploitability := 8.22 * w["AV"] * w["AC"] * w["PR"] * w["UI"]
+	score := impact + exploitability
+	if changed {
+		score *= 1.08
+	}
+	return cvssRoundup(math.Min(score, 10)), true
+}
+
+// cvssRoundup rounds up to one decimal, as CVSS v3.1 defines it.
+func cvssRoundup(x float64) float64 {
+	i := int64(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return float64(i/10000+1) / 10
+}
+
+// FmtVulns returns the report in a readable text form.
+func (r *VulnReport) FmtVulns() string {
+	var b strings.Builder
+	total := 0
+	for _, f := range r.Findings {
+		pkg := f.Package
+		fmt.Fprintf(&b, "%s %s (%s", pkg.Name, pkg.Version, pkg.Type)
+		if pkg.Source != "" && pkg.Source != pkg.Name {
+			fmt.Fprintf(&b, ", source %s", pkg.Source)
+		}
+		b.WriteString(")\n")
+		for _, v := range f.Vulnerabilities {
+			fixed := "no fix"
+			if v.Fixed != "" {
+				fixed = "fixed in " + v.Fixed
+			}
+			fmt.Fprintf(&b, "  %-8s %-20s %-28s %s\n", v.Severity, v.ID, fixed, v.Summary)
+			total++
+		}
+	}
+
+	if len(r.Findings) > 0 {
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%d packages checked against %d advisories: %d vulnerabilities in %d packages", r.Packages, r.Advisories, total, len(r.Findings))
+	var counts []string
+	for _, s := range []string{"critical", "high", "medium", "low", "unknown"} {
+		if r.Counts[s] > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", r.Counts[s], s))
+		}
+	}
+	if len(counts) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(counts, ", "))
+	}
+	b.WriteString("\n")
+	if r.Unmatched > 0 {
+		fmt.Fprintf(&b, "%d packages could not be looked up (no known ecosystem for them)\n", r.Unmatched)
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(&b, "warning: %s\n", w)
+	}
+	return b.String()
+}
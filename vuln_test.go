@@ -0,0 +1,88 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCvss3Score(t *testing.T) {
+	tests := []struct {
+		vector string
+		want   float64
+		ok     bool
+	}{
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 9.8, true},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H", 10, true},
+		{"CVSS:3.0/AV:L/AC:L/PR:L/UI:N/S:U/C:L/I:N/A:N", 3.3, true},
+		{"CVSS:3.1/AV:N/AC:H/PR:L/UI:R/S:C/C:L/I:N/A:N", 3.0, true},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N", 0, true},
+		{"CVSS:2.0/AV:N/AC:L/Au:N/C:P/I:P/A:P", 0, false},
+		{"CVSS:3.1/AV:X/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 0, false},
+		{"CVSS:3.1/AV:N", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := cvss3Score(tt.vector); got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %v, %v, want %v, %v", tt.vector, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAdvisoryMatch(t *testing.T) {
+	db := NewAdvisoryDB()
+	db.Add("debian.json", []byte(`[
+		{"id": "DSA-1", "summary": "glibc overflow", "aliases": ["CVE-2024-1"],
+		 "severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"}],
+		 "affected": [{"package": {"ecosystem": "Debian:12", "name": "glibc"},
+		               "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "2.36-9+deb12u10"}]}]}]},
+		{"id": "DSA-2", "details": "fixed before\nmore details",
+		 "affected": [{"package": {"ecosystem": "Debian:12", "name": "glibc"},
+		               "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "2.36-9"}]}]}]},
+		{"id": "DSA-3", "summary": "another release",
+		 "affected": [{"package": {"ecosystem": "Debian:11", "name": "glibc"},
+		               "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}]}]}]},
+		{"id": "DSA-4", "summary": "withdrawn", "withdrawn": "2024-01-01T00:00:00Z",
+		 "affected": [{"package": {"ecosystem": "Debian:12", "name": "glibc"}, "versions": ["2.36-9+deb12u4"]}]}
+	]`))
+	db.Add("pypi.json", []byte(`{"id": "PYSEC-1", "summary": "requests leak",
+		"affected": [{"package": {"ecosystem": "PyPI", "name": "Requests"},
+		              "database_specific": {"severity": "MODERATE"},
+		              "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "2.3.0"}, {"last_affected": "2.31.0"}]}]}]}`))
+	db.Add("broken.json", []byte(`{"id": `))
+
+	s := &SBOM{
+		Image:  "test.sif",
+		Distro: &Distro{ID: "debian", VersionID: "12"},
+		Packages: []Package{
+			{Name: "libc6", Version: "2.36-9+deb12u4", Type: "deb", Source: "glibc"},
+			{Name: "requests", Version: "2.31.0", Type: "pypi"},
+			{Name: "urllib3", Version: "2.0.0", Type: "pypi"},
+			{Name: "left-pad", Version: "1.0", Type: "npm"},
+		},
+	}
+	report := db.Match(s)
+	if report.Advisories != 4 || report.Packages != 4 || report.Unmatched != 1 {
+		t.Errorf("got %d advisories, %d packages, %d unmatched", report.Advisories, report.Packages, report.Unmatched)
+	}
+	if len(report.Warnings) != 1 {
+		t.Errorf("got warnings %q, want one for broken.json", report.Warnings)
+	}
+	want := []PackageVulns{
+		{Package: s.Packages[0], Vulnerabilities: []Vulnerability{
+			{ID: "DSA-1", Aliases: []string{"CVE-2024-1"}, Summary: "glibc overflow", Severity: "critical", Score: 9.8, Fixed: "2.36-9+deb12u10"},
+		}},
+		{Package: s.Packages[1], Vulnerabilities: []Vulnerability{
+			{ID: "PYSEC-1", Aliases: []string{}, Summary: "requests leak", Severity: "medium"},
+		}},
+	}
+	if !reflect.DeepEqual(report.Findings, want) {
+		t.Errorf("got findings %+v, want %+v", report.Findings, want)
+	}
+	if report.Counts["critical"] != 1 || report.Counts["medium"] != 1 {
+		t.Errorf("got counts %v", report.Counts)
+	}
+}
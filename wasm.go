@@ -0,0 +1,726 @@
+// Copyright 2019 Vanessa Sochat. All rights reserved.
+// Use of this source code is governed by the Polyform Strict license
+// that can be found in the LICENSE file and available at
+// https://polyformproject.org/licenses/noncommercial/1.0.0
+
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"syscall/js"
+	"time"
+)
+
+// current is the image loaded with sifweb.load, in the Web Worker, and
+// currentName its name.
+var (
+	current     *FileImage
+	currentName string
+)
+
+// loadBytes loads an imageString from the browser and populates FileImage with data.
+func (fimg *FileImage) loadBytes(value js.Value, size int) error {
+
+	// We can use CopyBytesToGo, need golang 1.13+
+	sif := make([]byte, size)
+	howmany := js.CopyBytesToGo(sif, value)
+
+	// Save the data and size to the FileImage
+	fimg.Filedata = sif[:howmany]
+	fimg.loadReader(bytes.NewReader(fimg.Filedata), int64(howmany))
+
+	return nil
+}
+
+// blobReader reads ranges of a JavaScript Blob (or File) on demand with
+// FileReaderSync, so large images never have to be loaded in memory.
+// FileReaderSync is only available in Web Workers.
+type blobReader struct {
+	blob js.Value
+}
+
+func (b blobReader) ReadAt(p []byte, off int64) (int, error) {
+	slice := b.blob.Call("slice", off, off+int64(len(p)))
+	buf := js.Global().Get("FileReaderSync").New().Call("readAsArrayBuffer", slice)
+	n := js.CopyBytesToGo(p, js.Global().Get("Uint8Array").New(buf))
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// toJSValue converts a Go value into a plain JavaScript object by way of
+// JSON, so the structs in info.go don't need to know about syscall/js.
+func toJSValue(v interface{}) (js.Value, error) {
+	// raw bytes are handed over as a Uint8Array instead
+	if data, ok := v.([]byte); ok {
+		array := js.Global().Get("Uint8Array").New(len(data))
+		js.CopyBytesToJS(array, data)
+		return array, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return js.Undefined(), err
+	}
+	return js.Global().Get("JSON").Call("parse", string(b)), nil
+}
+
+// newPromise returns a JavaScript Promise that runs fn in a goroutine, and
+// resolves with its (converted) result or rejects with an Error, with the
+// code and hint of errorInfo.
+func newPromise(fn func() (interface{}, error)) js.Value {
+	var handler js.Func
+	handler = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve, reject := args[0], args[1]
+		go func() {
+			defer handler.Release()
+
+			result, err := fn()
+			if err == nil {
+				var value js.Value
+				if value, err = toJSValue(result); err == nil {
+					resolve.Invoke(value)
+					return
+				}
+			}
+			info := errorInfo(err)
+			jsErr := js.Global().Get("Error").New(err.Error())
+			jsErr.Set("code", info.Code)
+			jsErr.Set("hint", info.Hint)
+			reject.Invoke(jsErr)
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(handler)
+}
+
+// loadContainer is linked with the JavaScript function of the same name.
+// It takes as input the file name, binary data (Uint8Array) and size of
+// the SIF image, or the URL of an image (read with range requests), and
+// returns a Promise that resolves to a plain object with the file, header,
+// descriptors and errors. Rendering is left to the page.
+func loadContainer(this js.Value, val []js.Value) interface{} {
+	if len(val) == 1 && val[0].Type() == js.TypeString {
+		url := val[0].String()
+		return newPromise(func() (interface{}, error) {
+			_, info, err := openImage(url, val[0])
+			return info, err
+		})
+	}
+	if len(val) < 3 {
+		return newPromise(func() (interface{}, error) {
+			return nil, fmt.Errorf("loadContainer expects (name, bytes, size) or (url)")
+		})
+	}
+	name, data, size := val[0].String(), val[1], val[2].Int()
+
+	return newPromise(func() (interface{}, error) {
+		fimg := FileImage{}
+
+		// read the string of given size to bytes from the SIF file
+		if err := fimg.loadBytes(data, size); err != nil {
+			return nil, err
+		}
+
+		info := fimg.getInfo(name)
+
+		// Print header to console
+		if info.Header != nil {
+			fmt.Print(addFileName(name, fimg.FmtHeader()))
+		}
+		for _, e := range info.Errors {
+			fmt.Println("Error:", e.Message)
+		}
+		return info, nil
+	})
+}
+
+// callOptions returns the context and progress function from the optional
+// options object ({onProgress, signal}) given as args[i]. The signal is an
+// AbortSignal: aborting it cancels the context.
+func callOptions(args []js.Value, i int) (context.Context, ProgressFunc) {
+	ctx := context.Background()
+	if len(args) <= i || args[i].Type() != js.TypeObject {
+		return ctx, nil
+	}
+	options := args[i]
+
+	if signal := options.Get("signal"); signal.Type() == js.TypeObject {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		if signal.Get("aborted").Bool() {
+			cancel()
+		}
+		var onAbort js.Func
+		onAbort = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			cancel()
+			onAbort.Release()
+			return nil
+		})
+		signal.Call("addEventListener", "abort", onAbort)
+	}
+
+	var fn ProgressFunc
+	if callback := options.Get("onProgress"); callback.Type() == js.TypeFunction {
+		fn = func(done, total int64) {
+			callback.Invoke(done, total)
+		}
+	}
+	return ctx, fn
+}
+
+func init() {
+	// Sleeping lets the Go runtime hand control back to the JavaScript
+	// event loop, so that an abort can be delivered during long operations.
+	yield = func() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// loadedImage returns the image loaded with sifweb.load.
+func loadedImage() (*FileImage, error) {
+	if current == nil {
+		return nil, fmt.Errorf("no container loaded, call load first")
+	}
+	return current, nil
+}
+
+// apiLoad is sifweb.load(name, file). The file is a Blob or File (read
+// lazily, in a Web Worker), a URL or a Uint8Array. It resolves to the same
+// object as loadContainer, and keeps the image open for the other calls.
+func apiLoad(this js.Value, args []js.Value) interface{} {
+	if len(args) < 2 {
+		return newPromise(func() (interface{}, error) {
+			return nil, fmt.Errorf("load expects (name, file)")
+		})
+	}
+	name, file := args[0].String(), args[1]
+
+	return newPromise(func() (interface{}, error) {
+		fimg, info, err := openImage(name, file)
+		if err != nil {
+			return nil, err
+		}
+		current, currentName = nil, name
+		if info.Header != nil && fimg.DescrArr != nil {
+			current = fimg
+		}
+		return info, nil
+	})
+}
+
+// openImage reads the header and descriptors of file, a Blob (read
+// lazily), a URL (read with range requests) or a Uint8Array.
+func openImage(name string, file js.Value) (*FileImage, *ContainerInfo, error) {
+	fimg := &FileImage{}
+	switch {
+	case file.Type() == js.TypeString:
+		r, err := openRemote(file.String())
+		if err != nil {
+			return nil, nil, err
+		}
+		fimg.loadReader(r, r.size)
+	case file.InstanceOf(js.Global().Get("Blob")):
+		fimg.loadReader(blobReader{file}, int64(file.Get("size").Int()))
+	default:
+		if err := fimg.loadBytes(file, file.Get("byteLength").Int()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return fimg, fimg.getInfo(name), nil
+}
+
+// apiListDescriptors is sifweb.listDescriptors(), for the loaded image.
+func apiListDescriptors(this js.Value, args []js.Value) interface{} {
+	return newPromise(func() (interface{}, error) {
+		fimg, err := loadedImage()
+		if err != nil {
+			return nil, err
+		}
+		descriptors, _ := fimg.getDescriptors()
+		return descriptors, nil
+	})
+}
+
+// apiReadRange is sifweb.readRange(offset, length, options), it resolves
+// to a Uint8Array with the bytes of the loaded image.
+func apiReadRange(this js.Value, args []js.Value) interface{} {
+	if len(args) < 2 {
+		return newPromise(func() (interface{}, error) {
+			return nil, fmt.Errorf("readRange expects (offset, length)")
+		})
+	}
+	offset, length := int64(args[0].Float()), int64(args[1].Float())
+	ctx, fn := callOptions(args, 2)
+
+	return newPromise(func() (interface{}, error) {
+		fimg, err := loadedImage()
+		if err != nil {
+			return nil, err
+		}
+		if offset < 0 || length < 0 || offset+length > fimg.Filesize {
+			return nil, fmt.Errorf("range %d+%d is outside of the file (%d bytes)", offset, length, fimg.Filesize)
+		}
+
+		var buf bytes.Buffer
+		p := newProgress(ctx, length, fn)
+		defer p.finish()
+		if _, err := copyProgress(&buf, io.NewSectionReader(fimg.Reader, offset, length), p); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+}
+
+// primSquashFS opens the primary partition of the loaded image.
+func primSquashFS() (*SquashFS, error) {
+	fimg, err := loadedImage()
+	if err != nil {
+		return nil, err
+	}
+	return fimg.GetPrimSquashFS()
+}
+
+// apiListDir is sifweb.listDir(path), it lists a directory of the
+// primary (squashfs) partition of the loaded image.
+func apiListDir(this js.Value, args []js.Value) interface{} {
+	dir := "/"
+	if len(args) > 0 && args[0].Type() == js.TypeString {
+		dir = args[0].String()
+	}
+
+	return newPromise(func() (interface{}, error) {
+		fs, err := primSquashFS()
+		if err != nil {
+			return nil, err
+		}
+		inode, err := fs.Lookup(dir)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := fs.ReadDir(inode)
+		if err != nil {
+			return nil, err
+		}
+
+		files := []FileInfo{}
+		for _, e := range entries {
+			files = append(files, fileInfo(path.Join("/", dir, e.Name), e.Inode))
+		}
+		return files, nil
+	})
+}
+
+// apiExtract is sifweb.extract(path, options), it resolves to a
+// Uint8Array with the content of a file of the primary partition.
+func apiExtract(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 {
+		return newPromise(func() (interface{}, error) {
+			return nil, fmt.Errorf("extract expects (path)")
+		})
+	}
+	file := args[0].String()
+	ctx, fn := callOptions(args, 1)
+
+	return newPromise(func() (interface{}, error) {
+		fs, err := primSquashFS()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := fs.Extract(ctx, &buf, file, fn); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+}
+
+// apiExportTar is sifweb.exportTar(path, options), it resolves to a
+// Uint8Array with a tar archive of the tree under path.
+func apiExportTar(this js.Value, args []js.Value) interface{} {
+	root := "/"
+	if len(args) > 0 && args[0].Type() == js.TypeString {
+		root = args[0].String()
+	}
+	ctx, fn := callOptions(args, 1)
+
+	return newPromise(func() (interface{}, error) {
+		fs, err := primSquashFS()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := fs.WriteTar(ctx, &buf, root, fn); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+}
+
+// apiVerify is sifweb.verify(options), it checks the digests of every
+// signature of the loaded image.
+func apiVerify(this js.Value, args []js.Value) interface{} {
+	ctx, fn := callOptions(args, 0)
+
+	return newPromise(func() (interface{}, error) {
+		fimg, err := loadedImage()
+		if err != nil {
+			return nil, err
+		}
+		checks, err := fimg.VerifyDigests(ctx, fn)
+		if checks == nil {
+			checks = []SignatureCheck{}
+		}
+		return checks, err
+	})
+}
+
+// datatypeNames are the names of the data types in sifweb.build inputs.
+var datatypeNames = map[string]Datatype{
+	"deffile":   DataDeffile,
+	"env":       DataEnvVar,
+	"labels":    DataLabels,
+	"partition": DataPartition,
+	"signature": DataSignature,
+	"json":      DataGenericJSON,
+	"generic":   DataGeneric,
+	"crypto":    DataCryptoMessage,
+}
+
+// fstypeNames and parttypeNames are the names of the partition options.
+var (
+	fstypeNames = map[string]Fstype{
+		"squashfs":  FsSquash,
+		"ext3":      FsExt3,
+		"immuobj":   FsImmuObj,
+		"raw":       FsRaw,
+		"encrypted": FsEncryptedSquashfs,
+	}
+	parttypeNames = map[string]Parttype{
+		"system":  PartSystem,
+		"primsys": PartPrimSys,
+		"data":    PartData,
+		"overlay": PartOverlay,
+	}
+)
+
+// apiLint is sifweb.lint(), it checks the structure of the loaded image
+// in depth and resolves to the findings.
+func apiLint(this js.Value, args []js.Value) interface{} {
+	return newPromise(func() (interface{}, error) {
+		fimg, err := loadedImage()
+		if err != nil {
+			return nil, err
+		}
+		findings := fimg.Lint()
+		if findings == nil {
+			findings = []Finding{}
+		}
+		return findings, nil
+	})
+}
+
+// apiPackages is sifweb.packages(format, options), it reads the package
+// databases of the primary partition of the loaded image. It resolves to
+// the list of packages (see SBOM), or for a format (json, spdx or
+// cyclonedx) to a Uint8Array with the document.
+func apiPackages(this js.Value, args []js.Value) interface{} {
+	format := ""
+	if len(args) > 0 && args[0].Type() == js.TypeString {
+		format = args[0].String()
+	}
+	ctx, fn := callOptions(args, 1)
+
+	return newPromise(func() (interface{}, error) {
+		fimg, err := loadedImage()
+		if err != nil {
+			return nil, err
+		}
+		sbom, err := fimg.Packages(ctx, path.Base(currentName), fn)
+		if err != nil || format == "" {
+			return sbom, err
+		}
+		data, _, err := sbom.Document(format, time.Now())
+		return data, err
+	})
+}
+
+// apiVulns is sifweb.vulns(files, options), it matches the packages of
+// the loaded image against the advisories of files, an array of Blobs
+// (OSV JSON files or zips of them). It resolves to a VulnReport.
+func apiVulns(this js.Value, args []js.Value) interface{} {
+	var files []js.Value
+	if len(args) > 0 && args[0].Type() == js.TypeObject {
+		for i := 0; i < args[0].Length(); i++ {
+			files = append(files, args[0].Index(i))
+		}
+	}
+	ctx, fn := callOptions(args, 1)
+
+	return newPromise(func() (interface{}, error) {
+		fimg, err := loadedImage()
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("vulns expects advisory files")
+		}
+		db := NewAdvisoryDB()
+		for i, file := range files {
+			if !file.InstanceOf(js.Global().Get("Blob")) {
+				return nil, fmt.Errorf("advisory file %d is not a Blob", i)
+			}
+			name := fmt.Sprintf("file %d", i)
+			if n := file.Get("name"); n.Type() == js.TypeString {
+				name = n.String()
+			}
+			data := make([]byte, int64(file.Get("size").Float()))
+			if _, err := (blobReader{file}).ReadAt(data, 0); err != nil && err != io.EOF {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			db.Add(name, data)
+		}
+
+		sbom, err := fimg.Packages(ctx, path.Base(currentName), fn)
+		if err != nil {
+			return nil, err
+		}
+		return db.Match(sbom), nil
+	})
+}
+
+// apiDiff is sifweb.diff(old, new, options), with old and new given as
+// {name, file} like for load. It resolves to what changed from old to new,
+// and leaves the loaded image alone.
+func apiDiff(this js.Value, args []js.Value) interface{} {
+	if len(args) < 2 {
+		return newPromise(func() (interface{}, error) {
+			return nil, fmt.Errorf("diff expects (old, new)")
+		})
+	}
+	oldArg, newArg := args[0], args[1]
+	ctx, fn := callOptions(args, 2)
+
+	return newPromise(func() (interface{}, error) {
+		var images [2]*FileImage
+		for i, arg := range []js.Value{oldArg, newArg} {
+			fimg, info, err := openImage(arg.Get("name").String(), arg.Get("file"))
+			if err != nil {
+				return nil, err
+			}
+			if len(info.errs) > 0 {
+				return nil, fmt.Errorf("%s: %w", info.File, info.errs[0])
+			}
+			images[i] = fimg
+		}
+
+		diff, err := DiffImages(ctx, images[0], images[1], fn)
+		if err != nil {
+			return nil, err
+		}
+		diff.Old, diff.New = oldArg.Get("name").String(), newArg.Get("name").String()
+		return diff, nil
+	})
+}
+
+// buildInput returns the DescriptorInput for one input of sifweb.build:
+// {file, datatype, groupid, link, alignment} and for partitions {fstype,
+// parttype, arch}. Group 0 means no group, the arch is a go arch name.
+func buildInput(v js.Value) (DescriptorInput, error) {
+	option := func(name, def string) string {
+		if o := v.Get(name); o.Type() == js.TypeString {
+			return o.String()
+		}
+		return def
+	}
+	number := func(name string) int {
+		if o := v.Get(name); o.Type() == js.TypeNumber {
+			return o.Int()
+		}
+		return 0
+	}
+
+	file := v.Get("file")
+	if !file.InstanceOf(js.Global().Get("Blob")) {
+		return DescriptorInput{}, fmt.Errorf("input has no file")
+	}
+	size := int64(file.Get("size").Float())
+	name := ""
+	if n := file.Get("name"); n.Type() == js.TypeString {
+		name = n.String()
+	}
+	input := DescriptorInput{
+		Size:      size,
+		Alignment: number("alignment"),
+		Fname:     option("name", name),
+		Fp:        io.NewSectionReader(blobReader{file}, 0, size),
+		Groupid:   DescrUnusedGroup,
+		Link:      uint32(number("link")),
+	}
+	if g := number("groupid"); g > 0 {
+		input.Groupid = DescrGroupMask | uint32(g)
+	}
+
+	var ok bool
+	datatype := option("datatype", "generic")
+	if input.Datatype, ok = datatypeNames[datatype]; !ok {
+		return input, fmt.Errorf("%s: unknown datatype %q", input.Fname, datatype)
+	}
+	if input.Datatype == DataPartition {
+		fs, ok := fstypeNames[option("fstype", "squashfs")]
+		if !ok {
+			return input, fmt.Errorf("%s: unknown fstype %q", input.Fname, option("fstype", ""))
+		}
+		part, ok := parttypeNames[option("parttype", "primsys")]
+		if !ok {
+			return input, fmt.Errorf("%s: unknown parttype %q", input.Fname, option("parttype", ""))
+		}
+		arch := GetSIFArch(option("arch", "amd64"))
+		if arch == HdrArchUnknown {
+			return input, fmt.Errorf("%s: unknown arch %q", input.Fname, option("arch", ""))
+		}
+		if err := input.SetPartExtra(fs, part, arch); err != nil {
+			return input, err
+		}
+	}
+	return input, nil
+}
+
+// chunkWriter hands what is written to a JavaScript callback, in chunks
+// of up to chunkSize bytes, as Uint8Arrays.
+type chunkWriter struct {
+	onChunk js.Value
+	buf     []byte
+}
+
+// chunkSize is the size of the chunks sifweb.build streams out.
+const chunkSize = 1 << 20
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		if len(w.buf) == cap(w.buf) {
+			w.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush passes the buffered bytes to the callback.
+func (w *chunkWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	array, _ := toJSValue(w.buf)
+	w.onChunk.Invoke(array)
+	w.buf = w.buf[:0]
+}
+
+// apiBuild is sifweb.build(spec, options), it creates a SIF from spec
+// {inputs: [...], launch} (see buildInput). The image is streamed out to
+// options.onChunk(Uint8Array), and the call resolves to its header and
+// descriptors.
+func apiBuild(this js.Value, args []js.Value) interface{} {
+	if len(args) < 2 || args[1].Get("onChunk").Type() != js.TypeFunction {
+		return newPromise(func() (interface{}, error) {
+			return nil, fmt.Errorf("build expects (spec, {onChunk})")
+		})
+	}
+	spec := args[0]
+	ctx, fn := callOptions(args, 1)
+	w := &chunkWriter{onChunk: args[1].Get("onChunk"), buf: make([]byte, 0, chunkSize)}
+
+	return newPromise(func() (interface{}, error) {
+		cinfo := CreateInfo{}
+		if launch := spec.Get("launch"); launch.Type() == js.TypeString {
+			cinfo.Launchstr = launch.String()
+		}
+		inputs := spec.Get("inputs")
+		for i := 0; i < inputs.Length(); i++ {
+			input, err := buildInput(inputs.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			cinfo.InputDescr = append(cinfo.InputDescr, input)
+		}
+
+		fimg, err := WriteContainer(ctx, w, &cinfo, fn)
+		if err != nil {
+			return nil, err
+		}
+		w.flush()
+
+		// The image was streamed out, so only the descriptors themselves
+		// can be shown, not the content of signatures and crypto messages
+		info := &ContainerInfo{Header: fimg.headerInfo(), Descriptors: []DescriptorInfo{}}
+		for _, v := range fimg.DescrArr {
+			if !v.Used {
+				continue
+			}
+			d := descriptorInfo(v)
+			if v.Datatype == DataPartition {
+				d.Partition, _ = parsePartition(v)
+			}
+			info.Descriptors = append(info.Descriptors, d)
+		}
+		return info, nil
+	})
+}
+
+// apiLibrary is sifweb.library(url, ref, options), it resolves to the
+// entry of the library server at url that ref points to, with the entries
+// below it (see LibraryClient.Browse). options are {arch, token}.
+func apiLibrary(this js.Value, args []js.Value) interface{} {
+	if len(args) < 2 {
+		return newPromise(func() (interface{}, error) {
+			return nil, fmt.Errorf("library expects (url, ref)")
+		})
+	}
+	base, ref := args[0].String(), args[1].String()
+	var arch, token string
+	if len(args) > 2 && args[2].Type() == js.TypeObject {
+		if v := args[2].Get("arch"); v.Type() == js.TypeString {
+			arch = v.String()
+		}
+		if v := args[2].Get("token"); v.Type() == js.TypeString {
+			token = v.String()
+		}
+	}
+
+	return newPromise(func() (interface{}, error) {
+		return NewLibraryClient(base, token).Browse(context.Background(), ref, arch)
+	})
+}
+
+// registerAPI sets the sifweb object, with the functions used by the
+// Web Worker (docs/js/worker.js) to answer messages from the page.
+// Long running calls take an optional last argument {onProgress, signal}.
+func registerAPI() {
+	js.Global().Set("sifweb", map[string]interface{}{
+		"load":            js.FuncOf(apiLoad),
+		"listDescriptors": js.FuncOf(apiListDescriptors),
+		"readRange":       js.FuncOf(apiReadRange),
+		"listDir":         js.FuncOf(apiListDir),
+		"extract":         js.FuncOf(apiExtract),
+		"exportTar":       js.FuncOf(apiExportTar),
+		"verify":          js.FuncOf(apiVerify),
+		"lint":            js.FuncOf(apiLint),
+		"packages":        js.FuncOf(apiPackages),
+		"vulns":           js.FuncOf(apiVulns),
+		"build":           js.FuncOf(apiBuild),
+		"diff":            js.FuncOf(apiDiff),
+		"library":         js.FuncOf(apiLibrary),
+	})
+}